@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Kinds of query failure, distinguished because each suggests a different
+// remedy
+const (
+	errorTimeout       = "timeout"
+	errorTooManyConns  = "too many connections"
+	errorConnection    = "connection"
+	errorSerialization = "serialization"
+	errorNoRows        = "no rows"
+	errorServer        = "server"
+	errorOther         = "other"
+)
+
+// SQLSTATE codes and classes of errors classified by errorKind
+const (
+	sqlStateCanceled     = "57014"
+	sqlStateTooManyConns = "53300"
+	sqlClassConnection   = "08"
+	sqlClassRollback     = "40"
+)
+
+// Thresholds beyond which the report recommends a change
+const (
+	adviseExhaustion     = 0.1
+	adviseUtilisation    = 0.5
+	adviseSeqScanShare   = 0.5
+	adviseExclusion      = 0.5
+	adviseChunksScanned  = 8
+	advisePlanningShare  = 0.25
+	adviseBufferHitRatio = 0.9
+	adviseMisestimated   = 0.1
+)
+
+// errorKind classifies a query's error
+func errorKind(err error) string {
+	var pgErr *pgconn.PgError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return errorNoRows
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return errorTimeout
+	case errors.As(err, &pgErr):
+		switch {
+		case pgErr.Code == sqlStateCanceled:
+			return errorTimeout
+		case pgErr.Code == sqlStateTooManyConns:
+			return errorTooManyConns
+		case strings.HasPrefix(pgErr.Code, sqlClassConnection):
+			return errorConnection
+		case strings.HasPrefix(pgErr.Code, sqlClassRollback):
+			return errorSerialization
+		}
+		return errorServer
+	case errors.As(err, &netErr):
+		return errorConnection
+	}
+	return errorOther
+}
+
+// adviceInput is what the recommendations are drawn from
+type adviceInput struct {
+	stats   *runStats
+	pools   []poolUsage
+	workers int
+	elapsed time.Duration
+
+	// Whether tasks were dispatched on a schedule, under -rate
+	scheduled bool
+}
+
+// utilisation is the fraction of the workers' time spent running queries
+func (in adviceInput) utilisation() float64 {
+	if in.workers == 0 || in.elapsed <= 0 {
+		return 0
+	}
+	return float64(in.stats.busy) / (float64(in.workers) * float64(in.elapsed.Microseconds()))
+}
+
+// recommend suggests changes to the client, schema or server, from the pool
+// waits, worker utilisation, queue waits, errors and sampled plans of a run
+func recommend(in adviceInput) []string {
+	var recs []string
+	st := in.stats
+
+	for _, u := range in.pools {
+		if u.exhaustion() <= adviseExhaustion {
+			continue
+		}
+		if int32(in.workers) > u.maxConns {
+			recs = append(recs, fmt.Sprintf("Pool %s was exhausted on %.0f%% of acquisitions, with %d workers sharing %d connections: raise pool_max_conns to %d, use -conn-per-worker, or reduce -workers to %d",
+				u.target, 100*u.exhaustion(), in.workers, u.maxConns, in.workers, u.maxConns))
+		} else {
+			recs = append(recs, fmt.Sprintf("Pool %s was exhausted on %.0f%% of acquisitions: raise pool_max_conns or use -conn-per-worker",
+				u.target, 100*u.exhaustion()))
+		}
+	}
+
+	util := in.utilisation()
+	queued := st.queueTimes.Summary()
+	ran := st.queryTimes.Summary()
+	switch {
+	case in.scheduled && st.queueTimes.Count() > 0 && queued.Median > ran.Median:
+		recs = append(recs, fmt.Sprintf("Tasks waited a median %.3fms for a worker, longer than queries took: add workers with -workers or lower -rate",
+			float64(queued.Median)/1000.0))
+	case !in.scheduled && st.attempted() > 0 && util < adviseUtilisation:
+		recs = append(recs, fmt.Sprintf("Workers were busy for only %.0f%% of the run, so input or dispatch limited the load: check the Input section, or reduce -workers to %d",
+			100*util, int(util*float64(in.workers))+1))
+	}
+
+	kinds := make([]string, 0, len(st.errorKinds))
+	for kind := range st.errorKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		n := st.errorKinds[kind]
+		switch kind {
+		case errorTimeout:
+			recs = append(recs, fmt.Sprintf("%d queries timed out or were cancelled: investigate the slowest queries, or raise statement_timeout or -latency-budget", n))
+		case errorTooManyConns:
+			recs = append(recs, fmt.Sprintf("%d queries were refused a connection: reduce -workers or pool_max_conns, or raise the server's max_connections", n))
+		case errorConnection:
+			recs = append(recs, fmt.Sprintf("%d queries lost their connection: check the network and the server's logs", n))
+		case errorSerialization:
+			recs = append(recs, fmt.Sprintf("%d queries failed on serialization or deadlock: reduce concurrency on conflicting rows", n))
+		case errorNoRows:
+			recs = append(recs, fmt.Sprintf("%d queries returned no rows: check that the parameters match the data's hostnames and time range", n))
+		}
+	}
+
+	p := st.plans
+	if p.samples > 0 {
+		var scans int
+		for _, n := range p.scans {
+			scans += n
+		}
+		if scans > 0 && float64(p.scans["Seq Scan"])/float64(scans) > adviseSeqScanShare {
+			recs = append(recs, fmt.Sprintf("%.0f%% of sampled scan nodes were sequential scans: add an index, e.g. CREATE INDEX ON %s (host, ts DESC)",
+				100*float64(p.scans["Seq Scan"])/float64(scans), benchRelation))
+		}
+
+		scanned := stats.Summarise(p.chunksScanned)
+		var total int64
+		for _, c := range p.chunksScanned {
+			total += c
+		}
+		if p.totalChunks > 1 {
+			if excluded := 1 - float64(total)/float64(p.totalChunks*p.samples); excluded < adviseExclusion {
+				recs = append(recs, fmt.Sprintf("Queries excluded only %.0f%% of chunks: check that their time predicates allow exclusion, or use a larger chunk_time_interval",
+					100*excluded))
+			}
+		}
+		if scanned.Median > adviseChunksScanned {
+			recs = append(recs, fmt.Sprintf("Queries scanned a median %d chunks: a larger chunk_time_interval would cut per-chunk overhead (compare intervals with scenario %s)",
+				scanned.Median, scenarioChunkSweep))
+		}
+
+		planning := p.planningTime / float64(p.samples)
+		if median := float64(ran.Median) / 1000.0; median > 0 && planning > advisePlanningShare*median {
+			recs = append(recs, fmt.Sprintf("Planning took a mean %.3fms, %.0f%% of the median query time: fewer chunks or the extended protocol's prepared statements would reduce it",
+				planning, 100*planning/median))
+		}
+
+		if share := float64(p.misestimated) / float64(p.samples); share > adviseMisestimated {
+			recs = append(recs, fmt.Sprintf("%.0f%% of sampled plans misestimated rows by %dx or more: ANALYZE %s, or raise the statistics target of the columns queried",
+				100*share, misestimateFactor, benchRelation))
+		}
+
+		if p.sharedHit+p.sharedRead > 0 && p.hitRatio() < adviseBufferHitRatio {
+			recs = append(recs, fmt.Sprintf("Sampled queries found %.0f%% of blocks in shared buffers: raise shared_buffers, or use -prewarm if the run should start warm",
+				100*p.hitRatio()))
+		}
+	}
+	return recs
+}
+
+func printRecommendations(recs []string) {
+	fmt.Printf("\n## Recommendations\n")
+	if len(recs) == 0 {
+		fmt.Printf("None: no bottlenecks detected\n")
+		return
+	}
+	for _, r := range recs {
+		fmt.Printf("- %s\n", r)
+	}
+}
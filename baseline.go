@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Earlier runs needed for a -baseline check; with fewer, their spread means
+// little
+const minBaselineRuns = 3
+
+// Exit status of a run which regressed against its -baseline
+const regressionExitCode = 3
+
+// The spread of a baseline's runs is their median absolute deviation,
+// scaled to estimate the standard deviation of normally distributed
+// figures, so that one bad run in the baseline doesn't widen the band
+const madScale = 1.4826
+
+// baselineCheck compares one headline figure of the run with the median of
+// the baseline runs
+type baselineCheck struct {
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline"`
+	Sigma    float64 `json:"sigma"`
+	Value    float64 `json:"value"`
+
+	// The worst value within the bands
+	Limit float64 `json:"limit"`
+
+	// Relative change from the baseline
+	Change float64 `json:"change"`
+
+	Regressed bool `json:"regressed"`
+
+	name string
+}
+
+// baselineStats is the outcome of a -baseline check
+type baselineStats struct {
+	Runs       int             `json:"runs"`
+	SigmaBand  float64         `json:"sigma_band,omitempty"`
+	ChangeBand float64         `json:"change_band,omitempty"`
+	Checks     []baselineCheck `json:"checks"`
+	Regressed  bool            `json:"regressed"`
+}
+
+// loadBaselineRuns returns the earlier runs in the results store if there
+// is one, or else in the -history file, oldest first
+func loadBaselineRuns(store *sql.DB, historyFile string) ([]historyRecord, error) {
+	if store != nil {
+		runs, err := loadHistory(store)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]historyRecord, len(runs))
+		for i, r := range runs {
+			records[i] = r.historyRecord
+		}
+		return records, nil
+	}
+	records, err := readHistory(historyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+// selectBaseline returns the last n runs with the given config hash and all
+// of labels
+func selectBaseline(runs []historyRecord, hash string, labels map[string]string, n int) []historyRecord {
+	var selected []historyRecord
+	for _, r := range runs {
+		if r.ConfigHash == hash && hasLabels(r.Labels, labels) {
+			selected = append(selected, r)
+		}
+	}
+	if len(selected) > n {
+		selected = selected[len(selected)-n:]
+	}
+	return selected
+}
+
+// compareBaseline checks each headline figure of r against the median of
+// the baseline runs. A figure has regressed if it's worse than that by more
+// than sigmaBand times the baseline's spread and by more than changeBand
+// relative to it, each band applying if non-zero. Figures whose baseline is
+// zero, such as an error rate, are skipped, as no band can be drawn
+// around them; -notify-max-error-rate covers those.
+func compareBaseline(r historyRecord, baseline []historyRecord, sigmaBand float64, changeBand float64) *baselineStats {
+	b := &baselineStats{Runs: len(baseline), SigmaBand: sigmaBand, ChangeBand: changeBand}
+	current := runMetrics(r)
+	for i, metric := range current {
+		// The number of queries is set by the input or -duration
+		if metric.key == "attempted" {
+			continue
+		}
+		values := make([]float64, len(baseline))
+		for j, earlier := range baseline {
+			values[j] = runMetrics(earlier)[i].value
+		}
+		median := medianOf(values)
+		if median == 0 {
+			continue
+		}
+		deviations := make([]float64, len(values))
+		for j, v := range values {
+			deviations[j] = math.Abs(v - median)
+		}
+		sigma := madScale * medianOf(deviations)
+
+		band := math.Max(sigmaBand*sigma, changeBand*math.Abs(median))
+		c := baselineCheck{
+			Metric:   metric.key,
+			Baseline: median,
+			Sigma:    sigma,
+			Value:    metric.value,
+			Change:   metric.value/median - 1,
+			name:     metric.name,
+		}
+		if metric.lowerIsBetter {
+			c.Limit = median + band
+			c.Regressed = metric.value > c.Limit
+		} else {
+			c.Limit = median - band
+			c.Regressed = metric.value < c.Limit
+		}
+		b.Regressed = b.Regressed || c.Regressed
+		b.Checks = append(b.Checks, c)
+	}
+	return b
+}
+
+// thresholdChecks returns the checks for notifications
+func (b *baselineStats) thresholdChecks() []thresholdCheck {
+	checks := make([]thresholdCheck, len(b.Checks))
+	for i, c := range b.Checks {
+		checks[i] = thresholdCheck{Name: "baseline_" + c.Metric, Limit: c.Limit, Value: c.Value, Passed: !c.Regressed}
+	}
+	return checks
+}
+
+func printBaselineReport(b *baselineStats) {
+	fmt.Printf("\n## Baseline\n")
+	fmt.Printf("Runs:              median of the last %d with the same config hash\n", b.Runs)
+	var bands []string
+	if b.SigmaBand > 0 {
+		bands = append(bands, fmt.Sprintf("%g sigma", b.SigmaBand))
+	}
+	if b.ChangeBand > 0 {
+		bands = append(bands, fmt.Sprintf("%g%%", 100*b.ChangeBand))
+	}
+	if len(bands) == 2 {
+		fmt.Printf("Bands:             worse by more than %s and %s\n", bands[0], bands[1])
+	} else {
+		fmt.Printf("Bands:             worse by more than %s\n", bands[0])
+	}
+	fmt.Printf("%-20s %12s %12s %12s %12s %9s\n", "metric", "baseline", "sigma", "limit", "this run", "change")
+	for _, c := range b.Checks {
+		change := colorize(fmt.Sprintf("%+8.1f%%", 100*c.Change), colorIf(c.Regressed, false))
+		fmt.Printf("%-20s %12.3f %12.3f %12.3f %12.3f %s\n", c.name, c.Baseline, c.Sigma, c.Limit, c.Value, change)
+	}
+	verdict := colorize("passed", colorGreen)
+	if b.Regressed {
+		verdict = colorize("regressed", colorRed)
+	}
+	fmt.Printf("Result:            %s\n", verdict)
+}
@@ -2,239 +2,2053 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"database/sql"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"os"
-	"sort"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nrhtr/timescale-project/stats"
 )
 
-var dbPool *pgxpool.Pool
-
 const (
-	csvHostnameField  = 0
-	csvStartField     = 1
-	csvEndField       = 2
-	dbConnectAttempts = 5
-	dbConnectDelay    = 10
+	csvHostnameField = 0
+	csvStartField    = 1
+	csvEndField      = 2
 )
 
+// The raw start/end strings are kept for logging and export; queries are
+// bound with the parsed UTC times
 type task struct {
-	hostname string
-	start    string
-	end      string
+	hostname  string
+	start     string
+	end       string
+	startTime time.Time
+	endTime   time.Time
+
+	// 1 for the first time this (hostname, start, end) appears in the input
+	occurrence int
+
+	// When the query was originally issued, from the input's "at" column
+	at time.Time
+
+	// time_bucket width from the input's "bucket" column, as an interval
+	bucket string
+
+	// Values of the extra query parameters mapped by -param-map
+	params []string
+
+	// Name of the -source the task came from, if several were given
+	source string
+
+	// Under -tenants, the hostname's tenant and when the tenant scheduler
+	// received the task
+	tenant string
+	queued time.Time
+
+	// When the task should have started under -rate or -replay; zero
+	// otherwise
+	intended time.Time
+
+	// When the task was handed to a worker's queue, and when the worker
+	// picked it up
+	dispatched time.Time
+	pickedUp   time.Time
+
+	// The formulation of the benchmark query to run, and where to run it
+	variant queryVariant
+	target  *dbTarget
+
+	// Wire protocol the query is sent with, and the format its results are
+	// requested in, under -protocol and -result-format
+	protocol     string
+	resultFormat string
+
+	// Set for pgbench script runs, which replace the benchmark query
+	script *scriptRun
+
+	// If set, receives the final attempt's result, e.g. to answer an HTTP
+	// submission. Must have room for one result per variant and target.
+	reply chan<- benchResult
 }
 
+// args returns the benchmark query's parameters for the task
+func (t task) args() []interface{} {
+	args := []interface{}{t.hostname, t.startTime, t.endTime}
+	if t.bucket != "" {
+		args = append(args, t.bucket)
+	}
+	for _, p := range t.params {
+		args = append(args, p)
+	}
+	return args
+}
+
+// One result is produced per query attempt. Failed attempts carry err and
+// are retried up to the configured limit.
 type benchResult struct {
+	task      task
+	worker    int
+	attempt   int
 	queryTime int64
+	finished  time.Time
+	err       error
+
+	// Time from the task's intended start to completion, including any time
+	// spent waiting behind earlier tasks. Only set under -rate.
+	correctedTime int64
+
+	// Set when this query was sampled for EXPLAIN
+	plan       *planSummary
+	explainErr error
+
+	// Time spent acquiring a connection from the pool, which is included in
+	// queryTime. Always zero under -conn-per-worker.
+	acquireTime int64
+
+	// Time the task spent queued for a worker (µs), excluded from queryTime
+	queueTime int64
+
+	// Time until the first row arrived (µs), and the number of rows read.
+	// queryTime covers consuming the whole result.
+	firstRowTime int64
+	rows         int64
+
+	// Bytes of column values received, excluding protocol framing
+	resultBytes int64
+
+	// Whether the result is in the -record-sample fraction recorded in
+	// detail. Every result is counted.
+	recorded bool
+
+	// Bytes sent and received over the connection by the query, if counted
+	wireCounted   bool
+	bytesSent     int64
+	bytesReceived int64
+
+	// Artificial delay injected around the query (µs), excluded from
+	// queryTime
+	injected int64
+
+	// Set if the query was cancelled by -latency-budget, in which case
+	// queryTime is the time elapsed when it was cancelled
+	overBudget bool
+
+	// Time taken by each page under -paginate (µs)
+	pageTimes []int64
+
+	// Time taken by the immediate re-execution under -repeat (µs); zero if
+	// the query wasn't repeated or the repeat failed
+	repeatTime int64
+
+	// Under -shadow-dsn, how the candidate's result compared, on the
+	// primary's results
+	shadow *shadowOutcome
 }
 
-func worker(id int, in <-chan task, out chan<- benchResult) {
+// dispatchConfig controls how tasks are handed out to workers
+type dispatchConfig struct {
+	numWorkers int
+	retries    int
+	dedupe     bool
+
+	// Tasks for a hostname are spread over this many workers, each running
+	// one query at a time, so no more queries for it run at once. Under
+	// steal, tasks are queued per worker and idle workers take runnable
+	// tasks from the others, still running no more than maxInflightPerHost
+	// queries per hostname.
+	maxInflightPerHost int
+	steal              bool
+
+	// Target queries per second; 0 dispatches as fast as workers accept them
+	rate float64
+
+	// Under -replay, tasks are dispatched with the same gaps between them as
+	// their original times, divided by replaySpeed
+	replay      bool
+	replaySpeed float64
+
+	// Every task is run once with each variant against each target,
+	// rotating the order. Under mix, each task is instead run with one
+	// variant, chosen at random by weight.
+	variants []queryVariant
+	targets  []*dbTarget
+	mix      bool
+
+	// If set, every query is also run against this target at the same time,
+	// on the same worker, and the results compared
+	shadow *dbTarget
+
+	// Protocols and result formats each task is also run with, rotated as
+	// for variants and targets
+	protocols     []string
+	resultFormats []string
+
+	// Pin one connection per target to each worker for the whole run
+	connPerWorker bool
+
+	// Fraction of successful queries to re-run under EXPLAIN ANALYZE
+	explainSample float64
+	seed          int64
+
+	// Fraction of results recorded in detail
+	recordSample float64
+
+	// Run each successful query a second time, back to back
+	repeat bool
+
+	// Fetch each task's result in pages, unless mode is empty
+	paginate pagination
+
+	// Queries still running after this long are cancelled; 0 for no limit
+	latencyBudget time.Duration
+
+	// Artificial delays slept before and after each query; nil for none
+	injectBefore delayDistribution
+	injectAfter  delayDistribution
+}
+
+// querier is satisfied by both pools and individual pooled connections
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// fetched describes a result consumed by runQuery
+type fetched struct {
+	firstRow time.Time
+	rows     int64
+
+	// Bytes of column values, as received in the text or binary format
+	bytes int64
+
+	// Sum of a hash of each row, the same for the same rows in any order.
+	// Only set by runQueryChecksum.
+	checksum uint64
+}
+
+// runQuery executes sql and consumes the whole result without decoding it,
+// returning when the first row arrived, how many rows were read and their
+// size. As with QueryRow, an empty result is an error.
+func runQuery(ctx context.Context, q querier, sql string, args ...interface{}) (fetched, error) {
+	return fetchResult(ctx, q, false, sql, args...)
+}
+
+// runQueryChecksum is runQuery, also hashing the rows, for comparing results
+// between databases
+func runQueryChecksum(ctx context.Context, q querier, sql string, args ...interface{}) (fetched, error) {
+	return fetchResult(ctx, q, true, sql, args...)
+}
+
+func fetchResult(ctx context.Context, q querier, checksum bool, sql string, args ...interface{}) (f fetched, err error) {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return f, err
+	}
+	defer rows.Close()
+
+	h := fnv.New64a()
+	var length [4]byte
+	for rows.Next() {
+		if f.rows == 0 {
+			f.firstRow = time.Now()
+		}
+		f.rows++
+		h.Reset()
+		for _, v := range rows.RawValues() {
+			f.bytes += int64(len(v))
+			if checksum {
+				// Prefixed by length, or -1 for NULL, so values can't run
+				// into each other
+				n := uint32(len(v))
+				if v == nil {
+					n = math.MaxUint32
+				}
+				binary.BigEndian.PutUint32(length[:], n)
+				h.Write(length[:])
+				h.Write(v)
+			}
+		}
+		if checksum {
+			f.checksum += h.Sum64()
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return f, err
+	}
+	if f.rows == 0 {
+		return f, pgx.ErrNoRows
+	}
+	return f, nil
+}
+
+func (b *Benchmarker) worker(id int, in taskSource, ready *sync.WaitGroup, gate <-chan struct{}) {
 	log.Printf("[INFO] Starting worker %d\n", id)
 
-	for q := range in {
-		var bucket time.Time
-		var minCpu float64
-		var maxCpu float64
-
-		t0 := time.Now()
-		err := dbPool.QueryRow(context.Background(),
-			`SELECT time_bucket('1 minutes', ts) AS minute,
-		MIN(usage) as minCpu,
-		MAX(usage) as maxCpu
-		FROM cpu_usage
-		WHERE host=$1 AND ts >= $2 AND ts <= $3
-		GROUP BY host, minute`, q.hostname, q.start, q.end).Scan(&bucket, &minCpu, &maxCpu)
+	cfg := b.cfg.Dispatch
+	out := b.results
+
+	rng := newRand(cfg.seed, fmt.Sprintf("explain-%d", id))
+	injectRng := newRand(cfg.seed, fmt.Sprintf("inject-%d", id))
+	recordRng := newRand(cfg.seed, fmt.Sprintf("record-%d", id))
+	mockRng := newRand(cfg.seed, fmt.Sprintf("mock-%d", id))
+	ctx := context.Background()
+
+	// Under -conn-per-worker, connections are acquired up front so the
+	// measured time never includes waiting on the pool
+	pinned := make(map[*dbTarget]*pgxpool.Conn)
+	defer func() {
+		for _, c := range pinned {
+			c.Release()
+		}
+	}()
+	pin := func(t *dbTarget) {
+		c, err := t.pool.Acquire(ctx)
 		if err != nil {
-			log.Printf("[ERROR] Failed retrieving row: %s\n", err.Error())
-			continue
+			log.Fatalf("[ERROR] Worker %d unable to acquire connection to %s: %s\n", id, t.name, err.Error())
 		}
-		t1 := time.Now()
-		delta := t1.Sub(t0).Microseconds()
+		pinned[t] = c
+	}
+	if cfg.connPerWorker {
+		for _, t := range cfg.targets {
+			if t.mock == nil {
+				pin(t)
+			}
+		}
+		if cfg.shadow != nil && cfg.shadow.mock == nil {
+			pin(cfg.shadow)
+		}
+	}
+	shadowRng := newRand(cfg.seed, fmt.Sprintf("shadow-%d", id))
 
-		bench := benchResult{
-			queryTime: delta,
+	// Every worker begins at once, when the run starts
+	ready.Done()
+	<-gate
+
+	for {
+		q, ok := in.next()
+		if !ok {
+			return
 		}
+		q.pickedUp = time.Now()
+		for attempt := 1; attempt <= cfg.retries+1; attempt++ {
+			// Replace pinned connections broken by a previous failure
+			if c, ok := pinned[q.target]; ok && c.Conn().IsClosed() {
+				c.Release()
+				pin(q.target)
+			}
+
+			var injected time.Duration
+			if cfg.injectBefore != nil {
+				d := cfg.injectBefore.sample(injectRng)
+				time.Sleep(d)
+				injected += d
+			}
 
-		out <- bench
+			// Under -latency-budget, queries are cancelled once the client
+			// would have given up waiting
+			qctx, cancel := ctx, context.CancelFunc(func() {})
+			if cfg.latencyBudget > 0 {
+				qctx, cancel = context.WithTimeout(ctx, cfg.latencyBudget)
+			}
+
+			// Under -shadow-dsn, the candidate runs the query at the same time
+			var shadowDone chan shadowRun
+			if cfg.shadow != nil {
+				if c, ok := pinned[cfg.shadow]; ok && c.Conn().IsClosed() {
+					c.Release()
+					pin(cfg.shadow)
+				}
+				shadowDone = make(chan shadowRun, 1)
+				go func(q task, attempt int, conn *pgxpool.Conn) {
+					shadowDone <- b.shadowQuery(id, attempt, q, conn, shadowRng)
+				}(q, attempt, pinned[cfg.shadow])
+			}
+
+			t0 := time.Now()
+			conn, ok := pinned[q.target]
+			var err error
+			if !ok && q.target.mock == nil {
+				conn, err = q.target.pool.Acquire(qctx)
+			}
+			acquired := time.Now()
+			sent, received, wireCounted := wireBytes(conn)
+			var result fetched
+			var pageTimes []int64
+			qc := withWireOptions(conn, q.protocol, q.resultFormat)
+			if err == nil && q.target.mock != nil {
+				result, err = q.target.mock.run(qctx, mockRng)
+			} else if err == nil && q.script != nil {
+				result.rows, err = runScript(qctx, conn, q.script)
+			} else if err == nil && cfg.paginate.mode != "" {
+				pageTimes, result.rows, err = runPages(qctx, qc, cfg.paginate, q.target.query(q.variant), q.args()...)
+			} else if err == nil && cfg.shadow != nil {
+				result, err = runQueryChecksum(qctx, qc, q.target.query(q.variant), q.args()...)
+			} else if err == nil {
+				result, err = runQuery(qctx, qc, q.target.query(q.variant), q.args()...)
+			}
+			t1 := time.Now()
+			if wireCounted {
+				s, r, _ := wireBytes(conn)
+				sent, received = s-sent, r-received
+			}
+			overBudget := err != nil && qctx.Err() == context.DeadlineExceeded
+			cancel()
+
+			var repeatTime int64
+			if err == nil && cfg.repeat && q.script == nil && cfg.paginate.mode == "" {
+				r0 := time.Now()
+				var rerr error
+				if q.target.mock != nil {
+					_, rerr = q.target.mock.run(ctx, mockRng)
+				} else {
+					_, rerr = runQuery(ctx, qc, q.target.query(q.variant), q.args()...)
+				}
+				if rerr != nil {
+					log.Printf("[WARN] Failed repeating query (worker=%d hostname=%q start=%q end=%q): %s\n",
+						id, q.hostname, q.start, q.end, rerr.Error())
+				} else {
+					repeatTime = time.Since(r0).Microseconds()
+				}
+			}
+
+			if cfg.injectAfter != nil {
+				d := cfg.injectAfter.sample(injectRng)
+				time.Sleep(d)
+				injected += d
+			}
+
+			bench := benchResult{
+				task:      q,
+				worker:    id,
+				attempt:   attempt,
+				queryTime: t1.Sub(t0).Microseconds(),
+				finished:  t1,
+				err:       err,
+				queueTime: q.pickedUp.Sub(q.dispatched).Microseconds(),
+				rows:      result.rows,
+				injected:  injected.Microseconds(),
+
+				resultBytes: result.bytes,
+
+				recorded: cfg.recordSample >= 1 || recordRng.Float64() < cfg.recordSample,
+
+				wireCounted:   wireCounted,
+				bytesSent:     sent,
+				bytesReceived: received,
+
+				overBudget: overBudget,
+				pageTimes:  pageTimes,
+				repeatTime: repeatTime,
+			}
+			if !result.firstRow.IsZero() {
+				bench.firstRowTime = result.firstRow.Sub(t0).Microseconds()
+			}
+			if !ok && q.target.mock == nil {
+				bench.acquireTime = acquired.Sub(t0).Microseconds()
+			}
+			if !q.intended.IsZero() {
+				bench.correctedTime = t1.Sub(q.intended).Microseconds()
+			}
+			if !ok && conn != nil {
+				conn.Release()
+			}
+			if shadowDone != nil {
+				s := <-shadowDone
+				s.result.recorded = bench.recorded
+				bench.shadow = compareShadow(err, result, s)
+				out.send(s.result)
+			}
+
+			// Sampled queries are re-run with EXPLAIN ANALYZE on another
+			// connection, so that tasks queued behind this one don't wait
+			// for it, and their result is sent with the plan
+			if err == nil && q.script == nil && bench.recorded && cfg.explainSample > 0 && rng.Float64() < cfg.explainSample {
+				b.explaining.Add(1)
+				go func(bench benchResult) {
+					defer b.explaining.Done()
+					bench.plan, bench.explainErr = explainTask(ctx, bench.task)
+					out.send(bench)
+				}(bench)
+			} else {
+				out.send(bench)
+			}
+			// A client that gave up doesn't retry
+			final := err == nil || overBudget || attempt == cfg.retries+1
+			if q.reply != nil && final {
+				q.reply <- bench
+			}
+
+			if err == nil || overBudget {
+				break
+			}
+			log.Printf("[ERROR] Failed retrieving row (worker=%d target=%s variant=%s hostname=%q start=%q end=%q attempt=%d): %s\n",
+				id, q.target.name, q.variant.name, q.hostname, q.start, q.end, attempt, err.Error())
+		}
+		in.done(q)
 	}
 }
 
-func processCSV(f io.Reader, numWorkers int, results chan<- benchResult, done chan<- bool) {
-	cr := csv.NewReader(f)
+// dispatch hands tasks out to the workers, and closes the results once
+// every worker has exited
+func (b *Benchmarker) dispatch(batches <-chan []parsedRecord, validation *validationSummary, stop <-chan struct{}) {
+	cfg := b.cfg.Dispatch
+	workers := b.workers
 
-	var wg sync.WaitGroup
-	workers := make([]chan task, numWorkers)
+	duplicates := newDuplicateTracker(duplicateWindow)
+	validation.deduped = cfg.dedupe
 
-	// Initialise channels and start workers
-	for w := range workers {
-		workers[w] = make(chan task)
-		wg.Add(1)
-		// Pass 'w' in to ensure each closure binds to new value of 'w'
-		go func(w int) {
-			defer wg.Done()
-			worker(w, workers[w], results)
-		}(w)
+	perHost := cfg.maxInflightPerHost
+	if perHost < 1 || perHost > cfg.numWorkers {
+		perHost = cfg.numWorkers
 	}
 
-	// Skip header
-	_, err := cr.Read()
-	if err != nil {
-		log.Fatalf("[ERROR] Error when reading CSV header: %s\n", err.Error())
+	var mix *variantPicker
+	if cfg.mix {
+		mix = newVariantPicker(cfg.variants, newRand(cfg.seed, "mix"))
+	}
+
+	// Under -rate, task n is scheduled at dispatchStart + n/rate regardless
+	// of how long earlier tasks took
+	var interval time.Duration
+	if cfg.rate > 0 {
+		interval = time.Duration(float64(time.Second) / cfg.rate)
 	}
+	dispatchStart := time.Now()
+	dispatched := 0
+	records := 0
+	var replayOrigin time.Time
+	replayOutOfOrder := false
 
+dispatch:
 	for {
-		record, err := cr.Read()
-		if err == io.EOF {
-			log.Print("[INFO] Reached end of file\n")
-			break
-		} else if err != nil {
-			log.Fatalf("[ERROR] Failed parsing CSV file: %s", err.Error())
+		var batch []parsedRecord
+		select {
+		case <-stop:
+			log.Print("[INFO] Stopping dispatch\n")
+			break dispatch
+		case b, ok := <-batches:
+			if !ok {
+				break dispatch
+			}
+			batch = b
 		}
 
-		hostname := record[csvHostnameField]
-		start := record[csvStartField]
-		end := record[csvEndField]
+		for _, r := range batch {
+			records++
+			if !r.looped {
+				validation.rows++
+			}
+			if r.err != nil {
+				validation.reject(r.row, r.err, r.fields)
+				continue
+			}
+			t := r.task
+
+			// Each pass of -until-stable repeats the whole input, so
+			// duplicates are counted within a pass, and only in the first
+			if r.passStart {
+				duplicates = newDuplicateTracker(duplicateWindow)
+			}
+
+			// Script runs differ in their variables rather than times
+			t.occurrence = 1
+			if t.script == nil {
+				t.occurrence = duplicates.occurrence(t)
+			}
+			if t.occurrence > 1 {
+				if !r.looped {
+					validation.duplicates++
+				}
+				if cfg.dedupe {
+					continue
+				}
+			}
 
-		// Select which worker to use for hostname
-		h := fnv.New32a()
-		h.Write([]byte(hostname))
-		chosenWorker := int(h.Sum32()) % numWorkers
+			// Select which workers to use for hostname
+			h := fnv.New32a()
+			h.Write([]byte(t.hostname))
+			chosenWorker := int(h.Sum32()) % cfg.numWorkers
 
-		t := task{
-			hostname: hostname,
-			start:    start,
-			end:      end,
+			// Rotate the starting combination so no variant, target,
+			// protocol or result format is systematically run first against
+			// a cold cache
+			variants := cfg.variants
+			if mix != nil {
+				variants = []queryVariant{mix.pick()}
+			}
+			combinations := len(variants) * len(cfg.targets) * len(cfg.protocols) * len(cfg.resultFormats)
+			for i := 0; i < combinations; i++ {
+				c := (records + i) % combinations
+				vt := t
+				vt.variant = variants[c%len(variants)]
+				c /= len(variants)
+				vt.target = cfg.targets[c%len(cfg.targets)]
+				c /= len(cfg.targets)
+				vt.protocol = cfg.protocols[c%len(cfg.protocols)]
+				c /= len(cfg.protocols)
+				vt.resultFormat = cfg.resultFormats[c]
+
+				if interval > 0 {
+					vt.intended = dispatchStart.Add(time.Duration(dispatched) * interval)
+				} else if cfg.replay {
+					if replayOrigin.IsZero() {
+						replayOrigin = t.at
+					}
+					gap := t.at.Sub(replayOrigin)
+					if gap < 0 && !replayOutOfOrder {
+						log.Printf("[WARN] Row %d is earlier than the first replayed query; out of order rows are dispatched immediately\n", r.row)
+						replayOutOfOrder = true
+					}
+					vt.intended = dispatchStart.Add(time.Duration(float64(gap) / cfg.replaySpeed))
+				}
+				if !vt.intended.IsZero() {
+					if wait := time.Until(vt.intended); wait > 0 {
+						time.Sleep(wait)
+					}
+				}
+				dispatched++
+				atomic.AddInt64(&b.dispatched, 1)
+
+				vt.dispatched = time.Now()
+				if b.steal != nil {
+					b.steal.push(chosenWorker, vt)
+				} else {
+					sendTask(workers, chosenWorker, perHost, vt)
+				}
+			}
 		}
+	}
 
-		workers[chosenWorker] <- t
+	if validation.duplicates > 0 && !cfg.dedupe {
+		log.Printf("[WARN] Input contains %d duplicate tasks, which may hit warm caches (use -dedupe to skip them)\n",
+			validation.duplicates)
 	}
 
 	// Tell workers to shutdown
 	for w := range workers {
 		close(workers[w])
 	}
+	if b.steal != nil {
+		b.steal.close()
+	}
 
-	// Await completion of all workers and signal main goroutine
+	// Await completion of all workers, then let the main goroutine drain
+	// any buffered results
 	log.Print("[INFO] Waiting for workers to shutdown...\n")
-	wg.Wait()
-	done <- true
+	b.running.Wait()
+	b.explaining.Wait()
+	b.results.close()
+}
+
+// sendTask hands t to whichever of n consecutive workers, starting at first,
+// is free first. Each worker runs one query at a time, so at most n queries
+// for the task's hostname run at once.
+func sendTask(workers []chan task, first int, n int, t task) {
+	if n == 1 {
+		workers[first] <- t
+		return
+	}
+	cases := make([]reflect.SelectCase, n)
+	for i := range cases {
+		cases[i] = reflect.SelectCase{
+			Dir:  reflect.SelectSend,
+			Chan: reflect.ValueOf(workers[(first+i)%len(workers)]),
+			Send: reflect.ValueOf(t),
+		}
+	}
+	reflect.Select(cases)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		runExtract(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenario" {
+		runScenario(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		runCompare(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		runReport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trend" {
+		runTrend(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selfbench" {
+		runSelfBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelfTest(os.Args[2:])
+		return
+	}
+
 	fileName := flag.String("file", "-", "input filename (csv)")
-	numWorkers := flag.Int("workers", 2, "number of workers")
+	inputEncoding := flag.String("input-format", inputFormatCSV, "input file format: csv or ndjson")
+	charset := flag.String("encoding", charsetUTF8, "character encoding of the input: utf-8, utf-16le, utf-16be, latin1 or windows-1252; a byte order mark is detected regardless")
+	kafkaBrokers := flag.String("kafka-brokers", "", "consume NDJSON tasks from Kafka via these brokers (comma separated) instead of -file")
+	kafkaTopic := flag.String("kafka-topic", "", "Kafka topic to consume tasks from")
+	kafkaGroup := flag.String("kafka-group", "timescaledb-benchmark", "Kafka consumer group")
+	pgChannel := flag.String("pg-channel", "", "LISTEN on this PostgreSQL channel and run an NDJSON task from each NOTIFY payload instead of reading -file")
+	scriptFile := flag.String("pgbench-script", "", "run transactions from a pgbench script instead of reading tasks")
+	transactions := flag.Int("transactions", 1000, "number of pgbench script transactions to run")
+	var sources sourceFlags
+	flag.Var(&sources, "source", "combine several task sources, e.g. name=bulk,file=big.csv,rate=50 or name=synthetic,generate=1000 (repeatable)")
+	listen := flag.String("listen", "", "run as a daemon accepting tasks via POST /tasks on this address, e.g. :8080")
+	var schedules scheduleFlags
+	flag.Var(&schedules, "schedule", "under -listen, run the tool with these arguments on a crontab schedule, e.g. \"0 2 * * * scenario hypertable-vs-plain -- -store results.db\" (repeatable)")
+	untilStable := flag.Bool("until-stable", false, "repeat the input until the p99's confidence interval is narrower than -stable-width")
+	stableWidth := flag.Float64("stable-width", 0.05, "under -until-stable, the target width of the p99's 95% confidence interval, relative to the p99")
+	maxDuration := flag.Duration("max-duration", 10*time.Minute, "under -until-stable, stop repeating the input after this long even if the p99 isn't stable")
+	follow := flag.Bool("follow", false, "keep reading -file as it grows, like tail -f, until the run is stopped; implies -stream")
+	stream := flag.Bool("stream", false, "dispatch tasks as they arrive and run until end of input or SIGTERM, logging periodic stats")
+	statsInterval := flag.Duration("stats-interval", 10*time.Second, "interval between progress lines under -stream or when reading a file")
+	uiAddr := flag.String("ui", "", "serve a live dashboard of the run on this address, e.g. :8080")
+	tui := flag.Bool("tui", false, "draw a live dashboard of the run in the terminal, replaced by the report when it finishes")
+	columns := flag.String("columns", "", "input column indices, e.g. host=0,start=1,end=2")
+	delimiter := flag.String("delimiter", ",", "field delimiter of CSV input, e.g. \\t (or tab) for TSV, or ;")
+	lazyQuotes := flag.Bool("lazy-quotes", false, "accept quotes inside unquoted fields and unescaped quotes inside quoted fields of CSV input")
+	trimSpace := flag.Bool("trim-space", false, "ignore leading white space in CSV fields")
+	comment := flag.String("comment", "", "skip CSV lines starting with this character, e.g. #")
+	strictFields := flag.Bool("strict-fields", false, "reject CSV rows whose field count differs from the header's, rather than only rows too short for the mapped columns")
+	paramMap := flag.String("param-map", "", "extra query placeholders from input columns (csv) or fields (ndjson), e.g. $4=3,$5=4 or $4=region")
+	timeFormat := flag.String("time-format", timeFormatAuto, "format of the start/end columns: auto, layout, epoch-s or epoch-ms")
+	timeLayout := flag.String("time-layout", "", "Go time layout of the start/end columns (default: auto-detect)")
+	timezone := flag.String("timezone", "UTC", "timezone for start/end times without an explicit offset")
+	driver := flag.String("driver", driverPostgres, "execution backend: postgres, or mock to simulate the database with -mock-latency and -mock-error-rate")
+	mockLatency := flag.String("mock-latency", "1ms", "under -driver mock, latency of each query, in the same format as -inject-before")
+	mockErrorRate := flag.Float64("mock-error-rate", 0, "under -driver mock, fraction of queries which fail")
+	mockRows := flag.Int64("mock-rows", 1, "under -driver mock, rows returned by each successful query")
+	waitForDB := flag.Duration("wait-for-db", defaultDBWait, "how long to wait for the database to accept queries and have TimescaleDB installed")
+	numWorkers := flag.Int("workers", 0, "number of workers (default: the number of CPUs or pool_max_conns, whichever is fewer)")
+	connPerWorker := flag.Bool("conn-per-worker", false, "pin one pooled connection to each worker for the whole run")
+	parsers := flag.Int("parsers", runtime.GOMAXPROCS(0), "number of goroutines parsing input records")
+	steal := flag.Bool("steal", false, "let idle workers take queued tasks from busy ones, within -max-inflight-per-host")
+	tenantsFile := flag.String("tenants", "", "file mapping hostnames to tenants with rate limits and priorities")
+	starvation := flag.Duration("starvation-threshold", time.Second, "under -tenants, tasks held back longer than this are counted as starved")
+	maxInflightPerHost := flag.Int("max-inflight-per-host", 1, "maximum number of queries for the same hostname running at once")
+	resultBuffer := flag.Int("result-buffer", 1024, "number of results buffered between workers and the collector")
+	backpressure := flag.String("backpressure", backpressureBlock, "when the results buffer is full: block workers, or drop results and count them")
+	protocol := flag.String("protocol", protocolExtended, "wire protocol for the benchmark query: simple, extended, or both to interleave and compare them")
+	resultFormat := flag.String("result-format", resultFormatAuto, "format to request the benchmark query's results in: auto, text, binary, or both to interleave and compare them")
+	compareDSN := flag.String("compare-dsn", "", "also run the workload against this database, e.g. postgres://user@host/db")
+	compareSchema := flag.String("compare-schema", "", "search_path for the comparison target (default: same database, different schema)")
+	targetRelation := flag.String("target-relation", "", "query this relation, e.g. a continuous aggregate, in place of "+benchRelation)
+	compareRelation := flag.String("compare-relation", "", "also run the workload against this relation in place of "+benchRelation+", in the comparison target's database")
+	compareLabel := flag.String("compare-label", "comparison", "name of the comparison target in the report")
+	var endpoints endpointFlags
+	flag.Var(&endpoints, "endpoint", "run the workload against this database, given as label=postgres://user@host/db, instead of the one in POSTGRES_* (repeatable, to compare several)")
+	shadowDSN := flag.String("shadow-dsn", "", "also run every query against this candidate database, at the same time as against the primary, comparing latencies and results")
+	shadowLabel := flag.String("shadow-label", defaultShadowLabel, "name of the -shadow-dsn target in the report")
+	endpointOrder := flag.String("endpoint-order", endpointsInterleaved, "with several -endpoint: interleaved to run every task against each, or sequential to run the whole workload against each in turn")
+	variantsFile := flag.String("variants", "", "file of alternative SQL formulations to interleave and compare")
+	mix := flag.Bool("mix", false, "run each task with one of the -variants, chosen at random by weight, rather than with all of them")
+	dedupe := flag.Bool("dedupe", false, "skip tasks whose hostname, start, end, bucket and parameters were already seen")
+	rejectsFile := flag.String("rejects", "", "write input rows rejected by validation to this file (csv), with their row number and reason")
+	rate := flag.Float64("rate", 0, "target queries per second, dispatched on a fixed schedule (0 runs closed-loop)")
+	replay := flag.Bool("replay", false, "dispatch tasks with the gaps between their original times, from the \"at\" column")
+	replaySpeed := flag.Float64("replay-speed", 1, "under -replay, speed up (>1) or slow down (<1) the original timing")
+	retries := flag.Int("retries", 0, "number of times to retry a failed query")
+	slo := flag.Duration("slo", 0, "latency objective to score queries against, e.g. 100ms (0 disables)")
+	apdexTolerance := flag.Float64("apdex-tolerance", 4, "multiple of -slo below which queries are tolerable rather than frustrating")
+	rangeBuckets := flag.String("range-buckets", "", "upper bounds of the range length buckets in the report (default 1h,6h,24h)")
+	repeat := flag.Bool("repeat", false, "run each successful query again immediately on the same connection, and report how much faster the second run was")
+	prime := flag.Int("prime", 0, "before the run, run the first N tasks of -file unmeasured to bring caches to a steady state")
+	prewarm := flag.Bool("prewarm", false, "before the run, load the benchmark relation's chunks into shared buffers with pg_prewarm")
+	recordSample := flag.Float64("record-sample", 1, "fraction of queries to record in detail for latencies and breakdowns, while counting all of them")
+	explainSample := flag.Float64("explain-sample", 0, "fraction of queries to re-run with EXPLAIN ANALYZE to summarise plan shapes")
+	sampleSize := flag.Int("sample", 0, "retain a uniform sample of this many query times per distribution for quantiles (0 keeps all)")
+	trim := flag.Float64("trim", 0.05, "fraction of queries to discard from each end for the trimmed mean")
+	heatmap := flag.Bool("heatmap", false, "render a latency heatmap over the course of the run")
+	topN := flag.Int("top", 10, "number of slowest queries to list in the report")
+	failedLatencies := flag.Bool("failed-latencies", false, "report latencies of failed queries as a separate distribution")
+	rawFile := flag.String("raw", "", "write every query attempt to this file (csv)")
+	manifestFile := flag.String("manifest", "", "write a JSON manifest of the run configuration, environment and statistics to this file (- for stdout)")
+	flag.StringVar(manifestFile, "o", "", "shorthand for -manifest")
+	labels := make(labelFlags)
+	flag.Var(labels, "label", "key=value describing the run, recorded in every output (repeatable)")
+	historyFile := flag.String("history", "", "append a one-line JSON summary of the run to this file")
+	notifyURL := flag.String("notify-url", "", "POST a JSON summary of the run to this webhook when it finishes or is aborted")
+	notifyFormat := flag.String("notify-format", notifyJSON, "format of -notify-url messages: json, or slack for a Slack incoming webhook")
+	notifyMaxP99 := flag.Duration("notify-max-p99", 0, "report the run as failed in notifications if the p99 exceeds this (0 disables)")
+	notifyMaxErrorRate := flag.Float64("notify-max-error-rate", 0, "report the run as failed in notifications if the error rate exceeds this fraction (0 disables)")
+	reportDir := flag.String("report-dir", "", "write the report and manifest into this directory, as report.txt and manifest.json")
+	uploadSpec := flag.String("upload", "", "upload the report, manifest and raw output to s3://bucket/prefix/ or gs://bucket/prefix/, under a new run ID")
+	storeFile := flag.String("store", "", "save the run to this SQLite results store, for the report command")
+	baselineRuns := flag.Int("baseline", 0, "compare the run with the median of the last N earlier runs with the same config hash in -store or -history, exiting with status 3 if it regressed (0 disables)")
+	baselineSigma := flag.Float64("baseline-sigma", 3, "under -baseline, a figure regresses if worse than the baseline by more than this many standard deviations of the baseline runs (0 disables)")
+	baselineChange := flag.Float64("baseline-change", 0.05, "under -baseline, and by more than this fraction of the baseline (0 disables)")
+	baselineLabels := make(labelFlags)
+	flag.Var(baselineLabels, "baseline-label", "under -baseline, only compare with earlier runs with this key=value label (repeatable)")
+	seed := flag.Int64("seed", 0, "seed for all randomised behaviour (default: derived from the current time)")
+	sampleInterval := flag.Duration("server-sample-interval", 0, "interval at which to sample server activity during the run (0 disables)")
+	injectBefore := flag.String("inject-before", "", "artificial delay before each query: 20ms, 10ms-30ms (uniform), normal:20ms,5ms or lognormal:20ms,0.5")
+	injectAfter := flag.String("inject-after", "", "artificial delay after each query, in the same format as -inject-before")
+	chaosRate := flag.Float64("chaos-rate", 0, "terminate benchmark connections at random, on average this many times per second (0 disables)")
+	chaosReset := flag.Float64("chaos-reset", 0.1, "fraction of chaos events which terminate every connection to a target, as a failover would")
+	chaosWindow := flag.Duration("chaos-window", 5*time.Second, "results finishing within this long after a chaos event are reported as disturbed")
+	paginateMode := flag.String("paginate", "", "fetch each task's result in pages: offset or keyset (default: all at once)")
+	pageSize := flag.Int("page-size", 100, "rows per page under -paginate")
+	maxPages := flag.Int("max-pages", 0, "stop each task after this many pages under -paginate (0 fetches every page)")
+	latencyBudget := flag.Duration("latency-budget", 0, "cancel queries running longer than this, as a client giving up would (0 disables)")
+	hookCmd := flag.String("hook", "", "shell command to run mid-run, e.g. to trigger a switchover")
+	hookAt := flag.Duration("hook-at", 30*time.Second, "when to run -hook, relative to the start of the run")
+	hookWindow := flag.Duration("hook-window", time.Minute, "how long after -hook starts to analyse errors and recovery")
+	snapshotConfig := flag.Bool("server-config", false, "record server settings and the hypertable's size, dimensions, compression and jobs in the report")
+	statStatements := flag.Bool("stat-statements", false, "report pg_stat_statements and pg_stat_database deltas for the run")
+	quiet := flag.Bool("quiet", false, "log only warnings and errors, so stdout carries just the final report")
+	noColor := flag.Bool("no-color", false, "disable coloured output, which is otherwise used when stdout is a terminal")
 	flag.Parse()
 
-	dbHost := os.Getenv("POSTGRES_HOST")
-	if dbHost == "" {
-		log.Fatal("[ERROR] must set POSTGRES_HOST environment variable\n")
+	if *quiet {
+		silenceInfo()
+	}
+
+	if *reportDir != "" {
+		if err := os.MkdirAll(*reportDir, 0755); err != nil {
+			log.Fatalf("[ERROR] Unable to create report directory: %s\n", err.Error())
+		}
+		if *manifestFile == "" {
+			*manifestFile = filepath.Join(*reportDir, reportDirManifest)
+		}
+	}
+
+	var upload *uploadDest
+	var runID string
+	if *uploadSpec != "" {
+		var err error
+		if upload, err = parseUploadDest(*uploadSpec); err != nil {
+			log.Fatalf("[ERROR] Invalid -upload: %s\n", err.Error())
+		}
+		if *reportDir == "" && (*manifestFile == "" || *manifestFile == stdoutName) && (*rawFile == "" || *rawFile == stdoutName) {
+			log.Fatal("[ERROR] -upload needs -report-dir, -manifest or -raw to write files to upload\n")
+		}
+	}
+	var store *sql.DB
+	if *storeFile != "" {
+		var err error
+		if store, err = openStore(*storeFile); err != nil {
+			log.Fatalf("[ERROR] Unable to open results store: %s\n", err.Error())
+		}
+		defer store.Close()
+	}
+	if upload != nil || store != nil {
+		runID = newRunID(time.Now())
+	}
+
+	// Keep stdout for the manifest alone, printing the report to stderr
+	// instead, or nowhere under -quiet
+	if *manifestFile == stdoutName {
+		if *quiet {
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				log.Fatalf("[ERROR] Unable to open %s: %s\n", os.DevNull, err.Error())
+			}
+			os.Stdout = devNull
+		} else {
+			os.Stdout = os.Stderr
+		}
+	}
+
+	var notify *notifier
+	if *notifyURL != "" {
+		var err error
+		if notify, err = newNotifier(*notifyURL, *notifyFormat, *notifyMaxP99, *notifyMaxErrorRate); err != nil {
+			log.Fatalf("[ERROR] Invalid -notify-format: %s\n", err.Error())
+		}
+	}
+
+	if *tui && !isTerminal(os.Stderr) {
+		log.Fatal("[ERROR] -tui needs a terminal on stderr\n")
+	}
+
+	// The saved report shouldn't contain colour codes
+	useColor = !*noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout) && *reportDir == ""
+
+	if len(endpoints) > 0 && (*compareDSN != "" || *compareSchema != "" || *compareRelation != "") {
+		log.Fatal("[ERROR] -endpoint can't be used with -compare-dsn, -compare-schema or -compare-relation\n")
+	}
+	if *shadowDSN != "" {
+		if *compareDSN != "" || *compareSchema != "" || *compareRelation != "" || len(endpoints) > 1 {
+			log.Fatal("[ERROR] -shadow-dsn can't be used with -compare-dsn, -compare-schema, -compare-relation or several -endpoint flags\n")
+		}
+		if *scriptFile != "" || *paginateMode != "" {
+			log.Fatal("[ERROR] -shadow-dsn can't be used with -pgbench-script or -paginate\n")
+		}
+		if *shadowLabel == primaryTargetName || (len(endpoints) == 1 && *shadowLabel == endpoints[0].label) {
+			log.Fatal("[ERROR] -shadow-label must differ from the primary's name\n")
+		}
+	}
+	if *endpointOrder != endpointsInterleaved && *endpointOrder != endpointsSequential {
+		log.Fatalf("[ERROR] -endpoint-order must be %s or %s\n", endpointsInterleaved, endpointsSequential)
+	}
+	if len(endpoints) > 1 && *endpointOrder == endpointsSequential {
+		if (*fileName == stdinName && len(sources) == 0 && *scriptFile == "") || *listen != "" || *kafkaBrokers != "" || *pgChannel != "" || *follow {
+			log.Fatal("[ERROR] -endpoint-order sequential repeats the workload, so it needs -file to name a file, or -source or -pgbench-script\n")
+		}
+		if *manifestFile != "" || *reportDir != "" || *rawFile != "" || *rejectsFile != "" || *uploadSpec != "" {
+			log.Fatal("[ERROR] -endpoint-order sequential can't be used with -manifest, -report-dir, -raw, -rejects or -upload, which each run would overwrite; use -store or -history\n")
+		}
+		if _, ok := labels["endpoint"]; ok {
+			log.Fatal("[ERROR] -endpoint-order sequential labels each run with endpoint=<label>, so it can't be used with -label endpoint\n")
+		}
+		// Every endpoint gets the same workload, down to any random choices
+		seqSeed := time.Now().UnixNano()
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "seed" {
+				seqSeed = *seed
+			}
+		})
+		if code := runEndpointsSequentially(endpoints, os.Args[1:], seqSeed); code != 0 {
+			os.Exit(code)
+		}
+		return
+	}
+
+	// Under -driver mock, nothing needs a real database
+	var mock *mockDriver
+	var dbUrl string
+	switch *driver {
+	case driverPostgres:
+		if len(endpoints) > 0 {
+			dbUrl = endpoints[0].dsn
+		} else {
+			dbUrl = dbURLFromEnv()
+		}
+	case driverMock:
+		var err error
+		if mock, err = newMockDriver(*mockLatency, *mockErrorRate, *mockRows); err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+		if *explainSample > 0 || *statStatements || *snapshotConfig || *sampleInterval > 0 || *prewarm || *prime > 0 || *chaosRate > 0 || *paginateMode != "" || *scriptFile != "" || *pgChannel != "" {
+			log.Fatal("[ERROR] -driver mock can't be used with -explain-sample, -stat-statements, -server-config, -server-sample-interval, -prewarm, -prime, -chaos-rate, -paginate, -pgbench-script or -pg-channel\n")
+		}
+	default:
+		log.Fatalf("[ERROR] -driver must be %s or %s\n", driverPostgres, driverMock)
+	}
+
+	if *numWorkers < 0 {
+		log.Fatal("[ERROR] workers must not be negative\n")
+	}
+
+	// More workers than pooled connections would mostly measure queuing for
+	// the pool, and more than CPUs would contend for the client
+	if *numWorkers == 0 {
+		*numWorkers = runtime.GOMAXPROCS(0)
+		if mock == nil {
+			maxConns, err := poolMaxConns(dbUrl)
+			if err != nil {
+				log.Fatalf("[ERROR] Invalid connection string: %s\n", err.Error())
+			}
+			if int(maxConns) < *numWorkers {
+				*numWorkers = int(maxConns)
+			}
+		}
+		log.Printf("[INFO] Using %d workers\n", *numWorkers)
+	}
+
+	if *maxInflightPerHost < 1 {
+		log.Fatal("[ERROR] max-inflight-per-host must be at least 1\n")
+	}
+	if *maxInflightPerHost > *numWorkers {
+		log.Printf("[WARN] Only %d queries per hostname can run at once with %d workers\n", *numWorkers, *numWorkers)
+	}
+
+	// flag.Int64 can't distinguish an explicit 0, so check whether it was set
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["seed"] {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("[INFO] Using seed %d\n", *seed)
+
+	cols, err := parseColumns(*columns)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -columns: %s\n", err.Error())
+	}
+
+	if *baselineRuns < 0 || *baselineSigma < 0 || *baselineChange < 0 {
+		log.Fatal("[ERROR] -baseline, -baseline-sigma and -baseline-change must not be negative\n")
+	}
+	if *baselineRuns > 0 {
+		if *storeFile == "" && *historyFile == "" {
+			log.Fatal("[ERROR] -baseline requires -store or -history, to find earlier runs\n")
+		}
+		if *baselineSigma == 0 && *baselineChange == 0 {
+			log.Fatal("[ERROR] -baseline requires -baseline-sigma or -baseline-change\n")
+		}
+	}
+	if *slo < 0 {
+		log.Fatal("[ERROR] slo must not be negative\n")
+	}
+
+	if *apdexTolerance < 1 {
+		log.Fatal("[ERROR] apdex-tolerance must be at least 1\n")
+	}
+
+	if *sampleSize < 0 {
+		log.Fatal("[ERROR] sample must not be negative\n")
+	}
+
+	if *trim < 0 || *trim >= 0.5 {
+		log.Fatal("[ERROR] trim must be at least 0 and less than 0.5\n")
+	}
+
+	rangeBounds, err := parseRangeBounds(*rangeBuckets)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -range-buckets: %s\n", err.Error())
+	}
+
+	timestamps, err := newTimestampParser(*timeFormat, *timeLayout, *timezone)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -time-format or -timezone: %s\n", err.Error())
+	}
+
+	// Tasks submitted over HTTP are dispatched immediately, and the daemon
+	// runs until stopped
+	if len(schedules) > 0 && *listen == "" {
+		log.Fatal("[ERROR] -schedule requires -listen\n")
+	}
+	if *listen != "" {
+		if *dedupe {
+			log.Fatal("[ERROR] -dedupe can't be used with -listen, as skipped tasks would never be answered\n")
+		}
+		*stream = true
+		if *uiAddr == *listen {
+			log.Fatal("[ERROR] -ui and -listen need different addresses\n")
+		}
+	}
+
+	// Kafka messages are always NDJSON tasks, and the topic never ends
+	if *kafkaBrokers != "" {
+		if *kafkaTopic == "" {
+			log.Fatal("[ERROR] -kafka-topic is required with -kafka-brokers\n")
+		}
+		*inputEncoding = inputFormatNDJSON
+		*stream = true
+	}
+
+	// A followed file never ends, so its rows must be dispatched as they're
+	// written
+	if *follow {
+		if *fileName == stdinName || *listen != "" || *kafkaBrokers != "" || *pgChannel != "" || *scriptFile != "" || len(sources) > 0 {
+			log.Fatal("[ERROR] -follow reads tasks from -file, which must name a file\n")
+		}
+		*stream = true
+	}
+
+	// Notifications carry NDJSON tasks too, and arrive until the run is
+	// stopped
+	if *pgChannel != "" {
+		if *kafkaBrokers != "" || *listen != "" {
+			log.Fatal("[ERROR] -pg-channel can't be combined with -kafka-brokers or -listen\n")
+		}
+		*inputEncoding = inputFormatNDJSON
+		*stream = true
+	}
+
+	// Input with no end mustn't keep every query time in memory
+	if (*stream || *listen != "") && !set["sample"] {
+		*sampleSize = defaultStreamSample
+		log.Printf("[INFO] Keeping a sample of %d times per distribution, as the input may not end; set -sample 0 to keep all\n", *sampleSize)
+	}
+
+	// Looping needs an input with an end, and would repeat replay times
+	// and skip every repeated task
+	if *untilStable {
+		switch {
+		case *stream:
+			log.Fatal("[ERROR] -until-stable can't be used with -stream, -follow, -listen, -kafka-brokers or -pg-channel\n")
+		case *replay:
+			log.Fatal("[ERROR] -until-stable can't be used with -replay\n")
+		case *dedupe:
+			log.Fatal("[ERROR] -until-stable can't be used with -dedupe\n")
+		case *stableWidth <= 0:
+			log.Fatal("[ERROR] -stable-width must be positive\n")
+		}
+	}
+
+	if *inputEncoding != inputFormatCSV && *inputEncoding != inputFormatNDJSON {
+		log.Fatalf("[ERROR] Invalid -input-format %q, expected %s or %s\n", *inputEncoding, inputFormatCSV, inputFormatNDJSON)
+	}
+
+	// Extra parameters follow $1-$3 and, if mapped, the bucket width
+	firstParam := 4
+	if cols.bucket >= 0 {
+		firstParam = 5
+	}
+	cols.params, err = parseParamMap(*paramMap, *inputEncoding, firstParam, cols.minFields())
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -param-map: %s\n", err.Error())
+	}
+
+	csvOpts, err := parseCSVOptions(*delimiter, *comment)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid CSV options: %s\n", err.Error())
+	}
+	csvOpts.lazyQuotes = *lazyQuotes
+	csvOpts.trimLeadingSpace = *trimSpace
+	csvOpts.strictFields = *strictFields
+
+	*charset, err = parseCharset(*charset)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -encoding: %s\n", err.Error())
+	}
+
+	format := inputFormat{
+		encoding:   *inputEncoding,
+		charset:    *charset,
+		csv:        csvOpts,
+		cols:       cols,
+		timestamps: timestamps,
+	}
+
+	// Sources replace -file, and generated tasks have only the standard
+	// parameters
+	if len(sources) > 0 {
+		if set["file"] || *listen != "" || *kafkaBrokers != "" || *pgChannel != "" || *scriptFile != "" {
+			log.Fatal("[ERROR] -source can't be combined with -file, -listen, -kafka-brokers, -pg-channel or -pgbench-script\n")
+		}
+		for _, spec := range sources {
+			if spec.generate > 0 && (cols.bucket >= 0 || len(cols.params) > 0) {
+				log.Fatalf("[ERROR] Source %q generates tasks without the bucket or -param-map columns\n", spec.name)
+			}
+			if spec.format != "" && spec.format != *inputEncoding && len(cols.params) > 0 {
+				log.Fatalf("[ERROR] Source %q must use -input-format %s, which -param-map refers to\n", spec.name, *inputEncoding)
+			}
+		}
+	}
+
+	if *repeat && (*paginateMode != "" || *scriptFile != "") {
+		log.Fatal("[ERROR] -repeat can't be used with -paginate or -pgbench-script\n")
+	}
+
+	if *mix && *variantsFile == "" {
+		log.Fatal("[ERROR] -mix needs a -variants file of weighted query templates\n")
+	}
+
+	variants := defaultVariants
+	if cols.bucket >= 0 {
+		variants = bucketVariants
+	}
+	if *variantsFile != "" {
+		variants, err = loadVariants(*variantsFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when loading variants from %s: %s\n", *variantsFile, err.Error())
+		}
+	}
+
+	// A script replaces the benchmark query, and is reported as its variant
+	var script *pgbenchScript
+	if *scriptFile != "" {
+		if *variantsFile != "" || *listen != "" || *kafkaBrokers != "" || *pgChannel != "" {
+			log.Fatal("[ERROR] -pgbench-script can't be combined with -variants, -listen, -kafka-brokers or -pg-channel\n")
+		}
+		script, err = loadPgbenchScript(*scriptFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when loading script %s: %s\n", *scriptFile, err.Error())
+		}
+		variants = []queryVariant{{name: script.name, weight: 1}}
+	}
+
+	protocols, err := parseProtocols(*protocol)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -protocol: %s\n", err.Error())
+	}
+	if *scriptFile != "" && *protocol != protocolExtended {
+		log.Fatal("[ERROR] -protocol can't be used with -pgbench-script\n")
+	}
+	resultFormats, err := parseResultFormats(*resultFormat)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -result-format: %s\n", err.Error())
+	}
+	if *resultFormat != resultFormatAuto && (*protocol != protocolExtended || *scriptFile != "") {
+		log.Fatal("[ERROR] -result-format needs the extended protocol, and can't be used with -pgbench-script\n")
 	}
 
-	dbUser := os.Getenv("POSTGRES_USER")
-	if dbUser == "" {
-		log.Fatal("[ERROR] must set POSTGRES_USER environment variable\n")
+	var tenants []*tenant
+	if *tenantsFile != "" {
+		tenants, err = loadTenants(*tenantsFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when loading tenants from %s: %s\n", *tenantsFile, err.Error())
+		}
 	}
 
-	dbPassword := os.Getenv("POSTGRES_PASSWORD")
-	if dbPassword == "" {
-		log.Fatal("[ERROR] must set POSTGRES_PASSWORD environment variable\n")
+	if *compareLabel == primaryTargetName {
+		log.Fatalf("[ERROR] compare-label must not be %q\n", primaryTargetName)
 	}
 
-	dbDatabase := os.Getenv("POSTGRES_DATABASE")
-	if dbDatabase == "" {
-		log.Fatal("[ERROR] must set POSTGRES_DATABASE environment variable\n")
+	if *prime < 0 {
+		log.Fatal("[ERROR] prime must not be negative\n")
+	}
+	if *prime > 0 && (*fileName == stdinName || *listen != "" || *kafkaBrokers != "" || *pgChannel != "" || *scriptFile != "" || len(sources) > 0) {
+		log.Fatal("[ERROR] -prime reads tasks from -file, which must name a file\n")
 	}
 
-	dbUrl := fmt.Sprintf("postgres://%s:%s@%s/%s", dbUser, dbPassword, dbHost, dbDatabase)
+	if *recordSample <= 0 || *recordSample > 1 {
+		log.Fatal("[ERROR] record-sample must be greater than 0 and at most 1\n")
+	}
 
-	if *numWorkers < 1 {
-		log.Fatal("[ERROR] workers must be at least 1\n")
+	if *explainSample < 0 || *explainSample > 1 {
+		log.Fatal("[ERROR] explain-sample must be between 0 and 1\n")
 	}
 
-	var err error
-	var attempt int
-	for attempt = 0; attempt < dbConnectAttempts; attempt++ {
-		log.Printf("[INFO] Connecting to database [attempt %d] ...\n", attempt)
-		dbPool, err = pgxpool.Connect(context.Background(), dbUrl)
-		if err == nil {
-			break
+	if *parsers < 1 {
+		log.Fatal("[ERROR] parsers must be at least 1\n")
+	}
+
+	if *replay {
+		if cols.at < 0 {
+			log.Fatal("[ERROR] -replay requires an \"at\" column, e.g. -columns at=3\n")
+		}
+		if *rate > 0 {
+			log.Fatal("[ERROR] -replay and -rate can't be used together\n")
 		}
-		time.Sleep(dbConnectDelay * time.Second)
+		if *replaySpeed <= 0 {
+			log.Fatal("[ERROR] -replay-speed must be positive\n")
+		}
+	}
+	before, err := parseDelay(*injectBefore)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -inject-before: %s\n", err.Error())
 	}
+	after, err := parseDelay(*injectAfter)
 	if err != nil {
-		log.Fatalf("[ERROR] Unable to connect to %s after %d attempts: %s\n", dbUrl, attempt, err.Error())
+		log.Fatalf("[ERROR] Invalid -inject-after: %s\n", err.Error())
+	}
+
+	if *paginateMode != "" {
+		if *paginateMode != paginateOffset && *paginateMode != paginateKeyset {
+			log.Fatalf("[ERROR] Invalid -paginate %q, expected %s or %s\n", *paginateMode, paginateOffset, paginateKeyset)
+		}
+		if *pageSize < 1 || *maxPages < 0 {
+			log.Fatal("[ERROR] -page-size must be positive and -max-pages must not be negative\n")
+		}
+	}
+	if *chaosRate < 0 || *chaosReset < 0 || *chaosReset > 1 {
+		log.Fatal("[ERROR] -chaos-rate must not be negative and -chaos-reset must be between 0 and 1\n")
+	}
+	if *rate < 0 {
+		log.Fatal("[ERROR] rate must not be negative\n")
+	}
+
+	if *retries < 0 {
+		log.Fatal("[ERROR] retries must not be negative\n")
+	}
+
+	b, err := New(Config{
+		DatabaseURL:     dbUrl,
+		Relation:        *targetRelation,
+		CompareDSN:      *compareDSN,
+		CompareSchema:   *compareSchema,
+		CompareRelation: *compareRelation,
+		CompareLabel:    *compareLabel,
+		Endpoints:       endpoints,
+		ShadowDSN:       *shadowDSN,
+		ShadowLabel:     *shadowLabel,
+		WaitForDB:       *waitForDB,
+		Mock:            mock,
+		ResultBuffer:    *resultBuffer,
+		Backpressure:    *backpressure,
+		Dispatch: dispatchConfig{
+			numWorkers:         *numWorkers,
+			maxInflightPerHost: *maxInflightPerHost,
+			steal:              *steal,
+			retries:            *retries,
+			dedupe:             *dedupe,
+			rate:               *rate,
+			variants:           variants,
+			mix:                *mix,
+			protocols:          protocols,
+			resultFormats:      resultFormats,
+
+			replay:      *replay,
+			replaySpeed: *replaySpeed,
+
+			connPerWorker: *connPerWorker,
+
+			explainSample: *explainSample,
+			seed:          *seed,
+			recordSample:  *recordSample,
+			repeat:        *repeat,
+
+			paginate:      pagination{mode: *paginateMode, size: *pageSize, maxPages: *maxPages},
+			latencyBudget: *latencyBudget,
+			injectBefore:  before,
+			injectAfter:   after,
+		},
+		Stats: statsConfig{
+			sampleSize:     *sampleSize,
+			seed:           *seed,
+			connPerWorker:  *connPerWorker,
+			injected:       before != nil || after != nil,
+			heatmap:        *heatmap,
+			topN:           *topN,
+			rangeBounds:    rangeBounds,
+			slo:            *slo,
+			apdexTolerance: *apdexTolerance,
+			repeat:         *repeat,
+			sampleInterval: *sampleInterval,
+			sources:        sources.names(),
+			protocols:      protocols,
+			resultFormats:  resultFormats,
+			tenants:        tenants,
+			starvation:     *starvation,
+		},
+	})
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to connect to %s\n", err.Error())
+	}
+	defer b.Close()
+	targets := b.targets
+
+	// Pinned connections enlarge the pool as needed
+	if !*connPerWorker && mock == nil {
+		for _, t := range targets {
+			if maxConns := t.pool.Config().MaxConns; int32(*numWorkers) > maxConns {
+				log.Printf("[WARN] %d workers share %d connections to %s, so latencies will include waiting for a connection; raise pool_max_conns or use -conn-per-worker\n",
+					*numWorkers, maxConns, t.name)
+			}
+		}
+	}
+
+	server := serverInfo{Version: mockServerVersion}
+	if mock == nil {
+		server, err = describeServer(context.Background(), b.pool, b.Relation())
+		if err != nil {
+			log.Printf("[WARN] Unable to describe server: %s\n", err.Error())
+		}
+	}
+	var manifest *runManifest
+	if *manifestFile != "" || *historyFile != "" || notify != nil || store != nil || *baselineRuns > 0 {
+		manifest = newManifest(*seed, server, labels)
+		manifest.RunID = runID
+	}
+
+	var serverCfg *serverConfig
+	if *snapshotConfig {
+		serverCfg, err = snapshotServerConfig(context.Background(), b.pool, b.Relation())
+		if err != nil {
+			log.Printf("[WARN] Unable to record server configuration: %s\n", err.Error())
+		}
+	}
+
+	// Priming happens before server statistics are snapshotted, so they
+	// cover only the measured run
+	var primed priming
+	if *prewarm {
+		if err := b.Prewarm(&primed); err != nil {
+			log.Fatalf("[ERROR] Unable to prewarm: %s\n", err.Error())
+		}
+	}
+	if *prime > 0 {
+		tasks, err := readPrimingTasks(*fileName, format, *prime)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when reading priming tasks from %s: %s\n", *fileName, err.Error())
+		}
+		b.Prime(tasks, &primed)
+	}
+
+	var statsBefore *serverSnapshot
+	if *statStatements {
+		statsBefore, err = takeServerSnapshot(context.Background(), b.pool, b.Relation())
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to snapshot server statistics: %s\n", err.Error())
+		}
+	}
+
+	// Connections are established and workers started before the run, so
+	// its first seconds aren't a mix of startup and measurement
+	if err := b.Warm(); err != nil {
+		log.Fatalf("[ERROR] Unable to start workers: %s\n", err.Error())
 	}
 
-	results := make(chan benchResult)
+	poolsBefore := snapshotPools(targets)
 
-	var f *os.File
-	if *fileName == "-" {
+	var f io.Reader
+	var kafka *kafkaSource
+	var channel *channelSource
+	if *listen != "" || *scriptFile != "" {
+		// Tasks arrive over HTTP, or are generated from the script
+	} else if len(sources) > 0 {
+		if err := sources.open(); err != nil {
+			log.Fatalf("[ERROR] Error when opening sources: %s\n", err.Error())
+		}
+	} else if *kafkaBrokers != "" {
+		kafka, err = startKafkaSource(*kafkaBrokers, *kafkaGroup, *kafkaTopic)
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to consume from Kafka: %s\n", err.Error())
+		}
+		defer kafka.close()
+		f = kafka
+	} else if *pgChannel != "" {
+		channel, err = startChannelSource(dbUrl, *pgChannel)
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to listen on channel %s: %s\n", *pgChannel, err.Error())
+		}
+		defer channel.close()
+		f = channel
+	} else if *fileName == "-" {
 		f = os.Stdin
 	} else {
-		var err error
-		f, err = os.Open(*fileName)
+		file, err := os.Open(*fileName)
 		if err != nil {
 			log.Fatalf("[ERROR] Error when opening file %s: %s", *fileName, err.Error())
 		}
+		f = file
+		if *follow {
+			f = newFollowReader(file)
+		}
+	}
+
+	// Bytes read and time spent reading, so a slow input shows in the report
+	// rather than as a lower query rate
+	var inputMeters []*inputMeter
+	var fileRead *fileProgress
+	if f != nil {
+		meter := newInputMeter(f)
+		inputMeters = append(inputMeters, meter)
+		fileRead = newFileProgress(f, meter)
+		f = meter
+	} else {
+		inputMeters = sources.meters()
+	}
+
+	// Measured before the run, so it doesn't compete with the workers
+	timer := calibrateTimer()
+
+	runStart := time.Now()
+	usage := startClientUsage()
+
+	var dash *dashboard
+	var term *terminalUI
+	if *uiAddr != "" || *tui {
+		dash = newDashboard(runStart, *numWorkers)
+		go dash.rollEvery()
+	}
+	if *uiAddr != "" {
+		go dash.serve(*uiAddr)
+	}
+	if *tui {
+		term = startTerminalUI(dash)
+	}
+
+	var serverSamples chan []serverSample
+	stopSampling := func() {}
+	if *sampleInterval > 0 {
+		var ctx context.Context
+		ctx, stopSampling = context.WithCancel(context.Background())
+		serverSamples = make(chan []serverSample)
+		go sampleServer(ctx, b.pool, *sampleInterval, runStart, serverSamples)
+	}
+
+	var chaos *chaosMonkey
+	stopChaos := func() {}
+	if *chaosRate > 0 {
+		var ctx context.Context
+		ctx, stopChaos = context.WithCancel(context.Background())
+		chaos = newChaosMonkey(targets, *chaosRate, *chaosReset, newRand(*seed, "chaos"))
+		go chaos.run(ctx)
+	}
+
+	var hook *hookRun
+	stopHook := func() {}
+	if *hookCmd != "" {
+		var ctx context.Context
+		ctx, stopHook = context.WithCancel(context.Background())
+		hook = newHookRun(*hookCmd, *hookAt)
+		go hook.run(ctx, runStart)
+	}
+
+	stopSchedules := func() {}
+	if len(schedules) > 0 {
+		stopSchedules = startSchedules(schedules)
+	}
+
+	var raw *rawWriter
+	if *rawFile != "" {
+		raw, err = newRawWriter(*rawFile, labels)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when creating raw output file %s: %s", *rawFile, err.Error())
+		}
+	}
+
+	validation := newValidationSummary()
+	if *rejectsFile != "" {
+		validation.rejects, err = newRejectWriter(*rejectsFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when creating rejects file %s: %s", *rejectsFile, err.Error())
+		}
+	}
+
+	// Signals stop dispatching and produce the final report, which is the
+	// only way to end -stream and -listen runs
+	stop := make(chan struct{})
+	handleShutdownSignals(stop, func() {
+		if term != nil {
+			term.stop()
+		}
+		if notify != nil {
+			notify.aborted(runStart, labels)
+		}
+		if raw != nil {
+			if err := raw.close(); err != nil {
+				log.Printf("[ERROR] Failed writing raw output file %s: %s\n", *rawFile, err.Error())
+			}
+		}
+		if validation.rejects != nil {
+			if err := validation.rejects.close(); err != nil {
+				log.Printf("[ERROR] Failed writing rejects file %s: %s\n", *rejectsFile, err.Error())
+			}
+		}
+		if kafka != nil {
+			kafka.close()
+		}
+		if channel != nil {
+			channel.close()
+		}
+	})
+
+	// Queries dispatched for each task, one for each combination of
+	// variant, target, protocol and result format. A shadow target isn't
+	// dispatched to.
+	dispatchTargets := len(b.cfg.Dispatch.targets)
+	perTask := len(variants) * dispatchTargets * len(protocols) * len(resultFormats)
+	if *mix {
+		perTask = dispatchTargets * len(protocols) * len(resultFormats)
+	}
+
+	// A looping input has no end to estimate
+	var inputProgress *runProgress
+	if !*untilStable {
+		var total int64
+		if script != nil {
+			total = int64(*transactions) * int64(perTask)
+		} else if generated := sources.generated(); generated > 0 {
+			total = int64(generated) * int64(perTask)
+		}
+		inputProgress = newRunProgress(fileRead, total, perTask)
 	}
 
-	done := make(chan bool)
-	go processCSV(f, *numWorkers, results, done)
+	var progress <-chan time.Time
+	var sinceProgress *intervalStats
+	if *stream || inputProgress != nil {
+		ticker := time.NewTicker(*statsInterval)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+	if *stream {
+		sinceProgress = newIntervalStats()
+	}
 
-	// Values are in microseconds
-	var queryTimes []int64
+	batches := make(chan []parsedRecord, *parsers)
+	dispatchStop := stop
+	if *listen != "" {
+		// The server stops dispatch by closing batches once its in-flight
+		// requests have been answered
+		go newTaskServer(format, perTask, batches).serve(*listen, stop)
+		dispatchStop = nil
+	} else if script != nil {
+		go generateScriptRuns(script, *transactions, *seed, batches)
+	} else {
+		batchSize := pipelineBatchSize
+		if *stream {
+			batchSize = 1
+		}
+		if len(sources) > 0 {
+			sources.start(format, *parsers, batchSize, *seed, batches)
+		} else {
+			go parseInput(f, format, *parsers, batchSize, batches)
+		}
+	}
 
-	var totalQueryTime int64
-	var minQueryTime int64
-	var maxQueryTime int64
-	var medianQueryTime int64
+	var stable *stability
+	var stableCheck, stableTimeout <-chan time.Time
+	stopLooping := make(chan struct{})
+	if *untilStable {
+		stable = newStability(*stableWidth, *maxDuration)
+		ticker := time.NewTicker(stabilityCheckInterval)
+		defer ticker.Stop()
+		stableCheck = ticker.C
+		stableTimeout = time.After(*maxDuration)
+
+		looped := make(chan []parsedRecord, *parsers)
+		go loopInput(batches, looped, stopLooping)
+		batches = looped
+	}
+	if tenants != nil {
+		scheduled := make(chan []parsedRecord)
+		go scheduleTenants(tenants, batches, scheduled)
+		batches = scheduled
+	}
+	st := b.stats
+	if chaos != nil {
+		st.watchChaos(chaos, *chaosWindow)
+	}
+	if hook != nil {
+		st.watchHook(hook, *hookWindow)
+	}
+	if err := b.Start(runStart, batches, validation, dispatchStop); err != nil {
+		log.Fatalf("[ERROR] Unable to start workers: %s\n", err.Error())
+	}
 
 out:
 	for {
 		select {
-		case r := <-results:
-			queryTimes = append(queryTimes, r.queryTime)
-			totalQueryTime += r.queryTime
-		case _ = <-done:
-			log.Print("[INFO] Gathered all results\n")
-			break out
+		case <-progress:
+			if sinceProgress != nil {
+				sinceProgress.logAndReset(st.attempted())
+			}
+			if inputProgress != nil {
+				inputProgress.log(atomic.LoadInt64(&b.dispatched))
+			}
+		case <-stableCheck:
+			if stable.check(st.queryTimes.Values()) {
+				log.Printf("[INFO] P99 stable to within %.1f%% after %d queries, finishing\n",
+					100*stable.relativeWidth(), stable.count)
+				close(stopLooping)
+				stableCheck, stableTimeout = nil, nil
+			}
+		case <-stableTimeout:
+			stable.check(st.queryTimes.Values())
+			log.Printf("[WARN] P99 not stable after %s, finishing\n", *maxDuration)
+			close(stopLooping)
+			stableCheck, stableTimeout = nil, nil
+		case r, ok := <-b.results.ch:
+			if !ok {
+				log.Print("[INFO] Gathered all results\n")
+				break out
+			}
+			if sinceProgress != nil && st.counted(r) {
+				sinceProgress.add(r)
+			}
+			if dash != nil && st.counted(r) {
+				dash.add(r)
+			}
+			if raw != nil && r.recorded {
+				raw.write(r)
+			}
+			st.add(r)
 		}
 	}
 
-	n := len(queryTimes)
-	if n == 0 {
+	usageReport := usage.finish()
+	runEnd := time.Now()
+	if dash != nil {
+		dash.finish()
+	}
+	if term != nil {
+		term.stop()
+	}
+
+	if raw != nil {
+		if err := raw.close(); err != nil {
+			log.Printf("[ERROR] Failed writing raw output file %s: %s\n", *rawFile, err.Error())
+		}
+	}
+	if validation.rejects != nil {
+		if err := validation.rejects.close(); err != nil {
+			log.Printf("[ERROR] Failed writing rejects file %s: %s\n", *rejectsFile, err.Error())
+		}
+	}
+
+	stopChaos()
+	stopHook()
+	stopSchedules()
+
+	var timeline []serverSample
+	if serverSamples != nil {
+		stopSampling()
+		timeline = <-serverSamples
+	}
+
+	dropped := b.results.droppedCount()
+	if dropped > 0 {
+		log.Printf("[WARN] Dropped %d results because the collector fell behind; increase -result-buffer or use -backpressure block\n", dropped)
+	}
+
+	attempted := st.attempted()
+	if attempted == 0 {
+		printValidationSummary(validation)
 		log.Printf("[INFO] No queries provided. Exiting\n")
 		return
 	}
 
-	// Accumulating all results and then sorting is not
-	// the most efficient, but makes calculating the median
-	// value straightforward
-	sort.Slice(queryTimes, func(i, j int) bool {
-		return queryTimes[i] < queryTimes[j]
-	})
-	if n%2 == 0 {
-		medianQueryTime = (queryTimes[n/2-1] + queryTimes[n/2]) / 2
+	var finishReport func() error
+	if *reportDir != "" {
+		finishReport, err = saveStdout(filepath.Join(*reportDir, reportDirReport))
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to save report: %s\n", err.Error())
+		}
+	}
+
+	fmt.Printf("\n###########################\n")
+	fmt.Printf("Seed:              %d\n", *seed)
+	fmt.Printf("Attempted queries: %d\n", attempted)
+	fmt.Printf("Successful:        %d\n", st.succeeded)
+	failedColor := colorIf(st.failed > 0, false)
+	fmt.Printf("Failed:            %s\n", colorize(strconv.Itoa(st.failed), failedColor))
+	fmt.Printf("Error rate:        %s\n", colorize(fmt.Sprintf("%.2f%%", 100*float32(st.failed)/float32(attempted)), failedColor))
+	if dropped > 0 {
+		fmt.Printf("Dropped results:   %s (not included in any statistics)\n", colorize(strconv.FormatInt(dropped, 10), colorRed))
+	}
+	printRowVolume(st)
+	if *recordSample < 1 {
+		fmt.Printf("Recorded sample:   %g%% of queries (%d); the statistics below are estimated from this sample\n",
+			100**recordSample, st.queryTimes.Count()+st.failedQueryTimes.Count())
+	}
+	fmt.Printf("\n")
+
+	if st.queryTimes.Count() > 0 {
+		stats.WriteSummary(os.Stdout, st.queryTimes.Summary())
+		stats.WriteRobust(os.Stdout, st.queryTimes.Values(), *trim)
 	} else {
-		medianQueryTime = queryTimes[n/2]
+		fmt.Printf("No successful queries\n")
 	}
 
-	minQueryTime = queryTimes[0]
-	maxQueryTime = queryTimes[n-1]
+	if st.correctedTimes.Count() > 0 {
+		if *replay {
+			fmt.Printf("\n## Corrected for coordinated omission (replay at %gx)\n", *replaySpeed)
+		} else {
+			fmt.Printf("\n## Corrected for coordinated omission (target %g/s)\n", *rate)
+		}
+		fmt.Printf("Times below are measured from each query's scheduled start,\n")
+		fmt.Printf("including time spent waiting behind earlier queries.\n")
+		stats.WriteSummary(os.Stdout, st.correctedTimes.Summary())
+	}
 
-	fmt.Printf("\n###########################\n")
-	fmt.Printf("Number of queries: %d\n", len(queryTimes))
-	fmt.Printf("Total query time:  %.3fms\n", float32(totalQueryTime)/1000.0)
-	fmt.Printf("Min query time:    %.3fms\n", float32(minQueryTime)/1000.0)
-	fmt.Printf("Max query time:    %.3fms\n", float32(maxQueryTime)/1000.0)
-	fmt.Printf("Mean query time:   %.3fms\n", float32(totalQueryTime)/1000.0/float32(len(queryTimes)))
-	fmt.Printf("Median query time: %.3fms\n", float32(medianQueryTime)/1000.0)
+	if st.injectedTimes.Count() > 0 {
+		fmt.Printf("\n## Including injected latency (before %s, after %s)\n", orNone(*injectBefore), orNone(*injectAfter))
+		stats.WriteSummary(os.Stdout, st.injectedTimes.Summary())
+		stats.WritePercentiles(os.Stdout, st.injectedTimes.Values())
+	}
+
+	if st.firstRowTimes.Count() > 0 {
+		fmt.Printf("\n## Time to first row (query times above cover the full fetch)\n")
+		stats.WriteSummary(os.Stdout, st.firstRowTimes.Summary())
+		stats.WritePercentiles(os.Stdout, st.firstRowTimes.Values())
+		fmt.Printf("Rows fetched:      %d (%.1f per query)\n", st.totalRows, float64(st.totalRows)/float64(st.succeeded))
+	}
+
+	if st.queueTimes.Count() > 0 {
+		fmt.Printf("\n## Queue wait (dispatch to worker pickup, excluded from query times)\n")
+		stats.WriteSummary(os.Stdout, st.queueTimes.Summary())
+	}
+
+	pools := diffPools(targets, poolsBefore, snapshotPools(targets))
+	printWireVolume(st.wire)
+	if mock == nil {
+		printPoolReport(st.acquireTimes, pools)
+		printConnectReport(targets)
+	}
+
+	if *failedLatencies && st.failedQueryTimes.Count() > 0 {
+		fmt.Printf("\n## Failed query latencies\n")
+		stats.WriteSummary(os.Stdout, st.failedQueryTimes.Summary())
+	}
+
+	if st.slo != nil {
+		printSLOReport(st.slo)
+	}
+
+	if stable != nil {
+		printStabilityReport(stable)
+	}
+
+	if *paginateMode != "" {
+		printPageBreakdown(b.cfg.Dispatch.paginate, st.pages)
+	}
+
+	if *latencyBudget > 0 {
+		printBudgetReport(*latencyBudget, st.budgetTimes, attempted)
+	}
+
+	if st.repeats != nil {
+		printCacheSensitivity(st.repeats)
+	}
+
+	if st.bySource != nil {
+		printComparison("Sources", st.bySource, true)
+	}
+
+	if st.byProtocol != nil {
+		printComparison("Protocols", st.byProtocol, false)
+	}
+
+	if st.byFormat != nil {
+		printFormatReport(st.byFormat)
+	}
+
+	if st.tenants != nil {
+		printTenantReport(st.tenants)
+	}
+
+	if b.steal != nil {
+		printStealReport(b.steal.stealCounts(), st.queueTimes.Count())
+	}
+
+	if chaos != nil {
+		printChaosReport(chaos, st.chaosResult)
+	}
+
+	if hook != nil {
+		printHookReport(hook, st.hookResult, runStart)
+	}
+
+	if len(targets) > 1 {
+		printComparison("Targets", st.byTarget, false)
+	}
+	if st.shadow != nil {
+		printShadowReport(st.shadow)
+	}
+
+	if len(variants) > 1 {
+		if *mix {
+			printComparison("Query mix", st.byVariant, true)
+		} else {
+			printComparison("Query variants", st.byVariant, false)
+		}
+	}
+
+	if *explainSample > 0 {
+		printPlanAggregate(st.plans)
+	}
+
+	printRangeBreakdown("", st.byRange)
+	for _, v := range variants {
+		if breakdown, ok := st.byVariantRange[v.name]; ok {
+			printRangeBreakdown(fmt.Sprintf(", variant %s", v.name), breakdown)
+		}
+	}
+	if *heatmap {
+		printHeatmaps(st.heatPoints, variants)
+	}
+	printSlowestQueries(st.slowest, len(targets) > 1, len(variants) > 1)
+	printValidationSummary(validation)
+	inputRead := totalInputRead(inputMeters)
+	printInputRead(inputRead, runEnd.Sub(runStart))
+
+	printClientUsage(usageReport)
+	printTimerCalibration(timer)
+
+	var serverDelta *serverStatsDelta
+	if statsBefore != nil {
+		statsAfter, err := takeServerSnapshot(context.Background(), b.pool, b.Relation())
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to snapshot server statistics: %s\n", err.Error())
+		}
+		delta := diffServerSnapshots(statsBefore, statsAfter)
+		serverDelta = &delta
+		printServerStatsDiff(delta)
+	}
+
+	if serverSamples != nil {
+		marks := make(map[int64]string)
+		if chaos != nil {
+			for _, e := range chaos.snapshot() {
+				marks[int64(e.at.Sub(runStart) / *sampleInterval)] = "chaos " + e.action
+			}
+		}
+		if hook != nil {
+			if started, ok := hook.startedAt(); ok {
+				marks[int64(started.Sub(runStart) / *sampleInterval)] = "hook"
+			}
+		}
+		printServerTimeline(timeline, *sampleInterval, st.clientIntervals, marks)
+	}
+
+	printRunMetadata(server, labels)
+	if serverCfg != nil {
+		printServerConfig(serverCfg)
+	}
+
+	recommendations := recommend(adviceInput{
+		stats:     st,
+		pools:     pools,
+		workers:   *numWorkers,
+		elapsed:   runEnd.Sub(runStart),
+		scheduled: *rate > 0 || *replay,
+	})
+	printRecommendations(recommendations)
+
+	if manifest != nil {
+		manifest.Timing = timingInfo{
+			Start:           runStart,
+			End:             runEnd,
+			DurationSeconds: runEnd.Sub(runStart).Seconds(),
+		}
+		manifest.Queries = queryCounts{
+			Attempted:  attempted,
+			Successful: st.succeeded,
+			Failed:     st.failed,
+			ErrorRate:  float64(st.failed) / float64(attempted),
+			Rows:       st.totalRows,
+			Dropped:    dropped,
+
+			ResultBytes:  st.totalBytes,
+			RowsPerQuery: newRowCountStats(st.rowsPerQuery),
+			EmptyResults: st.emptyResults,
+			Recorded:     st.queryTimes.Count() + st.failedQueryTimes.Count(),
+		}
+		if *recordSample < 1 {
+			manifest.Queries.RecordSample = *recordSample
+		}
+		manifest.Latency = newLatencyStats(st.queryTimes, *trim)
+		manifest.CorrectedLatency = newLatencyStats(st.correctedTimes, *trim)
+		manifest.FailedLatency = newLatencyStats(st.failedQueryTimes, *trim)
+		manifest.AcquireWait = newLatencyStats(st.acquireTimes, *trim)
+		manifest.QueueWait = newLatencyStats(st.queueTimes, *trim)
+		manifest.FirstRowLatency = newLatencyStats(st.firstRowTimes, *trim)
+		manifest.InjectedLatency = newLatencyStats(st.injectedTimes, *trim)
+		if *latencyBudget > 0 {
+			manifest.Budget = newBudgetStats(*latencyBudget, st.budgetTimes)
+		}
+		manifest.Pools = newPoolStats(pools)
+		manifest.Connects = newConnectStats(targets, *trim)
+		manifest.Wire = newWireStats(st.wire)
+		if st.slo != nil {
+			manifest.SLO = newSLOStats(st.slo)
+		}
+		if stable != nil {
+			manifest.Stability = newStabilityStats(stable)
+		}
+		if st.repeats != nil {
+			manifest.CacheSensitivity = newCacheStats(st.repeats, *trim)
+		}
+		if st.bySource != nil {
+			manifest.Sources = newComparisonStats(st.bySource, nil, *trim)
+		}
+		if st.byProtocol != nil {
+			manifest.Protocols = newComparisonStats(st.byProtocol, nil, *trim)
+		}
+		if st.byFormat != nil {
+			manifest.ResultFormats = newFormatStats(st.byFormat, *trim)
+		}
+		if b.steal != nil {
+			manifest.Steals = b.steal.stealCounts()
+		}
+		if st.tenants != nil {
+			manifest.Tenants = newTenantStats(st.tenants, *trim)
+		}
+		if len(targets) > 1 {
+			manifest.Targets = newComparisonStats(st.byTarget, nil, *trim)
+		}
+		if st.shadow != nil {
+			manifest.Shadow = newShadowStats(st.shadow)
+		}
+		if len(variants) > 1 {
+			manifest.Variants = newVariantStats(st.byVariant, st.byVariantRange, variants, *trim)
+		}
+		if *explainSample > 0 {
+			manifest.Plans = newPlanStats(st.plans)
+		}
+		manifest.RangeBreakdown = newRangeStats(st.byRange, *trim)
+		manifest.Slowest = newSlowQueries(st.slowest)
+		manifest.Input = newInputStats(validation, inputRead)
+		manifest.Client = newClientStats(usageReport)
+		manifest.Timer = newTimerStats(timer)
+		manifest.Priming = newPrimingStats(&primed)
+		manifest.Recommendations = recommendations
+		if serverDelta != nil {
+			manifest.ServerStats = newServerStatsSummary(*serverDelta)
+		}
+		manifest.ServerConfig = serverCfg
+
+		interrupted := false
+		select {
+		case <-stop:
+			interrupted = true
+		default:
+		}
+
+		// Earlier runs are read before this one is added to them
+		if *baselineRuns > 0 && interrupted {
+			log.Printf("[WARN] Skipping -baseline check of an interrupted run\n")
+		} else if *baselineRuns > 0 {
+			earlier, err := loadBaselineRuns(store, *historyFile)
+			if err != nil {
+				log.Fatalf("[ERROR] Unable to read earlier runs for -baseline: %s\n", err.Error())
+			}
+			baseline := selectBaseline(earlier, configHash(manifest.Config), baselineLabels, *baselineRuns)
+			if len(baseline) < minBaselineRuns {
+				log.Printf("[WARN] Found %d earlier runs with the same config hash, need %d for -baseline; skipping the check\n",
+					len(baseline), minBaselineRuns)
+			} else {
+				manifest.Baseline = compareBaseline(newHistoryRecord(manifest), baseline, *baselineSigma, *baselineChange)
+				printBaselineReport(manifest.Baseline)
+			}
+		}
+
+		if *manifestFile != "" {
+			if err := writeManifest(*manifestFile, manifest); err != nil {
+				log.Fatalf("[ERROR] Failed writing manifest %s: %s\n", *manifestFile, err.Error())
+			}
+			log.Printf("[INFO] Wrote manifest to %s\n", *manifestFile)
+		}
+		if *historyFile != "" {
+			if err := appendHistory(*historyFile, newHistoryRecord(manifest)); err != nil {
+				log.Fatalf("[ERROR] Failed appending to history %s: %s\n", *historyFile, err.Error())
+			}
+			log.Printf("[INFO] Appended run to %s\n", *historyFile)
+		}
+		if store != nil {
+			if err := saveRun(store, manifest); err != nil {
+				log.Fatalf("[ERROR] Failed saving run to %s: %s\n", *storeFile, err.Error())
+			}
+			log.Printf("[INFO] Saved run %s to %s\n", runID, *storeFile)
+		}
+		if notify != nil {
+			notify.finished(manifest, interrupted)
+		}
+	}
+
+	if finishReport != nil {
+		if err := finishReport(); err != nil {
+			log.Fatalf("[ERROR] Failed saving report: %s\n", err.Error())
+		}
+		log.Printf("[INFO] Wrote report to %s\n", filepath.Join(*reportDir, reportDirReport))
+	}
+
+	if upload != nil {
+		var files []string
+		if *reportDir != "" {
+			files = append(files, filepath.Join(*reportDir, reportDirReport))
+		}
+		for _, name := range []string{*manifestFile, *rawFile} {
+			if name != "" && name != stdoutName {
+				files = append(files, name)
+			}
+		}
+		if err := upload.upload(runID, files); err != nil {
+			log.Fatalf("[ERROR] Failed uploading results: %s\n", err.Error())
+		}
+	}
+
+	if manifest != nil && manifest.Baseline != nil && manifest.Baseline.Regressed {
+		log.Printf("[ERROR] Run regressed against the median of the last %d runs\n", manifest.Baseline.Runs)
+		os.Exit(regressionExitCode)
+	}
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Config describes the databases a Benchmarker runs against, how tasks are
+// dispatched to them and which statistics are recorded
+type Config struct {
+	// Connection string of the primary target, and the relation queried in
+	// place of benchRelation (empty for benchRelation itself)
+	DatabaseURL string
+	Relation    string
+
+	// A comparison target is added if any of these is set. CompareDSN
+	// defaults to DatabaseURL, so a schema or relation alone is compared
+	// within the same database.
+	CompareDSN      string
+	CompareSchema   string
+	CompareRelation string
+	CompareLabel    string
+
+	// If set, these databases are the targets instead, named by their
+	// labels. The first takes the primary's place, for server statistics.
+	Endpoints []endpoint
+
+	// If ShadowDSN is set, every query also runs against it at the same
+	// time as against the primary, and the results are compared
+	ShadowDSN   string
+	ShadowLabel string
+
+	// How long to wait for each database to accept queries
+	WaitForDB time.Duration
+
+	// If set, targets are simulated by Mock rather than connected to
+	Mock *mockDriver
+
+	// Results buffered between the workers and the collector, and what
+	// workers do when the buffer is full
+	ResultBuffer int
+	Backpressure string
+
+	// Targets are filled in by New
+	Dispatch dispatchConfig
+	Stats    statsConfig
+}
+
+// Benchmarker runs a workload against one or more targets and accumulates
+// the results. Several can run in one process, each with its own pools.
+type Benchmarker struct {
+	cfg Config
+
+	// The primary target's pool, also used for server statistics
+	pool    *pgxpool.Pool
+	targets []*dbTarget
+
+	results *resultSink
+	stats   *runStats
+
+	// Set under Dispatch.steal
+	steal *workQueues
+
+	// Tasks handed to workers so far, accessed atomically
+	dispatched int64
+
+	// Workers started by Warm wait on gate until Start closes it
+	workers []chan task
+	running sync.WaitGroup
+	gate    chan struct{}
+
+	// Plans of sampled queries still being captured
+	explaining sync.WaitGroup
+}
+
+// New connects to the configured targets, waiting for them to be ready
+func New(cfg Config) (*Benchmarker, error) {
+	results, err := newResultSink(cfg.ResultBuffer, cfg.Backpressure)
+	if err != nil {
+		return nil, fmt.Errorf("invalid results buffer: %w", err)
+	}
+
+	// Pinned worker connections mustn't exhaust the pool, which is also
+	// needed for server sampling and statistics
+	var minConns int32
+	if cfg.Dispatch.connPerWorker {
+		minConns = int32(cfg.Dispatch.numWorkers) + 2
+	}
+
+	primaryName, primaryURL := primaryTargetName, cfg.DatabaseURL
+	if len(cfg.Endpoints) > 0 {
+		primaryName, primaryURL = cfg.Endpoints[0].label, cfg.Endpoints[0].dsn
+	}
+	connects := newConnTimings()
+	var pool *pgxpool.Pool
+	if cfg.Mock == nil {
+		pool, err = connectPool(primaryURL, "", minConns, cfg.WaitForDB, true, connects)
+		if err != nil {
+			if len(cfg.Endpoints) > 0 {
+				return nil, fmt.Errorf("endpoint %s: %w", primaryName, err)
+			}
+			return nil, fmt.Errorf("%s: %w", dsnHost(primaryURL), err)
+		}
+	}
+	targets := []*dbTarget{{name: primaryName, pool: pool, mock: cfg.Mock, relation: cfg.Relation, connects: connects}}
+
+	// Pools already connected are closed if a later one fails
+	closeTargets := func() {
+		for _, t := range targets {
+			if t.pool != nil {
+				t.pool.Close()
+			}
+		}
+	}
+
+	// Endpoints may be plain PostgreSQL, or other services entirely
+	for i := 1; i < len(cfg.Endpoints); i++ {
+		ep := cfg.Endpoints[i]
+		epConnects := newConnTimings()
+		var epPool *pgxpool.Pool
+		if cfg.Mock == nil {
+			epPool, err = connectPool(ep.dsn, "", minConns, cfg.WaitForDB, false, epConnects)
+			if err != nil {
+				closeTargets()
+				return nil, fmt.Errorf("endpoint %s: %w", ep.label, err)
+			}
+		}
+		targets = append(targets, &dbTarget{name: ep.label, pool: epPool, mock: cfg.Mock, relation: cfg.Relation, connects: epConnects})
+	}
+
+	// A comparison relation alone is queried in the same database, through
+	// its own pool so the targets' pool statistics stay separate
+	if cfg.CompareDSN != "" || cfg.CompareSchema != "" || cfg.CompareRelation != "" {
+		url := cfg.CompareDSN
+		if url == "" {
+			url = cfg.DatabaseURL
+		}
+		// The comparison may be plain PostgreSQL
+		compareConnects := newConnTimings()
+		var comparePool *pgxpool.Pool
+		if cfg.Mock == nil {
+			comparePool, err = connectPool(url, cfg.CompareSchema, minConns, cfg.WaitForDB, false, compareConnects)
+			if err != nil {
+				closeTargets()
+				return nil, fmt.Errorf("comparison target: %w", err)
+			}
+		}
+		targets = append(targets, &dbTarget{name: cfg.CompareLabel, pool: comparePool, mock: cfg.Mock, relation: cfg.CompareRelation, connects: compareConnects})
+	}
+	cfg.Dispatch.targets = targets
+
+	// The shadow target is connected, reported and closed along with the
+	// others, but queried by the workers alongside the primary rather than
+	// dispatched to
+	if cfg.ShadowDSN != "" {
+		shadowConnects := newConnTimings()
+		var shadowPool *pgxpool.Pool
+		if cfg.Mock == nil {
+			shadowPool, err = connectPool(cfg.ShadowDSN, "", minConns, cfg.WaitForDB, false, shadowConnects)
+			if err != nil {
+				closeTargets()
+				return nil, fmt.Errorf("shadow target: %w", err)
+			}
+		}
+		cfg.Dispatch.shadow = &dbTarget{name: cfg.ShadowLabel, pool: shadowPool, mock: cfg.Mock, relation: cfg.Relation, connects: shadowConnects}
+		targets = append(targets, cfg.Dispatch.shadow)
+	}
+	for _, t := range targets {
+		t.prepare(cfg.Dispatch.variants)
+	}
+
+	// Plan-time exclusion is only meaningful against a single hypertable
+	if cfg.Dispatch.explainSample > 0 && len(targets) == 1 && pool != nil {
+		relation := targets[0].relationName()
+		hypertable, err := isHypertable(context.Background(), pool, relation)
+		if err == nil && hypertable {
+			cfg.Stats.totalChunks, err = countChunks(context.Background(), pool, relation)
+		}
+		if err != nil {
+			log.Printf("[WARN] Unable to count chunks of %s, plan-time exclusion will not be reported: %s\n",
+				relation, err.Error())
+		} else if !hypertable {
+			log.Printf("[INFO] %s isn't a hypertable, so plan-time exclusion will not be reported\n", relation)
+		}
+	}
+
+	b := &Benchmarker{
+		cfg:     cfg,
+		pool:    pool,
+		targets: targets,
+		results: results,
+		stats:   newRunStats(cfg.Stats, cfg.Dispatch.variants, targets),
+	}
+	if cfg.Dispatch.shadow != nil {
+		b.stats.shadow = newShadowReport(cfg.ShadowLabel)
+	}
+	if cfg.Dispatch.steal {
+		b.steal = newWorkQueues(cfg.Dispatch.numWorkers, cfg.Dispatch.maxInflightPerHost)
+	}
+	return b, nil
+}
+
+// Warm opens a connection per worker in each target's pool (up to the pool's
+// size), then starts the workers and waits until each has any pinned
+// connections, so that none of this falls within the measured run
+func (b *Benchmarker) Warm() error {
+	if b.gate != nil {
+		return nil
+	}
+	cfg := b.cfg.Dispatch
+	if !cfg.connPerWorker {
+		for _, t := range b.targets {
+			if t.pool == nil {
+				continue
+			}
+			n, err := warmPool(t.pool, cfg.numWorkers)
+			if err != nil {
+				return fmt.Errorf("warming %s: %w", t.name, err)
+			}
+			log.Printf("[INFO] Warmed %d connections to %s\n", n, t.name)
+		}
+	}
+
+	// Under steal, workers share queues from which idle workers can take
+	// others' tasks
+	b.gate = make(chan struct{})
+	b.workers = make([]chan task, cfg.numWorkers)
+	var ready sync.WaitGroup
+	for w := range b.workers {
+		b.workers[w] = make(chan task)
+		var source taskSource = chanSource(b.workers[w])
+		if b.steal != nil {
+			source = b.steal.source(w)
+		}
+		ready.Add(1)
+		b.running.Add(1)
+		// Pass 'w' in to ensure each closure binds to new value of 'w'
+		go func(w int) {
+			defer b.running.Done()
+			b.worker(w, source, &ready, b.gate)
+		}(w)
+	}
+	ready.Wait()
+	return nil
+}
+
+// Start releases the workers, warming them first if Warm wasn't called, and
+// dispatches tasks from batches to them until batches is closed, or stop is
+// closed if not nil. Results are timed from start, and the results channel
+// is closed once every worker has exited.
+func (b *Benchmarker) Start(start time.Time, batches <-chan []parsedRecord, validation *validationSummary, stop <-chan struct{}) error {
+	if err := b.Warm(); err != nil {
+		return err
+	}
+	b.stats.start = start
+	close(b.gate)
+	go b.dispatch(batches, validation, stop)
+	return nil
+}
+
+// warmPool establishes up to n of pool's connections at once, returning how
+// many it holds afterwards
+func warmPool(pool *pgxpool.Pool, n int) (int, error) {
+	if max := int(pool.Config().MaxConns); n > max {
+		n = max
+	}
+	conns := make([]*pgxpool.Conn, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = pool.Acquire(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	var err error
+	for i, c := range conns {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		c.Release()
+	}
+	return int(pool.Stat().TotalConns()), err
+}
+
+// Relation returns the relation queried on the primary target, which the
+// server's statistics and configuration are recorded for
+func (b *Benchmarker) Relation() string {
+	return b.targets[0].relationName()
+}
+
+// Close closes the targets' pools
+func (b *Benchmarker) Close() {
+	for _, t := range b.targets {
+		if t.pool != nil {
+			t.pool.Close()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// runMockWorkload runs tasks spread over hosts through a Benchmarker against
+// mock, returning the results and the statistics collected from them
+func runMockWorkload(t *testing.T, mock *mockDriver, tasks, hosts, workers int) ([]benchResult, *runStats) {
+	t.Helper()
+	b, err := New(Config{
+		ResultBuffer: 16,
+		Backpressure: backpressureBlock,
+		Mock:         mock,
+		Dispatch: dispatchConfig{
+			numWorkers:         workers,
+			maxInflightPerHost: 1,
+			variants:           defaultVariants,
+			protocols:          []string{protocolExtended},
+			resultFormats:      []string{resultFormatAuto},
+			recordSample:       1,
+		},
+		Stats: statsConfig{topN: 10, rangeBounds: defaultRangeBounds},
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer b.Close()
+	if err := b.Warm(); err != nil {
+		t.Fatalf("Warm failed: %v", err)
+	}
+
+	batches := make(chan []parsedRecord, 1)
+	var batch []parsedRecord
+	for i := 0; i < tasks; i++ {
+		batch = append(batch, parsedRecord{row: i + 1, task: selfBenchTask(i, hosts)})
+	}
+	batches <- batch
+	close(batches)
+
+	if err := b.Start(time.Now(), batches, newValidationSummary(), nil); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	var results []benchResult
+	for r := range b.results.ch {
+		b.stats.add(r)
+		results = append(results, r)
+	}
+	return results, b.stats
+}
+
+func TestBenchmarkerMockWorkload(t *testing.T) {
+	silenceInfo()
+	tests := []struct {
+		name      string
+		tasks     int
+		hosts     int
+		workers   int
+		latency   time.Duration
+		errorRate float64
+
+		wantSucceeded int
+		wantFailed    int
+	}{
+		{"one worker", 20, 4, 1, 0, 0, 20, 0},
+		{"several workers", 60, 7, 4, 0, 0, 60, 0},
+		{"more workers than hosts", 30, 2, 8, 0, 0, 30, 0},
+		{"fixed latency", 24, 6, 3, 2 * time.Millisecond, 0, 24, 0},
+		{"every query fails", 15, 3, 2, 0, 1, 0, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockDriver{errorRate: tt.errorRate, rows: 1}
+			if tt.latency > 0 {
+				d, err := parseDelay(tt.latency.String())
+				if err != nil {
+					t.Fatalf("parseDelay failed: %v", err)
+				}
+				mock.latency = d
+			}
+			results, st := runMockWorkload(t, mock, tt.tasks, tt.hosts, tt.workers)
+
+			if len(results) != tt.tasks {
+				t.Errorf("got %d results, want %d", len(results), tt.tasks)
+			}
+			if st.succeeded != tt.wantSucceeded || st.failed != tt.wantFailed {
+				t.Errorf("succeeded %d, failed %d; want %d, %d", st.succeeded, st.failed, tt.wantSucceeded, tt.wantFailed)
+			}
+			if st.attempted() != tt.tasks {
+				t.Errorf("attempted %d, want %d", st.attempted(), tt.tasks)
+			}
+			if st.queryTimes.Count() != tt.wantSucceeded || st.failedQueryTimes.Count() != tt.wantFailed {
+				t.Errorf("recorded %d query times and %d failed; want %d and %d",
+					st.queryTimes.Count(), st.failedQueryTimes.Count(), tt.wantSucceeded, tt.wantFailed)
+			}
+
+			// Each hostname's queries all run on the worker it hashes to
+			for _, r := range results {
+				h := fnv.New32a()
+				h.Write([]byte(r.task.hostname))
+				if want := int(h.Sum32()) % tt.workers; r.worker != want {
+					t.Errorf("%s ran on worker %d, want %d", r.task.hostname, r.worker, want)
+				}
+			}
+
+			if tt.wantSucceeded == 0 {
+				return
+			}
+			// Queries can't finish before the mock answers, and shouldn't be
+			// held up for long after
+			floor := float64(tt.latency / time.Microsecond)
+			ceiling := floor + float64(100*time.Millisecond/time.Microsecond)
+			times := st.queryTimes.Values()
+			for _, q := range []float64{0.5, 0.99} {
+				got := stats.Quantile(times, q)
+				if got < floor || got > ceiling {
+					t.Errorf("p%.0f = %.0fµs, want between %.0fµs and %.0fµs", q*100, got, floor, ceiling)
+				}
+			}
+		})
+	}
+}
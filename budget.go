@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// printBudgetReport summarises queries cancelled under -latency-budget. The
+// server spent at least the elapsed time on each before giving up, which is
+// reported as wasted work.
+func printBudgetReport(budget time.Duration, cancelled *stats.Recorder, attempted int) {
+	fmt.Printf("\n## Latency budget (%s)\n", budget)
+	fmt.Printf("Budget violations: %s\n", colorize(fmt.Sprintf("%d (%.2f%% of attempts)", cancelled.Count(),
+		100*float64(cancelled.Count())/float64(attempted)), colorIf(cancelled.Count() > 0, false)))
+	if cancelled.Count() == 0 {
+		return
+	}
+	s := cancelled.Summary()
+	fmt.Printf("Wasted query time: %.3fms\n", float32(s.Total)/1000.0)
+	fmt.Printf("Elapsed at cancel:\n")
+	stats.WriteSummary(os.Stdout, s)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// A second execution this many times faster than the first is counted as
+// strongly cache-sensitive
+const cacheSensitiveRatio = 2
+
+// cacheSensitivity compares each query's time with that of an immediate
+// re-execution on the same connection under -repeat, as a cheap measure of
+// how much the workload depends on warm caches
+type cacheSensitivity struct {
+	first  *stats.Recorder
+	second *stats.Recorder
+
+	// First time divided by second time, per query
+	ratios []float64
+}
+
+func newCacheSensitivity(newRecorder recorderFactory) *cacheSensitivity {
+	return &cacheSensitivity{
+		first:  newRecorder("repeat-first"),
+		second: newRecorder("repeat-second"),
+	}
+}
+
+func (c *cacheSensitivity) add(r benchResult) {
+	if r.err != nil || r.repeatTime <= 0 {
+		return
+	}
+	c.first.Add(r.queryTime)
+	c.second.Add(r.repeatTime)
+	c.ratios = append(c.ratios, float64(r.queryTime)/float64(r.repeatTime))
+}
+
+// sortedRatios returns the ratios in ascending order
+func (c *cacheSensitivity) sortedRatios() []float64 {
+	sort.Float64s(c.ratios)
+	return c.ratios
+}
+
+// sensitive counts the queries at least cacheSensitiveRatio times faster
+// the second time
+func (c *cacheSensitivity) sensitive() int {
+	n := 0
+	for _, r := range c.ratios {
+		if r >= cacheSensitiveRatio {
+			n++
+		}
+	}
+	return n
+}
+
+// ratioQuantile returns the q-quantile of sorted ratios, by nearest rank
+func ratioQuantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1)+0.5)]
+}
+
+func printCacheSensitivity(c *cacheSensitivity) {
+	fmt.Printf("\n## Cache sensitivity (each query run twice)\n")
+	if len(c.ratios) == 0 {
+		fmt.Printf("No queries were repeated\n")
+		return
+	}
+	ratios := c.sortedRatios()
+	first := c.first.Summary()
+	second := c.second.Summary()
+	fmt.Printf("Repeated queries:  %d\n", len(ratios))
+	fmt.Printf("Median first run:  %.3fms\n", float64(first.Median)/1000.0)
+	fmt.Printf("Median second run: %.3fms\n", float64(second.Median)/1000.0)
+	fmt.Printf("First/second:      median %.2fx, p90 %.2fx, p99 %.2fx\n",
+		ratioQuantile(ratios, 0.5), ratioQuantile(ratios, 0.9), ratioQuantile(ratios, 0.99))
+	n := c.sensitive()
+	fmt.Printf("%dx+ faster second: %d (%.2f%%)\n", cacheSensitiveRatio, n, 100*float64(n)/float64(len(ratios)))
+}
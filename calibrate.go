@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Number of clock reads and channel round trips timed when calibrating
+const (
+	calibrationReads  = 100000
+	calibrationRounds = 10000
+)
+
+// Clock steps coarser than this are warned about, as they make
+// microsecond-level comparisons meaningless
+const coarseClock = time.Microsecond
+
+// timerCalibration is the client's own measurement overhead, measured before
+// the run
+type timerCalibration struct {
+	// Mean cost of reading the clock
+	nowCost time.Duration
+
+	// Smallest non-zero step between successive clock reads: differences
+	// below this can't be measured
+	resolution time.Duration
+
+	// Mean time to hand a value from one goroutine to another over an
+	// unbuffered channel, as tasks are handed to workers
+	channelHop time.Duration
+}
+
+// queryOverhead estimates the client time included in each query time: the
+// clock reads for the acquisition and first row stamps
+func (c timerCalibration) queryOverhead() time.Duration {
+	return 2 * c.nowCost
+}
+
+func calibrateTimer() timerCalibration {
+	var c timerCalibration
+
+	start := time.Now()
+	prev := start
+	for i := 0; i < calibrationReads; i++ {
+		now := time.Now()
+		if step := now.Sub(prev); step > 0 && (c.resolution == 0 || step < c.resolution) {
+			c.resolution = step
+		}
+		prev = now
+	}
+	c.nowCost = prev.Sub(start) / calibrationReads
+
+	ping := make(chan struct{})
+	pong := make(chan struct{})
+	go func() {
+		for range ping {
+			pong <- struct{}{}
+		}
+	}()
+	start = time.Now()
+	for i := 0; i < calibrationRounds; i++ {
+		ping <- struct{}{}
+		<-pong
+	}
+	c.channelHop = time.Since(start) / (2 * calibrationRounds)
+	close(ping)
+
+	if c.resolution > coarseClock {
+		log.Printf("[WARN] Clock resolution is %s, so smaller latency differences can't be measured\n", c.resolution)
+	}
+	return c
+}
+
+func printTimerCalibration(c timerCalibration) {
+	fmt.Printf("\n## Measurement overhead\n")
+	fmt.Printf("Clock read:        %dns\n", c.nowCost.Nanoseconds())
+	fmt.Printf("Clock resolution:  %dns\n", c.resolution.Nanoseconds())
+	fmt.Printf("Channel hop:       %dns (included in queue waits)\n", c.channelHop.Nanoseconds())
+	fmt.Printf("Per-query overhead: ~%dns (included in query times, not subtracted)\n", c.queryOverhead().Nanoseconds())
+}
+
+type timerStats struct {
+	ClockReadNs     int64 `json:"clock_read_ns"`
+	ResolutionNs    int64 `json:"resolution_ns"`
+	ChannelHopNs    int64 `json:"channel_hop_ns"`
+	QueryOverheadNs int64 `json:"query_overhead_ns"`
+}
+
+func newTimerStats(c timerCalibration) *timerStats {
+	return &timerStats{
+		ClockReadNs:     c.nowCost.Nanoseconds(),
+		ResolutionNs:    c.resolution.Nanoseconds(),
+		ChannelHopNs:    c.channelHop.Nanoseconds(),
+		QueryOverheadNs: c.queryOverhead().Nanoseconds(),
+	}
+}
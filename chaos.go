@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Set on every connection, so chaos mode only terminates the benchmark's own
+// backends
+const benchApplicationName = "timescaledb-benchmark"
+
+const (
+	chaosTerminate = "terminate"
+	chaosReset     = "reset"
+)
+
+type chaosEvent struct {
+	at         time.Time
+	target     string
+	action     string
+	terminated int64
+	err        error
+}
+
+// chaosMonkey terminates benchmark connections at random: either one
+// backend, or every backend of a target as if its pool had been reset
+// (e.g. by a failover).
+type chaosMonkey struct {
+	targets       []*dbTarget
+	rate          float64
+	resetFraction float64
+	rng           *rand.Rand
+
+	mu     sync.Mutex
+	events []chaosEvent
+}
+
+func newChaosMonkey(targets []*dbTarget, rate float64, resetFraction float64, rng *rand.Rand) *chaosMonkey {
+	return &chaosMonkey{targets: targets, rate: rate, resetFraction: resetFraction, rng: rng}
+}
+
+// run causes events at exponentially distributed intervals averaging rate
+// per second, until ctx is cancelled
+func (m *chaosMonkey) run(ctx context.Context) {
+	for {
+		wait := time.Duration(m.rng.ExpFloat64() / m.rate * float64(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		t := m.targets[m.rng.Intn(len(m.targets))]
+		e := chaosEvent{at: time.Now(), target: t.name, action: chaosTerminate}
+		limit := "LIMIT 1"
+		if m.rng.Float64() < m.resetFraction {
+			e.action = chaosReset
+			limit = ""
+		}
+		// Recorded before terminating anything, so results failing as a
+		// consequence are always seen as disturbed
+		m.mu.Lock()
+		m.events = append(m.events, e)
+		i := len(m.events) - 1
+		m.mu.Unlock()
+
+		e.err = t.pool.QueryRow(ctx,
+			`SELECT count(pg_terminate_backend(pid)) FROM (
+				SELECT pid FROM pg_stat_activity
+				WHERE application_name = $1 AND datname = current_database() AND pid <> pg_backend_pid()
+				ORDER BY random() `+limit+`) AS victims`, benchApplicationName).Scan(&e.terminated)
+		if ctx.Err() != nil {
+			return
+		}
+		if e.err != nil {
+			log.Printf("[WARN] Chaos %s on %s failed: %s\n", e.action, t.name, e.err.Error())
+		} else {
+			log.Printf("[INFO] Chaos %s on %s: terminated %d connections\n", e.action, t.name, e.terminated)
+		}
+
+		m.mu.Lock()
+		m.events[i] = e
+		m.mu.Unlock()
+	}
+}
+
+func (m *chaosMonkey) snapshot() []chaosEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]chaosEvent(nil), m.events...)
+}
+
+// disturbed reports whether t falls within window after an event
+func (m *chaosMonkey) disturbed(t time.Time, window time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Index of the first event after t
+	i := sort.Search(len(m.events), func(i int) bool {
+		return m.events[i].at.After(t)
+	})
+	return i > 0 && t.Sub(m.events[i-1].at) <= window
+}
+
+// chaosImpact compares results shortly after chaos events with the rest
+type chaosImpact struct {
+	window          time.Duration
+	disturbed       *stats.Recorder
+	steady          *stats.Recorder
+	disturbedFailed int
+	steadyFailed    int
+}
+
+func newChaosImpact(window time.Duration, newRecorder recorderFactory) *chaosImpact {
+	return &chaosImpact{
+		window:    window,
+		disturbed: newRecorder("chaos-disturbed"),
+		steady:    newRecorder("chaos-steady"),
+	}
+}
+
+func (c *chaosImpact) add(m *chaosMonkey, r benchResult) {
+	disturbed := m.disturbed(r.finished, c.window)
+	switch {
+	case disturbed && r.err != nil:
+		c.disturbedFailed++
+	case disturbed:
+		c.disturbed.Add(r.queryTime)
+	case r.err != nil:
+		c.steadyFailed++
+	default:
+		c.steady.Add(r.queryTime)
+	}
+}
+
+func printChaosReport(m *chaosMonkey, c *chaosImpact) {
+	events := m.snapshot()
+
+	fmt.Printf("\n## Chaos\n")
+	var terminated int64
+	counts := make(map[string]int)
+	for _, e := range events {
+		if e.err == nil {
+			counts[e.action]++
+			terminated += e.terminated
+		}
+	}
+	fmt.Printf("Events:            %d (%d %s, %d %s)\n", len(events),
+		counts[chaosTerminate], chaosTerminate, counts[chaosReset], chaosReset)
+	fmt.Printf("Killed connections: %d\n", terminated)
+
+	fmt.Printf("%-28s %8s %8s %10s %12s %12s\n", "", "queries", "failed", "error rate", "median (ms)", "p99 (ms)")
+	row := func(name string, rec *stats.Recorder, failed int) {
+		total := rec.Count() + failed
+		var errRate float64
+		if total > 0 {
+			errRate = 100 * float64(failed) / float64(total)
+		}
+		sorted := rec.Values()
+		fmt.Printf("%-28s %8d %8d %9.2f%% %12.3f %12.3f\n", name, total, failed, errRate,
+			stats.Quantile(sorted, 0.5)/1000.0, stats.Quantile(sorted, 0.99)/1000.0)
+	}
+	row(fmt.Sprintf("Within %s of an event", c.window), c.disturbed, c.disturbedFailed)
+	row("Otherwise", c.steady, c.steadyFailed)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Values accepted by -encoding
+const (
+	charsetUTF8        = "utf-8"
+	charsetUTF16LE     = "utf-16le"
+	charsetUTF16BE     = "utf-16be"
+	charsetLatin1      = "latin1"
+	charsetWindows1252 = "windows-1252"
+)
+
+// Decoders from each -encoding to UTF-8. UTF-8 input is passed through
+// untouched, so invalid bytes reach validation as they are.
+var charsetDecoders = map[string]func() transform.Transformer{
+	charsetUTF8: func() transform.Transformer { return transform.Nop },
+	charsetUTF16LE: func() transform.Transformer {
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder()
+	},
+	charsetUTF16BE: func() transform.Transformer {
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewDecoder()
+	},
+	charsetLatin1:      func() transform.Transformer { return charmap.ISO8859_1.NewDecoder() },
+	charsetWindows1252: func() transform.Transformer { return charmap.Windows1252.NewDecoder() },
+}
+
+// parseCharset normalises common spellings of the -encoding names
+func parseCharset(s string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	switch name {
+	case "utf8":
+		name = charsetUTF8
+	case "utf16le", "utf-16":
+		name = charsetUTF16LE
+	case "utf16be":
+		name = charsetUTF16BE
+	case "iso-8859-1", "iso8859-1", "latin-1":
+		name = charsetLatin1
+	case "cp1252", "windows1252":
+		name = charsetWindows1252
+	}
+	if _, ok := charsetDecoders[name]; !ok {
+		names := make([]string, 0, len(charsetDecoders))
+		for n := range charsetDecoders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown encoding %q, expected one of %s", s, strings.Join(names, ", "))
+	}
+	return name, nil
+}
+
+// decodeInput converts r from charset to UTF-8. A leading byte order mark
+// is dropped, and a UTF-16 one overrides charset, since spreadsheets write
+// one that would otherwise end up in the first header field.
+func decodeInput(r io.Reader, charset string) io.Reader {
+	decoder, ok := charsetDecoders[charset]
+	if !ok {
+		decoder = charsetDecoders[charsetUTF8]
+	}
+	return transform.NewReader(r, unicode.BOMOverride(decoder()))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const goroutineSampleInterval = 100 * time.Millisecond
+
+// clientUsage tracks resources consumed by the benchmark process itself, so
+// a starved load generator can be told apart from a slow database
+type clientUsage struct {
+	start          time.Time
+	startCPU       processCPU
+	startGC        runtime.MemStats
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+	peakGoroutines int
+}
+
+type processCPU struct {
+	user   time.Duration
+	system time.Duration
+}
+
+type clientUsageReport struct {
+	wall           time.Duration
+	user           time.Duration
+	system         time.Duration
+	peakRSS        int64 // bytes, 0 if unavailable
+	numGC          uint32
+	gcPauseTotal   time.Duration
+	gcPauseMax     time.Duration
+	peakGoroutines int
+}
+
+func startClientUsage() *clientUsage {
+	u := &clientUsage{
+		start:          time.Now(),
+		startCPU:       readProcessCPU(),
+		stop:           make(chan struct{}),
+		peakGoroutines: runtime.NumGoroutine(),
+	}
+	runtime.ReadMemStats(&u.startGC)
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		ticker := time.NewTicker(goroutineSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case <-ticker.C:
+				n := runtime.NumGoroutine()
+				u.mu.Lock()
+				if n > u.peakGoroutines {
+					u.peakGoroutines = n
+				}
+				u.mu.Unlock()
+			}
+		}
+	}()
+
+	return u
+}
+
+// finish stops goroutine sampling and returns usage since startClientUsage
+func (u *clientUsage) finish() clientUsageReport {
+	close(u.stop)
+	u.wg.Wait()
+
+	cpu := readProcessCPU()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	r := clientUsageReport{
+		wall:           time.Since(u.start),
+		user:           cpu.user - u.startCPU.user,
+		system:         cpu.system - u.startCPU.system,
+		peakRSS:        readPeakRSS(),
+		numGC:          ms.NumGC - u.startGC.NumGC,
+		gcPauseTotal:   time.Duration(ms.PauseTotalNs - u.startGC.PauseTotalNs),
+		peakGoroutines: u.peakGoroutines,
+	}
+
+	// PauseNs is a circular buffer of the most recent 256 pauses
+	n := r.numGC
+	if n > uint32(len(ms.PauseNs)) {
+		n = uint32(len(ms.PauseNs))
+	}
+	for i := uint32(0); i < n; i++ {
+		p := time.Duration(ms.PauseNs[(ms.NumGC-i+255)%256])
+		if p > r.gcPauseMax {
+			r.gcPauseMax = p
+		}
+	}
+
+	return r
+}
+
+func printClientUsage(r clientUsageReport) {
+	cpu := r.user + r.system
+	fmt.Printf("\n## Client resource usage\n")
+	fmt.Printf("Wall time:         %s\n", r.wall.Round(time.Millisecond))
+	fmt.Printf("CPU time:          %s (user %s, system %s)\n",
+		cpu.Round(time.Millisecond), r.user.Round(time.Millisecond), r.system.Round(time.Millisecond))
+	fmt.Printf("CPU utilisation:   %.1f%% of one core (%d available)\n",
+		100*cpu.Seconds()/r.wall.Seconds(), runtime.NumCPU())
+	if r.peakRSS > 0 {
+		fmt.Printf("Peak RSS:          %.1fMB\n", float64(r.peakRSS)/(1024*1024))
+	}
+	fmt.Printf("GC cycles:         %d\n", r.numGC)
+	fmt.Printf("GC pause total:    %s\n", r.gcPauseTotal)
+	fmt.Printf("GC pause max:      %s\n", r.gcPauseMax)
+	fmt.Printf("Peak goroutines:   %d\n", r.peakGoroutines)
+}
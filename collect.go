@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Times kept per distribution when the input may never end, unless -sample
+// is given
+const defaultStreamSample = 100000
+
+// statsConfig controls which distributions are recorded and how
+type statsConfig struct {
+	// Retain a uniform sample of this many times per distribution (0 keeps
+	// all), drawn from random streams seeded by seed
+	sampleSize int
+	seed       int64
+
+	// Acquisition waits are always zero with pinned connections
+	connPerWorker bool
+
+	// Record latencies including the -inject-before/-inject-after delays
+	injected bool
+
+	// Under sampleSize, the heatmap's points are sampled likewise
+	heatmap     bool
+	topN        int
+	rangeBounds []time.Duration
+
+	// Score queries against an objective; 0 disables
+	slo            time.Duration
+	apdexTolerance float64
+
+	repeat bool
+
+	// Chunks in the benchmark hypertable, for plan-time exclusion; 0 if
+	// unknown
+	totalChunks int
+
+	// Bucket client latencies by this interval for the server timeline; 0
+	// disables
+	sampleInterval time.Duration
+
+	// Names of the -source flags, if any, to report separately
+	sources []string
+
+	// Protocols and result formats each task is run with, compared if
+	// there are several
+	protocols     []string
+	resultFormats []string
+
+	// Report per-tenant latencies and scheduling waits, counting waits over
+	// starvation as starved
+	tenants    []*tenant
+	starvation time.Duration
+}
+
+// recorderFactory creates the recorder for one distribution in the report.
+// name distinguishes the random streams of different recorders.
+type recorderFactory func(name string) *stats.Recorder
+
+// runStats accumulates every statistic in the report from the results of a
+// run
+type runStats struct {
+	cfg         statsConfig
+	start       time.Time
+	newRecorder recorderFactory
+
+	// Every result is counted, whether or not it's recorded in detail
+	succeeded int
+	failed    int
+
+	// Total query time of every result (µs), and failures by errorKind
+	busy       int64
+	errorKinds map[string]int
+
+	// Values are in microseconds
+	queryTimes       *stats.Recorder
+	failedQueryTimes *stats.Recorder
+	correctedTimes   *stats.Recorder
+	acquireTimes     *stats.Recorder
+	queueTimes       *stats.Recorder
+	firstRowTimes    *stats.Recorder
+	injectedTimes    *stats.Recorder
+	pages            *pageBreakdown
+	wire             *wireVolume
+	repeats          *cacheSensitivity
+
+	// Elapsed time when queries were cancelled under -latency-budget
+	budgetTimes *stats.Recorder
+
+	hook        *hookRun
+	hookResult  *hookImpact
+	chaos       *chaosMonkey
+	chaosResult *chaosImpact
+
+	totalRows      int64
+	totalBytes     int64
+	rowsPerQuery   *stats.Recorder
+	emptyResults   int
+	slo            *sloReport
+	heatPoints     []heatPoint
+	heatSeen       int
+	heatRng        *rand.Rand
+	slowest        *slowestQueries
+	byRange        *rangeBreakdown
+	byVariantRange map[string]*rangeBreakdown
+	byVariant      *comparison
+	byTarget       *comparison
+	bySource       *comparison
+	byProtocol     *comparison
+	byFormat       *formatBreakdown
+	tenants        *tenantBreakdown
+	plans          *planAggregate
+	shadow         *shadowReport
+
+	// Only the primary target's results are counted in the run's own
+	// statistics; the others are compared with it by target
+	primary *dbTarget
+
+	// Client-side latencies bucketed by sampling interval, for the server
+	// timeline
+	clientIntervals map[int64]*clientInterval
+}
+
+func newRunStats(cfg statsConfig, variants []queryVariant, targets []*dbTarget) *runStats {
+	newRecorder := func(name string) *stats.Recorder {
+		return stats.NewRecorder(cfg.sampleSize, newRand(cfg.seed, "reservoir-"+name))
+	}
+
+	s := &runStats{
+		cfg:         cfg,
+		newRecorder: newRecorder,
+
+		queryTimes:       newRecorder("queries"),
+		failedQueryTimes: newRecorder("failed"),
+		correctedTimes:   newRecorder("corrected"),
+		acquireTimes:     newRecorder("acquire"),
+		queueTimes:       newRecorder("queue"),
+		firstRowTimes:    newRecorder("first-row"),
+		injectedTimes:    newRecorder("injected"),
+		rowsPerQuery:     newRecorder("rows"),
+		pages:            newPageBreakdown(newRecorder),
+		wire:             newWireVolume(newRecorder),
+		budgetTimes:      newRecorder("budget"),
+
+		slowest:   newSlowestQueries(cfg.topN),
+		byRange:   newRangeBreakdown(cfg.rangeBounds, newRecorder),
+		byVariant: newVariantComparison(variants, newRecorder),
+		byTarget:  newTargetComparison(targets, newRecorder),
+		plans:     newPlanAggregate(cfg.totalChunks),
+
+		errorKinds:      make(map[string]int),
+		clientIntervals: make(map[int64]*clientInterval),
+		primary:         targets[0],
+		heatRng:         newRand(cfg.seed, "reservoir-heatmap"),
+	}
+	if cfg.repeat {
+		s.repeats = newCacheSensitivity(newRecorder)
+	}
+	if cfg.slo > 0 {
+		s.slo = newSLOReport(cfg.slo, cfg.apdexTolerance)
+	}
+	if len(cfg.sources) > 0 {
+		s.bySource = newComparison("source", cfg.sources, func(r benchResult) string {
+			return r.task.source
+		}, newRecorder)
+	}
+	if len(cfg.protocols) > 1 {
+		s.byProtocol = newProtocolComparison(cfg.protocols, newRecorder)
+	}
+	if len(cfg.resultFormats) > 1 {
+		s.byFormat = newFormatBreakdown(cfg.resultFormats, newRecorder)
+	}
+	if cfg.tenants != nil {
+		s.tenants = newTenantBreakdown(cfg.tenants, cfg.starvation, newRecorder)
+	}
+	if len(variants) > 1 {
+		s.byVariantRange = newVariantRangeBreakdowns(cfg.rangeBounds, variants, newRecorder)
+	}
+	return s
+}
+
+// watchChaos attributes results to the chaos events around them
+func (s *runStats) watchChaos(chaos *chaosMonkey, window time.Duration) {
+	s.chaos = chaos
+	s.chaosResult = newChaosImpact(window, s.newRecorder)
+}
+
+// watchHook attributes results to the hook running around them
+func (s *runStats) watchHook(hook *hookRun, window time.Duration) {
+	s.hook = hook
+	s.hookResult = newHookImpact(window, s.newRecorder)
+}
+
+// attempted is the number of query attempts counted
+func (s *runStats) attempted() int {
+	return s.succeeded + s.failed
+}
+
+// counted reports whether r is counted in the run's own statistics, rather
+// than only in the comparison of targets
+func (s *runStats) counted(r benchResult) bool {
+	return r.task.target == s.primary
+}
+
+func (s *runStats) add(r benchResult) {
+	if !s.counted(r) {
+		if r.recorded {
+			s.byTarget.add(r)
+			if r.err == nil {
+				s.slowest.add(r)
+			}
+		}
+		return
+	}
+
+	s.busy += r.queryTime
+	if r.err != nil {
+		s.failed++
+		s.errorKinds[errorKind(r.err)]++
+		if errors.Is(r.err, pgx.ErrNoRows) {
+			s.emptyResults++
+		}
+	} else {
+		s.succeeded++
+		s.totalRows += r.rows
+		s.totalBytes += r.resultBytes
+	}
+	if r.shadow != nil {
+		s.shadow.add(r)
+	}
+	if !r.recorded {
+		return
+	}
+
+	if !s.cfg.connPerWorker {
+		s.acquireTimes.Add(r.acquireTime)
+	}
+	if r.attempt == 1 {
+		s.queueTimes.Add(r.queueTime)
+	}
+	if s.chaos != nil {
+		s.chaosResult.add(s.chaos, r)
+	}
+	if s.hook != nil {
+		s.hookResult.add(s.hook, r)
+	}
+	s.byVariant.add(r)
+	s.byTarget.add(r)
+	if s.bySource != nil {
+		s.bySource.add(r)
+	}
+	if s.byProtocol != nil {
+		s.byProtocol.add(r)
+	}
+	if s.byFormat != nil {
+		s.byFormat.add(r)
+	}
+	if s.tenants != nil {
+		s.tenants.add(r)
+	}
+	if r.plan != nil {
+		s.plans.add(r.plan)
+	} else if r.explainErr != nil {
+		s.plans.failures++
+		log.Printf("[WARN] Failed to capture plan: %s\n", r.explainErr.Error())
+	}
+	if r.overBudget {
+		s.budgetTimes.Add(r.queryTime)
+	}
+	s.pages.add(r)
+	s.wire.add(r)
+	if s.repeats != nil {
+		s.repeats.add(r)
+	}
+	if r.err != nil {
+		s.failedQueryTimes.Add(r.queryTime)
+		if s.slo != nil {
+			s.slo.addFailure()
+		}
+		return
+	}
+
+	s.queryTimes.Add(r.queryTime)
+	s.firstRowTimes.Add(r.firstRowTime)
+	if s.cfg.injected {
+		s.injectedTimes.Add(r.queryTime + r.injected)
+	}
+	s.rowsPerQuery.Add(r.rows)
+	if !r.task.intended.IsZero() {
+		s.correctedTimes.Add(r.correctedTime)
+	}
+	if s.slo != nil {
+		s.slo.add(r.queryTime)
+	}
+	if s.cfg.heatmap {
+		s.addHeatPoint(heatPoint{stats.HeatPoint{Offset: r.finished.Sub(s.start), Latency: r.queryTime}, r.task.variant.name})
+	}
+	s.slowest.add(r)
+	s.byRange.add(r)
+	if s.byVariantRange != nil {
+		s.byVariantRange[r.task.variant.name].add(r)
+	}
+
+	if s.cfg.sampleInterval > 0 {
+		i := int64(r.finished.Sub(s.start) / s.cfg.sampleInterval)
+		ci, ok := s.clientIntervals[i]
+		if !ok {
+			ci = &clientInterval{}
+			s.clientIntervals[i] = ci
+		}
+		ci.count++
+		if r.queryTime > ci.max {
+			ci.max = r.queryTime
+		}
+	}
+}
+
+// addHeatPoint keeps p, or under sampleSize keeps a uniform sample of the
+// points as stats.Recorder does
+func (s *runStats) addHeatPoint(p heatPoint) {
+	s.heatSeen++
+	limit := s.cfg.sampleSize
+	if limit <= 0 || len(s.heatPoints) < limit {
+		s.heatPoints = append(s.heatPoints, p)
+		return
+	}
+	if i := s.heatRng.Intn(s.heatSeen); i < limit {
+		s.heatPoints[i] = p
+	}
+}
+
+// printRowVolume summarises how much data successful queries returned.
+// Queries returning no rows fail, as fast empty results usually mean bad
+// parameters rather than good performance.
+func printRowVolume(s *runStats) {
+	if s.rowsPerQuery.Count() > 0 {
+		rows := s.rowsPerQuery.Summary()
+		fmt.Printf("Rows returned:     %d (median %d per query, p99 %.0f, max %d)\n",
+			s.totalRows, rows.Median, stats.Quantile(s.rowsPerQuery.Values(), 0.99), rows.Max)
+		fmt.Printf("Payload:           %.3f MB (%.1f bytes per query)\n",
+			float64(s.totalBytes)/1e6, float64(s.totalBytes)/float64(s.succeeded))
+	}
+	if s.emptyResults > 0 {
+		fmt.Printf("Empty results:     %s (counted as failed; check the input's hostnames and times)\n",
+			colorize(strconv.Itoa(s.emptyResults), colorRed))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "os"
+
+// ANSI colours used to highlight report figures
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// Relative differences beyond this are highlighted as regressions or
+// improvements
+const colorThreshold = 0.05
+
+// Set in main when stdout is a terminal, unless disabled with -no-color or
+// the NO_COLOR environment variable
+var useColor bool
+
+// colorize wraps s in color when colour output is enabled. Pad s to its
+// column width first, as the escape codes would otherwise count towards it.
+func colorize(s string, color string) string {
+	if !useColor || color == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// colorIf returns red if bad and green if good, or no colour
+func colorIf(bad bool, good bool) string {
+	switch {
+	case bad:
+		return colorRed
+	case good:
+		return colorGreen
+	}
+	return ""
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
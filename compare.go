@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// comparison collects query times for each value of one dimension of the
+// workload, such as the query variant or the target database
+type comparison struct {
+	dimension string
+	names     []string
+	key       func(benchResult) string
+	times     map[string]*stats.Recorder
+	failed    map[string]int
+}
+
+func newComparison(dimension string, names []string, key func(benchResult) string, newRecorder recorderFactory) *comparison {
+	c := &comparison{
+		dimension: dimension,
+		names:     names,
+		key:       key,
+		times:     make(map[string]*stats.Recorder),
+		failed:    make(map[string]int),
+	}
+	for _, name := range names {
+		c.times[name] = newRecorder(dimension + "-" + name)
+	}
+	return c
+}
+
+func newVariantComparison(variants []queryVariant, newRecorder recorderFactory) *comparison {
+	var names []string
+	for _, v := range variants {
+		names = append(names, v.name)
+	}
+	return newComparison("variant", names, func(r benchResult) string {
+		return r.task.variant.name
+	}, newRecorder)
+}
+
+func newTargetComparison(targets []*dbTarget, newRecorder recorderFactory) *comparison {
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+	return newComparison("target", names, func(r benchResult) string {
+		return r.task.target.name
+	}, newRecorder)
+}
+
+func (c *comparison) add(r benchResult) {
+	name := c.key(r)
+	if r.err != nil {
+		c.failed[name]++
+		return
+	}
+	c.times[name].Add(r.queryTime)
+}
+
+// printComparison reports each value side by side, relative to the first,
+// or under shares as a share of all queries, when the values are different
+// queries rather than alternatives to each other
+func printComparison(title string, c *comparison, shares bool) {
+	last := "vs first"
+	total := 0
+	if shares {
+		last = "share"
+		for _, name := range c.names {
+			total += c.times[name].Count() + c.failed[name]
+		}
+	}
+
+	fmt.Printf("\n## %s\n", title)
+	fmt.Printf("%-20s %8s %7s %10s %10s %10s %10s %9s\n",
+		c.dimension, "queries", "failed", "median", "mean", "p95", "p99", last)
+
+	var baseline float64
+	for i, name := range c.names {
+		rec := c.times[name]
+		if rec.Count() == 0 {
+			fmt.Printf("%-20s %8d %7d\n", name, 0, c.failed[name])
+			continue
+		}
+		s := rec.Summary()
+		times := rec.Values()
+		median := float64(s.Median)
+		if i == 0 {
+			baseline = median
+		}
+		relative := fmt.Sprintf("%9s", "-")
+		if shares {
+			relative = fmt.Sprintf("%8.1f%%", 100*float64(s.Count+c.failed[name])/float64(total))
+		} else if baseline > 0 {
+			ratio := median / baseline
+			relative = colorize(fmt.Sprintf("%8.2fx", ratio), colorIf(ratio > 1+colorThreshold, ratio < 1-colorThreshold))
+		}
+		fmt.Printf("%-20s %8d %7d %10.3f %10.3f %10.3f %10.3f %s\n", name, s.Count, c.failed[name],
+			median/1000.0, s.Mean()/1000.0, stats.Quantile(times, 0.95)/1000.0, stats.Quantile(times, 0.99)/1000.0, relative)
+	}
+	if shares {
+		fmt.Printf("(times in ms)\n")
+	} else {
+		fmt.Printf("(times in ms; relative figures compare medians)\n")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// connTimings records how long each phase of establishing a target's
+// connections took, in µs: resolving the host, the TCP connect, the TLS
+// handshake (including the SSLRequest round trip) and the startup and
+// authentication exchange. Connections are opened by the pool at startup and
+// whenever it replaces one, so the phases are recorded concurrently.
+type connTimings struct {
+	mu    sync.Mutex
+	dns   *stats.Recorder
+	tcp   *stats.Recorder
+	tls   *stats.Recorder
+	auth  *stats.Recorder
+	total *stats.Recorder
+}
+
+func newConnTimings() *connTimings {
+	return &connTimings{
+		dns:   stats.NewRecorder(0, nil),
+		tcp:   stats.NewRecorder(0, nil),
+		tls:   stats.NewRecorder(0, nil),
+		auth:  stats.NewRecorder(0, nil),
+		total: stats.NewRecorder(0, nil),
+	}
+}
+
+// timedConn is a connection being established, stamped as each phase ends.
+// It goes on to count the bytes sent and received over it.
+type timedConn struct {
+	net.Conn
+
+	// Accessed atomically
+	sent     int64
+	received int64
+
+	start     time.Time
+	resolved  time.Time
+	connected time.Time
+
+	// Zero without TLS
+	handshaken time.Time
+}
+
+// LocalAddr lets a TLS connection wrapping c be traced back to it
+func (c *timedConn) LocalAddr() net.Addr {
+	return timedAddr{Addr: c.Conn.LocalAddr(), conn: c}
+}
+
+type timedAddr struct {
+	net.Addr
+	conn *timedConn
+}
+
+// timedConnOf returns the timedConn underlying a connection's (possibly TLS)
+// net.Conn
+func timedConnOf(c net.Conn) (*timedConn, bool) {
+	if tc, ok := c.(*timedConn); ok {
+		return tc, true
+	}
+	addr, ok := c.LocalAddr().(timedAddr)
+	return addr.conn, ok
+}
+
+// instrument hooks config's connection establishment to record the phases.
+// Host lookup moves into the dial, so that it can be attributed to the
+// connection; each resolved address is dialed in turn.
+func (t *connTimings) instrument(config *pgconn.Config) {
+	dial := config.DialFunc
+	config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+		return []string{host}, nil
+	}
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tc := &timedConn{start: time.Now()}
+		addrs := []string{addr}
+		if network == "tcp" {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			addrs = addrs[:0]
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip, port))
+			}
+		}
+		tc.resolved = time.Now()
+
+		var err error
+		for _, a := range addrs {
+			if tc.Conn, err = dial(ctx, network, a); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		tc.connected = time.Now()
+		return tc, nil
+	}
+
+	// The frontend is built once any TLS handshake has completed
+	buildFrontend := config.BuildFrontend
+	config.BuildFrontend = func(r io.Reader, w io.Writer) pgconn.Frontend {
+		if c, ok := r.(*tls.Conn); ok {
+			if tc, ok := timedConnOf(c); ok {
+				tc.handshaken = time.Now()
+			}
+		}
+		return buildFrontend(r, w)
+	}
+
+	afterConnect := config.AfterConnect
+	config.AfterConnect = func(ctx context.Context, conn *pgconn.PgConn) error {
+		if tc, ok := timedConnOf(conn.Conn()); ok {
+			t.add(tc, time.Now())
+		}
+		if afterConnect != nil {
+			return afterConnect(ctx, conn)
+		}
+		return nil
+	}
+}
+
+func (t *connTimings) add(c *timedConn, ready time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dns.Add(c.resolved.Sub(c.start).Microseconds())
+	t.tcp.Add(c.connected.Sub(c.resolved).Microseconds())
+	authStart := c.connected
+	if !c.handshaken.IsZero() {
+		t.tls.Add(c.handshaken.Sub(c.connected).Microseconds())
+		authStart = c.handshaken
+	}
+	t.auth.Add(ready.Sub(authStart).Microseconds())
+	t.total.Add(ready.Sub(c.start).Microseconds())
+}
+
+// phases returns the recorded phases in order, by name
+func (t *connTimings) phases() ([]string, []*stats.Recorder) {
+	return []string{"dns", "tcp", "tls", "auth", "total"},
+		[]*stats.Recorder{t.dns, t.tcp, t.tls, t.auth, t.total}
+}
+
+// printConnectReport lists the distribution of each phase of establishing
+// connections, per target
+func printConnectReport(targets []*dbTarget) {
+	fmt.Printf("\n## Connection establishment\n")
+	for _, target := range targets {
+		t := target.connects
+		t.mu.Lock()
+		fmt.Printf("Target %s: %d connections\n", target.name, t.total.Count())
+		if t.total.Count() > 0 {
+			fmt.Printf("  %-8s %10s %10s %10s\n", "phase", "median", "p99", "max")
+			names, phases := t.phases()
+			for i, p := range phases {
+				if p.Count() == 0 {
+					continue
+				}
+				s := p.Summary()
+				fmt.Printf("  %-8s %10.3f %10.3f %10.3f\n", names[i],
+					float64(s.Median)/1000.0, stats.Quantile(p.Values(), 0.99)/1000.0, float64(s.Max)/1000.0)
+			}
+		}
+		t.mu.Unlock()
+	}
+	fmt.Printf("(times in ms; auth includes the startup exchange)\n")
+}
+
+type connectStats struct {
+	Target      string                   `json:"target"`
+	Connections int                      `json:"connections"`
+	Phases      map[string]*latencyStats `json:"phases,omitempty"`
+}
+
+func newConnectStats(targets []*dbTarget, trim float64) []connectStats {
+	var out []connectStats
+	for _, target := range targets {
+		t := target.connects
+		t.mu.Lock()
+		s := connectStats{Target: target.name, Connections: t.total.Count()}
+		names, phases := t.phases()
+		for i, p := range phases {
+			if p.Count() == 0 {
+				continue
+			}
+			if s.Phases == nil {
+				s.Phases = make(map[string]*latencyStats)
+			}
+			s.Phases[names[i]] = newLatencyStats(p, trim)
+		}
+		t.mu.Unlock()
+		out = append(out, s)
+	}
+	return out
+}
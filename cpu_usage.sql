@@ -1,6 +1,7 @@
 CREATE DATABASE homework;
 \c homework
 CREATE EXTENSION IF NOT EXISTS timescaledb;
+CREATE EXTENSION IF NOT EXISTS pg_stat_statements;
 CREATE TABLE cpu_usage(
   ts    TIMESTAMPTZ,
   host  TEXT,
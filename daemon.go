@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Largest request body accepted by POST /tasks
+const maxTaskRequestBytes = 16 * 1024 * 1024
+
+// taskResult is returned for each variant and target a submitted task ran
+// against, or once for a task which failed validation
+type taskResult struct {
+	Hostname     string  `json:"hostname"`
+	Start        string  `json:"start"`
+	End          string  `json:"end"`
+	Bucket       string  `json:"bucket,omitempty"`
+	Target       string  `json:"target,omitempty"`
+	Variant      string  `json:"variant,omitempty"`
+	Attempts     int     `json:"attempts,omitempty"`
+	QueryTime    float64 `json:"query_time_ms"`
+	FirstRowTime float64 `json:"first_row_ms"`
+	Rows         int64   `json:"rows"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// taskServer accepts tasks over HTTP and feeds them to the dispatcher as if
+// they had been read from the input file
+type taskServer struct {
+	format       inputFormat
+	combinations int
+	out          chan<- []parsedRecord
+
+	// Submitted tasks are numbered like input rows
+	mu  sync.Mutex
+	row int
+
+	// Once stopping, new requests are refused, and the output is closed
+	// when the handlers already running return
+	stopping bool
+	handlers sync.WaitGroup
+}
+
+func newTaskServer(format inputFormat, combinations int, out chan<- []parsedRecord) *taskServer {
+	return &taskServer{format: format, combinations: combinations, out: out}
+}
+
+// serve handles requests on addr until stop is closed, then waits for
+// in-flight requests to complete and closes the output. Requests still
+// running when Shutdown gives up are waited for regardless, as they may yet
+// submit tasks.
+func (s *taskServer) serve(addr string, stop <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tasks", s.handleTasks)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	// ListenAndServe returns as soon as shutdown starts, but handlers may
+	// still be submitting tasks until Shutdown returns
+	shutdown := make(chan struct{})
+	go func() {
+		<-stop
+		s.mu.Lock()
+		s.stopping = true
+		s.mu.Unlock()
+
+		// Requests wait for their queries, so allow time for slow ones
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("[WARN] Failed to shut down task server cleanly: %s\n", err.Error())
+		}
+		close(shutdown)
+	}()
+
+	log.Printf("[INFO] Accepting tasks on http://%s/tasks\n", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("[ERROR] Task server failed: %s\n", err.Error())
+	}
+	<-shutdown
+	s.handlers.Wait()
+	close(s.out)
+}
+
+// handleTasks runs a single task object, or an array of them, and responds
+// with the results once every query has completed
+func (s *taskServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.handlers.Add(1)
+	s.mu.Unlock()
+	defer s.handlers.Done()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTaskRequestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var raw []json.RawMessage
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &raw)
+	} else {
+		raw = []json.RawMessage{body}
+	}
+	submitted := make([]ndjsonTask, len(raw))
+	for i := 0; err == nil && i < len(raw); i++ {
+		submitted[i], err = decodeNDJSONTask(raw[i], s.format.cols)
+	}
+	if err != nil {
+		http.Error(w, "invalid task JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Invalid tasks go through the dispatcher too, so they are counted in
+	// the validation summary, but get their error back immediately
+	records := make([]parsedRecord, len(submitted))
+	replies := make([]chan benchResult, len(submitted))
+	s.mu.Lock()
+	for i, t := range submitted {
+		s.row++
+		records[i].row = s.row
+		var record []string
+		record, records[i].err = t.record(s.format.cols)
+		if records[i].err == nil {
+			records[i].task, records[i].err = s.format.parseRecord(record)
+		}
+		if records[i].err == nil {
+			replies[i] = make(chan benchResult, s.combinations)
+			records[i].task.reply = replies[i]
+		}
+	}
+	s.mu.Unlock()
+	s.out <- records
+
+	var results []taskResult
+	for i, rec := range records {
+		if rec.err != nil {
+			results = append(results, taskResult{
+				Hostname: submitted[i].Hostname,
+				Start:    rec.task.start,
+				End:      rec.task.end,
+				Error:    rec.err.Error(),
+			})
+			continue
+		}
+		for c := 0; c < s.combinations; c++ {
+			select {
+			case res := <-replies[i]:
+				results = append(results, newTaskResult(res))
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("[WARN] Failed writing task response: %s\n", err.Error())
+	}
+}
+
+func newTaskResult(r benchResult) taskResult {
+	res := taskResult{
+		Hostname:     r.task.hostname,
+		Start:        r.task.start,
+		End:          r.task.end,
+		Bucket:       r.task.bucket,
+		Target:       r.task.target.name,
+		Variant:      r.task.variant.name,
+		Attempts:     r.attempt,
+		QueryTime:    float64(r.queryTime) / 1000.0,
+		FirstRowTime: float64(r.firstRowTime) / 1000.0,
+		Rows:         r.rows,
+	}
+	if r.err != nil {
+		res.Error = r.err.Error()
+	}
+	return res
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// dbURLFromEnv builds the connection URL from the POSTGRES_* environment
+// variables, all of which must be set
+func dbURLFromEnv() string {
+	dbHost := os.Getenv("POSTGRES_HOST")
+	if dbHost == "" {
+		log.Fatal("[ERROR] must set POSTGRES_HOST environment variable\n")
+	}
+
+	dbUser := os.Getenv("POSTGRES_USER")
+	if dbUser == "" {
+		log.Fatal("[ERROR] must set POSTGRES_USER environment variable\n")
+	}
+
+	dbPassword := os.Getenv("POSTGRES_PASSWORD")
+	if dbPassword == "" {
+		log.Fatal("[ERROR] must set POSTGRES_PASSWORD environment variable\n")
+	}
+
+	dbDatabase := os.Getenv("POSTGRES_DATABASE")
+	if dbDatabase == "" {
+		log.Fatal("[ERROR] must set POSTGRES_DATABASE environment variable\n")
+	}
+
+	return fmt.Sprintf("postgres://%s:%s@%s/%s", dbUser, dbPassword, dbHost, dbDatabase)
+}
+
+// Delay between readiness probes, doubling up to the maximum
+const (
+	dbProbeInitialDelay = 250 * time.Millisecond
+	dbProbeMaxDelay     = 5 * time.Second
+)
+
+// Default for -wait-for-db
+const defaultDBWait = time.Minute
+
+// probeDatabase checks that the database accepts connections and queries
+// and, if requireTimescale, has the TimescaleDB extension installed (which
+// may happen in an init script after the server first starts)
+func probeDatabase(ctx context.Context, config *pgx.ConnConfig, requireTimescale bool) error {
+	conn, err := pgx.ConnectConfig(ctx, config.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	var one int
+	if err := conn.QueryRow(ctx, "SELECT 1").Scan(&one); err != nil {
+		return err
+	}
+	if requireTimescale {
+		var installed bool
+		err := conn.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&installed)
+		if err != nil {
+			return err
+		}
+		if !installed {
+			return errors.New("timescaledb extension is not installed")
+		}
+	}
+	return nil
+}
+
+// waitForDatabase probes the database until it's ready, or returns the last
+// probe's error once wait has elapsed
+func waitForDatabase(config *pgx.ConnConfig, wait time.Duration, requireTimescale bool) error {
+	deadline := time.Now().Add(wait)
+	delay := dbProbeInitialDelay
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := probeDatabase(ctx, config, requireTimescale)
+		cancel()
+		if err == nil {
+			log.Printf("[INFO] Database %s is ready [attempt %d]\n", config.Host, attempt)
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("not ready after %s (%d attempts): %w", wait, attempt, err)
+		}
+		log.Printf("[INFO] Waiting for database %s [attempt %d, %s left]: %s\n",
+			config.Host, attempt, remaining.Round(time.Second), err.Error())
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > dbProbeMaxDelay {
+			delay = dbProbeMaxDelay
+		}
+	}
+}
+
+// connectPool waits up to wait for the database at dbUrl to be ready, then
+// connects. If schema is set, it becomes the search_path for every connection
+// in the pool. The pool's maximum size is raised to at least minConns. The
+// phases of establishing each of the pool's connections are recorded in
+// timings, if not nil.
+func connectPool(dbUrl string, schema string, minConns int32, wait time.Duration, requireTimescale bool, timings *connTimings) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(dbUrl)
+	if err != nil {
+		return nil, err
+	}
+	if schema != "" {
+		config.ConnConfig.RuntimeParams["search_path"] = schema
+	}
+	config.ConnConfig.RuntimeParams["application_name"] = benchApplicationName
+	if config.MaxConns < minConns {
+		config.MaxConns = minConns
+	}
+
+	if err := waitForDatabase(config.ConnConfig, wait, requireTimescale); err != nil {
+		return nil, err
+	}
+	if timings != nil {
+		timings.instrument(&config.ConnConfig.Config)
+	}
+	return pgxpool.ConnectConfig(context.Background(), config)
+}
+
+// dsnHost returns the host named by dbUrl, for messages, as the URL may
+// hold a password
+func dsnHost(dbUrl string) string {
+	config, err := pgxpool.ParseConfig(dbUrl)
+	if err != nil {
+		return "the database"
+	}
+	return config.ConnConfig.Host
+}
+
+// poolMaxConns returns the maximum size of a pool connected to dbUrl: its
+// pool_max_conns if set, otherwise pgxpool's default
+func poolMaxConns(dbUrl string) (int32, error) {
+	config, err := pgxpool.ParseConfig(dbUrl)
+	if err != nil {
+		return 0, err
+	}
+	return config.MaxConns, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// runMetric is one headline figure of a run, as compared between runs
+type runMetric struct {
+	name  string
+	key   string
+	value float64
+
+	// Whether a decrease is an improvement, as for latencies
+	lowerIsBetter bool
+}
+
+// runMetrics returns the headline figures of a run summary
+func runMetrics(r historyRecord) []runMetric {
+	return []runMetric{
+		{"queries", "attempted", float64(r.Attempted), false},
+		{"error rate", "error_rate", r.ErrorRate, true},
+		{"throughput (qps)", "throughput_qps", r.Throughput, false},
+		{"mean (ms)", "mean_ms", r.Mean, true},
+		{"median (ms)", "median_ms", r.Median, true},
+		{"p95 (ms)", "p95_ms", r.P95, true},
+		{"p99 (ms)", "p99_ms", r.P99, true},
+		{"max (ms)", "max_ms", r.Max, true},
+	}
+}
+
+// metricChange is the relative change from a to b, or false if a is zero
+func metricChange(a, b float64) (float64, bool) {
+	if a == 0 {
+		return 0, false
+	}
+	return b/a - 1, true
+}
+
+// metricDelta compares one headline figure between two runs
+type metricDelta struct {
+	Metric string  `json:"metric"`
+	A      float64 `json:"a"`
+	B      float64 `json:"b"`
+	Delta  float64 `json:"delta"`
+
+	// Relative change from a to b, unset if a is zero
+	Change *float64 `json:"change,omitempty"`
+
+	name          string
+	lowerIsBetter bool
+}
+
+// verdict reports whether b is worse or better than a by more than
+// colorThreshold
+func (d metricDelta) verdict() (worse, better bool) {
+	if d.Change == nil {
+		return false, false
+	}
+	worse, better = *d.Change > colorThreshold, *d.Change < -colorThreshold
+	if !d.lowerIsBetter {
+		worse, better = better, worse
+	}
+	return worse, better
+}
+
+// compareMetrics compares the headline figures of two runs
+func compareMetrics(a, b *runManifest) []metricDelta {
+	metricsA, metricsB := runMetrics(newHistoryRecord(a)), runMetrics(newHistoryRecord(b))
+	deltas := make([]metricDelta, len(metricsA))
+	for i, ma := range metricsA {
+		mb := metricsB[i]
+		deltas[i] = metricDelta{
+			Metric:        ma.key,
+			A:             ma.value,
+			B:             mb.value,
+			Delta:         mb.value - ma.value,
+			name:          ma.name,
+			lowerIsBetter: ma.lowerIsBetter,
+		}
+		if c, ok := metricChange(ma.value, mb.value); ok {
+			deltas[i].Change = &c
+		}
+	}
+	return deltas
+}
+
+// printRunDiff compares the headline figures of two runs, and lists the
+// flags and labels that differ between them
+func printRunDiff(nameA string, a *runManifest, nameB string, b *runManifest) {
+	fmt.Printf("\n## %s vs %s\n", nameA, nameB)
+	fmt.Printf("%-20s %12s %12s %12s %9s\n", "metric", "a", "b", "delta", "change")
+	for _, d := range compareMetrics(a, b) {
+		change := fmt.Sprintf("%9s", "-")
+		if d.Change != nil {
+			change = colorize(fmt.Sprintf("%+8.1f%%", 100**d.Change), colorIf(d.verdict()))
+		}
+		fmt.Printf("%-20s %12.3f %12.3f %+12.3f %s\n", d.name, d.A, d.B, d.Delta, change)
+	}
+
+	printMapDiff("Flags", mapDiff(a.Config, b.Config, unhashedFlags))
+	printMapDiff("Labels", mapDiff(a.Labels, b.Labels, nil))
+}
+
+// keyChange is a flag or label whose value differs between two runs
+type keyChange struct {
+	Key string `json:"key"`
+	A   string `json:"a"`
+	B   string `json:"b"`
+}
+
+// mapDiff returns the keys whose values differ between a and b, skipping
+// those in ignore
+func mapDiff(a, b map[string]string, ignore map[string]bool) []keyChange {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	var differ []keyChange
+	for k := range keys {
+		if !ignore[k] && a[k] != b[k] {
+			differ = append(differ, keyChange{Key: k, A: a[k], B: b[k]})
+		}
+	}
+	sort.Slice(differ, func(i, j int) bool { return differ[i].Key < differ[j].Key })
+	return differ
+}
+
+func printMapDiff(title string, differ []keyChange) {
+	if len(differ) == 0 {
+		return
+	}
+	fmt.Printf("%s differing:\n", title)
+	for _, c := range differ {
+		fmt.Printf("  %-18s %q -> %q\n", c.Key, c.A, c.B)
+	}
+}
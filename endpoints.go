@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// How the workload is run against several -endpoint databases
+const (
+	endpointsInterleaved = "interleaved"
+	endpointsSequential  = "sequential"
+)
+
+// endpoint is a database given by -endpoint, named in the report by label
+type endpoint struct {
+	label string
+	dsn   string
+}
+
+// endpointFlags collects repeated -endpoint label=dsn flags, in order
+type endpointFlags []endpoint
+
+func (e *endpointFlags) String() string {
+	labels := make([]string, len(*e))
+	for i, ep := range *e {
+		labels[i] = ep.label
+	}
+	return strings.Join(labels, ",")
+}
+
+func (e *endpointFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected label=dsn, got %q", value)
+	}
+	label := strings.TrimSpace(value[:i])
+	for _, ep := range *e {
+		if ep.label == label {
+			return fmt.Errorf("endpoint %q given more than once", label)
+		}
+	}
+	*e = append(*e, endpoint{label: label, dsn: value[i+1:]})
+	return nil
+}
+
+// withoutFlags returns args, as parsed by fs, with the named flags and their
+// values removed
+func withoutFlags(fs *flag.FlagSet, args []string, names ...string) []string {
+	drop := make(map[string]bool)
+	for _, name := range names {
+		drop[name] = true
+	}
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return append(kept, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		// Otherwise the value is the next argument, except for booleans
+		takesNext := false
+		if f := fs.Lookup(name); f != nil && !hasValue {
+			b, ok := f.Value.(interface{ IsBoolFlag() bool })
+			takesNext = !ok || !b.IsBoolFlag()
+		}
+		if !drop[name] {
+			kept = append(kept, arg)
+			if takesNext && i+1 < len(args) {
+				kept = append(kept, args[i+1])
+			}
+		}
+		if takesNext {
+			i++
+		}
+	}
+	return kept
+}
+
+// endpointRun is the outcome of the workload against one endpoint under
+// -endpoint-order sequential
+type endpointRun struct {
+	label    string
+	manifest *runManifest
+}
+
+// runEndpointsSequentially runs the workload against each endpoint in turn,
+// as a separate run of this program with the same args and seed, so each
+// has the databases to itself, and then compares them. It returns the
+// highest exit status of the runs, which is non-zero if any regressed
+// against its -baseline.
+func runEndpointsSequentially(endpoints []endpoint, args []string, seed int64) int {
+	dir, err := ioutil.TempDir("", "endpoints")
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to create a directory for manifests: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	args = withoutFlags(flag.CommandLine, args, "endpoint", "endpoint-order", "seed")
+
+	var runs []endpointRun
+	exitCode := 0
+	for i, ep := range endpoints {
+		log.Printf("[INFO] Running the workload against %s (%d of %d)\n", ep.label, i+1, len(endpoints))
+		manifestFile := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		cmd := exec.Command(exe, append([]string{
+			"-endpoint", ep.label + "=" + ep.dsn,
+			"-seed", fmt.Sprint(seed),
+			"-manifest", manifestFile,
+			"-label", "endpoint=" + ep.label,
+		}, args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			// A run which regressed still completed
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok || exitErr.ExitCode() != regressionExitCode {
+				log.Fatalf("[ERROR] Run against %s failed: %s\n", ep.label, err.Error())
+			}
+			if exitErr.ExitCode() > exitCode {
+				exitCode = exitErr.ExitCode()
+			}
+		}
+		m, err := readManifest(manifestFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to read the manifest of the run against %s: %s\n", ep.label, err.Error())
+		}
+		runs = append(runs, endpointRun{label: ep.label, manifest: m})
+	}
+
+	printEndpointComparison(runs)
+	return exitCode
+}
+
+// printEndpointComparison reports each endpoint's run side by side, relative
+// to the first
+func printEndpointComparison(runs []endpointRun) {
+	fmt.Printf("\n## Endpoints\n")
+	fmt.Printf("%-20s %8s %7s %9s %10s %10s %10s %10s %9s\n",
+		"endpoint", "queries", "failed", "qps", "median", "mean", "p95", "p99", "vs first")
+	var baseline float64
+	for i, run := range runs {
+		r := newHistoryRecord(run.manifest)
+		l := run.manifest.Latency
+		if l == nil {
+			fmt.Printf("%-20s %8d %7d\n", run.label, r.Attempted, run.manifest.Queries.Failed)
+			continue
+		}
+		if i == 0 {
+			baseline = l.Median
+		}
+		relative := fmt.Sprintf("%9s", "-")
+		if baseline > 0 {
+			ratio := l.Median / baseline
+			relative = colorize(fmt.Sprintf("%8.2fx", ratio), colorIf(ratio > 1+colorThreshold, ratio < 1-colorThreshold))
+		}
+		fmt.Printf("%-20s %8d %7d %9.1f %10.3f %10.3f %10.3f %10.3f %s\n", run.label, r.Attempted, run.manifest.Queries.Failed,
+			r.Throughput, l.Median, l.Mean, l.P95, l.P99, relative)
+	}
+	fmt.Printf("(times in ms; relative figures compare medians)\n")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Fields of a PostgreSQL csvlog record
+const (
+	csvlogTimeField    = 0
+	csvlogMessageField = 13
+	csvlogDetailField  = 14
+)
+
+// Layout of csvlog's log_time, e.g. "2022-01-05 10:32:07.123 UTC"
+const csvlogTimeLayout = "2006-01-02 15:04:05.999 MST"
+
+var (
+	// Matches "$1 = 'value'" (or NULL) in the detail of logged statements
+	logParameter = regexp.MustCompile(`\$(\d+) = (NULL|'(?:[^']|'')*')`)
+
+	// Prefixes of messages for the parse and bind steps of the extended
+	// protocol, which would otherwise duplicate the execute step
+	logParseOrBind = regexp.MustCompile(`^(duration: [\d.]+ ms\s+)?(parse|bind) `)
+)
+
+// workloadExtractor pulls benchmark tasks out of statements which query the
+// benchmark relation. Values are either literals or placeholders resolved
+// from the logged parameters.
+type workloadExtractor struct {
+	relation string
+	host     *regexp.Regexp
+	start    *regexp.Regexp
+	end      *regexp.Regexp
+}
+
+func newWorkloadExtractor(relation string, hostColumn string, timeColumn string) *workloadExtractor {
+	value := `('(?:[^']|'')*'|\$\d+)`
+	host := regexp.QuoteMeta(hostColumn)
+	ts := regexp.QuoteMeta(timeColumn)
+	return &workloadExtractor{
+		relation: strings.ToLower(relation),
+		host:     regexp.MustCompile(`(?i)\b` + host + `\s*=\s*` + value),
+		start:    regexp.MustCompile(`(?i)\b` + ts + `\s*>=?\s*` + value),
+		end:      regexp.MustCompile(`(?i)\b` + ts + `\s*<=?\s*` + value),
+	}
+}
+
+// extract returns the hostname, start and end of statement, or ok=false if
+// it isn't a benchmark-shaped query against the relation
+func (e *workloadExtractor) extract(statement string, params map[string]string) (task []string, ok bool) {
+	if !strings.Contains(strings.ToLower(statement), e.relation) {
+		return nil, false
+	}
+	for _, re := range []*regexp.Regexp{e.host, e.start, e.end} {
+		m := re.FindStringSubmatch(statement)
+		if m == nil {
+			return nil, false
+		}
+		v, ok := resolveValue(m[1], params)
+		if !ok {
+			return nil, false
+		}
+		task = append(task, v)
+	}
+	return task, true
+}
+
+// resolveValue unquotes a SQL literal, or looks up a placeholder
+func resolveValue(v string, params map[string]string) (string, bool) {
+	if strings.HasPrefix(v, "$") {
+		p, ok := params[strings.TrimPrefix(v, "$")]
+		return p, ok
+	}
+	return unquoteLiteral(v), true
+}
+
+func unquoteLiteral(v string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(v, "'"), "'"), "''", "'")
+}
+
+// parseLogParameters parses the "parameters: $1 = '...', ..." detail of a
+// logged statement. NULL parameters are omitted.
+func parseLogParameters(detail string) map[string]string {
+	params := make(map[string]string)
+	if !strings.HasPrefix(detail, "parameters: ") {
+		return params
+	}
+	for _, m := range logParameter.FindAllStringSubmatch(detail, -1) {
+		if m[2] != "NULL" {
+			params[m[1]] = unquoteLiteral(m[2])
+		}
+	}
+	return params
+}
+
+// extractFromCSVLog writes a task for each benchmark query logged in a
+// PostgreSQL csvlog, which requires log_statement = 'all' or
+// log_min_duration_statement = 0. The log time is written as the "at" column
+// so the workload can be replayed with its original timing.
+func extractFromCSVLog(in io.Reader, e *workloadExtractor, out *csv.Writer) (int, error) {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+
+	n := 0
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if len(record) <= csvlogDetailField {
+			continue
+		}
+		message := record[csvlogMessageField]
+		if logParseOrBind.MatchString(message) {
+			continue
+		}
+		task, ok := e.extract(message, parseLogParameters(record[csvlogDetailField]))
+		if !ok {
+			continue
+		}
+
+		at := record[csvlogTimeField]
+		if t, err := time.Parse(csvlogTimeLayout, at); err == nil {
+			at = t.UTC().Format(time.RFC3339Nano)
+		}
+		if err := out.Write(append(task, at)); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// extractFromStatStatements writes the statements against the relation
+// recorded by pg_stat_statements as a variants file, most called first.
+// pg_stat_statements doesn't retain parameter values, so it can't provide
+// tasks; placeholders must be renumbered to $1 hostname, $2 start, $3 end
+// where they differ.
+func extractFromStatStatements(ctx context.Context, q querier, relation string, out io.Writer) (int, error) {
+	rows, err := q.Query(ctx,
+		`SELECT queryid::text, calls, query
+		FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		AND queryid IS NOT NULL
+		AND query ILIKE '%' || $1 || '%'
+		AND query NOT ILIKE '%pg_stat_statements%'
+		ORDER BY calls DESC`, relation)
+	if err != nil {
+		return 0, fmt.Errorf("querying pg_stat_statements: %w", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var id, query string
+		var calls int64
+		if err := rows.Scan(&id, &calls, &query); err != nil {
+			return n, err
+		}
+		fmt.Fprintf(out, "%s q%s\n-- calls: %d\n%s;\n\n", variantHeader, strings.TrimPrefix(id, "-"), calls, strings.TrimSpace(query))
+		n++
+	}
+	return n, rows.Err()
+}
+
+// runExtract implements the extract command, which turns a captured
+// workload into benchmark input
+func runExtract(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	csvlog := fs.String("csvlog", "", "PostgreSQL csvlog file to extract tasks from (- for stdin)")
+	statStatements := fs.Bool("stat-statements", false, "extract statements from pg_stat_statements as a variants file instead")
+	output := fs.String("o", "-", "output file (- for stdout)")
+	relation := fs.String("relation", benchRelation, "only extract queries against this relation")
+	hostColumn := fs.String("host-column", "host", "column compared with the hostname")
+	timeColumn := fs.String("time-column", "ts", "column compared with the start and end times")
+	fs.Parse(args)
+
+	if (*csvlog == "") == !*statStatements {
+		log.Fatal("[ERROR] extract requires exactly one of -csvlog or -stat-statements\n")
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when creating %s: %s\n", *output, err.Error())
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if *statStatements {
+		pool, err := connectPool(dbURLFromEnv(), "", 0, defaultDBWait, false, nil)
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to connect to %s: %s\n", os.Getenv("POSTGRES_HOST"), err.Error())
+		}
+		n, err := extractFromStatStatements(context.Background(), pool, *relation, out)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed extracting from pg_stat_statements: %s\n", err.Error())
+		}
+		log.Printf("[INFO] Extracted %d statements\n", n)
+		return
+	}
+
+	in := os.Stdin
+	if *csvlog != "-" {
+		f, err := os.Open(*csvlog)
+		if err != nil {
+			log.Fatalf("[ERROR] Error when opening file %s: %s\n", *csvlog, err.Error())
+		}
+		defer f.Close()
+		in = f
+	}
+
+	w := csv.NewWriter(out)
+	w.Write([]string{"hostname", "start_time", "end_time", "at"})
+	n, err := extractFromCSVLog(in, newWorkloadExtractor(*relation, *hostColumn, *timeColumn), w)
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] Failed extracting from %s: %s\n", *csvlog, err.Error())
+	}
+	log.Printf("[INFO] Extracted %d tasks (use -columns at=3 -replay to replay their timing)\n", n)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// How often -follow checks a file for new data once it has read to the end
+const followPollInterval = 250 * time.Millisecond
+
+// followReader reads a file as it grows, like tail -f: at the end of the
+// file it waits for more to be written rather than returning io.EOF, so the
+// input only ends when the run is stopped. A partly written last row is
+// held by the CSV reader until the rest arrives. If the file is truncated,
+// as by copytruncate log rotation, reading restarts from the beginning.
+type followReader struct {
+	f      *os.File
+	offset int64
+}
+
+func newFollowReader(f *os.File) *followReader {
+	return &followReader{f: f}
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		r.offset += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+
+		time.Sleep(followPollInterval)
+		info, err := r.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() < r.offset {
+			log.Printf("[WARN] %s was truncated, following it from the start\n", r.f.Name())
+			if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			r.offset = 0
+		}
+	}
+}
@@ -3,8 +3,10 @@ module github.com/nrhtr/timescale-project
 go 1.16
 
 require (
+	github.com/jackc/pgconn v1.10.1
 	github.com/jackc/pgx/v4 v4.14.0
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/text v0.3.7
+	modernc.org/sqlite v1.14.2
 )
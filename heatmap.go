@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+type heatPoint struct {
+	stats.HeatPoint
+	variant string
+}
+
+// printHeatmaps renders one heatmap for all queries and, if several
+// variants ran, one for each variant
+func printHeatmaps(points []heatPoint, variants []queryVariant) {
+	printHeatmap("", points)
+	if len(variants) < 2 {
+		return
+	}
+	for _, v := range variants {
+		var own []heatPoint
+		for _, p := range points {
+			if p.variant == v.name {
+				own = append(own, p)
+			}
+		}
+		printHeatmap(fmt.Sprintf(", variant %s", v.name), own)
+	}
+}
+
+func printHeatmap(suffix string, points []heatPoint) {
+	plain := make([]stats.HeatPoint, len(points))
+	for i, p := range points {
+		plain[i] = p.HeatPoint
+	}
+	stats.WriteHeatmap(os.Stdout, suffix, plain)
+}
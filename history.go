@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Flags which only affect where and how results are written, or vary
+// between otherwise identical runs, and so are left out of the config hash.
+// Labels are recorded separately.
+var unhashedFlags = map[string]bool{
+	"manifest":              true,
+	"o":                     true,
+	"report-dir":            true,
+	"raw":                   true,
+	"rejects":               true,
+	"schedule":              true,
+	"baseline":              true,
+	"baseline-sigma":        true,
+	"baseline-change":       true,
+	"baseline-label":        true,
+	"history":               true,
+	"upload":                true,
+	"store":                 true,
+	"quiet":                 true,
+	"no-color":              true,
+	"seed":                  true,
+	"label":                 true,
+	"notify-url":            true,
+	"notify-format":         true,
+	"notify-max-p99":        true,
+	"notify-max-error-rate": true,
+	"ui":                    true,
+	"tui":                   true,
+	"stats-interval":        true,
+}
+
+// historyRecord is one line of a -history file: a summary of a run small
+// enough to keep for every run, for tracking results over time
+type historyRecord struct {
+	Time            time.Time         `json:"time"`
+	Version         string            `json:"version"`
+	ServerVersion   string            `json:"server_version"`
+	ConfigHash      string            `json:"config_hash"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Seed            int64             `json:"seed"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Attempted       int               `json:"attempted"`
+	ErrorRate       float64           `json:"error_rate"`
+	Throughput      float64           `json:"throughput_qps"`
+
+	// Latencies of successful queries, in milliseconds
+	Mean   float64 `json:"mean_ms,omitempty"`
+	Median float64 `json:"median_ms,omitempty"`
+	P95    float64 `json:"p95_ms,omitempty"`
+	P99    float64 `json:"p99_ms,omitempty"`
+	Max    float64 `json:"max_ms,omitempty"`
+
+	Apdex *float64 `json:"apdex,omitempty"`
+
+	// Set if several variants ran
+	Variants map[string]historyVariant `json:"variants,omitempty"`
+}
+
+type historyVariant struct {
+	Queries int     `json:"queries"`
+	Failed  int     `json:"failed"`
+	Median  float64 `json:"median_ms,omitempty"`
+	P99     float64 `json:"p99_ms,omitempty"`
+}
+
+// configHash identifies runs with the same configuration, so that their
+// results can be compared
+func configHash(config map[string]string) string {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		if !unhashedFlags[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(config[name]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func newHistoryRecord(m *runManifest) historyRecord {
+	r := historyRecord{
+		Time:            m.Timing.Start,
+		Version:         m.Tool.Version,
+		ServerVersion:   m.Server.Version,
+		ConfigHash:      configHash(m.Config),
+		Labels:          m.Labels,
+		Seed:            m.Seed,
+		DurationSeconds: m.Timing.DurationSeconds,
+		Attempted:       m.Queries.Attempted,
+		ErrorRate:       m.Queries.ErrorRate,
+	}
+	if m.Timing.DurationSeconds > 0 {
+		r.Throughput = float64(m.Queries.Successful) / m.Timing.DurationSeconds
+	}
+	if l := m.Latency; l != nil {
+		r.Mean = l.Mean
+		r.Median = l.Median
+		r.P95 = l.P95
+		r.P99 = l.P99
+		r.Max = l.Max
+	}
+	if m.SLO != nil {
+		r.Apdex = &m.SLO.Apdex
+	}
+	if len(m.Variants) > 0 {
+		r.Variants = make(map[string]historyVariant)
+		for _, v := range m.Variants {
+			hv := historyVariant{Failed: v.Failed}
+			if v.Latency != nil {
+				hv.Queries = v.Latency.Count
+				hv.Median = v.Latency.Median
+				hv.P99 = v.Latency.P99
+			}
+			r.Variants[v.Name] = hv
+		}
+	}
+	return r
+}
+
+// appendHistory appends r to fileName as one JSON line. The line is written
+// in a single call so that runs appending concurrently don't interleave.
+func appendHistory(fileName string, r historyRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory returns the runs recorded in a -history file, in the order
+// they were appended
+func readHistory(fileName string) ([]historyRecord, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fileName, line, err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return records, nil
+}
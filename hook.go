@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Consecutive successful queries whose median must be back near the baseline
+// for latency to count as recovered
+const hookRecoveryQueries = 10
+
+// Latency has recovered when the median is within this factor of baseline
+const hookRecoveryFactor = 1.5
+
+// hookRun runs a user-provided command, such as a switchover, at a fixed
+// offset into the run
+type hookRun struct {
+	command string
+	at      time.Duration
+
+	mu       sync.Mutex
+	started  time.Time
+	finished time.Time
+	output   string
+	err      error
+}
+
+func newHookRun(command string, at time.Duration) *hookRun {
+	return &hookRun{command: command, at: at}
+}
+
+// run waits until the hook's offset from start, then runs its command with
+// sh -c, unless ctx is cancelled first
+func (h *hookRun) run(ctx context.Context, start time.Time) {
+	select {
+	case <-ctx.Done():
+		log.Printf("[WARN] Run finished before hook was due\n")
+		return
+	case <-time.After(time.Until(start.Add(h.at))):
+	}
+
+	log.Printf("[INFO] Running hook: %s\n", h.command)
+	h.mu.Lock()
+	h.started = time.Now()
+	h.mu.Unlock()
+
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", h.command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	h.mu.Lock()
+	h.finished = time.Now()
+	h.output = strings.TrimSpace(out.String())
+	h.err = err
+	h.mu.Unlock()
+
+	if err != nil {
+		log.Printf("[WARN] Hook failed: %s\n%s\n", err.Error(), h.output)
+	} else {
+		log.Printf("[INFO] Hook completed in %s\n", h.finished.Sub(h.started).Round(time.Millisecond))
+	}
+}
+
+// startedAt returns when the hook's command started, if it has
+func (h *hookRun) startedAt() (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.started, !h.started.IsZero()
+}
+
+type hookSample struct {
+	offset  time.Duration
+	latency int64
+	failed  bool
+}
+
+// hookImpact collects results around the hook: successful latencies before
+// it as a baseline, and every result within window after it starts
+type hookImpact struct {
+	window   time.Duration
+	baseline *stats.Recorder
+	after    []hookSample
+}
+
+func newHookImpact(window time.Duration, newRecorder recorderFactory) *hookImpact {
+	return &hookImpact{window: window, baseline: newRecorder("hook-baseline")}
+}
+
+func (hi *hookImpact) add(h *hookRun, r benchResult) {
+	started, ok := h.startedAt()
+	if !ok || r.finished.Before(started) {
+		if r.err == nil {
+			hi.baseline.Add(r.queryTime)
+		}
+		return
+	}
+	if offset := r.finished.Sub(started); offset <= hi.window {
+		hi.after = append(hi.after, hookSample{offset: offset, latency: r.queryTime, failed: r.err != nil})
+	}
+}
+
+func printHookReport(h *hookRun, hi *hookImpact, runStart time.Time) {
+	fmt.Printf("\n## Hook\n")
+	fmt.Printf("Command:           %s\n", h.command)
+
+	h.mu.Lock()
+	started, finished, hookErr := h.started, h.finished, h.err
+	h.mu.Unlock()
+	if started.IsZero() {
+		fmt.Printf("Not run: the run finished before %s\n", h.at)
+		return
+	}
+	fmt.Printf("Started at:        %s\n", started.Sub(runStart).Round(time.Millisecond))
+	if finished.IsZero() {
+		fmt.Printf("Still running at the end of the run\n")
+	} else {
+		fmt.Printf("Duration:          %s\n", finished.Sub(started).Round(time.Millisecond))
+	}
+	if hookErr != nil {
+		fmt.Printf("Failed:            %s\n", hookErr.Error())
+	}
+
+	sort.Slice(hi.after, func(i, j int) bool {
+		return hi.after[i].offset < hi.after[j].offset
+	})
+
+	var failures int
+	var firstFailure, lastFailure time.Duration
+	for _, s := range hi.after {
+		if s.failed {
+			if failures == 0 {
+				firstFailure = s.offset
+			}
+			lastFailure = s.offset
+			failures++
+		}
+	}
+
+	fmt.Printf("Errors within %s: %d\n", hi.window, failures)
+	if failures > 0 {
+		fmt.Printf("Error burst:       %s to %s after the hook started\n",
+			firstFailure.Round(time.Millisecond), lastFailure.Round(time.Millisecond))
+		recovered := false
+		for _, s := range hi.after {
+			if !s.failed && s.offset > lastFailure {
+				fmt.Printf("Error recovery:    %s (first success after the last error)\n", s.offset.Round(time.Millisecond))
+				recovered = true
+				break
+			}
+		}
+		if !recovered {
+			fmt.Printf("Error recovery:    none within %s\n", hi.window)
+		}
+	}
+
+	if hi.baseline.Count() == 0 {
+		fmt.Printf("No successful queries before the hook to compare latency with\n")
+		return
+	}
+	baseline := hi.baseline.Summary().Median
+	fmt.Printf("Baseline median:   %.3fms\n", float32(baseline)/1000.0)
+
+	// Latency has recovered once the median of the last few successes after
+	// the burst is back near the baseline
+	var recent []int64
+	for _, s := range hi.after {
+		if s.failed || s.offset <= lastFailure {
+			continue
+		}
+		recent = append(recent, s.latency)
+		if len(recent) > hookRecoveryQueries {
+			recent = recent[1:]
+		}
+		if len(recent) < hookRecoveryQueries {
+			continue
+		}
+		sorted := append([]int64(nil), recent...)
+		if median := stats.Summarise(sorted).Median; float64(median) <= hookRecoveryFactor*float64(baseline) {
+			fmt.Printf("Latency recovery:  %s (median of %d queries within %gx baseline)\n",
+				s.offset.Round(time.Millisecond), hookRecoveryQueries, hookRecoveryFactor)
+			return
+		}
+	}
+	fmt.Printf("Latency recovery:  none within %s\n", hi.window)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// delayDistribution produces artificial delays injected around queries, to
+// model clients further away from the database
+type delayDistribution interface {
+	sample(rng *rand.Rand) time.Duration
+}
+
+type fixedDelay time.Duration
+
+func (d fixedDelay) sample(*rand.Rand) time.Duration {
+	return time.Duration(d)
+}
+
+type uniformDelay struct {
+	min, max time.Duration
+}
+
+func (d uniformDelay) sample(rng *rand.Rand) time.Duration {
+	return d.min + time.Duration(rng.Int63n(int64(d.max-d.min)+1))
+}
+
+// normalDelay is truncated at zero
+type normalDelay struct {
+	mean, stddev time.Duration
+}
+
+func (d normalDelay) sample(rng *rand.Rand) time.Duration {
+	v := time.Duration(rng.NormFloat64()*float64(d.stddev)) + d.mean
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// logNormalDelay has the long right tail typical of query latencies: sigma
+// is the standard deviation of the delay's logarithm
+type logNormalDelay struct {
+	median time.Duration
+	sigma  float64
+}
+
+func (d logNormalDelay) sample(rng *rand.Rand) time.Duration {
+	return time.Duration(float64(d.median) * math.Exp(rng.NormFloat64()*d.sigma))
+}
+
+// parseDelay parses a delay distribution: "20ms" (fixed), "10ms-30ms"
+// (uniform), "normal:20ms,5ms" (mean and standard deviation) or
+// "lognormal:20ms,0.5" (median and the standard deviation of its log). An
+// empty spec means no delay.
+func parseDelay(spec string) (delayDistribution, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(spec, "lognormal:") {
+		parts := strings.Split(strings.TrimPrefix(spec, "lognormal:"), ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid delay %q, expected lognormal:median,sigma", spec)
+		}
+		median, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		sigma, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		if median < 0 || sigma < 0 {
+			return nil, fmt.Errorf("invalid delay %q, median and sigma must not be negative", spec)
+		}
+		return logNormalDelay{median: median, sigma: sigma}, nil
+	}
+
+	if strings.HasPrefix(spec, "normal:") {
+		parts := strings.Split(strings.TrimPrefix(spec, "normal:"), ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid delay %q, expected normal:mean,stddev", spec)
+		}
+		mean, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		stddev, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if mean < 0 || stddev < 0 {
+			return nil, fmt.Errorf("invalid delay %q, durations must not be negative", spec)
+		}
+		return normalDelay{mean: mean, stddev: stddev}, nil
+	}
+
+	if parts := strings.SplitN(spec, "-", 2); len(parts) == 2 {
+		min, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if min < 0 || max < min {
+			return nil, fmt.Errorf("invalid delay range %q", spec)
+		}
+		return uniformDelay{min: min, max: max}, nil
+	}
+
+	d, err := time.ParseDuration(spec)
+	if err != nil {
+		return nil, err
+	}
+	if d < 0 {
+		return nil, fmt.Errorf("invalid delay %q, must not be negative", spec)
+	}
+	return fixedDelay(d), nil
+}
+
+func orNone(spec string) string {
+	if spec == "" {
+		return "none"
+	}
+	return spec
+}
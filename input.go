@@ -0,0 +1,550 @@
+package main
+
+import (
+	"container/list"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// The runtime image has no zoneinfo database for -timezone
+	_ "time/tzdata"
+)
+
+// Timestamp layouts tried in turn when no -time-layout is given
+var defaultTimestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	// PostgreSQL's output for timestamptz, as found in server logs
+	"2006-01-02 15:04:05.999999999Z07",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Logging every rejected row would drown the output for badly broken files
+const maxLoggedRejects = 10
+
+// columnMap holds the indices of the input fields used to build a task
+type columnMap struct {
+	hostname int
+	start    int
+	end      int
+
+	// Original wall-clock time of the query, for -replay; -1 if absent
+	at int
+
+	// time_bucket width, bound as $4; -1 if absent
+	bucket int
+
+	// Extra query parameters, bound after the built-in ones
+	params []paramMapping
+}
+
+var defaultColumns = columnMap{
+	hostname: csvHostnameField,
+	start:    csvStartField,
+	end:      csvEndField,
+	at:       -1,
+	bucket:   -1,
+}
+
+// parseColumns parses overrides of the form "host=0,start=1,end=2,at=3,bucket=4".
+// Columns not mentioned keep their default index.
+func parseColumns(spec string) (columnMap, error) {
+	cols := defaultColumns
+	if spec == "" {
+		return cols, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return cols, fmt.Errorf("invalid column mapping %q, expected name=index", part)
+		}
+		idx, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || idx < 0 {
+			return cols, fmt.Errorf("invalid column index %q for %s", kv[1], kv[0])
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "host", "hostname":
+			cols.hostname = idx
+		case "start":
+			cols.start = idx
+		case "end":
+			cols.end = idx
+		case "at":
+			cols.at = idx
+		case "bucket":
+			cols.bucket = idx
+		default:
+			return cols, fmt.Errorf("unknown column %q, expected host, start, end, at or bucket", kv[0])
+		}
+	}
+
+	return cols, nil
+}
+
+// minFields is the number of fields a record needs for every column to exist
+func (c columnMap) minFields() int {
+	max := c.hostname
+	if c.start > max {
+		max = c.start
+	}
+	if c.end > max {
+		max = c.end
+	}
+	if c.at > max {
+		max = c.at
+	}
+	if c.bucket > max {
+		max = c.bucket
+	}
+	for _, p := range c.params {
+		if p.column > max {
+			max = p.column
+		}
+	}
+	return max + 1
+}
+
+// Values accepted by -time-format
+const (
+	timeFormatAuto    = "auto"
+	timeFormatLayout  = "layout"
+	timeFormatEpochS  = "epoch-s"
+	timeFormatEpochMS = "epoch-ms"
+)
+
+// Auto-detected epoch values at or above this are taken to be milliseconds;
+// as seconds it would be over 3000 years away, as milliseconds it's 1973
+const epochMillisThreshold = 1e11
+
+// timestampParser parses start/end times client-side, so that the values
+// bound into queries don't depend on the server's TimeZone setting.
+// Timestamps without an explicit offset are interpreted in loc.
+type timestampParser struct {
+	format  string
+	layouts []string
+	loc     *time.Location
+}
+
+func newTimestampParser(format string, layout string, timezone string) (*timestampParser, error) {
+	switch format {
+	case timeFormatAuto, timeFormatLayout, timeFormatEpochS, timeFormatEpochMS:
+	default:
+		return nil, fmt.Errorf("unknown time format %q, expected %s, %s, %s or %s",
+			format, timeFormatAuto, timeFormatLayout, timeFormatEpochS, timeFormatEpochMS)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	p := &timestampParser{
+		format:  format,
+		layouts: defaultTimestampLayouts,
+		loc:     loc,
+	}
+	if layout != "" {
+		p.layouts = []string{layout}
+	}
+	return p, nil
+}
+
+// parseEpoch parses a Unix timestamp, which may have a fractional part, in
+// units of seconds or milliseconds. The whole and fractional parts are
+// parsed separately, as a float64 can't hold epoch milliseconds to the
+// nanosecond.
+func parseEpoch(s string, unit time.Duration) (time.Time, error) {
+	invalid := fmt.Errorf("invalid epoch timestamp %q", s)
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	negative := strings.HasPrefix(whole, "-")
+	if (whole == "" || whole == "-") && frac != "" {
+		whole += "0"
+	}
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || strings.HasPrefix(whole, "+") {
+		return time.Time{}, invalid
+	}
+
+	// Digits beyond the nanosecond are dropped
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	var nanos int64
+	for i := 0; i < 9; i++ {
+		nanos *= 10
+		if i < len(frac) {
+			if frac[i] < '0' || frac[i] > '9' {
+				return time.Time{}, invalid
+			}
+			nanos += int64(frac[i] - '0')
+		}
+	}
+	nanos = nanos * int64(unit) / int64(time.Second)
+	if negative {
+		nanos = -nanos
+	}
+
+	perSecond := int64(time.Second / unit)
+	return time.Unix(n/perSecond, n%perSecond*int64(unit)+nanos).UTC(), nil
+}
+
+// isNumeric reports whether s looks like an epoch timestamp rather than a
+// formatted date
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if (r < '0' || r > '9') && r != '.' && !(i == 0 && r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parse returns the timestamp normalised to UTC
+func (p *timestampParser) parse(s string) (time.Time, error) {
+	switch p.format {
+	case timeFormatEpochS:
+		return parseEpoch(s, time.Second)
+	case timeFormatEpochMS:
+		return parseEpoch(s, time.Millisecond)
+	case timeFormatAuto:
+		if isNumeric(s) {
+			v, err := strconv.ParseFloat(s, 64)
+			if err == nil && (v >= epochMillisThreshold || v <= -epochMillisThreshold) {
+				return parseEpoch(s, time.Millisecond)
+			}
+			return parseEpoch(s, time.Second)
+		}
+	}
+
+	for _, layout := range p.layouts {
+		if t, err := time.ParseInLocation(layout, s, p.loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if len(p.layouts) == 1 {
+		return time.Time{}, fmt.Errorf("timestamp %q does not match layout %q", s, p.layouts[0])
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+// Values accepted by -input-format
+const (
+	inputFormatCSV    = "csv"
+	inputFormatNDJSON = "ndjson"
+)
+
+// inputFormat describes how input records are turned into tasks
+type inputFormat struct {
+	encoding   string
+	charset    string
+	csv        csvOptions
+	cols       columnMap
+	timestamps *timestampParser
+}
+
+// csvOptions configures how CSV input is tokenised, for files exported by
+// tools with other conventions
+type csvOptions struct {
+	delimiter        rune
+	lazyQuotes       bool
+	trimLeadingSpace bool
+
+	// Lines starting with this character are skipped; 0 for none
+	comment rune
+
+	// Reject records whose field count differs from the header's, rather
+	// than only those too short for the mapped columns
+	strictFields bool
+}
+
+var defaultCSVOptions = csvOptions{delimiter: ','}
+
+// parseCSVOptions checks the single character options of csvOptions, which
+// the csv package would otherwise reject on the first read
+func parseCSVOptions(delimiter string, comment string) (csvOptions, error) {
+	opts := defaultCSVOptions
+	var err error
+	opts.delimiter, err = parseDelimiter(delimiter)
+	if err != nil {
+		return opts, err
+	}
+	if comment != "" {
+		r := []rune(comment)
+		if len(r) != 1 || !validDelimiter(r[0]) {
+			return opts, fmt.Errorf("invalid comment character %q", comment)
+		}
+		if r[0] == opts.delimiter {
+			return opts, fmt.Errorf("comment character %q is also the delimiter", comment)
+		}
+		opts.comment = r[0]
+	}
+	return opts, nil
+}
+
+// parseDelimiter accepts a single character, or \t or "tab" for TSV
+func parseDelimiter(s string) (rune, error) {
+	switch s {
+	case `\t`, "tab":
+		return '\t', nil
+	}
+	r := []rune(s)
+	if len(r) != 1 {
+		return 0, fmt.Errorf("invalid delimiter %q, expected a single character or \\t", s)
+	}
+	if !validDelimiter(r[0]) {
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+	return r[0], nil
+}
+
+func validDelimiter(r rune) bool {
+	switch r {
+	case '"', '\r', '\n', utf8.RuneError:
+		return false
+	}
+	return true
+}
+
+// Reasons a row may be rejected, used to group the validation summary
+const (
+	rejectMalformed      = "malformed CSV"
+	rejectMalformedJSON  = "malformed JSON"
+	rejectFieldCount     = "too few fields"
+	rejectFieldMismatch  = "wrong field count"
+	rejectEmptyHost      = "empty hostname"
+	rejectInvalidStart   = "invalid start time"
+	rejectInvalidEnd     = "invalid end time"
+	rejectEndBeforeStart = "end before start"
+	rejectInvalidAt      = "invalid replay time"
+	rejectInvalidBucket  = "invalid bucket width"
+)
+
+type rowError struct {
+	reason string
+	detail string
+}
+
+func (e *rowError) Error() string {
+	if e.detail == "" {
+		return e.reason
+	}
+	return e.reason + ": " + e.detail
+}
+
+// parseRecord validates record and turns it into a task
+func (f inputFormat) parseRecord(record []string) (task, error) {
+	cols := f.cols
+
+	if len(record) < cols.minFields() {
+		return task{}, &rowError{rejectFieldCount, fmt.Sprintf("got %d, need %d", len(record), cols.minFields())}
+	}
+
+	t := task{
+		hostname: record[cols.hostname],
+		start:    record[cols.start],
+		end:      record[cols.end],
+	}
+
+	if strings.TrimSpace(t.hostname) == "" {
+		return t, &rowError{rejectEmptyHost, ""}
+	}
+	var err error
+	t.startTime, err = f.timestamps.parse(t.start)
+	if err != nil {
+		return t, &rowError{rejectInvalidStart, err.Error()}
+	}
+	t.endTime, err = f.timestamps.parse(t.end)
+	if err != nil {
+		return t, &rowError{rejectInvalidEnd, err.Error()}
+	}
+	if t.endTime.Before(t.startTime) {
+		return t, &rowError{rejectEndBeforeStart, fmt.Sprintf("%s < %s", t.end, t.start)}
+	}
+	if cols.at >= 0 {
+		t.at, err = f.timestamps.parse(record[cols.at])
+		if err != nil {
+			return t, &rowError{rejectInvalidAt, err.Error()}
+		}
+	}
+	if cols.bucket >= 0 {
+		t.bucket, err = parseBucketWidth(record[cols.bucket])
+		if err != nil {
+			return t, &rowError{rejectInvalidBucket, err.Error()}
+		}
+	}
+	for _, p := range cols.params {
+		t.params = append(t.params, record[p.column])
+	}
+
+	return t, nil
+}
+
+// parseBucketWidth accepts Go durations such as "5m", which are converted
+// to an interval PostgreSQL understands, or PostgreSQL intervals such as
+// "1 hour", which are checked by the server
+func parseBucketWidth(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return "", fmt.Errorf("%s is not positive", s)
+		}
+		return fmt.Sprintf("%d microseconds", d.Microseconds()), nil
+	}
+	return s, nil
+}
+
+// validationSummary counts rows rejected while reading the input
+type validationSummary struct {
+	rows     int
+	rejected map[string]int
+
+	// Tasks whose (hostname, start, end) was already seen, and whether they
+	// were dropped rather than dispatched
+	duplicates int
+	deduped    bool
+
+	// Receives the rejected rows under -rejects
+	rejects *rejectWriter
+}
+
+func newValidationSummary() *validationSummary {
+	return &validationSummary{rejected: make(map[string]int)}
+}
+
+type taskKey struct {
+	hostname string
+	start    int64
+	end      int64
+	bucket   string
+	params   string
+}
+
+// Distinct tasks remembered by a duplicateTracker. Streamed input has no
+// end, so the least recently seen tasks are forgotten beyond this, and a
+// repeat of one is no longer noticed.
+const duplicateWindow = 1 << 20
+
+type trackedTask struct {
+	key   taskKey
+	count int
+}
+
+// duplicateTracker counts occurrences of identical tasks. Repeated queries
+// hit warm caches and skew the aggregate toward lower latencies.
+type duplicateTracker struct {
+	seen   map[taskKey]*list.Element
+	recent *list.List
+	limit  int
+}
+
+func newDuplicateTracker(limit int) *duplicateTracker {
+	return &duplicateTracker{seen: make(map[taskKey]*list.Element), recent: list.New(), limit: limit}
+}
+
+// occurrence returns how many times t has been seen, including this time
+func (d *duplicateTracker) occurrence(t task) int {
+	k := taskKey{
+		hostname: t.hostname,
+		start:    t.startTime.UnixNano(),
+		end:      t.endTime.UnixNano(),
+		bucket:   t.bucket,
+		params:   strings.Join(t.params, "\x00"),
+	}
+	if e, ok := d.seen[k]; ok {
+		d.recent.MoveToFront(e)
+		tracked := e.Value.(*trackedTask)
+		tracked.count++
+		return tracked.count
+	}
+	d.seen[k] = d.recent.PushFront(&trackedTask{key: k, count: 1})
+	if d.recent.Len() > d.limit {
+		oldest := d.recent.Back()
+		d.recent.Remove(oldest)
+		delete(d.seen, oldest.Value.(*trackedTask).key)
+	}
+	return 1
+}
+
+// reject records a rejected row, logging the first few occurrences and
+// writing every one to any -rejects file. fields are the row as read, if it
+// could be tokenised.
+func (v *validationSummary) reject(row int, err error, fields []string) {
+	reason := rejectMalformed
+	detail := err.Error()
+	if re, ok := err.(*rowError); ok {
+		reason = re.reason
+		detail = re.detail
+	} else if pe, ok := err.(*csv.ParseError); ok {
+		err = pe.Err
+		detail = err.Error()
+		if err == csv.ErrFieldCount {
+			reason = rejectFieldMismatch
+		}
+	}
+	if v.rejects != nil {
+		v.rejects.write(row, reason, detail, fields)
+	}
+
+	total := v.totalRejected()
+	if total < maxLoggedRejects {
+		log.Printf("[WARN] Skipping row %d: %s\n", row, err.Error())
+	} else if total == maxLoggedRejects {
+		log.Printf("[WARN] Further rejected rows will not be logged\n")
+	}
+
+	v.rejected[reason]++
+}
+
+func (v *validationSummary) totalRejected() int {
+	total := 0
+	for _, n := range v.rejected {
+		total += n
+	}
+	return total
+}
+
+func printValidationSummary(v *validationSummary) {
+	total := v.totalRejected()
+	if total == 0 && v.duplicates == 0 {
+		return
+	}
+
+	reasons := make([]string, 0, len(v.rejected))
+	for r := range v.rejected {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+
+	fmt.Printf("\n## Input validation\n")
+	fmt.Printf("Rows read:         %d\n", v.rows)
+	fmt.Printf("Rows rejected:     %d\n", total)
+	for _, r := range reasons {
+		fmt.Printf("  %-20s %d\n", r+":", v.rejected[r])
+	}
+	if total > 0 && v.rejects != nil {
+		fmt.Printf("Rejected rows in:  %s\n", v.rejects.name)
+	}
+	if v.deduped {
+		fmt.Printf("Duplicates skipped: %d\n", v.duplicates)
+	} else {
+		fmt.Printf("Duplicate tasks:   %d\n", v.duplicates)
+	}
+}
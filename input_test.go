@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseEpoch(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		unit time.Duration
+		want time.Time
+	}{
+		{"seconds", "1700000000", time.Second, time.Unix(1700000000, 0)},
+		{"fractional seconds", "1700000000.000001", time.Second, time.Unix(1700000000, 1000)},
+		{"nanoseconds", "1700000000.123456789", time.Second, time.Unix(1700000000, 123456789)},
+		{"beyond nanoseconds", "1700000000.1234567891", time.Second, time.Unix(1700000000, 123456789)},
+		{"milliseconds", "1700000000001", time.Millisecond, time.Unix(1700000000, 1000000)},
+		{"fractional milliseconds", "1700000000001.5", time.Millisecond, time.Unix(1700000000, 1500000)},
+		{"negative seconds", "-1.5", time.Second, time.Unix(-2, 500000000)},
+		{"negative milliseconds", "-1500", time.Millisecond, time.Unix(-2, 500000000)},
+		{"fraction only", ".25", time.Second, time.Unix(0, 250000000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEpoch(tt.s, tt.unit)
+			if err != nil {
+				t.Fatalf("parseEpoch(%q) failed: %v", tt.s, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseEpoch(%q) = %s, want %s", tt.s, got.Format(time.RFC3339Nano), tt.want.UTC().Format(time.RFC3339Nano))
+			}
+		})
+	}
+}
+
+// Every millisecond must decode exactly, which a float64 can't manage
+func TestParseEpochMillisecondsExact(t *testing.T) {
+	for ms := int64(1700000000000); ms < 1700000100000; ms++ {
+		got, err := parseEpoch(strconv.FormatInt(ms, 10), time.Millisecond)
+		if err != nil {
+			t.Fatalf("parseEpoch(%d) failed: %v", ms, err)
+		}
+		if want := time.Unix(0, ms*int64(time.Millisecond)); !got.Equal(want) {
+			t.Fatalf("parseEpoch(%d) = %s, want %s", ms, got.Format(time.RFC3339Nano), want.UTC().Format(time.RFC3339Nano))
+		}
+	}
+}
+
+func TestParseEpochInvalid(t *testing.T) {
+	for _, s := range []string{"", "-", ".", "1.2.3", "+1", "1.-5", "1e9", "abc"} {
+		if _, err := parseEpoch(s, time.Second); err == nil {
+			t.Errorf("parseEpoch(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestDuplicateTracker(t *testing.T) {
+	at := func(hostname string, minute int) task {
+		start := time.Unix(int64(minute)*60, 0)
+		return task{hostname: hostname, startTime: start, endTime: start.Add(time.Hour)}
+	}
+	d := newDuplicateTracker(2)
+	steps := []struct {
+		task task
+		want int
+	}{
+		{at("host_1", 0), 1},
+		{at("host_1", 0), 2},
+		{at("host_2", 0), 1},
+		{at("host_1", 0), 3},
+		// Evicts host_2, the least recently seen
+		{at("host_1", 1), 1},
+		{at("host_1", 0), 4},
+		{at("host_2", 0), 1},
+	}
+	for i, s := range steps {
+		if got := d.occurrence(s.task); got != s.want {
+			t.Errorf("step %d: occurrence(%s, %s) = %d, want %d", i, s.task.hostname, s.task.startTime.UTC().Format(time.RFC3339), got, s.want)
+		}
+	}
+}
+
+// Tasks differing only in their bucket width run different queries
+func TestDuplicateTrackerBucket(t *testing.T) {
+	start := time.Unix(0, 0)
+	hourly := task{hostname: "host_1", startTime: start, endTime: start.Add(24 * time.Hour), bucket: "1 hour"}
+	daily := hourly
+	daily.bucket = "1 day"
+
+	d := newDuplicateTracker(duplicateWindow)
+	for i, s := range []struct {
+		task task
+		want int
+	}{
+		{hourly, 1},
+		{daily, 1},
+		{hourly, 2},
+	} {
+		if got := d.occurrence(s.task); got != s.want {
+			t.Errorf("step %d: occurrence(bucket %s) = %d, want %d", i, s.task.bucket, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Size of the buffer in front of the input, so that multi-GB files are read
+// in large chunks rather than a syscall per few KB
+const inputBufferSize = 1 << 20
+
+// Share of the run spent waiting on input reads beyond which the input is
+// reported as a likely limit on the dispatch rate
+const inputBoundShare = 0.5
+
+// inputMeter counts the bytes read from an input, which is the byte offset
+// reached in a file, the lines among them and the time spent waiting for
+// reads to return
+type inputMeter struct {
+	r io.Reader
+
+	// Accessed atomically, as the report may read them while the input is
+	// still being read
+	bytes int64
+	lines int64
+	wait  int64
+}
+
+func newInputMeter(r io.Reader) *inputMeter {
+	return &inputMeter{r: r}
+}
+
+func (m *inputMeter) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := m.r.Read(p)
+	atomic.AddInt64(&m.wait, int64(time.Since(start)))
+	atomic.AddInt64(&m.bytes, int64(n))
+	atomic.AddInt64(&m.lines, int64(bytes.Count(p[:n], []byte{'\n'})))
+	return n, err
+}
+
+// offset is the number of bytes read so far
+func (m *inputMeter) offset() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// waited is the total time spent in reads so far
+func (m *inputMeter) waited() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.wait))
+}
+
+// inputRead totals the bytes read and time spent reading across inputs
+type inputRead struct {
+	bytes int64
+	wait  time.Duration
+}
+
+func totalInputRead(meters []*inputMeter) inputRead {
+	var r inputRead
+	for _, m := range meters {
+		r.bytes += m.offset()
+		r.wait += m.waited()
+	}
+	return r
+}
+
+// throughput is the read rate in MB/s while waiting on reads, or 0 if no
+// time was spent reading
+func (r inputRead) throughput() float64 {
+	if r.wait <= 0 {
+		return 0
+	}
+	return float64(r.bytes) / 1e6 / r.wait.Seconds()
+}
+
+// printInputRead reports how much input was read and how fast, warning if
+// waiting on reads took up much of the run. Several inputs read concurrently
+// may together wait for longer than the run.
+func printInputRead(r inputRead, elapsed time.Duration) {
+	if r.bytes == 0 {
+		return
+	}
+	share := r.wait.Seconds() / elapsed.Seconds()
+
+	fmt.Printf("\n## Input\n")
+	fmt.Printf("Bytes read:        %.1f MB\n", float64(r.bytes)/1e6)
+	fmt.Printf("Time in reads:     %s (%.1f%% of run)\n", r.wait.Round(time.Millisecond), 100*share)
+	fmt.Printf("Read throughput:   %.1f MB/s\n", r.throughput())
+
+	if share > inputBoundShare {
+		log.Printf("[WARN] %.0f%% of the run was spent waiting on input reads, which may be limiting the dispatch rate\n", 100*share)
+	}
+}
+
+// fileProgress tracks how far through a file a run has read, for inputs
+// whose size is known in advance. Reads run ahead of dispatch by the
+// buffers between them, so the share read slightly overstates the share of
+// tasks dispatched.
+type fileProgress struct {
+	meter *inputMeter
+	size  int64
+
+	// As of the last sample, for the read rate over the interval
+	lastBytes int64
+	lastTime  time.Time
+}
+
+// newFileProgress returns nil unless f is a non-empty regular file
+func newFileProgress(f io.Reader, meter *inputMeter) *fileProgress {
+	file, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	return &fileProgress{meter: meter, size: info.Size(), lastTime: time.Now()}
+}
+
+// estimatedLines extrapolates the lines in the whole file from the average
+// length of those read so far
+func (p *fileProgress) estimatedLines() int64 {
+	read := p.meter.offset()
+	if read == 0 {
+		return 0
+	}
+	lines := atomic.LoadInt64(&p.meter.lines)
+	if read >= p.size {
+		return lines
+	}
+	return int64(float64(lines) * float64(p.size) / float64(read))
+}
+
+// sample returns the bytes read so far and the read rate in bytes per
+// second since the last sample
+func (p *fileProgress) sample() (read int64, rate float64) {
+	now := time.Now()
+	read = p.meter.offset()
+	rate = float64(read-p.lastBytes) / now.Sub(p.lastTime).Seconds()
+	p.lastBytes, p.lastTime = read, now
+	return read, rate
+}
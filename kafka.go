@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// kafkaSource consumes task messages from a Kafka topic as a member of a
+// consumer group, by running kcat (https://github.com/edenhill/kcat) and
+// reading its output. Each message payload must be one NDJSON task.
+type kafkaSource struct {
+	cmd *exec.Cmd
+	out io.ReadCloser
+}
+
+func startKafkaSource(brokers string, group string, topic string) (*kafkaSource, error) {
+	if _, err := exec.LookPath("kcat"); err != nil {
+		return nil, fmt.Errorf("kcat is required to consume from Kafka: %w", err)
+	}
+
+	// -G joins the consumer group so partitions are balanced across
+	// instances; -u disables output buffering so tasks arrive promptly
+	cmd := exec.Command("kcat", "-b", brokers, "-G", group, "-u", "-q", "-f", "%s\\n", topic)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Consuming topic %s from %s as group %s\n", topic, strings.TrimSpace(brokers), group)
+	return &kafkaSource{cmd: cmd, out: out}, nil
+}
+
+func (k *kafkaSource) Read(p []byte) (int, error) {
+	return k.out.Read(p)
+}
+
+// close stops consuming. Offsets of messages already read are committed by
+// kcat in the background, so a few tasks may be consumed again on restart.
+func (k *kafkaSource) close() {
+	if err := k.cmd.Process.Signal(os.Interrupt); err != nil {
+		k.cmd.Process.Kill()
+	}
+	k.cmd.Wait()
+}
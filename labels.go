@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelFlags collects repeated -label key=value flags, describing the run
+// for slicing results in later analysis
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	keys := l.keys()
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	key := strings.TrimSpace(value[:i])
+	if key == "" {
+		return fmt.Errorf("empty label key in %q", value)
+	}
+	if _, ok := l[key]; ok {
+		return fmt.Errorf("label %q given more than once", key)
+	}
+	l[key] = value[i+1:]
+	return nil
+}
+
+// keys returns the label keys in sorted order
+func (l labelFlags) keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
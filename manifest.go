@@ -0,0 +1,699 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Bump when fields are renamed or removed, so consumers can detect
+// manifests they don't understand
+const manifestSchemaVersion = 1
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// Server settings which most affect the benchmark query's plan and speed
+var reportedSettings = []string{"work_mem", "shared_buffers", "effective_cache_size", "max_parallel_workers_per_gather", "jit"}
+
+// runManifest is a self-describing record of a run, intended to be archived
+// and compared against other runs. Latencies are in milliseconds.
+type runManifest struct {
+	SchemaVersion int               `json:"schema_version"`
+	RunID         string            `json:"run_id,omitempty"`
+	Tool          toolInfo          `json:"tool"`
+	Server        serverInfo        `json:"server"`
+	Config        map[string]string `json:"config"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Seed          int64             `json:"seed"`
+	Timing        timingInfo        `json:"timing"`
+	Queries       queryCounts       `json:"queries"`
+
+	Latency          *latencyStats       `json:"latency,omitempty"`
+	CorrectedLatency *latencyStats       `json:"corrected_latency,omitempty"`
+	FirstRowLatency  *latencyStats       `json:"first_row_latency,omitempty"`
+	InjectedLatency  *latencyStats       `json:"injected_latency,omitempty"`
+	Budget           *budgetStats        `json:"budget,omitempty"`
+	FailedLatency    *latencyStats       `json:"failed_latency,omitempty"`
+	AcquireWait      *latencyStats       `json:"acquire_wait,omitempty"`
+	QueueWait        *latencyStats       `json:"queue_wait,omitempty"`
+	Pools            []poolStats         `json:"pools"`
+	Connects         []connectStats      `json:"connects,omitempty"`
+	Wire             *wireStats          `json:"wire,omitempty"`
+	SLO              *sloStats           `json:"slo,omitempty"`
+	Stability        *stabilityStats     `json:"stability,omitempty"`
+	CacheSensitivity *cacheStats         `json:"cache_sensitivity,omitempty"`
+	Sources          []comparisonStats   `json:"sources,omitempty"`
+	Protocols        []comparisonStats   `json:"protocols,omitempty"`
+	ResultFormats    []formatStats       `json:"result_formats,omitempty"`
+	Tenants          []tenantStats       `json:"tenants,omitempty"`
+	Steals           []int               `json:"steals_per_worker,omitempty"`
+	Targets          []comparisonStats   `json:"targets,omitempty"`
+	Variants         []comparisonStats   `json:"variants,omitempty"`
+	Plans            *planStats          `json:"plans,omitempty"`
+	RangeBreakdown   []rangeStats        `json:"range_breakdown,omitempty"`
+	Slowest          []slowQuery         `json:"slowest,omitempty"`
+	Input            inputStats          `json:"input"`
+	Client           clientStats         `json:"client"`
+	Timer            *timerStats         `json:"timer,omitempty"`
+	Priming          *primingStats       `json:"priming,omitempty"`
+	ServerStats      *serverStatsSummary `json:"server_stats,omitempty"`
+	ServerConfig     *serverConfig       `json:"server_config,omitempty"`
+	Recommendations  []string            `json:"recommendations,omitempty"`
+	Baseline         *baselineStats      `json:"baseline,omitempty"`
+	Shadow           *shadowStats        `json:"shadow,omitempty"`
+}
+
+type toolInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Args      []string `json:"args"`
+
+	// Version of the report's text layout, stats.FormatVersion
+	ReportFormat int `json:"report_format"`
+}
+
+type serverInfo struct {
+	Version            string            `json:"version"`
+	TimescaleDBVersion string            `json:"timescaledb_version,omitempty"`
+	Settings           map[string]string `json:"settings,omitempty"`
+
+	// The benchmarked relation, and its chunks if it's a hypertable
+	Relation string `json:"relation,omitempty"`
+	Chunks   *int64 `json:"chunks,omitempty"`
+}
+
+type timingInfo struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+type queryCounts struct {
+	Attempted  int     `json:"attempted"`
+	Successful int     `json:"successful"`
+	Failed     int     `json:"failed"`
+	ErrorRate  float64 `json:"error_rate"`
+	Rows       int64   `json:"rows"`
+
+	// Bytes of column values in the results, excluding protocol framing
+	ResultBytes int64 `json:"result_bytes"`
+
+	// Rows returned by successful queries, and queries failing because
+	// they returned none
+	RowsPerQuery *countStats `json:"rows_per_query,omitempty"`
+	EmptyResults int         `json:"empty_results"`
+
+	// Under -record-sample, the fraction of attempts recorded in detail and
+	// their number; latency and breakdown statistics cover only these
+	RecordSample float64 `json:"record_sample,omitempty"`
+	Recorded     int     `json:"recorded"`
+
+	// Results discarded under -backpressure drop, excluded from the above
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+type latencyStats struct {
+	Count         int     `json:"count"`
+	Total         float64 `json:"total_ms"`
+	Min           float64 `json:"min_ms"`
+	Max           float64 `json:"max_ms"`
+	Mean          float64 `json:"mean_ms"`
+	Median        float64 `json:"median_ms"`
+	P90           float64 `json:"p90_ms"`
+	P95           float64 `json:"p95_ms"`
+	P99           float64 `json:"p99_ms"`
+	TrimmedMean   float64 `json:"trimmed_mean_ms"`
+	Outliers      int     `json:"outliers"`
+	OutlierCutoff float64 `json:"outlier_cutoff_ms"`
+
+	// Set if quantiles were estimated from a sample of this many times
+	Sampled int `json:"sampled,omitempty"`
+}
+
+type sloStats struct {
+	Target     float64 `json:"target_ms"`
+	Tolerance  float64 `json:"tolerance"`
+	Satisfied  int     `json:"satisfied"`
+	Tolerating int     `json:"tolerating"`
+	Frustrated int     `json:"frustrated"`
+	Apdex      float64 `json:"apdex"`
+}
+
+type stabilityStats struct {
+	TargetWidth float64 `json:"target_width"`
+	Converged   bool    `json:"converged"`
+	Queries     int     `json:"queries"`
+	P99         float64 `json:"p99_ms,omitempty"`
+	Lower       float64 `json:"lower_ms,omitempty"`
+	Upper       float64 `json:"upper_ms,omitempty"`
+}
+
+type cacheStats struct {
+	Repeated    int           `json:"repeated"`
+	Second      *latencyStats `json:"second_run,omitempty"`
+	MedianRatio float64       `json:"median_ratio"`
+	P90Ratio    float64       `json:"p90_ratio"`
+	P99Ratio    float64       `json:"p99_ratio"`
+	Sensitive   int           `json:"sensitive"`
+}
+
+type rangeStats struct {
+	Range   string        `json:"range"`
+	Latency *latencyStats `json:"latency,omitempty"`
+}
+
+type comparisonStats struct {
+	Name    string        `json:"name"`
+	Failed  int           `json:"failed"`
+	Latency *latencyStats `json:"latency,omitempty"`
+
+	// Set for variants
+	SQL            string       `json:"sql,omitempty"`
+	RangeBreakdown []rangeStats `json:"range_breakdown,omitempty"`
+}
+
+type planStats struct {
+	Samples               int            `json:"samples"`
+	Failures              int            `json:"failures"`
+	MeanPlanningTime      float64        `json:"mean_planning_time_ms"`
+	TotalChunks           int            `json:"total_chunks,omitempty"`
+	ChunksPlanExcluded    *countStats    `json:"chunks_plan_excluded,omitempty"`
+	ChunksStartupExcluded countStats     `json:"chunks_startup_excluded"`
+	ChunksRuntimeExcluded countStats     `json:"chunks_runtime_excluded"`
+	ChunksScanned         countStats     `json:"chunks_scanned"`
+	WorkersPlanned        int            `json:"workers_planned"`
+	WorkersLaunched       int            `json:"workers_launched"`
+	SharedHitBlocks       int64          `json:"shared_hit_blocks"`
+	SharedReadBlocks      int64          `json:"shared_read_blocks"`
+	HitRatio              float64        `json:"hit_ratio"`
+	BlocksRead            countStats     `json:"blocks_read"`
+	ScanNodes             map[string]int `json:"scan_nodes"`
+	Shapes                map[string]int `json:"shapes"`
+
+	// Plans with a node's row estimate off by misestimateFactor or more,
+	// and the worst such node per label
+	RowMisestimates int             `json:"row_misestimates"`
+	WorstEstimates  []estimateStats `json:"worst_estimates,omitempty"`
+}
+
+type estimateStats struct {
+	Node      string  `json:"node"`
+	Plans     int     `json:"plans"`
+	Estimated float64 `json:"estimated_rows"`
+	Actual    float64 `json:"actual_rows"`
+	Factor    float64 `json:"factor"`
+}
+
+type budgetStats struct {
+	Budget     float64       `json:"budget_ms"`
+	Violations int           `json:"violations"`
+	Wasted     float64       `json:"wasted_ms"`
+	Elapsed    *latencyStats `json:"elapsed_at_cancel,omitempty"`
+}
+
+type poolStats struct {
+	Target           string  `json:"target"`
+	MaxConns         int32   `json:"max_conns"`
+	Acquires         int64   `json:"acquires"`
+	EmptyAcquires    int64   `json:"empty_acquires"`
+	CanceledAcquires int64   `json:"canceled_acquires"`
+	AcquireTime      float64 `json:"acquire_time_ms"`
+}
+
+type countStats struct {
+	Min    int64 `json:"min"`
+	Median int64 `json:"median"`
+	Max    int64 `json:"max"`
+	Total  int64 `json:"total"`
+}
+
+// newRowCountStats summarises the rows returned per query, or is nil if no
+// query succeeded
+func newRowCountStats(r *stats.Recorder) *countStats {
+	if r.Count() == 0 {
+		return nil
+	}
+	s := r.Summary()
+	return &countStats{Min: s.Min, Median: s.Median, Max: s.Max, Total: s.Total}
+}
+
+// newCountStats summarises counts, sorting them in place
+func newCountStats(counts []int64) countStats {
+	s := stats.Summarise(counts)
+	return countStats{Min: s.Min, Median: s.Median, Max: s.Max, Total: s.Total}
+}
+
+type slowQuery struct {
+	Hostname string  `json:"hostname"`
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Variant  string  `json:"variant"`
+	Target   string  `json:"target"`
+	Worker   int     `json:"worker"`
+	Time     float64 `json:"time_ms"`
+	Rows     int64   `json:"rows"`
+}
+
+type inputStats struct {
+	Rows       int            `json:"rows"`
+	Rejected   map[string]int `json:"rejected"`
+	Duplicates int            `json:"duplicates"`
+	Deduped    bool           `json:"deduped"`
+
+	// Bytes read from the input and time spent waiting on reads
+	Bytes       int64   `json:"bytes,omitempty"`
+	ReadSeconds float64 `json:"read_seconds,omitempty"`
+}
+
+type clientStats struct {
+	CPUUserSeconds   float64 `json:"cpu_user_seconds"`
+	CPUSystemSeconds float64 `json:"cpu_system_seconds"`
+	PeakRSSBytes     int64   `json:"peak_rss_bytes,omitempty"`
+	GCCycles         uint32  `json:"gc_cycles"`
+	GCPauseTotal     float64 `json:"gc_pause_total_ms"`
+	GCPauseMax       float64 `json:"gc_pause_max_ms"`
+	PeakGoroutines   int     `json:"peak_goroutines"`
+}
+
+type serverStatsSummary struct {
+	Statements []statementSummary `json:"statements"`
+	Database   databaseSummary    `json:"database"`
+}
+
+type statementSummary struct {
+	QueryID        string  `json:"query_id"`
+	Query          string  `json:"query"`
+	Calls          int64   `json:"calls"`
+	TotalExecTime  float64 `json:"total_exec_time_ms"`
+	MeanExecTime   float64 `json:"mean_exec_time_ms"`
+	SharedBlksHit  int64   `json:"shared_blks_hit"`
+	SharedBlksRead int64   `json:"shared_blks_read"`
+}
+
+type databaseSummary struct {
+	XactCommit   int64 `json:"xact_commit"`
+	XactRollback int64 `json:"xact_rollback"`
+	BlksRead     int64 `json:"blks_read"`
+	BlksHit      int64 `json:"blks_hit"`
+	TupReturned  int64 `json:"tup_returned"`
+	TupFetched   int64 `json:"tup_fetched"`
+}
+
+func newManifest(seed int64, server serverInfo, labels labelFlags) *runManifest {
+	config := redactedConfig(flag.CommandLine)
+
+	return &runManifest{
+		SchemaVersion: manifestSchemaVersion,
+		Tool: toolInfo{
+			Version:   version,
+			Commit:    commit,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+			Args:      redactArgs(flag.CommandLine, os.Args[1:]),
+
+			ReportFormat: stats.FormatVersion,
+		},
+		Server: server,
+		Config: config,
+		Labels: labels,
+		Seed:   seed,
+	}
+}
+
+// describeServer returns the server and TimescaleDB versions, settings
+// relevant to the benchmark and the number of chunks queried. The
+// TimescaleDB version is empty if the extension isn't installed. Whatever
+// could be determined is returned along with any error.
+func describeServer(ctx context.Context, q querier, relation string) (serverInfo, error) {
+	var info serverInfo
+	if err := q.QueryRow(ctx, "SHOW server_version").Scan(&info.Version); err != nil {
+		return info, err
+	}
+	err := q.QueryRow(ctx,
+		"SELECT COALESCE((SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'), '')").Scan(
+		&info.TimescaleDBVersion)
+	if err != nil {
+		return info, err
+	}
+
+	rows, err := q.Query(ctx,
+		"SELECT name, current_setting(name) FROM pg_settings WHERE name = ANY($1)", reportedSettings)
+	if err != nil {
+		return info, err
+	}
+	info.Settings = make(map[string]string)
+	for rows.Next() {
+		var name, setting string
+		if err := rows.Scan(&name, &setting); err != nil {
+			rows.Close()
+			return info, err
+		}
+		info.Settings[name] = setting
+	}
+	if err := rows.Err(); err != nil {
+		return info, err
+	}
+
+	info.Relation = relation
+	if info.TimescaleDBVersion != "" {
+		hypertable, err := isHypertable(ctx, q, relation)
+		if err != nil {
+			return info, fmt.Errorf("looking up %s: %w", relation, err)
+		}
+		if hypertable {
+			chunks, err := countChunks(ctx, q, relation)
+			if err != nil {
+				return info, fmt.Errorf("counting chunks of %s: %w", relation, err)
+			}
+			n := int64(chunks)
+			info.Chunks = &n
+		}
+	}
+	return info, nil
+}
+
+// printRunMetadata records what was benchmarked, so the report can be
+// interpreted long after the run
+func printRunMetadata(server serverInfo, labels labelFlags) {
+	fmt.Printf("\n## Run metadata\n")
+	if len(labels) > 0 {
+		fmt.Printf("Labels:            %s\n", labels)
+	}
+	fmt.Printf("Tool version:      %s (commit %s, %s)\n", version, commit, runtime.Version())
+	if server.Version == "" {
+		fmt.Printf("Server version:    unknown\n")
+	} else {
+		fmt.Printf("Server version:    %s\n", server.Version)
+		fmt.Printf("TimescaleDB:       %s\n", orNone(server.TimescaleDBVersion))
+	}
+	if server.Relation != "" {
+		fmt.Printf("Relation:          %s\n", server.Relation)
+	}
+	if server.Chunks != nil {
+		fmt.Printf("Chunks:            %d\n", *server.Chunks)
+	}
+	for _, name := range reportedSettings {
+		if setting, ok := server.Settings[name]; ok {
+			fmt.Printf("  %-32s %s\n", name, setting)
+		}
+	}
+	fmt.Printf("Arguments:         %s\n", orNone(quoteArgs(redactArgs(flag.CommandLine, os.Args[1:]))))
+}
+
+// quoteArgs joins command line arguments, quoting any which need it
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func usToMs(us float64) float64 {
+	return us / 1000.0
+}
+
+func newLatencyStats(rec *stats.Recorder, trim float64) *latencyStats {
+	if rec.Count() == 0 {
+		return nil
+	}
+	s := rec.Summary()
+	sorted := rec.Values()
+	n, cutoff := stats.Outliers(sorted)
+	return &latencyStats{
+		Count:         s.Count,
+		Total:         usToMs(float64(s.Total)),
+		Min:           usToMs(float64(s.Min)),
+		Max:           usToMs(float64(s.Max)),
+		Mean:          usToMs(float64(s.Mean())),
+		Median:        usToMs(float64(s.Median)),
+		P90:           usToMs(stats.Quantile(sorted, 0.90)),
+		P95:           usToMs(stats.Quantile(sorted, 0.95)),
+		P99:           usToMs(stats.Quantile(sorted, 0.99)),
+		TrimmedMean:   usToMs(stats.TrimmedMean(sorted, trim)),
+		Outliers:      n,
+		OutlierCutoff: usToMs(cutoff),
+		Sampled:       s.Sampled,
+	}
+}
+
+func newSLOStats(r *sloReport) *sloStats {
+	return &sloStats{
+		Target:     float64(r.target) / float64(time.Millisecond),
+		Tolerance:  r.tolerance,
+		Satisfied:  r.satisfied,
+		Tolerating: r.tolerating,
+		Frustrated: r.frustrated,
+		Apdex:      r.apdex(),
+	}
+}
+
+func newStabilityStats(s *stability) *stabilityStats {
+	stats := &stabilityStats{TargetWidth: s.width, Converged: s.converged, Queries: s.count}
+	if s.bounded {
+		stats.P99 = usToMs(s.estimate)
+		stats.Lower = usToMs(float64(s.lo))
+		stats.Upper = usToMs(float64(s.hi))
+	}
+	return stats
+}
+
+func newCacheStats(c *cacheSensitivity, trim float64) *cacheStats {
+	ratios := c.sortedRatios()
+	return &cacheStats{
+		Repeated:    len(ratios),
+		Second:      newLatencyStats(c.second, trim),
+		MedianRatio: ratioQuantile(ratios, 0.5),
+		P90Ratio:    ratioQuantile(ratios, 0.9),
+		P99Ratio:    ratioQuantile(ratios, 0.99),
+		Sensitive:   c.sensitive(),
+	}
+}
+
+func newRangeStats(b *rangeBreakdown, trim float64) []rangeStats {
+	var out []rangeStats
+	for i, rec := range b.times {
+		out = append(out, rangeStats{
+			Range:   b.label(i),
+			Latency: newLatencyStats(rec, trim),
+		})
+	}
+	return out
+}
+
+// newComparisonStats summarises each value of c, along with its range
+// breakdown if ranges has one
+func newComparisonStats(c *comparison, ranges map[string]*rangeBreakdown, trim float64) []comparisonStats {
+	var out []comparisonStats
+	for _, name := range c.names {
+		stats := comparisonStats{
+			Name:    name,
+			Failed:  c.failed[name],
+			Latency: newLatencyStats(c.times[name], trim),
+		}
+		if b, ok := ranges[name]; ok {
+			stats.RangeBreakdown = newRangeStats(b, trim)
+		}
+		out = append(out, stats)
+	}
+	return out
+}
+
+// newVariantStats summarises each variant, with the SQL it ran
+func newVariantStats(c *comparison, ranges map[string]*rangeBreakdown, variants []queryVariant, trim float64) []comparisonStats {
+	out := newComparisonStats(c, ranges, trim)
+	for i := range out {
+		for _, v := range variants {
+			if v.name == out[i].Name {
+				out[i].SQL = v.sql
+			}
+		}
+	}
+	return out
+}
+
+func newPlanStats(a *planAggregate) *planStats {
+	p := &planStats{
+		Samples:          a.samples,
+		TotalChunks:      a.totalChunks,
+		Failures:         a.failures,
+		WorkersPlanned:   a.workersPlanned,
+		WorkersLaunched:  a.workersLaunched,
+		SharedHitBlocks:  a.sharedHit,
+		SharedReadBlocks: a.sharedRead,
+		HitRatio:         a.hitRatio(),
+		ScanNodes:        a.scans,
+		Shapes:           a.shapes,
+		RowMisestimates:  a.misestimated,
+	}
+	for _, e := range a.misestimates() {
+		p.WorstEstimates = append(p.WorstEstimates, estimateStats{
+			Node:      e.node,
+			Plans:     a.estimateCounts[e.node],
+			Estimated: e.estimated,
+			Actual:    e.actual,
+			Factor:    e.factor(),
+		})
+	}
+	if a.samples > 0 {
+		p.MeanPlanningTime = a.planningTime / float64(a.samples)
+		p.ChunksStartupExcluded = newCountStats(a.chunksStartupExcluded)
+		p.ChunksRuntimeExcluded = newCountStats(a.chunksRuntimeExcluded)
+		p.ChunksScanned = newCountStats(a.chunksScanned)
+		p.BlocksRead = newCountStats(a.blocksRead)
+		if a.totalChunks > 0 {
+			c := newCountStats(a.chunksPlanExcluded)
+			p.ChunksPlanExcluded = &c
+		}
+	}
+	return p
+}
+
+func newSlowQueries(s *slowestQueries) []slowQuery {
+	var out []slowQuery
+	for _, r := range s.sorted() {
+		out = append(out, slowQuery{
+			Hostname: r.task.hostname,
+			Start:    r.task.start,
+			End:      r.task.end,
+			Variant:  r.task.variant.name,
+			Target:   r.task.target.name,
+			Worker:   r.worker,
+			Time:     usToMs(float64(r.queryTime)),
+			Rows:     r.rows,
+		})
+	}
+	return out
+}
+
+func newInputStats(v *validationSummary, read inputRead) inputStats {
+	return inputStats{
+		Rows:        v.rows,
+		Rejected:    v.rejected,
+		Duplicates:  v.duplicates,
+		Deduped:     v.deduped,
+		Bytes:       read.bytes,
+		ReadSeconds: read.wait.Seconds(),
+	}
+}
+
+func newClientStats(r clientUsageReport) clientStats {
+	return clientStats{
+		CPUUserSeconds:   r.user.Seconds(),
+		CPUSystemSeconds: r.system.Seconds(),
+		PeakRSSBytes:     r.peakRSS,
+		GCCycles:         r.numGC,
+		GCPauseTotal:     float64(r.gcPauseTotal) / float64(time.Millisecond),
+		GCPauseMax:       float64(r.gcPauseMax) / float64(time.Millisecond),
+		PeakGoroutines:   r.peakGoroutines,
+	}
+}
+
+func newServerStatsSummary(delta serverStatsDelta) *serverStatsSummary {
+	s := &serverStatsSummary{
+		Statements: []statementSummary{},
+		Database: databaseSummary{
+			XactCommit:   delta.database.xactCommit,
+			XactRollback: delta.database.xactRollback,
+			BlksRead:     delta.database.blksRead,
+			BlksHit:      delta.database.blksHit,
+			TupReturned:  delta.database.tupReturned,
+			TupFetched:   delta.database.tupFetched,
+		},
+	}
+	for _, st := range delta.statements {
+		s.Statements = append(s.Statements, statementSummary{
+			QueryID:        st.queryID,
+			Query:          st.query,
+			Calls:          st.calls,
+			TotalExecTime:  st.totalTime,
+			MeanExecTime:   st.meanTime(),
+			SharedBlksHit:  st.sharedBlksHit,
+			SharedBlksRead: st.sharedBlksRead,
+		})
+	}
+	return s
+}
+
+func newBudgetStats(budget time.Duration, cancelled *stats.Recorder) *budgetStats {
+	return &budgetStats{
+		Budget:     float64(budget.Microseconds()) / 1000.0,
+		Violations: cancelled.Count(),
+		Wasted:     float64(cancelled.Total()) / 1000.0,
+		Elapsed:    newLatencyStats(cancelled, 0),
+	}
+}
+
+func newPoolStats(usage []poolUsage) []poolStats {
+	stats := make([]poolStats, len(usage))
+	for i, u := range usage {
+		stats[i] = poolStats{
+			Target:           u.target,
+			MaxConns:         u.maxConns,
+			Acquires:         u.acquires,
+			EmptyAcquires:    u.emptyAcquires,
+			CanceledAcquires: u.canceledAcquires,
+			AcquireTime:      float64(u.acquireDuration.Microseconds()) / 1000.0,
+		}
+	}
+	return stats
+}
+
+// writeManifest writes m to fileName atomically, or to stdout for "-"
+func writeManifest(fileName string, m *runManifest) error {
+	if fileName == stdoutName {
+		return encodeManifest(resultsStdout, m)
+	}
+
+	f, err := createAtomic(fileName)
+	if err != nil {
+		return err
+	}
+	if err := encodeManifest(f, m); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
+
+// readManifest reads a manifest written by writeManifest
+func readManifest(fileName string) (*runManifest, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m runManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if m.SchemaVersion != manifestSchemaVersion {
+		return nil, fmt.Errorf("%s: unsupported schema version %d", fileName, m.SchemaVersion)
+	}
+	return &m, nil
+}
+
+func encodeManifest(w io.Writer, m *runManifest) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
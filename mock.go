@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Execution backends selectable with -driver
+const (
+	driverPostgres = "postgres"
+	driverMock     = "mock"
+)
+
+// Server version recorded for runs under -driver mock
+const mockServerVersion = "mock"
+
+// mockDriver stands in for the database under -driver mock, answering each
+// query after a synthetic latency, so the harness's dispatch, statistics and
+// reporting can be exercised without one
+type mockDriver struct {
+	// nil answers at once
+	latency delayDistribution
+
+	// Fraction of queries which fail, with a server error
+	errorRate float64
+
+	// Rows returned by each successful query; none fails as an empty result
+	// would
+	rows int64
+}
+
+func newMockDriver(latency string, errorRate float64, rows int64) (*mockDriver, error) {
+	d, err := parseDelay(latency)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -mock-latency: %w", err)
+	}
+	if errorRate < 0 || errorRate > 1 {
+		return nil, fmt.Errorf("-mock-error-rate must be between 0 and 1")
+	}
+	if rows < 0 {
+		return nil, fmt.Errorf("-mock-rows must not be negative")
+	}
+	return &mockDriver{latency: d, errorRate: errorRate, rows: rows}, nil
+}
+
+// run simulates one query, drawing its latency and outcome from rng. Like a
+// real query it is cut short if ctx ends first.
+func (m *mockDriver) run(ctx context.Context, rng *rand.Rand) (fetched, error) {
+	var f fetched
+	var latency time.Duration
+	if m.latency != nil {
+		latency = m.latency.sample(rng)
+	}
+	fail := rng.Float64() < m.errorRate
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return f, ctx.Err()
+		}
+	}
+	if fail {
+		return f, &pgconn.PgError{Severity: "ERROR", Code: "XX000", Message: "mock query failure"}
+	}
+	if m.rows == 0 {
+		return f, pgx.ErrNoRows
+	}
+	f.firstRow = time.Now()
+	f.rows = m.rows
+	return f, nil
+}
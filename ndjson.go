@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Longest NDJSON line accepted, well beyond any plausible task
+const maxNDJSONLine = 1024 * 1024
+
+// ndjsonTask is one line of NDJSON input. Times may be strings in any
+// accepted format, or JSON numbers for epoch timestamps.
+type ndjsonTask struct {
+	Hostname string          `json:"hostname"`
+	Start    json.RawMessage `json:"start"`
+	End      json.RawMessage `json:"end"`
+	At       json.RawMessage `json:"at,omitempty"`
+	Bucket   string          `json:"bucket,omitempty"`
+
+	// Every field, when some are mapped to extra parameters
+	fields map[string]json.RawMessage
+}
+
+// ndjsonSource reads newline-delimited JSON tasks, laying out the fields of
+// each as a record according to cols so they can be validated like CSV rows.
+// Blank lines are skipped.
+type ndjsonSource struct {
+	s    *bufio.Scanner
+	cols columnMap
+}
+
+func newNDJSONSource(f io.Reader, cols columnMap) *ndjsonSource {
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), maxNDJSONLine)
+	return &ndjsonSource{s: s, cols: cols}
+}
+
+func (n *ndjsonSource) Read() ([]string, error) {
+	var line []byte
+	for len(line) == 0 {
+		if !n.s.Scan() {
+			if err := n.s.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		line = n.s.Bytes()
+	}
+
+	t, err := decodeNDJSONTask(line, n.cols)
+	if err != nil {
+		return nil, &rowError{rejectMalformedJSON, err.Error()}
+	}
+	return t.record(n.cols)
+}
+
+// decodeNDJSONTask decodes one task, keeping all of its fields if some are
+// mapped to extra parameters
+func decodeNDJSONTask(b []byte, cols columnMap) (ndjsonTask, error) {
+	var t ndjsonTask
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, err
+	}
+	if len(cols.params) > 0 {
+		if err := json.Unmarshal(b, &t.fields); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// record lays out the task's fields as an input record
+func (t ndjsonTask) record(cols columnMap) ([]string, error) {
+	start, err := jsonTimeField(t.Start)
+	if err != nil {
+		return nil, &rowError{rejectMalformedJSON, fmt.Sprintf("start: %s", err.Error())}
+	}
+	end, err := jsonTimeField(t.End)
+	if err != nil {
+		return nil, &rowError{rejectMalformedJSON, fmt.Sprintf("end: %s", err.Error())}
+	}
+
+	record := make([]string, cols.minFields())
+	record[cols.hostname] = t.Hostname
+	record[cols.start] = start
+	record[cols.end] = end
+	if cols.at >= 0 {
+		record[cols.at], err = jsonTimeField(t.At)
+		if err != nil {
+			return nil, &rowError{rejectMalformedJSON, fmt.Sprintf("at: %s", err.Error())}
+		}
+	}
+	if cols.bucket >= 0 {
+		record[cols.bucket] = t.Bucket
+	}
+	for _, p := range cols.params {
+		record[p.column], err = jsonParamField(t.fields[p.field])
+		if err != nil {
+			return nil, &rowError{rejectMalformedJSON, fmt.Sprintf("%s: %s", p.field, err.Error())}
+		}
+	}
+	return record, nil
+}
+
+// jsonTimeField returns a time given as a JSON string or number as text
+func jsonTimeField(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", fmt.Errorf("expected a string or number, got %s", raw)
+	}
+	return n.String(), nil
+}
+
+// jsonParamField returns a JSON string as is, and any other scalar as its
+// JSON text, for binding as a text parameter
+func jsonParamField(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case '{', '[':
+		return "", fmt.Errorf("expected a string, number or boolean")
+	}
+	return string(raw), nil
+}
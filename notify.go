@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats a -notify-url notification can be sent in
+const (
+	notifyJSON  = "json"
+	notifySlack = "slack"
+)
+
+// Statuses reported in notifications
+const (
+	notifyPassed      = "passed"
+	notifyFailed      = "failed"
+	notifyInterrupted = "interrupted"
+	notifyAborted     = "aborted"
+)
+
+// How long to wait for the webhook to respond
+const notifyTimeout = 10 * time.Second
+
+// notifier posts a summary of the run to a webhook when it finishes or is
+// aborted
+type notifier struct {
+	url    string
+	format string
+
+	// Limits checked for the run to pass; zero disables each
+	maxP99       time.Duration
+	maxErrorRate float64
+}
+
+func newNotifier(url string, format string, maxP99 time.Duration, maxErrorRate float64) (*notifier, error) {
+	if format != notifyJSON && format != notifySlack {
+		return nil, fmt.Errorf("expected %s or %s", notifyJSON, notifySlack)
+	}
+	return &notifier{url: url, format: format, maxP99: maxP99, maxErrorRate: maxErrorRate}, nil
+}
+
+// thresholdCheck compares one statistic of the run with its limit
+type thresholdCheck struct {
+	Name   string  `json:"name"`
+	Limit  float64 `json:"limit"`
+	Value  float64 `json:"value"`
+	Passed bool    `json:"passed"`
+}
+
+// notification is the JSON posted to the webhook: the same summary as a
+// -history line, with the run's status and threshold checks
+type notification struct {
+	Status string `json:"status"`
+	historyRecord
+	Checks []thresholdCheck `json:"checks,omitempty"`
+}
+
+// check returns the status of a completed run and the result of each
+// threshold, including any -baseline checks
+func (n *notifier) check(r historyRecord, baseline *baselineStats) (string, []thresholdCheck) {
+	var checks []thresholdCheck
+	if n.maxP99 > 0 {
+		limit := float64(n.maxP99.Microseconds()) / 1000.0
+		checks = append(checks, thresholdCheck{Name: "p99_ms", Limit: limit, Value: r.P99, Passed: r.P99 <= limit})
+	}
+	if n.maxErrorRate > 0 {
+		checks = append(checks, thresholdCheck{Name: "error_rate", Limit: n.maxErrorRate, Value: r.ErrorRate, Passed: r.ErrorRate <= n.maxErrorRate})
+	}
+	if baseline != nil {
+		checks = append(checks, baseline.thresholdChecks()...)
+	}
+	for _, c := range checks {
+		if !c.Passed {
+			return notifyFailed, checks
+		}
+	}
+	return notifyPassed, checks
+}
+
+// finished notifies of a run that completed, or was interrupted and then
+// reported, checking its thresholds
+func (n *notifier) finished(m *runManifest, interrupted bool) {
+	r := newHistoryRecord(m)
+	status, checks := n.check(r, m.Baseline)
+	if interrupted {
+		status = notifyInterrupted
+	}
+	n.send(notification{Status: status, historyRecord: r, Checks: checks})
+}
+
+// aborted notifies of a run abandoned before its report. Results are still
+// being collected, so only the run's identity and duration are sent.
+func (n *notifier) aborted(start time.Time, labels map[string]string) {
+	n.send(notification{Status: notifyAborted, historyRecord: historyRecord{
+		Time:            start,
+		Version:         version,
+		Labels:          labels,
+		DurationSeconds: time.Since(start).Seconds(),
+	}})
+}
+
+func (n *notifier) send(msg notification) {
+	var body interface{} = msg
+	if n.format == notifySlack {
+		body = map[string]string{"text": slackText(msg)}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("[WARN] Unable to encode notification: %s\n", err.Error())
+		return
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// The error would repeat the URL, token and all
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		log.Printf("[WARN] Unable to send notification to %s: %s\n", redactURL(n.url), err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[WARN] Notification rejected with %s\n", resp.Status)
+		return
+	}
+	log.Printf("[INFO] Sent %s notification\n", msg.Status)
+}
+
+// slackText formats a notification as a Slack message
+func slackText(msg notification) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Benchmark %s*", msg.Status)
+	if len(msg.Labels) > 0 {
+		names := make([]string, 0, len(msg.Labels))
+		for name := range msg.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var labels []string
+		for _, name := range names {
+			labels = append(labels, name+"="+msg.Labels[name])
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(labels, ", "))
+	}
+	if msg.Status == notifyAborted {
+		fmt.Fprintf(&b, "\nAborted after %.0fs", msg.DurationSeconds)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\n%d queries in %.0fs, %.2f%% failed", msg.Attempted, msg.DurationSeconds, 100*msg.ErrorRate)
+	if msg.Throughput > 0 {
+		fmt.Fprintf(&b, ", %.1f/s", msg.Throughput)
+	}
+	if msg.Median > 0 {
+		fmt.Fprintf(&b, "\nmedian %.3fms, p95 %.3fms, p99 %.3fms, max %.3fms", msg.Median, msg.P95, msg.P99, msg.Max)
+	}
+	for _, c := range msg.Checks {
+		mark := ":white_check_mark:"
+		if !c.Passed {
+			mark = ":x:"
+		}
+		fmt.Fprintf(&b, "\n%s %s %g (limit %g)", mark, c.Name, c.Value, c.Limit)
+	}
+	return b.String()
+}
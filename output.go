@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Output file name for writing to stdout
+const stdoutName = "-"
+
+// Names of the files written under -report-dir
+const (
+	reportDirReport   = "report.txt"
+	reportDirManifest = "manifest.json"
+)
+
+// Where output named "-" is written. Set aside in main before the
+// human-readable report is moved off stdout, so the two don't interleave.
+var resultsStdout = os.Stdout
+
+// atomicFile is written under a temporary name alongside its destination
+// and renamed into place by commit, so interrupted or concurrent runs never
+// leave a truncated file under the final name
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func createAtomic(name string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	// TempFile creates files readable only by their owner
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{File: f, name: name}, nil
+}
+
+// commit closes the file and moves it into place
+func (a *atomicFile) commit() error {
+	if err := a.File.Close(); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	return os.Rename(a.File.Name(), a.name)
+}
+
+// abort closes and removes the file, leaving any previous file in place
+func (a *atomicFile) abort() {
+	a.File.Close()
+	os.Remove(a.File.Name())
+}
+
+// teeStdout copies everything printed to stdout from now on to w as well,
+// until the returned function is called
+func teeStdout(w io.Writer) (func() error, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.Stdout
+	os.Stdout = pw
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.MultiWriter(stdout, w), r)
+		r.Close()
+		copied <- err
+	}()
+
+	return func() error {
+		os.Stdout = stdout
+		pw.Close()
+		return <-copied
+	}, nil
+}
+
+// saveStdout tees stdout into fileName, which is written atomically once
+// the returned function is called
+func saveStdout(fileName string) (func() error, error) {
+	f, err := createAtomic(fileName)
+	if err != nil {
+		return nil, err
+	}
+	restore, err := teeStdout(f)
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+	return func() error {
+		if err := restore(); err != nil {
+			f.abort()
+			return err
+		}
+		return f.commit()
+	}, nil
+}
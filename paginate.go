@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Values accepted by -paginate
+const (
+	paginateOffset = "offset"
+	paginateKeyset = "keyset"
+)
+
+// Pages beyond this are reported together in the per-page breakdown
+const maxReportedPages = 20
+
+type pagination struct {
+	mode     string
+	size     int
+	maxPages int
+}
+
+// runPages fetches the result of sql page by page, as a UI scrolling through
+// a long time range would, until a short page or maxPages. Offset pages wrap
+// the query with ORDER BY 1 LIMIT/OFFSET; keyset pages instead filter on the
+// first column, whose name is taken from the first page, so it must be a
+// unique sort key. The time taken by each page is returned in µs.
+func runPages(ctx context.Context, q querier, p pagination, sql string, args ...interface{}) (pageTimes []int64, n int64, err error) {
+	var key interface{}
+	var keyColumn string
+	next := len(args) + 1
+
+	for page := 0; p.maxPages == 0 || page < p.maxPages; page++ {
+		var pageSQL string
+		pageArgs := append([]interface{}(nil), args...)
+		switch {
+		case p.mode == paginateOffset || page == 0:
+			pageSQL = fmt.Sprintf("SELECT * FROM (%s) AS paged ORDER BY 1 LIMIT $%d OFFSET $%d", sql, next, next+1)
+			pageArgs = append(pageArgs, p.size, page*p.size)
+		default:
+			pageSQL = fmt.Sprintf("SELECT * FROM (%s) AS paged WHERE %s > $%d ORDER BY 1 LIMIT $%d",
+				sql, keyColumn, next, next+1)
+			pageArgs = append(pageArgs, key, p.size)
+		}
+
+		t0 := time.Now()
+		rows, err := q.Query(ctx, pageSQL, pageArgs...)
+		if err != nil {
+			return pageTimes, n, err
+		}
+		pageRows := 0
+		for rows.Next() {
+			pageRows++
+			if p.mode == paginateKeyset {
+				values, err := rows.Values()
+				if err != nil {
+					rows.Close()
+					return pageTimes, n, err
+				}
+				key = values[0]
+			}
+		}
+		if keyColumn == "" && len(rows.FieldDescriptions()) > 0 {
+			keyColumn = pgx.Identifier{string(rows.FieldDescriptions()[0].Name)}.Sanitize()
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return pageTimes, n, err
+		}
+		pageTimes = append(pageTimes, time.Since(t0).Microseconds())
+		n += int64(pageRows)
+
+		if pageRows < p.size {
+			break
+		}
+	}
+
+	if n == 0 {
+		return pageTimes, 0, pgx.ErrNoRows
+	}
+	return pageTimes, n, nil
+}
+
+// pageBreakdown records page latencies by page number, showing whether
+// later pages get slower (as they do with OFFSET)
+type pageBreakdown struct {
+	all       *stats.Recorder
+	byPage    []*stats.Recorder
+	sequences int
+	pages     int
+}
+
+func newPageBreakdown(newRecorder recorderFactory) *pageBreakdown {
+	b := &pageBreakdown{all: newRecorder("pages")}
+	for i := 0; i <= maxReportedPages; i++ {
+		b.byPage = append(b.byPage, newRecorder("page-"+strconv.Itoa(i+1)))
+	}
+	return b
+}
+
+func (b *pageBreakdown) add(r benchResult) {
+	if r.err != nil || len(r.pageTimes) == 0 {
+		return
+	}
+	b.sequences++
+	for i, t := range r.pageTimes {
+		b.pages++
+		b.all.Add(t)
+		if i > maxReportedPages {
+			i = maxReportedPages
+		}
+		b.byPage[i].Add(t)
+	}
+}
+
+func printPageBreakdown(p pagination, b *pageBreakdown) {
+	fmt.Printf("\n## Pagination (%s, %d rows per page)\n", p.mode, p.size)
+	if b.sequences == 0 {
+		fmt.Printf("No successful sequences\n")
+		return
+	}
+	fmt.Printf("Sequences:         %d (query times above cover whole sequences)\n", b.sequences)
+	fmt.Printf("Pages/sequence:    %.1f\n", float64(b.pages)/float64(b.sequences))
+	fmt.Printf("Per-page latency:\n")
+	stats.WriteSummary(os.Stdout, b.all.Summary())
+	stats.WritePercentiles(os.Stdout, b.all.Values())
+
+	fmt.Printf("%-8s %8s %12s %12s\n", "page", "count", "median (ms)", "p95 (ms)")
+	for i, rec := range b.byPage {
+		if rec.Count() == 0 {
+			continue
+		}
+		label := strconv.Itoa(i + 1)
+		if i == maxReportedPages {
+			label += "+"
+		}
+		sorted := rec.Values()
+		fmt.Printf("%-8s %8d %12.3f %12.3f\n", label, rec.Count(),
+			stats.Quantile(sorted, 0.5)/1000.0, stats.Quantile(sorted, 0.95)/1000.0)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramMapping binds an extra input column, or NDJSON field, to a query
+// placeholder beyond the built-in ones
+type paramMapping struct {
+	placeholder int
+	column      int
+	field       string
+}
+
+// parseParamMap parses mappings of the form "$5=3,$6=4", from placeholder to
+// CSV column index, or "$5=region" to an NDJSON field. Placeholders must
+// follow on from first, the next after the built-in parameters, without
+// gaps. NDJSON fields are assigned columns from nextColumn upwards.
+func parseParamMap(spec string, encoding string, first int, nextColumn int) ([]paramMapping, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var params []paramMapping
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid parameter mapping %q, expected $N=column", part)
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(kv[0]), "$"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid placeholder %q", kv[0])
+		}
+		p := paramMapping{placeholder: n}
+		source := strings.TrimSpace(kv[1])
+		if encoding == inputFormatNDJSON {
+			if source == "" {
+				return nil, fmt.Errorf("empty field name for $%d", n)
+			}
+			p.field = source
+		} else {
+			p.column, err = strconv.Atoi(source)
+			if err != nil || p.column < 0 {
+				return nil, fmt.Errorf("invalid column index %q for $%d", source, n)
+			}
+		}
+		params = append(params, p)
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].placeholder < params[j].placeholder
+	})
+	for i := range params {
+		if params[i].placeholder != first+i {
+			return nil, fmt.Errorf("expected placeholders $%d to $%d, got $%d", first, first+len(params)-1, params[i].placeholder)
+		}
+		if params[i].field != "" {
+			params[i].column = nextColumn + i
+		}
+	}
+	return params, nil
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Variables pgbench defines for every script. Only scale is meaningful
+// here, as clients aren't tied to workers.
+var pgbenchBuiltins = map[string]scriptValue{"scale": int64(1)}
+
+// scriptValue is an int64 or float64, as in pgbench expressions
+type scriptValue interface{}
+
+// pgbenchScript is a pgbench transaction script: \set and \sleep meta
+// commands, and SQL statements with :variable references
+type pgbenchScript struct {
+	name     string
+	commands []scriptCommand
+}
+
+type scriptCommand struct {
+	// \set variable expr
+	set  string
+	expr scriptExpr
+
+	// \sleep duration [us|ms|s]
+	sleep     scriptExpr
+	sleepUnit time.Duration
+
+	// SQL, with :variable references
+	sql string
+}
+
+// scriptRun is one execution of a script, with its variables and sleeps
+// evaluated at dispatch so runs are reproducible from the seed
+type scriptRun struct {
+	script *pgbenchScript
+	vars   map[string]scriptValue
+
+	// Keyed by command index
+	sleeps map[int]time.Duration
+	sql    map[int]string
+}
+
+var scriptVariable = regexp.MustCompile(`(^|[^:]):([A-Za-z_][A-Za-z0-9_]*)`)
+
+// loadPgbenchScript parses a pgbench script file. As in pgbench, SQL
+// statements end with a semicolon at the end of a line, and meta commands
+// take one line (or more, with trailing backslashes).
+func loadPgbenchScript(fileName string) (*pgbenchScript, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	script := &pgbenchScript{name: strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))}
+
+	var sql strings.Builder
+	var meta string
+	lineNo := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if meta != "" || (sql.Len() == 0 && strings.HasPrefix(trimmed, `\`)) {
+			meta += trimmed
+			if strings.HasSuffix(meta, `\`) {
+				meta = strings.TrimSuffix(meta, `\`) + " "
+				continue
+			}
+			cmd, err := parseMetaCommand(meta)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			script.commands = append(script.commands, cmd)
+			meta = ""
+			continue
+		}
+
+		if sql.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		sql.WriteString(line)
+		sql.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			script.commands = append(script.commands, scriptCommand{sql: trimStatement(sql.String())})
+			sql.Reset()
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(sql.String()) != "" {
+		script.commands = append(script.commands, scriptCommand{sql: trimStatement(sql.String())})
+	}
+	if len(script.commands) == 0 {
+		return nil, fmt.Errorf("script has no commands")
+	}
+
+	return script, nil
+}
+
+func parseMetaCommand(line string) (scriptCommand, error) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case `\set`:
+		if len(fields) < 3 {
+			return scriptCommand{}, fmt.Errorf(`\set requires a variable and an expression`)
+		}
+		expr, err := parseScriptExpr(strings.Join(fields[2:], " "))
+		if err != nil {
+			return scriptCommand{}, fmt.Errorf(`\set %s: %w`, fields[1], err)
+		}
+		return scriptCommand{set: fields[1], expr: expr}, nil
+
+	case `\sleep`:
+		if len(fields) < 2 || len(fields) > 3 {
+			return scriptCommand{}, fmt.Errorf(`\sleep requires a duration and optional unit`)
+		}
+		expr, err := parseScriptExpr(fields[1])
+		if err != nil {
+			return scriptCommand{}, fmt.Errorf(`\sleep: %w`, err)
+		}
+		cmd := scriptCommand{sleep: expr, sleepUnit: time.Second}
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "us":
+				cmd.sleepUnit = time.Microsecond
+			case "ms":
+				cmd.sleepUnit = time.Millisecond
+			case "s":
+			default:
+				return scriptCommand{}, fmt.Errorf(`unknown \sleep unit %q`, fields[2])
+			}
+		}
+		return cmd, nil
+	}
+	return scriptCommand{}, fmt.Errorf("unsupported meta command %s", fields[0])
+}
+
+func trimStatement(sql string) string {
+	return strings.TrimRight(strings.TrimSpace(sql), ";")
+}
+
+// substituteVariables replaces references to the run's variables with
+// their values, as pgbench does in its default simple query mode. Other
+// :names, such as in ::casts, are left alone.
+func (r *scriptRun) substituteVariables(sql string) string {
+	return scriptVariable.ReplaceAllStringFunc(sql, func(m string) string {
+		sub := scriptVariable.FindStringSubmatch(m)
+		v, ok := r.vars[sub[2]]
+		if !ok {
+			return m
+		}
+		// Parenthesised so that e.g. "1-:x" can't become a comment
+		if toFloat(v) < 0 {
+			return fmt.Sprintf("%s(%v)", sub[1], v)
+		}
+		return fmt.Sprintf("%s%v", sub[1], v)
+	})
+}
+
+// newRun evaluates the script's \set and \sleep commands in order
+func (s *pgbenchScript) newRun(rng *rand.Rand) (*scriptRun, error) {
+	run := &scriptRun{
+		script: s,
+		vars:   make(map[string]scriptValue),
+		sleeps: make(map[int]time.Duration),
+		sql:    make(map[int]string),
+	}
+	for k, v := range pgbenchBuiltins {
+		run.vars[k] = v
+	}
+	for i, cmd := range s.commands {
+		switch {
+		case cmd.set != "":
+			v, err := cmd.expr.eval(run.vars, rng)
+			if err != nil {
+				return nil, fmt.Errorf(`\set %s: %w`, cmd.set, err)
+			}
+			run.vars[cmd.set] = v
+		case cmd.sleep != nil:
+			v, err := cmd.sleep.eval(run.vars, rng)
+			if err != nil {
+				return nil, fmt.Errorf(`\sleep: %w`, err)
+			}
+			run.sleeps[i] = time.Duration(toFloat(v) * float64(cmd.sleepUnit))
+		case cmd.sql != "":
+			run.sql[i] = run.substituteVariables(cmd.sql)
+		}
+	}
+	return run, nil
+}
+
+// generateScriptRuns sends transactions runs of script to out as tasks, in
+// batches like parsed input, then closes out
+func generateScriptRuns(script *pgbenchScript, transactions int, seed int64, out chan<- []parsedRecord) {
+	rng := newRand(seed, "pgbench")
+	var batch []parsedRecord
+	for i := 1; i <= transactions; i++ {
+		rec := parsedRecord{row: i}
+		run, err := script.newRun(rng)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed evaluating script %s: %s\n", script.name, err.Error())
+		}
+		rec.task = task{hostname: run.hostname(), script: run}
+		if rec.task.hostname == "" {
+			// Spread runs without a hostname across workers
+			rec.task.hostname = strconv.Itoa(i)
+		}
+		batch = append(batch, rec)
+		if len(batch) == pipelineBatchSize {
+			out <- batch
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		out <- batch
+	}
+	close(out)
+}
+
+// hostname returns the run's hostname or host variable, which routes runs
+// to workers like input rows
+func (r *scriptRun) hostname() string {
+	for _, name := range []string{"hostname", "host"} {
+		if v, ok := r.vars[name]; ok {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// runScript executes a script's statements in order on conn, reading every
+// result, and returns the total number of rows. Time spent in \sleep is
+// included, as in pgbench. A transaction left open by a failed statement is
+// rolled back.
+func runScript(ctx context.Context, conn *pgxpool.Conn, run *scriptRun) (int64, error) {
+	var n int64
+	for i, cmd := range run.script.commands {
+		if cmd.sleep != nil {
+			time.Sleep(run.sleeps[i])
+			continue
+		}
+		if cmd.sql == "" {
+			continue
+		}
+
+		rows, err := conn.Query(ctx, run.sql[i])
+		if err == nil {
+			for rows.Next() {
+				n++
+			}
+			rows.Close()
+			err = rows.Err()
+		}
+		if err != nil {
+			if conn.Conn().PgConn().TxStatus() != 'I' {
+				if _, rbErr := conn.Exec(ctx, "ROLLBACK"); rbErr != nil {
+					log.Printf("[WARN] Failed to roll back after script error: %s\n", rbErr.Error())
+				}
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// scriptExpr is a parsed pgbench expression
+type scriptExpr interface {
+	eval(vars map[string]scriptValue, rng *rand.Rand) (scriptValue, error)
+}
+
+type exprConst struct{ v scriptValue }
+type exprVar struct{ name string }
+type exprNeg struct{ x scriptExpr }
+type exprBinary struct {
+	op   byte
+	l, r scriptExpr
+}
+type exprCall struct {
+	fn   string
+	args []scriptExpr
+}
+
+func (e exprConst) eval(map[string]scriptValue, *rand.Rand) (scriptValue, error) {
+	return e.v, nil
+}
+
+func (e exprVar) eval(vars map[string]scriptValue, _ *rand.Rand) (scriptValue, error) {
+	v, ok := vars[e.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable :%s", e.name)
+	}
+	return v, nil
+}
+
+func (e exprNeg) eval(vars map[string]scriptValue, rng *rand.Rand) (scriptValue, error) {
+	v, err := e.x.eval(vars, rng)
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := v.(int64); ok {
+		return -i, nil
+	}
+	return -toFloat(v), nil
+}
+
+func (e exprBinary) eval(vars map[string]scriptValue, rng *rand.Rand) (scriptValue, error) {
+	l, err := e.l.eval(vars, rng)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.r.eval(vars, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	li, lInt := l.(int64)
+	ri, rInt := r.(int64)
+	if lInt && rInt {
+		switch e.op {
+		case '+':
+			return li + ri, nil
+		case '-':
+			return li - ri, nil
+		case '*':
+			return li * ri, nil
+		case '/', '%':
+			if ri == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if e.op == '/' {
+				return li / ri, nil
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, rf := toFloat(l), toFloat(r)
+	switch e.op {
+	case '+':
+		return lf + rf, nil
+	case '-':
+		return lf - rf, nil
+	case '*':
+		return lf * rf, nil
+	case '/':
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	}
+	return nil, fmt.Errorf("%% requires integer operands")
+}
+
+func (e exprCall) eval(vars map[string]scriptValue, rng *rand.Rand) (scriptValue, error) {
+	args := make([]scriptValue, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(vars, rng)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch e.fn {
+	case "random":
+		lo, hi := toInt(args[0]), toInt(args[1])
+		if hi < lo {
+			return nil, fmt.Errorf("random: empty range %d..%d", lo, hi)
+		}
+		return lo + rng.Int63n(hi-lo+1), nil
+	case "abs":
+		if i, ok := args[0].(int64); ok {
+			if i < 0 {
+				return -i, nil
+			}
+			return i, nil
+		}
+		return math.Abs(toFloat(args[0])), nil
+	case "least", "greatest":
+		best := args[0]
+		for _, a := range args[1:] {
+			if e.fn == "least" && toFloat(a) < toFloat(best) || e.fn == "greatest" && toFloat(a) > toFloat(best) {
+				best = a
+			}
+		}
+		return best, nil
+	case "int":
+		return toInt(args[0]), nil
+	case "double":
+		return toFloat(args[0]), nil
+	case "sqrt":
+		return math.Sqrt(toFloat(args[0])), nil
+	}
+	return nil, fmt.Errorf("unsupported function %s", e.fn)
+}
+
+// Number of arguments taken by each supported function; -1 is variadic
+var scriptFunctions = map[string]int{
+	"random": 2, "abs": 1, "least": -1, "greatest": -1, "int": 1, "double": 1, "sqrt": 1,
+}
+
+func toFloat(v scriptValue) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
+
+func toInt(v scriptValue) int64 {
+	if f, ok := v.(float64); ok {
+		return int64(f)
+	}
+	return v.(int64)
+}
+
+// exprParser is a recursive descent parser for pgbench's arithmetic
+// expressions: numbers, :variables, + - * / %, parentheses and a subset of
+// its functions
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func parseScriptExpr(s string) (scriptExpr, error) {
+	p := &exprParser{s: s}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) sum() (scriptExpr, error) {
+	l, err := p.product()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.s[p.pos]
+		p.pos++
+		var r scriptExpr
+		r, err = p.product()
+		l = exprBinary{op: op, l: l, r: r}
+	}
+	return l, err
+}
+
+func (p *exprParser) product() (scriptExpr, error) {
+	l, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/' || p.peek() == '%') {
+		op := p.s[p.pos]
+		p.pos++
+		var r scriptExpr
+		r, err = p.unary()
+		l = exprBinary{op: op, l: l, r: r}
+	}
+	return l, err
+}
+
+func (p *exprParser) unary() (scriptExpr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		return exprNeg{x}, err
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (scriptExpr, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+
+	case c == ':':
+		p.pos++
+		name := p.ident()
+		if name == "" {
+			return nil, fmt.Errorf("missing variable name after :")
+		}
+		return exprVar{name}, nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.' ||
+			p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+			p.pos++
+		}
+		lit := p.s[start:p.pos]
+		if i, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return exprConst{i}, nil
+		}
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", lit)
+		}
+		return exprConst{f}, nil
+
+	case unicode.IsLetter(rune(c)):
+		fn := strings.ToLower(p.ident())
+		arity, ok := scriptFunctions[fn]
+		if !ok {
+			return nil, fmt.Errorf("unsupported function %s", fn)
+		}
+		if p.peek() != '(' {
+			return nil, fmt.Errorf("missing ( after %s", fn)
+		}
+		p.pos++
+		var args []scriptExpr
+		for p.peek() != ')' {
+			a, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+			if p.peek() == ',' {
+				p.pos++
+			} else if p.peek() != ')' {
+				return nil, fmt.Errorf("expected , or ) in arguments to %s", fn)
+			}
+		}
+		p.pos++
+		if (arity >= 0 && len(args) != arity) || len(args) == 0 {
+			return nil, fmt.Errorf("wrong number of arguments to %s", fn)
+		}
+		return exprCall{fn: fn, args: args}, nil
+	}
+
+	if c == 0 {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", c)
+}
+
+func (p *exprParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] == '_' || unicode.IsLetter(rune(p.s[p.pos])) || unicode.IsDigit(rune(p.s[p.pos]))) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
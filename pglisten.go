@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// channelSource consumes tasks from NOTIFY payloads on a PostgreSQL channel,
+// each one NDJSON task, so triggers or jobs in the database itself can drive
+// the benchmark's traffic. It holds its own connection, as LISTEN belongs to
+// a session and the pool's connections come and go.
+type channelSource struct {
+	conn   *pgx.Conn
+	cancel context.CancelFunc
+	r      *io.PipeReader
+	done   chan struct{}
+	closed sync.Once
+}
+
+func startChannelSource(dbUrl string, channel string) (*channelSource, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := pgx.Connect(ctx, dbUrl)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		cancel()
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	c := &channelSource{conn: conn, cancel: cancel, r: r, done: make(chan struct{})}
+	go c.receive(ctx, w)
+	log.Printf("[INFO] Listening for tasks on channel %s\n", channel)
+	return c, nil
+}
+
+// receive writes each payload to w as one line, until the context is
+// cancelled or the connection fails, either of which ends the input
+func (c *channelSource) receive(ctx context.Context, w *io.PipeWriter) {
+	defer close(c.done)
+	defer w.Close()
+	for {
+		n, err := c.conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[ERROR] Stopped listening for tasks: %s\n", err.Error())
+			}
+			return
+		}
+		// Newlines are only valid JSON between tokens, where a space will do
+		payload := strings.ReplaceAll(n.Payload, "\n", " ")
+		if _, err := io.WriteString(w, payload+"\n"); err != nil {
+			return
+		}
+	}
+}
+
+func (c *channelSource) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// close stops listening. Notifications sent after this are lost, as
+// PostgreSQL only queues them for listening sessions. It may be called from
+// a signal handler as well as at the end of the run.
+func (c *channelSource) close() {
+	c.closed.Do(func() {
+		c.cancel()
+		c.r.Close()
+		<-c.done
+		c.conn.Close(context.Background())
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type statementStats struct {
+	query          string
+	calls          int64
+	totalTime      float64 // milliseconds
+	sharedBlksHit  int64
+	sharedBlksRead int64
+}
+
+type databaseStats struct {
+	xactCommit   int64
+	xactRollback int64
+	blksRead     int64
+	blksHit      int64
+	tupReturned  int64
+	tupFetched   int64
+}
+
+type serverSnapshot struct {
+	// Keyed by pg_stat_statements queryid
+	statements map[string]statementStats
+	database   databaseStats
+}
+
+// unqualifiedRelation returns the name of relation without its schema, as
+// statements may refer to it either way
+func unqualifiedRelation(relation string) string {
+	return relation[strings.LastIndex(relation, ".")+1:]
+}
+
+// takeServerSnapshot records the current contents of pg_stat_statements
+// (for statements touching the benchmark relation) and pg_stat_database
+// (for the current database).
+func takeServerSnapshot(ctx context.Context, q querier, relation string) (*serverSnapshot, error) {
+	var versionNum int
+	err := q.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum)
+	if err != nil {
+		return nil, fmt.Errorf("reading server version: %w", err)
+	}
+
+	// PostgreSQL 13 renamed total_time to total_exec_time
+	totalTimeColumn := "total_exec_time"
+	if versionNum < 130000 {
+		totalTimeColumn = "total_time"
+	}
+
+	snap := &serverSnapshot{
+		statements: make(map[string]statementStats),
+	}
+
+	rows, err := q.Query(ctx, fmt.Sprintf(
+		`SELECT queryid::text, query, calls, %s, shared_blks_hit, shared_blks_read
+		FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		AND queryid IS NOT NULL
+		AND query ILIKE '%%' || $1 || '%%'
+		AND query NOT ILIKE '%%pg_stat_statements%%'`, totalTimeColumn), unqualifiedRelation(relation))
+	if err != nil {
+		return nil, fmt.Errorf("querying pg_stat_statements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var s statementStats
+		if err := rows.Scan(&id, &s.query, &s.calls, &s.totalTime, &s.sharedBlksHit, &s.sharedBlksRead); err != nil {
+			return nil, fmt.Errorf("scanning pg_stat_statements: %w", err)
+		}
+		snap.statements[id] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading pg_stat_statements: %w", err)
+	}
+
+	d := &snap.database
+	err = q.QueryRow(ctx,
+		`SELECT xact_commit, xact_rollback, blks_read, blks_hit, tup_returned, tup_fetched
+		FROM pg_stat_database
+		WHERE datname = current_database()`).Scan(
+		&d.xactCommit, &d.xactRollback, &d.blksRead, &d.blksHit, &d.tupReturned, &d.tupFetched)
+	if err != nil {
+		return nil, fmt.Errorf("querying pg_stat_database: %w", err)
+	}
+
+	return snap, nil
+}
+
+// serverStatsDelta holds the change in server statistics over a run
+type serverStatsDelta struct {
+	statements []statementDelta
+	database   databaseStats
+}
+
+type statementDelta struct {
+	queryID string
+	statementStats
+}
+
+func (d statementDelta) meanTime() float64 {
+	return d.totalTime / float64(d.calls)
+}
+
+// diffServerSnapshots returns the deltas between two snapshots, for
+// statements which were called during the run
+func diffServerSnapshots(before, after *serverSnapshot) serverStatsDelta {
+	var delta serverStatsDelta
+
+	for id, a := range after.statements {
+		b := before.statements[id]
+		if a.calls <= b.calls {
+			continue
+		}
+		delta.statements = append(delta.statements, statementDelta{
+			queryID: id,
+			statementStats: statementStats{
+				query:          strings.Join(strings.Fields(a.query), " "),
+				calls:          a.calls - b.calls,
+				totalTime:      a.totalTime - b.totalTime,
+				sharedBlksHit:  a.sharedBlksHit - b.sharedBlksHit,
+				sharedBlksRead: a.sharedBlksRead - b.sharedBlksRead,
+			},
+		})
+	}
+	sort.Slice(delta.statements, func(i, j int) bool {
+		return delta.statements[i].queryID < delta.statements[j].queryID
+	})
+
+	a := after.database
+	b := before.database
+	delta.database = databaseStats{
+		xactCommit:   a.xactCommit - b.xactCommit,
+		xactRollback: a.xactRollback - b.xactRollback,
+		blksRead:     a.blksRead - b.blksRead,
+		blksHit:      a.blksHit - b.blksHit,
+		tupReturned:  a.tupReturned - b.tupReturned,
+		tupFetched:   a.tupFetched - b.tupFetched,
+	}
+
+	return delta
+}
+
+func printServerStatsDiff(delta serverStatsDelta) {
+	fmt.Printf("\n## pg_stat_statements\n")
+	if len(delta.statements) == 0 {
+		fmt.Printf("No benchmark statements recorded\n")
+	}
+	for _, st := range delta.statements {
+		fmt.Printf("Query %s: %s\n", st.queryID, st.query)
+		fmt.Printf("  Calls:             %d\n", st.calls)
+		fmt.Printf("  Total exec time:   %.3fms\n", st.totalTime)
+		fmt.Printf("  Mean exec time:    %.3fms\n", st.meanTime())
+		fmt.Printf("  Shared blks hit:   %d\n", st.sharedBlksHit)
+		fmt.Printf("  Shared blks read:  %d\n", st.sharedBlksRead)
+	}
+
+	d := delta.database
+	fmt.Printf("\n## pg_stat_database\n")
+	fmt.Printf("Transactions committed:   %d\n", d.xactCommit)
+	fmt.Printf("Transactions rolled back: %d\n", d.xactRollback)
+	fmt.Printf("Blocks hit:               %d\n", d.blksHit)
+	fmt.Printf("Blocks read:              %d\n", d.blksRead)
+	fmt.Printf("Tuples returned:          %d\n", d.tupReturned)
+	fmt.Printf("Tuples fetched:           %d\n", d.tupFetched)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"log"
+	"sync"
+)
+
+// Records are passed between pipeline stages in batches to keep channel
+// overhead per record low. Under -stream every record is passed on as soon
+// as it's read.
+const pipelineBatchSize = 256
+
+// parsedRecord is the outcome of reading and validating one input row
+type parsedRecord struct {
+	row  int
+	task task
+	err  error
+
+	// The fields of a rejected record, for -rejects
+	fields []string
+
+	// Set when the record is repeated by -until-stable
+	looped bool
+
+	// Set on the first record of each pass repeated by -until-stable
+	passStart bool
+}
+
+type recordBatch struct {
+	seq     int
+	records []parsedRecord
+	raw     [][]string
+}
+
+// recordSource yields input records as fields. Errors for individual
+// malformed records are *csv.ParseError or *rowError; any other error is
+// fatal.
+type recordSource interface {
+	Read() ([]string, error)
+}
+
+// isRecordError reports whether err affects only the record just read
+func isRecordError(err error) bool {
+	switch err.(type) {
+	case *csv.ParseError, *rowError:
+		return true
+	}
+	return false
+}
+
+// newRecordSource reads records of the given format from f, skipping any
+// header and byte order mark, and returns the row number of the first record
+func newRecordSource(f io.Reader, format inputFormat) (recordSource, int, error) {
+	f = decodeInput(f, format.charset)
+	if format.encoding == inputFormatNDJSON {
+		return newNDJSONSource(f, format.cols), 1, nil
+	}
+	cr := csv.NewReader(f)
+	cr.Comma = format.csv.delimiter
+	cr.LazyQuotes = format.csv.lazyQuotes
+	cr.TrimLeadingSpace = format.csv.trimLeadingSpace
+	cr.Comment = format.csv.comment
+	// Otherwise field counts are checked per record by parseRecord
+	cr.FieldsPerRecord = -1
+	if format.csv.strictFields {
+		cr.FieldsPerRecord = 0
+	}
+
+	// Skip header
+	if _, err := cr.Read(); err != nil {
+		return nil, 0, err
+	}
+	return cr, 2, nil
+}
+
+// parseInput reads records from f and validates them on parsers goroutines,
+// so that timestamp parsing doesn't limit the dispatch rate. Batches of up to
+// batchSize records are sent to out in input order, and out is closed at the
+// end of the input. Reads go through a large buffer so that very large files
+// are read in few syscalls.
+func parseInput(f io.Reader, format inputFormat, parsers int, batchSize int, out chan<- []parsedRecord) {
+	src, firstRow, err := newRecordSource(bufio.NewReaderSize(f, inputBufferSize), format)
+	if err != nil {
+		log.Fatalf("[ERROR] Error when reading CSV header: %s\n", err.Error())
+	}
+
+	read := make(chan recordBatch, parsers*2)
+	parsed := make(chan recordBatch, parsers*2)
+
+	// Reader: tokenises the input, which must happen sequentially
+	go func() {
+		batch := recordBatch{}
+		flush := func() {
+			if len(batch.records) > 0 {
+				read <- batch
+			}
+			batch = recordBatch{seq: batch.seq + 1}
+		}
+
+		for row := firstRow; ; row++ {
+			record, err := src.Read()
+			if err == io.EOF {
+				log.Print("[INFO] Reached end of file\n")
+				break
+			}
+			if err != nil && !isRecordError(err) {
+				log.Fatalf("[ERROR] Failed reading input: %s", err.Error())
+			}
+			batch.records = append(batch.records, parsedRecord{row: row, err: err})
+			batch.raw = append(batch.raw, record)
+			if len(batch.records) == batchSize {
+				flush()
+			}
+		}
+		flush()
+		close(read)
+	}()
+
+	// Parsers: validate records and parse timestamps concurrently
+	var wg sync.WaitGroup
+	for p := 0; p < parsers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range read {
+				for i := range batch.records {
+					r := &batch.records[i]
+					if r.err == nil {
+						r.task, r.err = format.parseRecord(batch.raw[i])
+					}
+					if r.err != nil {
+						r.fields = batch.raw[i]
+					}
+				}
+				batch.raw = nil
+				parsed <- batch
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	// Restore input order, which per-host dispatch ordering depends on
+	pending := make(map[int][]parsedRecord)
+	next := 0
+	for batch := range parsed {
+		pending[batch.seq] = batch.records
+		for {
+			records, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			out <- records
+			next++
+		}
+	}
+	close(out)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Maximum number of distinct plan shapes listed in the report
+const maxReportedShapes = 5
+
+// Plan nodes whose row estimate is off from the actual rows by at least this
+// factor, in either direction, are flagged as misestimated
+const misestimateFactor = 10
+
+// Maximum number of misestimated plan nodes listed in the report
+const maxReportedMisestimates = 5
+
+// TimescaleDB names chunk tables _hyper_<hypertable id>_<chunk id>_chunk
+var chunkRelation = regexp.MustCompile(`^_hyper_\d+_\d+_chunk$`)
+
+// planNode mirrors the parts of EXPLAIN (FORMAT JSON) output that are
+// summarised in the report
+type planNode struct {
+	NodeType           string     `json:"Node Type"`
+	CustomPlanProvider string     `json:"Custom Plan Provider"`
+	RelationName       string     `json:"Relation Name"`
+	ActualLoops        int        `json:"Actual Loops"`
+	PlanRows           float64    `json:"Plan Rows"`
+	ActualRows         float64    `json:"Actual Rows"`
+	WorkersPlanned     int        `json:"Workers Planned"`
+	WorkersLaunched    int        `json:"Workers Launched"`
+	Plans              []planNode `json:"Plans"`
+
+	// Reported by TimescaleDB's ChunkAppend node
+	ChunksExcludedStartup int `json:"Chunks excluded during startup"`
+	ChunksExcludedRuntime int `json:"Chunks excluded during runtime"`
+
+	// Reported with BUFFERS, including the node's children
+	SharedHitBlocks  int64 `json:"Shared Hit Blocks"`
+	SharedReadBlocks int64 `json:"Shared Read Blocks"`
+}
+
+type explainOutput struct {
+	Plan          planNode `json:"Plan"`
+	PlanningTime  float64  `json:"Planning Time"`
+	ExecutionTime float64  `json:"Execution Time"`
+}
+
+// planSummary describes one sampled query plan
+type planSummary struct {
+	shape string
+	scans map[string]int // node type -> count, for scan nodes
+
+	// Chunk scans in the plan, and those actually executed
+	chunksPlanned int
+	chunksScanned int
+
+	// Chunks removed by ChunkAppend when the executor started, and those
+	// skipped while running (e.g. for parameterised lookups)
+	chunksExcludedStartup int
+	chunksExcludedRuntime int
+
+	workersPlanned  int
+	workersLaunched int
+	planningTime    float64 // milliseconds
+	executionTime   float64 // milliseconds
+
+	// Shared buffer blocks found in the cache and read from disk (or the OS
+	// page cache) while executing
+	sharedHit  int64
+	sharedRead int64
+
+	// The executed node whose row estimate was furthest from its actual rows
+	worstEstimate rowEstimate
+}
+
+// rowEstimate compares a plan node's estimated rows with the rows it
+// actually returned, per loop
+type rowEstimate struct {
+	node      string
+	estimated float64
+	actual    float64
+}
+
+// factor is how many times the estimate was too high or too low; at least
+// 1, with both counts rounded up to one row
+func (e rowEstimate) factor() float64 {
+	est, act := math.Max(e.estimated, 1), math.Max(e.actual, 1)
+	if est > act {
+		return est / act
+	}
+	return act / est
+}
+
+// explainQuery runs EXPLAIN ANALYZE for sql. This executes the query again,
+// so it must happen outside the measured section, and its buffer counts
+// reflect the cache as the measured run left it.
+func explainQuery(ctx context.Context, q querier, sql string, args ...interface{}) (*planSummary, error) {
+	var raw []byte
+	err := q.QueryRow(ctx, "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "+sql, args...).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []explainOutput
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("parsing plan: %w", err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty plan")
+	}
+
+	p := &planSummary{
+		scans:         make(map[string]int),
+		planningTime:  out[0].PlanningTime,
+		executionTime: out[0].ExecutionTime,
+		sharedHit:     out[0].Plan.SharedHitBlocks,
+		sharedRead:    out[0].Plan.SharedReadBlocks,
+	}
+	p.shape = p.walk(out[0].Plan)
+
+	return p, nil
+}
+
+// explainTask re-runs q with EXPLAIN ANALYZE on a connection of its own
+// from the target's pool
+func explainTask(ctx context.Context, q task) (*planSummary, error) {
+	conn, err := q.target.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return explainQuery(ctx, conn, q.target.query(q.variant), q.args()...)
+}
+
+// walk accumulates statistics for node and its children, and returns the
+// shape of the subtree. Identical sibling subtrees (typically one scan per
+// chunk) are collapsed so plans over different numbers of chunks share a shape.
+func (p *planSummary) walk(node planNode) string {
+	if strings.Contains(node.NodeType, "Scan") && node.RelationName != "" {
+		p.scans[node.NodeType]++
+		if chunkRelation.MatchString(node.RelationName) {
+			p.chunksPlanned++
+			if node.ActualLoops > 0 {
+				p.chunksScanned++
+			}
+		}
+	}
+	if node.ActualLoops > 0 {
+		e := rowEstimate{node: estimateLabel(node), estimated: node.PlanRows, actual: node.ActualRows}
+		if e.factor() > p.worstEstimate.factor() {
+			p.worstEstimate = e
+		}
+	}
+	p.workersPlanned += node.WorkersPlanned
+	p.workersLaunched += node.WorkersLaunched
+	p.chunksExcludedStartup += node.ChunksExcludedStartup
+	p.chunksExcludedRuntime += node.ChunksExcludedRuntime
+
+	name := node.NodeType
+	if node.CustomPlanProvider != "" {
+		name += " (" + node.CustomPlanProvider + ")"
+	}
+
+	if len(node.Plans) == 0 {
+		return name
+	}
+
+	var children []string
+	var counts []int
+	for _, child := range node.Plans {
+		s := p.walk(child)
+		if n := len(children); n > 0 && children[n-1] == s {
+			counts[n-1]++
+			continue
+		}
+		children = append(children, s)
+		counts = append(counts, 1)
+	}
+	for i, c := range counts {
+		if c > 1 {
+			children[i] = "N x " + children[i]
+		}
+	}
+
+	return name + " -> (" + strings.Join(children, ", ") + ")"
+}
+
+// estimateLabel names a plan node for reporting misestimates, treating all
+// chunks alike so their misestimates are grouped
+func estimateLabel(node planNode) string {
+	switch {
+	case chunkRelation.MatchString(node.RelationName):
+		return node.NodeType + " on chunks"
+	case node.RelationName != "":
+		return node.NodeType + " on " + node.RelationName
+	}
+	return node.NodeType
+}
+
+// planAggregate summarises all sampled plans
+type planAggregate struct {
+	samples  int
+	failures int
+	shapes   map[string]int
+	scans    map[string]int
+
+	// Number of chunks in the hypertable when the run started; 0 if unknown
+	totalChunks int
+
+	// Per sampled plan
+	chunksPlanExcluded    []int64
+	chunksStartupExcluded []int64
+	chunksRuntimeExcluded []int64
+	chunksScanned         []int64
+
+	workersPlanned  int
+	workersLaunched int
+	planningTime    float64
+
+	// Shared buffer blocks hit and read in total, and read per sampled plan
+	sharedHit  int64
+	sharedRead int64
+	blocksRead []int64
+
+	// Plans with a node misestimated by misestimateFactor or more, and the
+	// worst misestimate and number of such plans per node label
+	misestimated   int
+	worstEstimates map[string]rowEstimate
+	estimateCounts map[string]int
+}
+
+func newPlanAggregate(totalChunks int) *planAggregate {
+	return &planAggregate{
+		shapes:         make(map[string]int),
+		scans:          make(map[string]int),
+		totalChunks:    totalChunks,
+		worstEstimates: make(map[string]rowEstimate),
+		estimateCounts: make(map[string]int),
+	}
+}
+
+// countChunks returns the number of chunks in the hypertable relation
+func countChunks(ctx context.Context, q querier, relation string) (int, error) {
+	var n int
+	err := q.QueryRow(ctx, "SELECT count(*) FROM show_chunks($1::regclass)", quoteRelation(relation)).Scan(&n)
+	return n, err
+}
+
+// isHypertable reports whether relation is a hypertable, rather than, say, a
+// continuous aggregate or a plain table
+func isHypertable(ctx context.Context, q querier, relation string) (bool, error) {
+	var hypertable bool
+	err := q.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables
+		WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass)`,
+		quoteRelation(relation)).Scan(&hypertable)
+	return hypertable, err
+}
+
+func (a *planAggregate) add(p *planSummary) {
+	a.samples++
+	a.shapes[p.shape]++
+	for t, n := range p.scans {
+		a.scans[t] += n
+	}
+	a.chunksScanned = append(a.chunksScanned, int64(p.chunksScanned))
+	a.chunksStartupExcluded = append(a.chunksStartupExcluded, int64(p.chunksExcludedStartup))
+	a.chunksRuntimeExcluded = append(a.chunksRuntimeExcluded, int64(p.chunksExcludedRuntime))
+	if a.totalChunks > 0 {
+		// Chunks never mentioned in the plan were excluded by the planner
+		planExcluded := a.totalChunks - p.chunksPlanned - p.chunksExcludedStartup
+		if planExcluded < 0 {
+			planExcluded = 0
+		}
+		a.chunksPlanExcluded = append(a.chunksPlanExcluded, int64(planExcluded))
+	}
+	a.workersPlanned += p.workersPlanned
+	a.workersLaunched += p.workersLaunched
+	a.planningTime += p.planningTime
+	a.sharedHit += p.sharedHit
+	a.sharedRead += p.sharedRead
+	a.blocksRead = append(a.blocksRead, p.sharedRead)
+	if e := p.worstEstimate; e.factor() >= misestimateFactor {
+		a.misestimated++
+		a.estimateCounts[e.node]++
+		if e.factor() > a.worstEstimates[e.node].factor() {
+			a.worstEstimates[e.node] = e
+		}
+	}
+}
+
+// misestimates returns the worst misestimate of each node label, worst first
+func (a *planAggregate) misestimates() []rowEstimate {
+	out := make([]rowEstimate, 0, len(a.worstEstimates))
+	for _, e := range a.worstEstimates {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].factor() != out[j].factor() {
+			return out[i].factor() > out[j].factor()
+		}
+		return out[i].node < out[j].node
+	})
+	return out
+}
+
+// hitRatio is the fraction of shared buffer accesses served from the cache
+func (a *planAggregate) hitRatio() float64 {
+	total := a.sharedHit + a.sharedRead
+	if total == 0 {
+		return 0
+	}
+	return float64(a.sharedHit) / float64(total)
+}
+
+func printPlanAggregate(a *planAggregate) {
+	fmt.Printf("\n## Query plans (%d sampled", a.samples)
+	if a.failures > 0 {
+		fmt.Printf(", %d failed", a.failures)
+	}
+	fmt.Printf(")\n")
+	if a.samples == 0 {
+		return
+	}
+
+	fmt.Printf("Mean planning time: %.3fms\n", a.planningTime/float64(a.samples))
+	fmt.Printf("Parallel workers:  %d planned, %d launched\n", a.workersPlanned, a.workersLaunched)
+
+	fmt.Printf("Chunks per query:  %8s %8s %8s %10s\n", "min", "median", "max", "total")
+	printChunkCounts := func(label string, counts []int64) {
+		var total int64
+		for _, c := range counts {
+			total += c
+		}
+		s := stats.Summarise(counts)
+		fmt.Printf("  %-16s %8d %8d %8d %10d\n", label, s.Min, s.Median, s.Max, total)
+	}
+	if a.totalChunks > 0 {
+		printChunkCounts("plan excluded", a.chunksPlanExcluded)
+	}
+	printChunkCounts("startup excluded", a.chunksStartupExcluded)
+	printChunkCounts("runtime excluded", a.chunksRuntimeExcluded)
+	printChunkCounts("scanned", a.chunksScanned)
+	if a.totalChunks > 0 {
+		var scanned int64
+		for _, c := range a.chunksScanned {
+			scanned += c
+		}
+		fmt.Printf("Chunk exclusion:   %.2f%% of %d chunks\n",
+			100*(1-float64(scanned)/float64(a.totalChunks*a.samples)), a.totalChunks)
+	}
+
+	fmt.Printf("Shared buffers:    %d hit, %d read (%.2f%% hit ratio)\n", a.sharedHit, a.sharedRead, 100*a.hitRatio())
+	read := stats.Summarise(a.blocksRead)
+	fmt.Printf("Blocks read:       min %d, median %d, max %d per query\n", read.Min, read.Median, read.Max)
+
+	fmt.Printf("Row estimates:     %s off by %dx or more\n",
+		colorize(fmt.Sprintf("%d of %d plans", a.misestimated, a.samples), colorIf(a.misestimated > 0, false)), misestimateFactor)
+	for i, e := range a.misestimates() {
+		if i == maxReportedMisestimates {
+			fmt.Printf("  ... %d more\n", len(a.worstEstimates)-maxReportedMisestimates)
+			break
+		}
+		fmt.Printf("  %-30s %5d plans, worst %.0f estimated vs %.0f actual (%.0fx)\n",
+			e.node, a.estimateCounts[e.node], e.estimated, e.actual, e.factor())
+	}
+
+	scanTypes := make([]string, 0, len(a.scans))
+	for t := range a.scans {
+		scanTypes = append(scanTypes, t)
+	}
+	sort.Strings(scanTypes)
+	fmt.Printf("Scan nodes:\n")
+	for _, t := range scanTypes {
+		fmt.Printf("  %-20s %d\n", t+":", a.scans[t])
+	}
+
+	shapes := make([]string, 0, len(a.shapes))
+	for s := range a.shapes {
+		shapes = append(shapes, s)
+	}
+	sort.Slice(shapes, func(i, j int) bool {
+		if a.shapes[shapes[i]] != a.shapes[shapes[j]] {
+			return a.shapes[shapes[i]] > a.shapes[shapes[j]]
+		}
+		return shapes[i] < shapes[j]
+	})
+	fmt.Printf("Plan shapes (%d distinct):\n", len(shapes))
+	for i, s := range shapes {
+		if i == maxReportedShapes {
+			fmt.Printf("  ... %d more\n", len(shapes)-maxReportedShapes)
+			break
+		}
+		fmt.Printf("  %5.1f%%  %s\n", 100*float64(a.shapes[s])/float64(a.samples), s)
+	}
+}
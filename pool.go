@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// poolCounters are the cumulative pgxpool statistics for one target
+type poolCounters struct {
+	maxConns         int32
+	acquires         int64
+	emptyAcquires    int64
+	canceledAcquires int64
+	acquireDuration  time.Duration
+}
+
+// snapshotPools reads the current pool statistics of each target
+func snapshotPools(targets []*dbTarget) []poolCounters {
+	counters := make([]poolCounters, len(targets))
+	for i, t := range targets {
+		if t.pool == nil {
+			continue
+		}
+		s := t.pool.Stat()
+		counters[i] = poolCounters{
+			maxConns:         s.MaxConns(),
+			acquires:         s.AcquireCount(),
+			emptyAcquires:    s.EmptyAcquireCount(),
+			canceledAcquires: s.CanceledAcquireCount(),
+			acquireDuration:  s.AcquireDuration(),
+		}
+	}
+	return counters
+}
+
+// poolUsage is the change in a target's pool statistics over the run
+type poolUsage struct {
+	target string
+	poolCounters
+}
+
+// exhaustion is the fraction of acquisitions which found no idle connection
+// and had to wait for one to be released or established
+func (u poolUsage) exhaustion() float64 {
+	if u.acquires == 0 {
+		return 0
+	}
+	return float64(u.emptyAcquires) / float64(u.acquires)
+}
+
+func diffPools(targets []*dbTarget, before, after []poolCounters) []poolUsage {
+	usage := make([]poolUsage, len(targets))
+	for i, t := range targets {
+		a := after[i]
+		b := before[i]
+		usage[i] = poolUsage{
+			target: t.name,
+			poolCounters: poolCounters{
+				maxConns:         a.maxConns,
+				acquires:         a.acquires - b.acquires,
+				emptyAcquires:    a.emptyAcquires - b.emptyAcquires,
+				canceledAcquires: a.canceledAcquires - b.canceledAcquires,
+				acquireDuration:  a.acquireDuration - b.acquireDuration,
+			},
+		}
+	}
+	return usage
+}
+
+// printPoolReport prints the distribution of per-query acquisition waits (if
+// any were recorded) followed by each target's pool counters. Counters include
+// acquisitions made for EXPLAIN sampling and server statistics.
+func printPoolReport(waits *stats.Recorder, usage []poolUsage) {
+	fmt.Printf("\n## Connection pool\n")
+	if waits.Count() > 0 {
+		fmt.Printf("Acquisition waits (included in query times):\n")
+		stats.WriteSummary(os.Stdout, waits.Summary())
+		stats.WritePercentiles(os.Stdout, waits.Values())
+	}
+	for _, u := range usage {
+		fmt.Printf("Target %s:\n", u.target)
+		fmt.Printf("  Max connections:   %d\n", u.maxConns)
+		fmt.Printf("  Acquisitions:      %d\n", u.acquires)
+		fmt.Printf("  Pool exhausted:    %s\n", colorize(fmt.Sprintf("%d (%.2f%%)", u.emptyAcquires, 100*u.exhaustion()),
+			colorIf(u.exhaustion() > adviseExhaustion, false)))
+		fmt.Printf("  Canceled:          %d\n", u.canceledAcquires)
+		fmt.Printf("  Total wait:        %.3fms\n", float64(u.acquireDuration.Microseconds())/1000.0)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// readPrimingTasks reads the first n valid tasks from the input file,
+// skipping rejected records
+func readPrimingTasks(fileName string, format inputFormat, n int) ([]task, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	src, _, err := newRecordSource(f, format)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []task
+	for len(tasks) < n {
+		record, err := src.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !isRecordError(err) {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+		if t, err := format.parseRecord(record); err == nil {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+// priming describes the unmeasured work done before a run to bring caches
+// to a steady state
+type priming struct {
+	queries  int
+	failed   int
+	elapsed  time.Duration
+	prewarms map[string]int64
+}
+
+// Prime runs each of tasks with every variant against every target, spread
+// over the workers, without recording the results
+func (b *Benchmarker) Prime(tasks []task, p *priming) {
+	cfg := b.cfg.Dispatch
+	start := time.Now()
+
+	in := make(chan task)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range in {
+				_, err := runQuery(context.Background(), t.target.pool, t.target.query(t.variant), t.args()...)
+				mu.Lock()
+				p.queries++
+				if err != nil {
+					p.failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range tasks {
+		for _, target := range cfg.targets {
+			for _, v := range cfg.variants {
+				t.target, t.variant = target, v
+				in <- t
+			}
+		}
+	}
+	close(in)
+	wg.Wait()
+
+	p.elapsed += time.Since(start)
+	if p.failed > 0 {
+		log.Printf("[WARN] %d of %d priming queries failed\n", p.failed, p.queries)
+	}
+	log.Printf("[INFO] Primed caches with %d queries in %s\n", p.queries, p.elapsed.Round(time.Millisecond))
+}
+
+// Prewarm loads each target's relation into shared buffers with pg_prewarm,
+// chunk by chunk for hypertables, recording the blocks read per target
+func (b *Benchmarker) Prewarm(p *priming) error {
+	start := time.Now()
+	ctx := context.Background()
+	p.prewarms = make(map[string]int64)
+	for _, t := range b.targets {
+		if _, err := t.pool.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pg_prewarm"); err != nil {
+			return fmt.Errorf("%s: installing pg_prewarm: %w", t.name, err)
+		}
+		relation := t.relationName()
+
+		var blocks int64
+		err := t.pool.QueryRow(ctx,
+			"SELECT coalesce(sum(pg_prewarm(c)), 0)::bigint FROM show_chunks($1::regclass) AS c",
+			quoteRelation(relation)).Scan(&blocks)
+		if err != nil {
+			// Not a hypertable, or TimescaleDB isn't installed
+			err = t.pool.QueryRow(ctx, "SELECT pg_prewarm($1::regclass)", quoteRelation(relation)).Scan(&blocks)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: prewarming %s: %w", t.name, relation, err)
+		}
+		p.prewarms[t.name] = blocks
+		log.Printf("[INFO] Prewarmed %d blocks of %s on %s\n", blocks, relation, t.name)
+	}
+	p.elapsed += time.Since(start)
+	return nil
+}
+
+type primingStats struct {
+	Queries  int              `json:"queries,omitempty"`
+	Failed   int              `json:"failed,omitempty"`
+	Seconds  float64          `json:"seconds"`
+	Prewarms map[string]int64 `json:"prewarmed_blocks,omitempty"`
+}
+
+func newPrimingStats(p *priming) *primingStats {
+	if p.queries == 0 && p.prewarms == nil {
+		return nil
+	}
+	return &primingStats{
+		Queries:  p.queries,
+		Failed:   p.failed,
+		Seconds:  p.elapsed.Seconds(),
+		Prewarms: p.prewarms,
+	}
+}
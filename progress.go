@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// runProgress logs how far through its input a run has got, with an
+// estimated time to completion at the dispatch rate over the last interval.
+// The number of queries is known when the input generates a fixed number of
+// tasks, and otherwise estimated from the lines in a file, extrapolated from
+// those read so far.
+type runProgress struct {
+	file  *fileProgress
+	total int64
+
+	// Queries dispatched for each input task
+	perTask int
+
+	// As of the last report, for the dispatch rate over the interval
+	lastDispatched int64
+	lastTime       time.Time
+}
+
+// newRunProgress returns nil if neither file nor total is known, in which
+// case there is nothing to report progress against
+func newRunProgress(file *fileProgress, total int64, perTask int) *runProgress {
+	if file == nil && total <= 0 {
+		return nil
+	}
+	return &runProgress{file: file, total: total, perTask: perTask, lastTime: time.Now()}
+}
+
+// log logs progress given the number of queries dispatched so far
+func (p *runProgress) log(dispatched int64) {
+	now := time.Now()
+	rate := float64(dispatched-p.lastDispatched) / now.Sub(p.lastTime).Seconds()
+	p.lastDispatched, p.lastTime = dispatched, now
+
+	if p.file == nil {
+		log.Printf("[INFO] %d of %d queries dispatched (%.1f%%), %s\n",
+			dispatched, p.total, 100*float64(dispatched)/float64(p.total), formatETA(p.total-dispatched, rate))
+		return
+	}
+
+	read, readRate := p.file.sample()
+	total := p.file.estimatedLines() * int64(p.perTask)
+	log.Printf("[INFO] Input %.1f%% read (%.1f of %.1f MB, %.1f MB/s), %d of ~%d queries dispatched, %s\n",
+		100*float64(read)/float64(p.file.size), float64(read)/1e6, float64(p.file.size)/1e6, readRate/1e6,
+		dispatched, total, formatETA(total-dispatched, rate))
+}
+
+// formatETA estimates the time to dispatch the remaining queries at rate
+// per second
+func formatETA(remaining int64, rate float64) string {
+	if remaining <= 0 {
+		return "finishing"
+	}
+	if rate <= 0 {
+		return "ETA unknown"
+	}
+	eta := time.Duration(float64(remaining) / rate * float64(time.Second))
+	return fmt.Sprintf("ETA %s", eta.Round(time.Second))
+}
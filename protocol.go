@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Wire protocols the benchmark query can be sent with. The extended
+// protocol, pgx's default, prepares each statement once per connection and
+// binds parameters separately; the simple protocol sends the query with its
+// parameters interpolated, as through PgBouncer in transaction mode.
+const (
+	protocolSimple   = "simple"
+	protocolExtended = "extended"
+	protocolBoth     = "both"
+)
+
+// parseProtocols returns the protocols to run each task with for -protocol
+func parseProtocols(mode string) ([]string, error) {
+	switch mode {
+	case protocolSimple, protocolExtended:
+		return []string{mode}, nil
+	case protocolBoth:
+		return []string{protocolExtended, protocolSimple}, nil
+	}
+	return nil, fmt.Errorf("expected %s, %s or %s", protocolSimple, protocolExtended, protocolBoth)
+}
+
+// Formats the benchmark query's results can be requested in under the
+// extended protocol. By default pgx requests binary for the types it knows
+// and text for any others; the simple protocol always returns text.
+const (
+	resultFormatAuto   = "auto"
+	resultFormatText   = "text"
+	resultFormatBinary = "binary"
+	resultFormatBoth   = "both"
+)
+
+// parseResultFormats returns the result formats to run each task with for
+// -result-format
+func parseResultFormats(mode string) ([]string, error) {
+	switch mode {
+	case resultFormatAuto, resultFormatText, resultFormatBinary:
+		return []string{mode}, nil
+	case resultFormatBoth:
+		return []string{resultFormatBinary, resultFormatText}, nil
+	}
+	return nil, fmt.Errorf("expected %s, %s, %s or %s", resultFormatAuto, resultFormatText, resultFormatBinary, resultFormatBoth)
+}
+
+// optionQuerier passes pgx query options ahead of every query's arguments
+type optionQuerier struct {
+	q       querier
+	options []interface{}
+}
+
+func (o optionQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return o.q.Query(ctx, sql, append(o.options[:len(o.options):len(o.options)], args...)...)
+}
+
+func (o optionQuerier) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return o.q.QueryRow(ctx, sql, append(o.options[:len(o.options):len(o.options)], args...)...)
+}
+
+// withWireOptions returns q, sending queries over the given protocol and
+// requesting results in the given format
+func withWireOptions(q querier, protocol string, format string) querier {
+	var options []interface{}
+	if protocol == protocolSimple {
+		options = append(options, pgx.QuerySimpleProtocol(true))
+	}
+	// A single format code applies to every column
+	switch format {
+	case resultFormatText:
+		options = append(options, pgx.QueryResultFormats{pgx.TextFormatCode})
+	case resultFormatBinary:
+		options = append(options, pgx.QueryResultFormats{pgx.BinaryFormatCode})
+	}
+	if len(options) == 0 {
+		return q
+	}
+	return optionQuerier{q: q, options: options}
+}
+
+func newProtocolComparison(protocols []string, newRecorder recorderFactory) *comparison {
+	return newComparison("protocol", protocols, func(r benchResult) string {
+		return r.task.protocol
+	}, newRecorder)
+}
+
+// formatBreakdown compares latencies and result sizes between result formats
+type formatBreakdown struct {
+	latencies *comparison
+	bytes     map[string]int64
+}
+
+func newFormatBreakdown(formats []string, newRecorder recorderFactory) *formatBreakdown {
+	return &formatBreakdown{
+		latencies: newComparison("format", formats, func(r benchResult) string {
+			return r.task.resultFormat
+		}, newRecorder),
+		bytes: make(map[string]int64),
+	}
+}
+
+func (b *formatBreakdown) add(r benchResult) {
+	b.latencies.add(r)
+	if r.err == nil {
+		b.bytes[r.task.resultFormat] += r.resultBytes
+	}
+}
+
+// bytesPerQuery is the mean size of a successful query's result values in
+// the given format
+func (b *formatBreakdown) bytesPerQuery(format string) float64 {
+	n := b.latencies.times[format].Count()
+	if n == 0 {
+		return 0
+	}
+	return float64(b.bytes[format]) / float64(n)
+}
+
+func printFormatReport(b *formatBreakdown) {
+	printComparison("Result formats", b.latencies, false)
+
+	first := b.latencies.names[0]
+	fmt.Printf("%-20s %14s %10s\n", "format", "bytes/query", "vs first")
+	for _, name := range b.latencies.names {
+		per := b.bytesPerQuery(name)
+		vs := ""
+		if base := b.bytesPerQuery(first); name != first && base > 0 {
+			vs = fmt.Sprintf("%+.1f%%", 100*(per/base-1))
+		}
+		fmt.Printf("%-20s %14.1f %10s\n", name, per, vs)
+	}
+	fmt.Printf("(bytes of column values, excluding protocol framing)\n")
+}
+
+type formatStats struct {
+	comparisonStats
+	BytesPerQuery float64 `json:"bytes_per_query"`
+}
+
+func newFormatStats(b *formatBreakdown, trim float64) []formatStats {
+	var out []formatStats
+	for i, c := range newComparisonStats(b.latencies, nil, trim) {
+		out = append(out, formatStats{
+			comparisonStats: c,
+			BytesPerQuery:   b.bytesPerQuery(b.latencies.names[i]),
+		})
+	}
+	return out
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+)
+
+// quietWriter drops [INFO] log lines, passing warnings and errors through
+type quietWriter struct {
+	w io.Writer
+}
+
+// Write receives one complete log line per call. The level tag is the first
+// bracketed text, after the timestamp.
+func (q quietWriter) Write(p []byte) (int, error) {
+	if i := bytes.IndexByte(p, '['); i >= 0 && bytes.HasPrefix(p[i:], []byte("[INFO]")) {
+		return len(p), nil
+	}
+	return q.w.Write(p)
+}
+
+// silenceInfo stops [INFO] lines being logged for the rest of the process
+func silenceInfo() {
+	log.SetOutput(quietWriter{w: log.Writer()})
+}
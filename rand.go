@@ -0,0 +1,16 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// newRand returns a random source for one randomised component of the run.
+// Each component derives its own stream from the run seed, so adding or
+// reordering random draws in one component doesn't perturb the others, and
+// a run can be reproduced exactly by passing the reported -seed.
+func newRand(seed int64, component string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(component))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
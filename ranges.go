@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+var defaultRangeBounds = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// rangeBreakdown groups query times by the length of the requested time
+// range, since query cost scales with the amount of data scanned
+type rangeBreakdown struct {
+	// Upper bounds of each bucket; the final bucket is unbounded
+	bounds []time.Duration
+	times  []*stats.Recorder
+}
+
+func parseRangeBounds(spec string) ([]time.Duration, error) {
+	if spec == "" {
+		return defaultRangeBounds, nil
+	}
+
+	var bounds []time.Duration
+	for _, part := range strings.Split(spec, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("range bound %s must be positive", d)
+		}
+		bounds = append(bounds, d)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return bounds[i] < bounds[j]
+	})
+
+	return bounds, nil
+}
+
+func newRangeBreakdown(bounds []time.Duration, newRecorder recorderFactory) *rangeBreakdown {
+	b := &rangeBreakdown{
+		bounds: bounds,
+		times:  make([]*stats.Recorder, len(bounds)+1),
+	}
+	for i := range b.times {
+		b.times[i] = newRecorder(fmt.Sprintf("range-%d", i))
+	}
+	return b
+}
+
+func (b *rangeBreakdown) add(r benchResult) {
+	length := r.task.endTime.Sub(r.task.startTime)
+	i := sort.Search(len(b.bounds), func(i int) bool {
+		return length < b.bounds[i]
+	})
+	b.times[i].Add(r.queryTime)
+}
+
+func (b *rangeBreakdown) label(i int) string {
+	switch {
+	case i == 0:
+		return "< " + formatRangeBound(b.bounds[0])
+	case i == len(b.bounds):
+		return ">= " + formatRangeBound(b.bounds[i-1])
+	default:
+		return formatRangeBound(b.bounds[i-1]) + " - " + formatRangeBound(b.bounds[i])
+	}
+}
+
+// formatRangeBound trims the zero minutes and seconds from whole-hour durations
+func formatRangeBound(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// newVariantRangeBreakdowns returns a range breakdown for each variant
+func newVariantRangeBreakdowns(bounds []time.Duration, variants []queryVariant, newRecorder recorderFactory) map[string]*rangeBreakdown {
+	breakdowns := make(map[string]*rangeBreakdown)
+	for _, v := range variants {
+		name := v.name
+		breakdowns[name] = newRangeBreakdown(bounds, func(recorder string) *stats.Recorder {
+			return newRecorder(name + "-" + recorder)
+		})
+	}
+	return breakdowns
+}
+
+func printRangeBreakdown(suffix string, b *rangeBreakdown) {
+	fmt.Printf("\n## Query time by requested range length%s\n", suffix)
+	fmt.Printf("%-14s %8s %10s %10s %10s %10s\n", "range", "queries", "min (ms)", "median", "mean", "max")
+	for i, rec := range b.times {
+		if rec.Count() == 0 {
+			fmt.Printf("%-14s %8d\n", b.label(i), 0)
+			continue
+		}
+		s := rec.Summary()
+		fmt.Printf("%-14s %8d %10.3f %10.3f %10.3f %10.3f\n", b.label(i), s.Count,
+			float32(s.Min)/1000.0, float32(s.Median)/1000.0, s.Mean()/1000.0, float32(s.Max)/1000.0)
+	}
+}
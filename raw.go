@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var rawHeader = []string{"worker", "target", "variant", "hostname", "start_time", "end_time", "occurrence", "attempt", "query_time_us", "first_row_us", "rows", "error", "bucket", "params"}
+
+// Separates the values of -param-map parameters in the raw output
+const rawParamSeparator = "|"
+
+// Prefix of the raw output columns holding -label values
+const rawLabelPrefix = "label_"
+
+// rawWriter exports one CSV row per query attempt, including failures, so
+// individual measurements and failing parameters can be inspected later.
+// Run labels are repeated on every row, so files from several runs can be
+// concatenated and analysed together.
+// The file is only moved into place once closed. It may be closed from a
+// signal handler while results are being written.
+type rawWriter struct {
+	mu     sync.Mutex
+	f      *atomicFile
+	w      *csv.Writer
+	labels []string
+	closed bool
+}
+
+func newRawWriter(fileName string, labels labelFlags) (*rawWriter, error) {
+	f, err := createAtomic(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]string(nil), rawHeader...)
+	var values []string
+	for _, k := range labels.keys() {
+		header = append(header, rawLabelPrefix+k)
+		values = append(values, labels[k])
+	}
+
+	w := csv.NewWriter(f)
+	if err := w.Write(header); err != nil {
+		f.abort()
+		return nil, err
+	}
+	return &rawWriter{f: f, w: w, labels: values}, nil
+}
+
+func (rw *rawWriter) write(r benchResult) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return
+	}
+
+	var errText string
+	if r.err != nil {
+		errText = r.err.Error()
+	}
+	// Errors are surfaced by close via csv.Writer.Error
+	row := []string{
+		strconv.Itoa(r.worker),
+		r.task.target.name,
+		r.task.variant.name,
+		r.task.hostname,
+		r.task.start,
+		r.task.end,
+		strconv.Itoa(r.task.occurrence),
+		strconv.Itoa(r.attempt),
+		strconv.FormatInt(r.queryTime, 10),
+		strconv.FormatInt(r.firstRowTime, 10),
+		strconv.FormatInt(r.rows, 10),
+		errText,
+		r.task.bucket,
+		strings.Join(r.task.params, rawParamSeparator),
+	}
+	_ = rw.w.Write(append(row, rw.labels...))
+}
+
+func (rw *rawWriter) close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+
+	rw.w.Flush()
+	if err := rw.w.Error(); err != nil {
+		rw.f.abort()
+		return err
+	}
+	return rw.f.commit()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Flags whose values may hold a password or token, and how each is reduced
+// before being recorded in the report, manifest or results store
+var redactedFlags = map[string]func(string) string{
+	"compare-dsn": redactDSN,
+	"shadow-dsn":  redactDSN,
+	"endpoint":    redactEndpoint,
+	"notify-url":  redactURL,
+}
+
+// Matches the password in a keyword/value connection string
+var dsnPassword = regexp.MustCompile(`(?i)\s*\bpassword\s*=\s*('(\\.|[^'])*'|\S*)`)
+
+// redactDSN returns a connection string without its password
+func redactDSN(dsn string) string {
+	if !strings.Contains(dsn, "://") {
+		return strings.TrimSpace(dsnPassword.ReplaceAllString(dsn, ""))
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "(unparsable connection string)"
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	q := u.Query()
+	if _, ok := q["password"]; ok {
+		q.Del("password")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redactEndpoint redacts the connection string of a label=dsn -endpoint
+func redactEndpoint(value string) string {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return value
+	}
+	return value[:i+1] + redactDSN(value[i+1:])
+}
+
+// redactURL reduces a URL, whose path or query may hold a token, to its
+// scheme and host
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "(unparsable URL)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// redactedConfig returns the value of every flag in fs, with secrets
+// removed
+func redactedConfig(fs *flag.FlagSet) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+		if redact, ok := redactedFlags[f.Name]; ok && config[f.Name] != "" {
+			config[f.Name] = redact(config[f.Name])
+		}
+	})
+	return config
+}
+
+// redactArgs returns args, as parsed by fs, with secrets removed from the
+// values of redactedFlags
+func redactArgs(fs *flag.FlagSet, args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		arg := redacted[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		redact, sensitive := redactedFlags[name]
+		switch {
+		case hasValue && sensitive:
+			redacted[i] = arg[:len(arg)-len(value)] + redact(value)
+		case !hasValue && i+1 < len(redacted):
+			if sensitive {
+				redacted[i+1] = redact(redacted[i+1])
+			}
+			i++
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/csv"
+	"strconv"
+	"sync"
+)
+
+var rejectsHeader = []string{"line", "reason", "detail"}
+
+// rejectWriter exports every input row rejected by validation, with its row
+// number, the reason and the row's original fields, so a dirty workload can
+// be benchmarked as it is and cleaned up afterwards. Rows that couldn't be
+// tokenised at all have no fields.
+// The file is only moved into place once closed. It may be closed from a
+// signal handler while rows are being written.
+type rejectWriter struct {
+	mu     sync.Mutex
+	f      *atomicFile
+	w      *csv.Writer
+	name   string
+	closed bool
+}
+
+func newRejectWriter(fileName string) (*rejectWriter, error) {
+	f, err := createAtomic(fileName)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(f)
+	if err := w.Write(rejectsHeader); err != nil {
+		f.abort()
+		return nil, err
+	}
+	return &rejectWriter{f: f, w: w, name: fileName}, nil
+}
+
+func (rw *rejectWriter) write(row int, reason string, detail string, fields []string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return
+	}
+	// Errors are surfaced by close via csv.Writer.Error
+	_ = rw.w.Write(append([]string{strconv.Itoa(row), reason, detail}, fields...))
+}
+
+func (rw *rejectWriter) close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+
+	rw.w.Flush()
+	if err := rw.w.Error(); err != nil {
+		rw.f.abort()
+		return err
+	}
+	return rw.f.commit()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// What workers do when the results buffer is full because the collector has
+// fallen behind
+const (
+	backpressureBlock = "block"
+	backpressureDrop  = "drop"
+)
+
+// resultSink carries results from workers to the collector. The channel is
+// buffered so workers aren't serialised through the collector; once the
+// buffer fills they either wait for space or, under the drop policy, discard
+// the result and count it.
+type resultSink struct {
+	ch      chan benchResult
+	drop    bool
+	dropped int64 // accessed atomically
+}
+
+func newResultSink(size int, policy string) (*resultSink, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("buffer size must not be negative")
+	}
+	s := &resultSink{ch: make(chan benchResult, size)}
+	switch policy {
+	case backpressureBlock:
+	case backpressureDrop:
+		s.drop = true
+	default:
+		return nil, fmt.Errorf("unknown backpressure policy %q (want %s or %s)", policy, backpressureBlock, backpressureDrop)
+	}
+	return s, nil
+}
+
+func (s *resultSink) send(r benchResult) {
+	if !s.drop {
+		s.ch <- r
+		return
+	}
+	select {
+	case s.ch <- r:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// droppedCount returns the number of results discarded so far
+func (s *resultSink) droppedCount() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// close is called once every worker has exited, so the collector knows no
+// more results will arrive once it has drained the buffer
+func (s *resultSink) close() {
+	close(s.ch)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats of the compare command
+const (
+	compareText     = "text"
+	compareMarkdown = "markdown"
+	compareJSON     = "json"
+)
+
+// Default significance level of the compare command
+const defaultCompareAlpha = 0.05
+
+// significance is a Mann–Whitney U test of whether successful query
+// latencies differ between two runs, using the normal approximation with a
+// correction for ties
+type significance struct {
+	SamplesA int     `json:"samples_a"`
+	SamplesB int     `json:"samples_b"`
+	U        float64 `json:"u"`
+	Z        float64 `json:"z"`
+	P        float64 `json:"p"`
+	Alpha    float64 `json:"alpha"`
+
+	// The chance that a query from b is slower than one from a, counting
+	// ties as half: 0.5 if neither run is faster
+	ProbabilitySlower float64 `json:"probability_b_slower"`
+}
+
+func (s *significance) significant() bool {
+	return s.P < s.Alpha
+}
+
+// mannWhitney tests samples a and b, which are sorted in place
+func mannWhitney(a, b []float64) *significance {
+	na, nb := float64(len(a)), float64(len(b))
+	if na == 0 || nb == 0 {
+		return nil
+	}
+	sort.Float64s(a)
+	sort.Float64s(b)
+
+	// Merge the sorted samples, ranking ties by their average rank
+	var rankSumB, tieTerm float64
+	i, j, rank := 0, 0, 0
+	for i < len(a) || j < len(b) {
+		var v float64
+		if j == len(b) || (i < len(a) && a[i] <= b[j]) {
+			v = a[i]
+		} else {
+			v = b[j]
+		}
+		inA, inB := 0, 0
+		for i < len(a) && a[i] == v {
+			i++
+			inA++
+		}
+		for j < len(b) && b[j] == v {
+			j++
+			inB++
+		}
+		t := float64(inA + inB)
+		avg := float64(rank) + (t+1)/2
+		rankSumB += avg * float64(inB)
+		tieTerm += t*t*t - t
+		rank += inA + inB
+	}
+
+	n := na + nb
+	u := rankSumB - nb*(nb+1)/2
+	mean := na * nb / 2
+	variance := na * nb / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	s := &significance{
+		SamplesA:          len(a),
+		SamplesB:          len(b),
+		U:                 u,
+		P:                 1,
+		ProbabilitySlower: u / (na * nb),
+	}
+	if variance > 0 {
+		// With a continuity correction towards the mean
+		diff := math.Abs(u-mean) - 0.5
+		if diff < 0 {
+			diff = 0
+		}
+		s.Z = math.Copysign(diff/math.Sqrt(variance), u-mean)
+		s.P = math.Erfc(math.Abs(s.Z) / math.Sqrt2)
+	}
+	return s
+}
+
+// readRawLatencies returns the latencies of successful queries against
+// target in a -raw file, in milliseconds. If target is "", the target of the
+// file's first row is used, so a run against several targets is only ever
+// tested target by target.
+func readRawLatencies(fileName, target string) ([]float64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	timeCol, errCol, targetCol := -1, -1, -1
+	for i, name := range header {
+		switch name {
+		case "target":
+			targetCol = i
+		case "query_time_us":
+			timeCol = i
+		case "error":
+			errCol = i
+		}
+	}
+	if timeCol < 0 || errCol < 0 {
+		return nil, fmt.Errorf("%s: not a -raw file", fileName)
+	}
+
+	var latencies []float64
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return latencies, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		if len(row) <= timeCol || len(row) <= errCol {
+			continue
+		}
+		if targetCol >= 0 && targetCol < len(row) {
+			if target == "" {
+				target = row[targetCol]
+			}
+			if row[targetCol] != target {
+				continue
+			}
+		}
+		if row[errCol] != "" {
+			continue
+		}
+		us, err := strconv.ParseInt(row[timeCol], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		latencies = append(latencies, float64(us)/1000.0)
+	}
+}
+
+// primaryTarget returns the name of the primary target of the run described
+// by a manifest, or "" if it only recorded one
+func primaryTarget(m *runManifest) string {
+	if len(m.Targets) == 0 {
+		return ""
+	}
+	return m.Targets[0].Name
+}
+
+// rawFileFor finds the -raw output of the run described by a manifest: the
+// file named by its raw flag, relative to the working directory or else to
+// the manifest. It returns "" if there is none.
+func rawFileFor(manifestFile string, m *runManifest) string {
+	name := m.Config["raw"]
+	if name == "" || name == stdoutName {
+		return ""
+	}
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = append(candidates, filepath.Join(filepath.Dir(manifestFile), filepath.Base(name)))
+	}
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c
+		}
+	}
+	return ""
+}
+
+// runComparison is the output of the compare command
+type runComparison struct {
+	A            string        `json:"a"`
+	B            string        `json:"b"`
+	Metrics      []metricDelta `json:"metrics"`
+	Flags        []keyChange   `json:"flags,omitempty"`
+	Labels       []keyChange   `json:"labels,omitempty"`
+	Significance *significance `json:"significance,omitempty"`
+}
+
+func printComparisonText(c *runComparison, a, b *runManifest) {
+	printRunDiff(c.A, a, c.B, b)
+	fmt.Printf("\n## Significance\n")
+	s := c.Significance
+	if s == nil {
+		fmt.Printf("No raw samples to test; run both with -raw, or pass -raw-a and -raw-b\n")
+		return
+	}
+	fmt.Printf("Samples:           %d vs %d successful queries\n", s.SamplesA, s.SamplesB)
+	fmt.Printf("Mann-Whitney U:    %.0f (z = %.2f)\n", s.U, s.Z)
+	verdict := "not significant"
+	if s.significant() {
+		verdict = "significant"
+	}
+	fmt.Printf("p-value:           %s\n",
+		colorize(fmt.Sprintf("%.4g, %s at %g", s.P, verdict, s.Alpha), colorIf(s.significant() && s.ProbabilitySlower > 0.5, s.significant() && s.ProbabilitySlower < 0.5)))
+	fmt.Printf("P(b slower):       %.1f%%\n", 100*s.ProbabilitySlower)
+}
+
+func printComparisonMarkdown(w io.Writer, c *runComparison) {
+	fmt.Fprintf(w, "## %s vs %s\n\n", c.A, c.B)
+	fmt.Fprintf(w, "| metric | a | b | delta | change |\n")
+	fmt.Fprintf(w, "|---|---:|---:|---:|---:|\n")
+	for _, d := range c.Metrics {
+		change := "-"
+		if d.Change != nil {
+			change = fmt.Sprintf("%+.1f%%", 100**d.Change)
+		}
+		fmt.Fprintf(w, "| %s | %.3f | %.3f | %+.3f | %s |\n", d.name, d.A, d.B, d.Delta, change)
+	}
+	for _, section := range []struct {
+		title   string
+		changes []keyChange
+	}{{"Flags", c.Flags}, {"Labels", c.Labels}} {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s differing:\n\n", section.title)
+		for _, k := range section.changes {
+			fmt.Fprintf(w, "- `%s`: `%s` → `%s`\n", k.Key, k.A, k.B)
+		}
+	}
+
+	fmt.Fprintf(w, "\n")
+	s := c.Significance
+	if s == nil {
+		fmt.Fprintf(w, "No raw samples to test for significance.\n")
+		return
+	}
+	verdict := "not significant"
+	if s.significant() {
+		verdict = "**significant**"
+	}
+	fmt.Fprintf(w, "Mann–Whitney U test on %d vs %d successful queries: p = %.4g, %s at %g; a query from b is slower %.1f%% of the time.\n",
+		s.SamplesA, s.SamplesB, s.P, verdict, s.Alpha, 100*s.ProbabilitySlower)
+}
+
+// runCompare compares two runs from their manifests: compare [flags]
+// run_a.json run_b.json
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	format := fs.String("format", compareText, "output format: text, markdown or json")
+	rawA := fs.String("raw-a", "", "-raw output of the first run, for the significance test (default: the run's -raw file, if found)")
+	rawB := fs.String("raw-b", "", "-raw output of the second run (default: the run's -raw file, if found)")
+	alpha := fs.Float64("alpha", defaultCompareAlpha, "significance level")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: compare [flags] run_a.json run_b.json\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != compareText && *format != compareMarkdown && *format != compareJSON {
+		log.Fatalf("[ERROR] -format must be %s, %s or %s\n", compareText, compareMarkdown, compareJSON)
+	}
+	fileA, fileB := fs.Arg(0), fs.Arg(1)
+
+	a, err := readManifest(fileA)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read manifest: %s\n", err.Error())
+	}
+	b, err := readManifest(fileB)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read manifest: %s\n", err.Error())
+	}
+
+	c := &runComparison{
+		A:       strings.TrimSuffix(filepath.Base(fileA), ".json"),
+		B:       strings.TrimSuffix(filepath.Base(fileB), ".json"),
+		Metrics: compareMetrics(a, b),
+		Flags:   mapDiff(a.Config, b.Config, unhashedFlags),
+		Labels:  mapDiff(a.Labels, b.Labels, nil),
+	}
+	if c.A == c.B {
+		c.A, c.B = fileA, fileB
+	}
+
+	if *rawA == "" {
+		*rawA = rawFileFor(fileA, a)
+	}
+	if *rawB == "" {
+		*rawB = rawFileFor(fileB, b)
+	}
+	if *rawA != "" && *rawB != "" {
+		samplesA, err := readRawLatencies(*rawA, primaryTarget(a))
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to read raw output: %s\n", err.Error())
+		}
+		samplesB, err := readRawLatencies(*rawB, primaryTarget(b))
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to read raw output: %s\n", err.Error())
+		}
+		if c.Significance = mannWhitney(samplesA, samplesB); c.Significance != nil {
+			c.Significance.Alpha = *alpha
+		}
+	}
+
+	switch *format {
+	case compareText:
+		printComparisonText(c, a, b)
+	case compareMarkdown:
+		printComparisonMarkdown(os.Stdout, c)
+	case compareJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c); err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+	}
+}
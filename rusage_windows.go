@@ -0,0 +1,30 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func readProcessCPU() processCPU {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return processCPU{}
+	}
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return processCPU{}
+	}
+	// Filetime values are in 100ns units
+	ticks := func(f syscall.Filetime) time.Duration {
+		return time.Duration(int64(f.HighDateTime)<<32|int64(f.LowDateTime)) * 100
+	}
+	return processCPU{
+		user:   ticks(user),
+		system: ticks(kernel),
+	}
+}
+
+// Peak RSS requires psapi, which the standard library doesn't expose
+func readPeakRSS() int64 {
+	return 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+type serverSample struct {
+	offset time.Duration
+
+	// pg_stat_activity for the current database
+	active        int64
+	idleInTx      int64
+	waitingOnLock int64
+
+	// pg_stat_bgwriter (cumulative)
+	checkpoints       int64
+	buffersCheckpoint int64
+
+	// timescaledb_information.job_stats
+	jobsRunning int64
+	jobRuns     int64 // cumulative
+	jobFailures int64 // cumulative
+}
+
+// Client-side latencies observed within one sampling interval
+type clientInterval struct {
+	count int64
+	max   int64
+}
+
+const (
+	activitySQL = `SELECT
+		count(*) FILTER (WHERE state = 'active'),
+		count(*) FILTER (WHERE state LIKE 'idle in transaction%'),
+		count(*) FILTER (WHERE wait_event_type = 'Lock')
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND pid <> pg_backend_pid()`
+	bgwriterSQL = `SELECT checkpoints_timed + checkpoints_req, buffers_checkpoint
+		FROM pg_stat_bgwriter`
+	jobStatsSQL = `SELECT
+		count(*) FILTER (WHERE job_status = 'Running'),
+		COALESCE(sum(total_runs), 0),
+		COALESCE(sum(total_failures), 0)
+		FROM timescaledb_information.job_stats`
+)
+
+// sampleServer polls server activity views every interval until ctx is
+// cancelled, then sends the collected timeline on out. Sources which fail
+// (e.g. missing TimescaleDB) are logged once and skipped thereafter.
+func sampleServer(ctx context.Context, q querier, interval time.Duration, start time.Time, out chan<- []serverSample) {
+	var samples []serverSample
+	failed := make(map[string]bool)
+
+	sample := func(name string, sql string, dest ...interface{}) {
+		if failed[name] {
+			return
+		}
+		if err := q.QueryRow(ctx, sql).Scan(dest...); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] Disabling %s sampling: %s\n", name, err.Error())
+			failed[name] = true
+		}
+	}
+
+	take := func(t time.Time) {
+		s := serverSample{offset: t.Sub(start)}
+		sample("pg_stat_activity", activitySQL, &s.active, &s.idleInTx, &s.waitingOnLock)
+		sample("pg_stat_bgwriter", bgwriterSQL, &s.checkpoints, &s.buffersCheckpoint)
+		sample("job_stats", jobStatsSQL, &s.jobsRunning, &s.jobRuns, &s.jobFailures)
+		if ctx.Err() == nil {
+			samples = append(samples, s)
+		}
+	}
+
+	// Initial sample provides the baseline for cumulative counters
+	take(start)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			out <- samples
+			return
+		case t := <-ticker.C:
+			take(t)
+		}
+	}
+}
+
+// printServerTimeline prints one row per sample, alongside the client-side
+// query count and max latency observed during the same interval. Cumulative
+// counters are shown as the delta since the previous sample. Intervals with
+// an entry in marks, such as when a hook ran, are labelled.
+func printServerTimeline(samples []serverSample, interval time.Duration, client map[int64]*clientInterval, marks map[int64]string) {
+	fmt.Printf("\n## Server activity timeline (every %s)\n", interval)
+	if len(samples) < 2 {
+		fmt.Printf("Run finished before the first sample\n")
+		return
+	}
+
+	fmt.Printf("%10s %8s %10s %7s %8s %9s %6s %9s %8s %9s %9s\n",
+		"offset", "queries", "max (ms)", "active", "idle-tx", "lock-wait",
+		"ckpts", "ckpt bufs", "jobs act", "jobs run", "jobs fail")
+
+	// Sample i closes the client interval i-1
+	for i := 1; i < len(samples); i++ {
+		s := samples[i]
+		prev := samples[i-1]
+
+		var c clientInterval
+		if ci, ok := client[int64(i-1)]; ok {
+			c = *ci
+		}
+		var mark string
+		if m, ok := marks[int64(i-1)]; ok {
+			mark = "  <- " + m
+		}
+		fmt.Printf("%10s %8d %10.3f %7d %8d %9d %6d %9d %8d %9d %9d%s\n",
+			s.offset.Round(time.Second), c.count, float32(c.max)/1000.0,
+			s.active, s.idleInTx, s.waitingOnLock,
+			s.checkpoints-prev.checkpoints, s.buffersCheckpoint-prev.buffersCheckpoint,
+			s.jobsRunning, s.jobRuns-prev.jobRuns, s.jobFailures-prev.jobFailures, mark)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Names of the built-in scenarios
+const (
+	scenarioHypertableVsPlain = "hypertable-vs-plain"
+	scenarioChunkSweep        = "chunk-sweep"
+)
+
+// Tables created by the scenarios
+const (
+	scenarioHypertable = "scenario_hypertable"
+	scenarioPlain      = "scenario_plain"
+)
+
+// Kinds of table a scenario can load
+const (
+	tableHypertable  = "hypertable"
+	tablePlain       = "plain"
+	tablePartitioned = "partitioned"
+)
+
+// datasetSpec describes generated cpu_usage data: a reading for each of
+// hosts hostnames (host_000000 onwards) every step from from to to, with
+// usage drawn from a random stream seeded by seed
+type datasetSpec struct {
+	hosts int
+	from  time.Time
+	to    time.Time
+	step  time.Duration
+	seed  int64
+}
+
+// addFlags registers flags for the dataset on fs, defaulting to the same
+// hostnames and times as generated tasks
+func (d *datasetSpec) addFlags(fs *flag.FlagSet) (from, to *string) {
+	fs.IntVar(&d.hosts, "hosts", defaultGenerateHosts, "number of hostnames in the generated data")
+	fs.DurationVar(&d.step, "step", time.Minute, "interval between each host's readings")
+	fs.Int64Var(&d.seed, "seed", 1, "seed for the generated readings")
+	from = fs.String("from", defaultGenerateFrom.Format(generatedTimeLayout), "time of the first readings")
+	to = fs.String("to", defaultGenerateTo.Format(generatedTimeLayout), "time after the last readings")
+	return from, to
+}
+
+// parseTimes sets the dataset's span from the -from and -to flags
+func (d *datasetSpec) parseTimes(from, to string) error {
+	var err error
+	if d.from, err = time.Parse(generatedTimeLayout, from); err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	if d.to, err = time.Parse(generatedTimeLayout, to); err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	switch {
+	case !d.to.After(d.from):
+		return fmt.Errorf("-to must be after -from")
+	case d.hosts < 1:
+		return fmt.Errorf("-hosts must be at least 1")
+	case d.step <= 0:
+		return fmt.Errorf("-step must be positive")
+	}
+	return nil
+}
+
+func (d datasetSpec) rows() int {
+	return d.hosts * int(d.to.Sub(d.from)/d.step)
+}
+
+// loadTable replaces the named table with one of the given kind, holding
+// the generated data, indexed on host and time. chunkInterval sets a
+// hypertable's chunk_time_interval; 0 keeps TimescaleDB's default.
+func loadTable(ctx context.Context, pool *pgxpool.Pool, name string, kind string, chunkInterval time.Duration, d datasetSpec) error {
+	table := pgx.Identifier{name}.Sanitize()
+	stmts := []string{
+		"DROP TABLE IF EXISTS " + table,
+	}
+	columns := "(ts TIMESTAMPTZ NOT NULL, host TEXT, usage DOUBLE PRECISION)"
+	switch kind {
+	case tableHypertable:
+		stmts = append(stmts, "CREATE TABLE "+table+" "+columns)
+		if chunkInterval > 0 {
+			stmts = append(stmts, fmt.Sprintf("SELECT create_hypertable('%s', 'ts', chunk_time_interval => interval '%d microseconds')",
+				name, chunkInterval.Microseconds()))
+		} else {
+			stmts = append(stmts, fmt.Sprintf("SELECT create_hypertable('%s', 'ts')", name))
+		}
+	case tablePlain:
+		stmts = append(stmts, "CREATE TABLE "+table+" "+columns)
+	case tablePartitioned:
+		// One partition per day, as declarative partitioning needs them
+		// created up front
+		stmts = append(stmts, "CREATE TABLE "+table+" "+columns+" PARTITION BY RANGE (ts)")
+		for day := d.from.Truncate(24 * time.Hour); day.Before(d.to); day = day.Add(24 * time.Hour) {
+			stmts = append(stmts, fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+				pgx.Identifier{name + day.Format("_p20060102")}.Sanitize(), table,
+				day.Format(time.RFC3339), day.Add(24*time.Hour).Format(time.RFC3339)))
+		}
+	default:
+		return fmt.Errorf("unknown table kind %q", kind)
+	}
+	stmts = append(stmts, "CREATE INDEX ON "+table+" (host, ts DESC)")
+	for _, sql := range stmts {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("%s: %w", sql, err)
+		}
+	}
+
+	rng := newRand(d.seed, "dataset")
+	n := d.rows()
+	start := time.Now()
+	_, err := pool.CopyFrom(ctx, pgx.Identifier{name}, []string{"ts", "host", "usage"},
+		pgx.CopyFromSlice(n, func(i int) ([]interface{}, error) {
+			ts := d.from.Add(time.Duration(i/d.hosts) * d.step)
+			return []interface{}{ts, fmt.Sprintf("host_%06d", i%d.hosts), 100 * rng.Float64()}, nil
+		}))
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", name, err)
+	}
+	if _, err := pool.Exec(ctx, "ANALYZE "+table); err != nil {
+		return fmt.Errorf("analyzing %s: %w", name, err)
+	}
+	log.Printf("[INFO] Loaded %d rows into %s %s in %s\n", n, kind, name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// dropTables drops tables created by a scenario, logging any failure
+func dropTables(ctx context.Context, pool *pgxpool.Pool, names ...string) {
+	for _, name := range names {
+		if _, err := pool.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{name}.Sanitize()); err != nil {
+			log.Printf("[WARN] Unable to drop %s: %s\n", name, err.Error())
+		}
+	}
+}
+
+// runBenchmark runs this program's benchmark with args, which default to
+// tasks generated over the dataset, followed by extra
+func runBenchmark(args []string, d datasetSpec, extra ...string) error {
+	if len(args) == 0 {
+		args = []string{"-source", fmt.Sprintf("name=generated,generate=1000,hosts=%d,from=%s,to=%s",
+			d.hosts, d.from.Format(generatedTimeLayout), d.to.Format(generatedTimeLayout))}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, append(args, extra...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runScenario runs a built-in scenario: scenario NAME [flags] [-- benchmark
+// flags]
+func runScenario(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("[ERROR] scenario needs a name: %s or %s\n", scenarioHypertableVsPlain, scenarioChunkSweep)
+	}
+	switch args[0] {
+	case scenarioHypertableVsPlain:
+		runHypertableVsPlain(args[1:])
+	case scenarioChunkSweep:
+		runChunkSweep(args[1:])
+	default:
+		log.Fatalf("[ERROR] Unknown scenario %q\n", args[0])
+	}
+}
+
+// runHypertableVsPlain loads identical generated data into a hypertable and
+// a plain or partitioned table, and runs the workload against both, comparing
+// them in the report
+func runHypertableVsPlain(args []string) {
+	fs := flag.NewFlagSet(scenarioHypertableVsPlain, flag.ExitOnError)
+	var d datasetSpec
+	from, to := d.addFlags(fs)
+	plainKind := fs.String("plain", tablePlain, "kind of table to compare with: plain or partitioned (by day)")
+	keep := fs.Bool("keep", false, "keep the tables after the run")
+	fs.Parse(args)
+	if err := d.parseTimes(*from, *to); err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	if *plainKind != tablePlain && *plainKind != tablePartitioned {
+		log.Fatalf("[ERROR] -plain must be %s or %s\n", tablePlain, tablePartitioned)
+	}
+
+	ctx := context.Background()
+	pool, err := connectPool(dbURLFromEnv(), "", 0, defaultDBWait, true, nil)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to connect to %s: %s\n", os.Getenv("POSTGRES_HOST"), err.Error())
+	}
+	defer pool.Close()
+
+	if err := loadTable(ctx, pool, scenarioHypertable, tableHypertable, 0, d); err != nil {
+		log.Fatalf("[ERROR] Unable to create the hypertable: %s\n", err.Error())
+	}
+	if err := loadTable(ctx, pool, scenarioPlain, *plainKind, 0, d); err != nil {
+		log.Fatalf("[ERROR] Unable to create the %s table: %s\n", *plainKind, err.Error())
+	}
+
+	err = runBenchmark(fs.Args(), d,
+		"-target-relation", scenarioHypertable,
+		"-compare-relation", scenarioPlain,
+		"-compare-label", *plainKind,
+		"-label", "scenario="+scenarioHypertableVsPlain)
+	if !*keep {
+		dropTables(ctx, pool, scenarioHypertable, scenarioPlain)
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] Benchmark failed: %s\n", err.Error())
+	}
+}
+
+// sweepRun is the outcome of the workload against one chunk interval
+type sweepRun struct {
+	interval time.Duration
+	chunks   int64
+	manifest *runManifest
+}
+
+// runChunkSweep reloads the generated data into a hypertable with each of a
+// list of chunk intervals in turn, runs the workload against each, and
+// compares their latencies and planning times
+func runChunkSweep(args []string) {
+	fs := flag.NewFlagSet(scenarioChunkSweep, flag.ExitOnError)
+	var d datasetSpec
+	from, to := d.addFlags(fs)
+	intervalSpec := fs.String("intervals", "1h,12h,24h,168h", "comma-separated chunk_time_interval settings to compare")
+	explainSample := fs.Float64("explain-sample", 0.1, "fraction of queries to re-run with EXPLAIN ANALYZE, for planning times")
+	keep := fs.Bool("keep", false, "keep the table, with the last interval, after the run")
+	fs.Parse(args)
+	if err := d.parseTimes(*from, *to); err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	var intervals []time.Duration
+	for _, part := range strings.Split(*intervalSpec, ",") {
+		interval, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || interval <= 0 {
+			log.Fatalf("[ERROR] Invalid chunk interval %q in -intervals\n", part)
+		}
+		intervals = append(intervals, interval)
+	}
+	if *explainSample <= 0 || *explainSample > 1 {
+		log.Fatal("[ERROR] -explain-sample must be in (0, 1]\n")
+	}
+
+	dir, err := ioutil.TempDir("", "chunk-sweep")
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to create a directory for manifests: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	pool, err := connectPool(dbURLFromEnv(), "", 0, defaultDBWait, true, nil)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to connect to %s: %s\n", os.Getenv("POSTGRES_HOST"), err.Error())
+	}
+	defer pool.Close()
+
+	var runs []sweepRun
+	for i, interval := range intervals {
+		manifestFile := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		run, err := sweepInterval(ctx, pool, interval, d, manifestFile, fs.Args(),
+			"-explain-sample", fmt.Sprint(*explainSample))
+		if err != nil {
+			if !*keep {
+				dropTables(ctx, pool, scenarioHypertable)
+			}
+			log.Fatalf("[ERROR] Sweep failed at chunk interval %s: %s\n", interval, err.Error())
+		}
+		runs = append(runs, run)
+	}
+	if !*keep {
+		dropTables(ctx, pool, scenarioHypertable)
+	}
+
+	printChunkSweep(runs)
+}
+
+// sweepInterval loads the dataset with the given chunk interval and runs the
+// workload against it, reading back the run's manifest from manifestFile
+func sweepInterval(ctx context.Context, pool *pgxpool.Pool, interval time.Duration, d datasetSpec, manifestFile string, args []string, extra ...string) (sweepRun, error) {
+	run := sweepRun{interval: interval}
+	if err := loadTable(ctx, pool, scenarioHypertable, tableHypertable, interval, d); err != nil {
+		return run, err
+	}
+	err := pool.QueryRow(ctx, "SELECT count(*) FROM show_chunks($1::regclass)", scenarioHypertable).Scan(&run.chunks)
+	if err != nil {
+		return run, fmt.Errorf("counting chunks: %w", err)
+	}
+
+	log.Printf("[INFO] Running the workload with %s chunks (%d chunks)\n", interval, run.chunks)
+	extra = append(extra,
+		"-target-relation", scenarioHypertable,
+		"-manifest", manifestFile,
+		"-label", "scenario="+scenarioChunkSweep,
+		"-label", "chunk_interval="+interval.String())
+	if err := runBenchmark(args, d, extra...); err != nil {
+		return run, err
+	}
+	run.manifest, err = readManifest(manifestFile)
+	return run, err
+}
+
+// printChunkSweep compares the latencies and planning times of each chunk
+// interval, relative to the first
+func printChunkSweep(runs []sweepRun) {
+	fmt.Printf("\n## Chunk interval sweep\n")
+	fmt.Printf("%-10s %8s %10s %10s %10s %10s %10s %10s\n",
+		"interval", "chunks", "median", "p95", "p99", "mean", "planning", "vs first")
+	var base float64
+	for i, run := range runs {
+		median, p95, p99, mean := "-", "-", "-", "-"
+		if l := run.manifest.Latency; l != nil {
+			median, p95, p99, mean = fmt.Sprintf("%.3f", l.Median), fmt.Sprintf("%.3f", l.P95),
+				fmt.Sprintf("%.3f", l.P99), fmt.Sprintf("%.3f", l.Mean)
+		}
+		planning := "-"
+		if p := run.manifest.Plans; p != nil && p.Samples > 0 {
+			planning = fmt.Sprintf("%.3f", p.MeanPlanningTime)
+		}
+		vs := ""
+		if l := run.manifest.Latency; l != nil {
+			if i == 0 {
+				base = l.Median
+			} else if base > 0 {
+				vs = fmt.Sprintf("%+.1f%%", 100*(l.Median/base-1))
+			}
+		}
+		fmt.Printf("%-10s %8d %10s %10s %10s %10s %10s %10s\n",
+			run.interval, run.chunks, median, p95, p99, mean, planning, vs)
+	}
+	fmt.Printf("(times in ms; vs first compares medians)\n")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shorthands accepted in place of the five schedule fields, as in crontab
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Minutes searched for a schedule's next time before concluding it never
+// comes, such as for 30 February; a leap day is at most eight years away
+const cronSearchLimit = 8 * 366 * 24 * 60
+
+// cronSchedule is a crontab schedule of minute, hour, day of month, month
+// and day of week, each held as a bit set of the values allowed. Times are
+// in the local time zone.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// If both days are restricted either may match, as in cron
+	domAny, dowAny bool
+}
+
+// parseCronSchedule parses the five fields of a crontab line, or a macro
+// such as @daily. Fields may be *, a value, a range a-b or a list of them,
+// each optionally followed by /step.
+func parseCronSchedule(spec string) (cronSchedule, error) {
+	if expanded, ok := cronMacros[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("invalid schedule %q, expected minute, hour, day of month, month and day of week", spec)
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, fmt.Errorf("month: %w", err)
+	}
+	// Sunday is 0 or 7
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return s, fmt.Errorf("day of week: %w", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	if s.next(time.Now()).IsZero() {
+		return s, fmt.Errorf("schedule %q never runs", spec)
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || lo > hi {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			var err error
+			lo, err = strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			// As in cron, a/step runs from a to the end of the range
+			if step == 1 {
+				hi = lo
+			}
+		}
+		if lo < min || hi > max {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time after t the schedule is due, or the zero
+// time if it never is
+func (s cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < cronSearchLimit; i++ {
+		y, m, d := t.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scheduledRun is one -schedule: a run of the tool itself with args, due
+// whenever schedule is
+type scheduledRun struct {
+	spec     string
+	schedule cronSchedule
+	args     []string
+}
+
+// scheduleFlags collects repeated -schedule flags, each a crontab line whose
+// command is the tool's arguments
+type scheduleFlags []*scheduledRun
+
+func (s *scheduleFlags) String() string {
+	specs := make([]string, len(*s))
+	for i, r := range *s {
+		specs[i] = r.spec
+	}
+	return strings.Join(specs, "; ")
+}
+
+func (s *scheduleFlags) Set(value string) error {
+	fields := strings.Fields(value)
+	n := 5
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	if len(fields) <= n {
+		return fmt.Errorf("expected a schedule followed by arguments, e.g. \"0 2 * * * scenario hypertable-vs-plain\", got %q", value)
+	}
+	schedule, err := parseCronSchedule(strings.Join(fields[:n], " "))
+	if err != nil {
+		return err
+	}
+	*s = append(*s, &scheduledRun{spec: value, schedule: schedule, args: fields[n:]})
+	return nil
+}
+
+// startSchedules runs each scheduled run of the tool whenever it's due, in
+// a child process whose output goes to the daemon's, until the returned
+// function is called. That interrupts any runs in progress, which finish
+// their in-flight queries and report as usual, and waits for them. A run
+// still going when it's next due skips that time.
+func startSchedules(runs scheduleFlags) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, r := range runs {
+		wg.Add(1)
+		go func(r *scheduledRun) {
+			defer wg.Done()
+			for {
+				due := r.schedule.next(time.Now())
+				log.Printf("[INFO] Next scheduled run (%s) at %s\n", strings.Join(r.args, " "), due.Format(time.RFC3339))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(due)):
+				}
+				r.run(ctx)
+			}
+		}(r)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (r *scheduledRun) run(ctx context.Context) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("[ERROR] Unable to start scheduled run: %s\n", err.Error())
+		return
+	}
+	cmd := exec.Command(exe, r.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Printf("[ERROR] Unable to start scheduled run: %s\n", err.Error())
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	start := time.Now()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Printf("[INFO] Interrupting scheduled run\n")
+		cmd.Process.Signal(os.Interrupt)
+		err = <-done
+	}
+
+	if err != nil {
+		log.Printf("[WARN] Scheduled run (%s) failed: %s\n", strings.Join(r.args, " "), err.Error())
+	} else {
+		log.Printf("[INFO] Scheduled run (%s) completed in %s\n", strings.Join(r.args, " "), time.Since(start).Round(time.Second))
+	}
+}
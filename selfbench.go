@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Records per batch handed to the dispatcher, as the input pipeline does
+const selfBenchBatch = 100
+
+// selfBenchStage is the measured throughput of one part of the harness
+type selfBenchStage struct {
+	name    string
+	ops     int
+	elapsed time.Duration
+}
+
+func (s selfBenchStage) rate() float64 {
+	return float64(s.ops) / s.elapsed.Seconds()
+}
+
+// selfBenchResults builds n successful results spread over hosts hostnames,
+// for feeding the stages after the workers
+func selfBenchResults(n int, hosts int, target *dbTarget) []benchResult {
+	start := time.Now()
+	results := make([]benchResult, n)
+	for i := range results {
+		t := selfBenchTask(i, hosts)
+		t.variant = defaultVariants[0]
+		t.target = target
+		results[i] = benchResult{
+			task:      t,
+			worker:    i % hosts,
+			attempt:   1,
+			queryTime: int64(1000 + i%1000),
+			finished:  start.Add(time.Duration(i) * time.Microsecond),
+			rows:      1,
+			recorded:  true,
+		}
+	}
+	return results
+}
+
+// selfBenchTask returns the ith of a set of distinct tasks querying an hour
+func selfBenchTask(i int, hosts int) task {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Minute)
+	end := start.Add(time.Hour)
+	return task{
+		hostname:  fmt.Sprintf("host_%06d", i%hosts),
+		start:     start.Format("2006-01-02 15:04:05"),
+		end:       end.Format("2006-01-02 15:04:05"),
+		startTime: start,
+		endTime:   end,
+	}
+}
+
+// benchResultChannel measures results passing from worker goroutines to a
+// single collector through the results sink
+func benchResultChannel(results []benchResult, workers int, buffer int) selfBenchStage {
+	sink, _ := newResultSink(buffer, backpressureBlock)
+	var wg sync.WaitGroup
+	t0 := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(results); i += workers {
+				sink.send(results[i])
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		sink.close()
+	}()
+	n := 0
+	for range sink.ch {
+		n++
+	}
+	return selfBenchStage{name: "result channel", ops: n, elapsed: time.Since(t0)}
+}
+
+// benchAggregation measures the collector adding results to the report's
+// statistics, and to the live dashboard's
+func benchAggregation(results []benchResult, target *dbTarget) (selfBenchStage, selfBenchStage) {
+	st := newRunStats(statsConfig{topN: 10, rangeBounds: defaultRangeBounds}, defaultVariants, []*dbTarget{target})
+	st.start = time.Now()
+	t0 := time.Now()
+	for _, r := range results {
+		st.add(r)
+	}
+	// Quantiles are computed once, when the report is printed
+	newLatencyStats(st.queryTimes, 0)
+	report := selfBenchStage{name: "report statistics", ops: len(results), elapsed: time.Since(t0)}
+
+	dash := newDashboard(time.Now(), 1)
+	t0 = time.Now()
+	for _, r := range results {
+		dash.add(r)
+	}
+	dash.snapshot()
+	live := selfBenchStage{name: "live dashboard", ops: len(results), elapsed: time.Since(t0)}
+	return report, live
+}
+
+// benchEndToEnd runs tasks through the dispatcher, workers and collector
+// against the mock driver with no latency, so only the harness's own
+// overhead limits the rate
+func benchEndToEnd(tasks int, hosts int, workers int, buffer int) (selfBenchStage, error) {
+	b, err := New(Config{
+		ResultBuffer: buffer,
+		Backpressure: backpressureBlock,
+		Mock:         &mockDriver{rows: 1},
+		Dispatch: dispatchConfig{
+			numWorkers:         workers,
+			maxInflightPerHost: 1,
+			variants:           defaultVariants,
+			protocols:          []string{protocolExtended},
+			resultFormats:      []string{resultFormatAuto},
+			recordSample:       1,
+		},
+		Stats: statsConfig{topN: 10, rangeBounds: defaultRangeBounds},
+	})
+	if err != nil {
+		return selfBenchStage{}, err
+	}
+	defer b.Close()
+	if err := b.Warm(); err != nil {
+		return selfBenchStage{}, err
+	}
+
+	batches := make(chan []parsedRecord)
+	go func() {
+		for i := 0; i < tasks; i += selfBenchBatch {
+			var batch []parsedRecord
+			for j := i; j < i+selfBenchBatch && j < tasks; j++ {
+				batch = append(batch, parsedRecord{row: j + 1, task: selfBenchTask(j, hosts)})
+			}
+			batches <- batch
+		}
+		close(batches)
+	}()
+
+	t0 := time.Now()
+	if err := b.Start(t0, batches, newValidationSummary(), nil); err != nil {
+		return selfBenchStage{}, err
+	}
+	for r := range b.results.ch {
+		b.stats.add(r)
+	}
+	return selfBenchStage{name: "end to end", ops: b.stats.attempted(), elapsed: time.Since(t0)}, nil
+}
+
+// runSelfBench measures how fast the harness itself can dispatch tasks and
+// collect their results on this machine, without a database
+func runSelfBench(args []string) {
+	fs := flag.NewFlagSet("selfbench", flag.ExitOnError)
+	tasks := fs.Int("tasks", 200000, "number of tasks to run through each stage")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "number of workers")
+	hosts := fs.Int("hosts", 1000, "number of distinct hostnames the tasks are spread over")
+	buffer := fs.Int("result-buffer", 1024, "number of results buffered between the workers and the collector")
+	rate := fs.Float64("rate", 0, "the -rate you intend to run at, to check the harness can sustain it")
+	fs.Parse(args)
+	if *tasks < 1 || *workers < 1 || *hosts < 1 {
+		log.Fatal("[ERROR] -tasks, -workers and -hosts must be at least 1\n")
+	}
+	useColor = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+
+	// Workers log as they start; only the figures matter here
+	silenceInfo()
+
+	target := &dbTarget{name: primaryTargetName}
+	results := selfBenchResults(*tasks, *hosts, target)
+	stages := []selfBenchStage{benchResultChannel(results, *workers, *buffer)}
+	report, live := benchAggregation(results, target)
+	stages = append(stages, report, live)
+	endToEnd, err := benchEndToEnd(*tasks, *hosts, *workers, *buffer)
+	if err != nil {
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	stages = append(stages, endToEnd)
+
+	fmt.Printf("\n## Harness self-benchmark\n")
+	fmt.Printf("Workers:           %d on %d CPUs\n", *workers, runtime.GOMAXPROCS(0))
+	fmt.Printf("Tasks:             %d over %d hostnames\n", *tasks, *hosts)
+	fmt.Printf("%-20s %14s %10s\n", "stage", "per second", "ns each")
+	for _, s := range stages {
+		fmt.Printf("%-20s %14.0f %10.0f\n", s.name, s.rate(), float64(s.elapsed.Nanoseconds())/float64(s.ops))
+	}
+
+	max := endToEnd.rate()
+	fmt.Printf("Max dispatch rate: %.0f queries/s\n", max)
+	if *rate > 0 {
+		// Real queries also spend time in the driver and on the network, so
+		// leave the harness some headroom
+		ok := *rate <= max/2
+		verdict := "the harness can sustain this on this machine"
+		if !ok {
+			verdict = "too close to the harness's own limit; results would measure the client"
+		}
+		fmt.Printf("Intended rate:     %s\n", colorize(fmt.Sprintf("%.0f/s, %s", *rate, verdict), colorIf(!ok, ok)))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// Tolerance for comparing exact statistics, which only differ from the
+// expected values by floating point rounding
+const selfTestEpsilon = 1e-6
+
+// selfTestCase is a known sequence of query times fed through the
+// statistics pipeline, with the figures the report should give for it.
+// Expected values are worked out by hand, not by the code under test, and
+// NaN skips a check.
+type selfTestCase struct {
+	name string
+
+	// Times of successful queries in ms, in the order they finish
+	times []int64
+
+	// A failed query taking failedTime is injected after every failEvery
+	// successes; 0 injects none
+	failEvery  int
+	failedTime int64
+
+	// Retain only this many times per distribution, as under -sample
+	sampleSize int
+
+	count, failed           int
+	min, median, p99, max   float64
+	sketchMedian, sketchP99 float64
+}
+
+// selfTestRange returns the times from..to ms in steps of 1ms, descending if
+// from > to
+func selfTestRange(from, to int64) []int64 {
+	var times []int64
+	step := int64(1)
+	if from > to {
+		step = -1
+	}
+	for t := from; t != to+step; t += step {
+		times = append(times, t)
+	}
+	return times
+}
+
+func selfTestRepeat(t int64, n int) []int64 {
+	times := make([]int64, n)
+	for i := range times {
+		times[i] = t
+	}
+	return times
+}
+
+func selfTestCases() []selfTestCase {
+	nan := math.NaN()
+	return []selfTestCase{
+		{
+			name: "constant", times: selfTestRepeat(5, 200),
+			count: 200, min: 5, median: 5, p99: 5, max: 5,
+			sketchMedian: 5, sketchP99: 5,
+		},
+		{
+			// The median of an even count averages the middle two; the p99
+			// interpolates between ranks 989 and 990
+			name: "ascending", times: selfTestRange(1, 1000),
+			count: 1000, min: 1, median: 500.5, p99: 990.01, max: 1000,
+			sketchMedian: 500, sketchP99: 990,
+		},
+		{
+			name: "descending", times: selfTestRange(1000, 1),
+			count: 1000, min: 1, median: 500.5, p99: 990.01, max: 1000,
+			sketchMedian: 500, sketchP99: 990,
+		},
+		{
+			// Slow failures must not leak into the successful latencies
+			name: "failures", times: selfTestRange(1, 100), failEvery: 10, failedTime: 60000,
+			count: 100, failed: 10, min: 1, median: 50.5, p99: 99.01, max: 100,
+			sketchMedian: 50, sketchP99: 99,
+		},
+		{
+			// A single outlier drags the interpolated p99 but not the
+			// sketch's, which reports the value at rank 98
+			name: "outlier", times: append(selfTestRepeat(10, 99), 10000),
+			count: 100, min: 10, median: 10, p99: 109.9, max: 10000,
+			sketchMedian: 10, sketchP99: 10,
+		},
+		{
+			// Counts and extremes stay exact when only a sample is kept
+			name: "reservoir", times: selfTestRange(1, 1000), sampleSize: 100,
+			count: 1000, min: 1, median: nan, p99: nan, max: 1000,
+			sketchMedian: 500, sketchP99: 990,
+		},
+	}
+}
+
+// selfTestCheck compares one reported figure with its expected value
+type selfTestCheck struct {
+	statistic string
+	want, got float64
+
+	// Relative tolerance, or selfTestEpsilon if zero
+	tolerance float64
+}
+
+func (c selfTestCheck) passed() bool {
+	if math.IsNaN(c.want) {
+		return true
+	}
+	if c.tolerance > 0 {
+		return math.Abs(c.got-c.want) <= c.tolerance*c.want
+	}
+	return math.Abs(c.got-c.want) <= selfTestEpsilon
+}
+
+var errSelfTestFailure = errors.New("injected failure")
+
+// run sends the case's results from a worker through the results sink to a
+// collector, as in a real run, and returns the checks of what the report,
+// manifest and live dashboard would show
+func (c selfTestCase) run() []selfTestCheck {
+	target := &dbTarget{name: primaryTargetName}
+	st := newRunStats(statsConfig{sampleSize: c.sampleSize}, defaultVariants, []*dbTarget{target})
+	start := time.Now()
+	st.start = start
+	dash := newDashboard(start, 1)
+	sink, _ := newResultSink(0, backpressureBlock)
+
+	go func() {
+		elapsed := time.Duration(0)
+		result := func(ms int64, err error) benchResult {
+			elapsed += time.Duration(ms) * time.Millisecond
+			r := benchResult{
+				task: task{
+					hostname:   "selftest",
+					occurrence: 1,
+					variant:    defaultVariants[0],
+					target:     target,
+				},
+				attempt:   1,
+				queryTime: ms * 1000,
+				finished:  start.Add(elapsed),
+				err:       err,
+				recorded:  true,
+			}
+			if err == nil {
+				r.rows = 1
+			}
+			return r
+		}
+		for i, t := range c.times {
+			sink.send(result(t, nil))
+			if c.failEvery > 0 && (i+1)%c.failEvery == 0 {
+				sink.send(result(c.failedTime, errSelfTestFailure))
+			}
+		}
+		sink.close()
+	}()
+	for r := range sink.ch {
+		dash.add(r)
+		st.add(r)
+	}
+	dash.finish()
+
+	latency := newLatencyStats(st.queryTimes, 0)
+	if latency == nil {
+		latency = &latencyStats{}
+	}
+	live := dash.snapshot()
+	accuracy := dash.times.Accuracy()
+	return []selfTestCheck{
+		{statistic: "count", want: float64(c.count), got: float64(st.succeeded)},
+		{statistic: "failed", want: float64(c.failed), got: float64(st.failed)},
+		{statistic: "min", want: c.min, got: latency.Min},
+		{statistic: "median", want: c.median, got: latency.Median},
+		{statistic: "p99", want: c.p99, got: latency.P99},
+		{statistic: "max", want: c.max, got: latency.Max},
+		{statistic: "live median", want: c.sketchMedian, got: live.Median, tolerance: accuracy},
+		{statistic: "live p99", want: c.sketchP99, got: live.P99, tolerance: accuracy},
+		{statistic: "live max", want: c.max, got: live.Max},
+	}
+}
+
+// runSelfTest feeds known latency sequences through the statistics
+// pipeline, exiting with an error if any reported figure is wrong
+func runSelfTest(args []string) {
+	if len(args) > 0 {
+		log.Fatalf("[ERROR] selftest takes no arguments\n")
+	}
+	useColor = os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+
+	fmt.Printf("## Self-test\n")
+	failures := 0
+	checks := 0
+	for _, c := range selfTestCases() {
+		var failed []selfTestCheck
+		results := c.run()
+		for _, check := range results {
+			if !check.passed() {
+				failed = append(failed, check)
+			}
+		}
+		checks += len(results)
+		failures += len(failed)
+		if len(failed) == 0 {
+			fmt.Printf("%-19s%s\n", c.name, colorize("ok", colorGreen))
+			continue
+		}
+		fmt.Printf("%-19s%s\n", c.name, colorize("FAIL", colorRed))
+		for _, check := range failed {
+			fmt.Printf("  %-17s want %.3f, got %.3f\n", check.statistic, check.want, check.got)
+		}
+	}
+
+	if failures > 0 {
+		log.Printf("[ERROR] %d of %d self-test checks failed\n", failures, checks)
+		os.Exit(1)
+	}
+	log.Printf("[INFO] All %d self-test checks passed\n", checks)
+}
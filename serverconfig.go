@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Settings recorded by -server-config, along with all timescaledb.* settings
+var serverConfigSettings = []string{
+	"shared_buffers",
+	"work_mem",
+	"maintenance_work_mem",
+	"effective_cache_size",
+	"effective_io_concurrency",
+	"random_page_cost",
+	"seq_page_cost",
+	"max_worker_processes",
+	"max_parallel_workers",
+	"max_parallel_workers_per_gather",
+	"jit",
+	"enable_partitionwise_aggregate",
+	"default_statistics_target",
+	"huge_pages",
+}
+
+// serverConfig is the server's configuration and the state of the
+// benchmarked hypertable when the run started
+type serverConfig struct {
+	Settings    []serverSetting      `json:"settings"`
+	Relation    string               `json:"relation,omitempty"`
+	Hypertable  *hypertableInfo      `json:"hypertable,omitempty"`
+	Dimensions  []hypertableDim      `json:"dimensions,omitempty"`
+	Compression *hypertableCompStats `json:"compression,omitempty"`
+	Jobs        []timescaleJob       `json:"jobs,omitempty"`
+}
+
+type serverSetting struct {
+	Name    string `json:"name"`
+	Setting string `json:"setting"`
+	Source  string `json:"source"`
+}
+
+type hypertableInfo struct {
+	TotalBytes int64 `json:"total_bytes"`
+	Chunks     int64 `json:"chunks"`
+}
+
+type hypertableDim struct {
+	Column   string  `json:"column"`
+	Type     string  `json:"type"`
+	Interval *string `json:"interval,omitempty"`
+}
+
+type hypertableCompStats struct {
+	TotalChunks      int64  `json:"total_chunks"`
+	CompressedChunks *int64 `json:"compressed_chunks"`
+	BytesBefore      *int64 `json:"bytes_before"`
+	BytesAfter       *int64 `json:"bytes_after"`
+}
+
+type timescaleJob struct {
+	ID               int32  `json:"id"`
+	Application      string `json:"application"`
+	ScheduleInterval string `json:"schedule_interval"`
+	Scheduled        bool   `json:"scheduled"`
+	Config           string `json:"config"`
+}
+
+// snapshotServerConfig records the server configuration, and the state of
+// relation if it's a hypertable. The TimescaleDB information views need
+// TimescaleDB 2; anything which can't be read is logged and left out rather
+// than failing the run.
+func snapshotServerConfig(ctx context.Context, q querier, relation string) (*serverConfig, error) {
+	cfg := &serverConfig{}
+
+	rows, err := q.Query(ctx,
+		`SELECT name, current_setting(name), source FROM pg_settings
+		WHERE name = ANY($1) OR name LIKE 'timescaledb.%'
+		ORDER BY name`, serverConfigSettings)
+	if err != nil {
+		return nil, fmt.Errorf("querying pg_settings: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s serverSetting
+		if err := rows.Scan(&s.Name, &s.Setting, &s.Source); err != nil {
+			return nil, fmt.Errorf("scanning pg_settings: %w", err)
+		}
+		cfg.Settings = append(cfg.Settings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading pg_settings: %w", err)
+	}
+
+	cfg.Relation = relation
+	hypertable, err := isHypertable(ctx, q, relation)
+	if err != nil {
+		log.Printf("[WARN] Unable to look up %s: %s\n", relation, err.Error())
+		return cfg, nil
+	}
+	if !hypertable {
+		return cfg, nil
+	}
+	quoted := quoteRelation(relation)
+
+	var h hypertableInfo
+	err = q.QueryRow(ctx,
+		"SELECT hypertable_size($1::regclass), (SELECT count(*) FROM show_chunks($1::regclass))",
+		quoted).Scan(&h.TotalBytes, &h.Chunks)
+	if err != nil {
+		log.Printf("[WARN] Unable to read size of hypertable %s: %s\n", relation, err.Error())
+	} else {
+		cfg.Hypertable = &h
+	}
+
+	cfg.Dimensions, err = readDimensions(ctx, q, quoted)
+	if err != nil {
+		log.Printf("[WARN] Unable to read dimensions of hypertable %s: %s\n", relation, err.Error())
+	}
+
+	var c hypertableCompStats
+	err = q.QueryRow(ctx,
+		`SELECT total_chunks, number_compressed_chunks, before_compression_total_bytes, after_compression_total_bytes
+		FROM hypertable_compression_stats($1::regclass)`, quoted).Scan(
+		&c.TotalChunks, &c.CompressedChunks, &c.BytesBefore, &c.BytesAfter)
+	switch {
+	case err == pgx.ErrNoRows:
+	case err != nil:
+		log.Printf("[WARN] Unable to read compression stats of hypertable %s: %s\n", relation, err.Error())
+	default:
+		cfg.Compression = &c
+	}
+
+	cfg.Jobs, err = readJobs(ctx, q, quoted)
+	if err != nil {
+		log.Printf("[WARN] Unable to read jobs of hypertable %s: %s\n", relation, err.Error())
+	}
+
+	return cfg, nil
+}
+
+func readDimensions(ctx context.Context, q querier, relation string) ([]hypertableDim, error) {
+	rows, err := q.Query(ctx,
+		`SELECT column_name, dimension_type, time_interval::text
+		FROM timescaledb_information.dimensions
+		WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass
+		ORDER BY dimension_number`, relation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dims []hypertableDim
+	for rows.Next() {
+		var d hypertableDim
+		if err := rows.Scan(&d.Column, &d.Type, &d.Interval); err != nil {
+			return nil, err
+		}
+		dims = append(dims, d)
+	}
+	return dims, rows.Err()
+}
+
+func readJobs(ctx context.Context, q querier, relation string) ([]timescaleJob, error) {
+	rows, err := q.Query(ctx,
+		`SELECT job_id, application_name, schedule_interval::text, scheduled, COALESCE(config::text, '')
+		FROM timescaledb_information.jobs
+		WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass
+		ORDER BY job_id`, relation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []timescaleJob
+	for rows.Next() {
+		var j timescaleJob
+		if err := rows.Scan(&j.ID, &j.Application, &j.ScheduleInterval, &j.Scheduled, &j.Config); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func printServerConfig(cfg *serverConfig) {
+	fmt.Printf("\n## Server configuration (at start of run)\n")
+	for _, s := range cfg.Settings {
+		fmt.Printf("  %-40s %-12s (%s)\n", s.Name, s.Setting, s.Source)
+	}
+
+	if h := cfg.Hypertable; h != nil {
+		fmt.Printf("Hypertable size:   %.1f MiB in %d chunks of %s\n", float64(h.TotalBytes)/(1<<20), h.Chunks, cfg.Relation)
+	}
+	for _, d := range cfg.Dimensions {
+		interval := "-"
+		if d.Interval != nil {
+			interval = *d.Interval
+		}
+		fmt.Printf("Dimension:         %s (%s, interval %s)\n", d.Column, d.Type, interval)
+	}
+	if c := cfg.Compression; c != nil && c.CompressedChunks != nil {
+		fmt.Printf("Compressed chunks: %d of %d", *c.CompressedChunks, c.TotalChunks)
+		if c.BytesBefore != nil && c.BytesAfter != nil && *c.BytesAfter > 0 {
+			fmt.Printf(" (%.1fx smaller)", float64(*c.BytesBefore)/float64(*c.BytesAfter))
+		}
+		fmt.Printf("\n")
+	}
+	for _, j := range cfg.Jobs {
+		state := "scheduled"
+		if !j.Scheduled {
+			state = "paused"
+		}
+		fmt.Printf("Job %d:            %s every %s, %s %s\n", j.ID, j.Application, j.ScheduleInterval, state, j.Config)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Default name of the -shadow-dsn target in the report
+const defaultShadowLabel = "candidate"
+
+// Mismatched queries listed in the shadow report
+const shadowExamples = 10
+
+// shadowRun is the candidate's side of one shadowed query
+type shadowRun struct {
+	result  benchResult
+	fetched fetched
+}
+
+// shadowOutcome compares the candidate's result for a query with the
+// primary's, and is carried by the primary's result
+type shadowOutcome struct {
+	err  error
+	rows int64
+
+	// Set if both succeeded, with the same rows in any order
+	match bool
+}
+
+// shadowQuery runs q against the shadow target, on conn if pinned or else a
+// connection of its own, while the worker runs it against the primary. The
+// candidate has its own -latency-budget, so a slow primary doesn't cut it
+// short.
+func (b *Benchmarker) shadowQuery(id int, attempt int, q task, conn *pgxpool.Conn, mockRng *rand.Rand) shadowRun {
+	cfg := b.cfg.Dispatch
+	q.target = cfg.shadow
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if cfg.latencyBudget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.latencyBudget)
+	}
+	defer cancel()
+
+	t0 := time.Now()
+	pooled := conn == nil && q.target.mock == nil
+	var err error
+	if pooled {
+		conn, err = q.target.pool.Acquire(ctx)
+	}
+	acquired := time.Now()
+	var result fetched
+	if err == nil && q.target.mock != nil {
+		result, err = q.target.mock.run(ctx, mockRng)
+	} else if err == nil {
+		result, err = runQueryChecksum(ctx, withWireOptions(conn, q.protocol, q.resultFormat), q.target.query(q.variant), q.args()...)
+	}
+	t1 := time.Now()
+	if pooled && conn != nil {
+		conn.Release()
+	}
+
+	r := benchResult{
+		task:        q,
+		worker:      id,
+		attempt:     attempt,
+		queryTime:   t1.Sub(t0).Microseconds(),
+		finished:    t1,
+		err:         err,
+		queueTime:   q.pickedUp.Sub(q.dispatched).Microseconds(),
+		rows:        result.rows,
+		resultBytes: result.bytes,
+		overBudget:  err != nil && ctx.Err() == context.DeadlineExceeded,
+	}
+	if !result.firstRow.IsZero() {
+		r.firstRowTime = result.firstRow.Sub(t0).Microseconds()
+	}
+	if pooled {
+		r.acquireTime = acquired.Sub(t0).Microseconds()
+	}
+	if !q.intended.IsZero() {
+		r.correctedTime = t1.Sub(q.intended).Microseconds()
+	}
+	return shadowRun{result: r, fetched: result}
+}
+
+func compareShadow(primaryErr error, primary fetched, candidate shadowRun) *shadowOutcome {
+	return &shadowOutcome{
+		err:   candidate.result.err,
+		rows:  candidate.fetched.rows,
+		match: primaryErr == nil && candidate.result.err == nil && primary.rows == candidate.fetched.rows && primary.checksum == candidate.fetched.checksum,
+	}
+}
+
+// shadowMismatch is a query whose results differed, or which failed on
+// only one side
+type shadowMismatch struct {
+	Hostname      string `json:"hostname"`
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	Variant       string `json:"variant"`
+	PrimaryRows   int64  `json:"primary_rows"`
+	CandidateRows int64  `json:"candidate_rows"`
+	Error         string `json:"error,omitempty"`
+}
+
+// shadowReport counts how often the candidate's results agreed with the
+// primary's. Latencies are compared with the other targets'.
+type shadowReport struct {
+	label string
+
+	compared        int
+	mismatched      int
+	candidateFailed int
+	primaryFailed   int
+	bothFailed      int
+	examples        []shadowMismatch
+}
+
+func newShadowReport(label string) *shadowReport {
+	return &shadowReport{label: label}
+}
+
+func (s *shadowReport) add(r benchResult) {
+	o := r.shadow
+	m := shadowMismatch{
+		Hostname:      r.task.hostname,
+		Start:         r.task.start,
+		End:           r.task.end,
+		Variant:       r.task.variant.name,
+		PrimaryRows:   r.rows,
+		CandidateRows: o.rows,
+	}
+	switch {
+	case r.err != nil && o.err != nil:
+		s.bothFailed++
+		return
+	case r.err != nil:
+		s.primaryFailed++
+		m.Error = "primary: " + r.err.Error()
+	case o.err != nil:
+		s.candidateFailed++
+		m.Error = s.label + ": " + o.err.Error()
+	default:
+		s.compared++
+		if o.match {
+			return
+		}
+		s.mismatched++
+	}
+	if len(s.examples) < shadowExamples {
+		s.examples = append(s.examples, m)
+	}
+}
+
+func printShadowReport(s *shadowReport) {
+	fmt.Printf("\n## Shadow comparison\n")
+	fmt.Printf("Candidate:         %s\n", s.label)
+	fmt.Printf("Compared:          %d queries which succeeded on both\n", s.compared)
+	mismatched := strconv.Itoa(s.mismatched)
+	if s.compared > 0 {
+		mismatched = fmt.Sprintf("%d (%.2f%%)", s.mismatched, 100*float64(s.mismatched)/float64(s.compared))
+	}
+	fmt.Printf("Mismatched:        %s\n", colorize(mismatched, colorIf(s.mismatched > 0, false)))
+	fmt.Printf("Failed on primary: %d\n", s.primaryFailed)
+	fmt.Printf("%-18s %d\n", "Failed on "+s.label+":", s.candidateFailed)
+	if s.bothFailed > 0 {
+		fmt.Printf("Failed on both:    %d\n", s.bothFailed)
+	}
+	if len(s.examples) == 0 {
+		return
+	}
+	fmt.Printf("%-20s %-20s %-20s %9s %9s  %s\n", "hostname", "start", "end", "primary", s.label, "error")
+	for _, m := range s.examples {
+		fmt.Printf("%-20s %-20s %-20s %9d %9d  %s\n", m.Hostname, m.Start, m.End, m.PrimaryRows, m.CandidateRows, m.Error)
+	}
+	fmt.Printf("(rows returned; the first %d differences)\n", shadowExamples)
+}
+
+// shadowStats is the shadow comparison in the manifest
+type shadowStats struct {
+	Candidate       string           `json:"candidate"`
+	Compared        int              `json:"compared"`
+	Mismatched      int              `json:"mismatched"`
+	PrimaryFailed   int              `json:"primary_failed"`
+	CandidateFailed int              `json:"candidate_failed"`
+	BothFailed      int              `json:"both_failed"`
+	Examples        []shadowMismatch `json:"examples,omitempty"`
+}
+
+func newShadowStats(s *shadowReport) *shadowStats {
+	return &shadowStats{
+		Candidate:       s.label,
+		Compared:        s.compared,
+		Mismatched:      s.mismatched,
+		PrimaryFailed:   s.primaryFailed,
+		CandidateFailed: s.candidateFailed,
+		BothFailed:      s.bothFailed,
+		Examples:        s.examples,
+	}
+}
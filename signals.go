@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// handleShutdownSignals closes stop on the first shutdown signal, so that
+// dispatch stops, in-flight queries drain and the report is printed. A second
+// signal calls abort, to flush partially written output, and exits.
+func handleShutdownSignals(stop chan<- struct{}, abort func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, shutdownSignals...)
+	go func() {
+		sig := <-signals
+		log.Printf("[INFO] Received %s, finishing in-flight queries (repeat to abort)\n", sig)
+		close(stop)
+
+		sig = <-signals
+		log.Printf("[WARN] Received %s again, aborting\n", sig)
+		abort()
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Go delivers Ctrl-C and Ctrl-Break as os.Interrupt, and closing the console,
+// logging off or shutting down as SIGTERM
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// sloReport scores query times against a latency objective. Failed queries
+// count as frustrated, as they would for a user.
+type sloReport struct {
+	target     time.Duration
+	tolerance  float64
+	satisfied  int
+	tolerating int
+	frustrated int
+}
+
+func newSLOReport(target time.Duration, tolerance float64) *sloReport {
+	return &sloReport{
+		target:    target,
+		tolerance: tolerance,
+	}
+}
+
+// add scores a successful query time, in microseconds
+func (r *sloReport) add(t int64) {
+	satisfiedUs := r.target.Microseconds()
+	toleratingUs := int64(float64(satisfiedUs) * r.tolerance)
+	switch {
+	case t <= satisfiedUs:
+		r.satisfied++
+	case t <= toleratingUs:
+		r.tolerating++
+	default:
+		r.frustrated++
+	}
+}
+
+func (r *sloReport) addFailure() {
+	r.frustrated++
+}
+
+func (r *sloReport) total() int {
+	return r.satisfied + r.tolerating + r.frustrated
+}
+
+func (r *sloReport) apdex() float64 {
+	return (float64(r.satisfied) + float64(r.tolerating)/2) / float64(r.total())
+}
+
+func printSLOReport(r *sloReport) {
+	total := float64(r.total())
+	toleratingLimit := time.Duration(float64(r.target) * r.tolerance)
+
+	fmt.Printf("\n## SLO\n")
+	fmt.Printf("Target:            %s\n", r.target)
+	fmt.Printf("Meeting SLO:       %.2f%%\n", 100*float64(r.satisfied)/total)
+	fmt.Printf("Tolerating:        %.2f%% (<= %s)\n", 100*float64(r.tolerating)/total, toleratingLimit)
+	fmt.Printf("Frustrated:        %.2f%% (incl. failures)\n", 100*float64(r.frustrated)/total)
+	// Apdex ratings: 0.94 and above is excellent, below 0.85 poor
+	apdex := r.apdex()
+	fmt.Printf("Apdex:             %s\n", colorize(fmt.Sprintf("%.3f", apdex), colorIf(apdex < 0.85, apdex >= 0.94)))
+}
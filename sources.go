@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source file name which reads stdin, as for -file
+const stdinName = "-"
+
+// Layout of the start and end times of generated tasks
+const generatedTimeLayout = "2006-01-02 15:04:05"
+
+// Defaults for generated tasks, matching the sample cpu_usage data
+var (
+	defaultGenerateHosts  = 20
+	defaultGenerateWindow = time.Hour
+	defaultGenerateFrom   = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	defaultGenerateTo     = time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)
+)
+
+// sourceSpec describes one of several task sources combined with -source:
+// either an input file (- for stdin) or a generator of random tasks
+type sourceSpec struct {
+	name string
+
+	file   string
+	format string
+	reader io.Reader
+	meter  *inputMeter
+
+	// Number of tasks to generate, over hostnames host_000000 onwards and
+	// windows of the given length between from and to
+	generate int
+	hosts    int
+	window   time.Duration
+	from     time.Time
+	to       time.Time
+
+	// Tasks per second taken from the source; 0 for as fast as they're
+	// dispatched
+	rate float64
+}
+
+// sourceFlags collects repeated -source flags, each a comma-separated list
+// of key=value options, e.g. name=bulk,file=big.csv,rate=50
+type sourceFlags []*sourceSpec
+
+func (s *sourceFlags) String() string {
+	var names []string
+	for _, spec := range *s {
+		names = append(names, spec.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (s *sourceFlags) Set(value string) error {
+	spec := &sourceSpec{
+		hosts:  defaultGenerateHosts,
+		window: defaultGenerateWindow,
+		from:   defaultGenerateFrom,
+		to:     defaultGenerateTo,
+	}
+	for _, opt := range strings.Split(value, ",") {
+		eq := strings.Index(opt, "=")
+		if eq < 0 {
+			return fmt.Errorf("expected key=value, got %q", opt)
+		}
+		key, v := strings.TrimSpace(opt[:eq]), strings.TrimSpace(opt[eq+1:])
+		var err error
+		switch key {
+		case "name":
+			spec.name = v
+		case "file":
+			spec.file = v
+		case "format":
+			if v != inputFormatCSV && v != inputFormatNDJSON {
+				err = fmt.Errorf("expected %s or %s", inputFormatCSV, inputFormatNDJSON)
+			}
+			spec.format = v
+		case "generate":
+			spec.generate, err = strconv.Atoi(v)
+			if err == nil && spec.generate < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "hosts":
+			spec.hosts, err = strconv.Atoi(v)
+			if err == nil && spec.hosts < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "window":
+			spec.window, err = time.ParseDuration(v)
+			if err == nil && spec.window <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "from":
+			spec.from, err = time.Parse(generatedTimeLayout, v)
+		case "to":
+			spec.to, err = time.Parse(generatedTimeLayout, v)
+		case "rate":
+			spec.rate, err = strconv.ParseFloat(v, 64)
+			if err == nil && spec.rate < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %q: %w", opt, err)
+		}
+	}
+
+	switch {
+	case spec.name == "":
+		return fmt.Errorf("source needs a name")
+	case (spec.file == "") == (spec.generate == 0):
+		return fmt.Errorf("source %q needs exactly one of file or generate", spec.name)
+	case spec.generate > 0 && spec.format != "":
+		return fmt.Errorf("source %q: format only applies to files", spec.name)
+	case spec.generate > 0 && spec.to.Sub(spec.from) < spec.window:
+		return fmt.Errorf("source %q: from and to must be at least a window apart", spec.name)
+	}
+	for _, other := range *s {
+		if other.name == spec.name {
+			return fmt.Errorf("source %q given more than once", spec.name)
+		}
+		if other.file == stdinName && spec.file == stdinName {
+			return fmt.Errorf("only one source can read stdin")
+		}
+	}
+	*s = append(*s, spec)
+	return nil
+}
+
+// names returns the sources' names in the order given
+func (s sourceFlags) names() []string {
+	var names []string
+	for _, spec := range s {
+		names = append(names, spec.name)
+	}
+	return names
+}
+
+// generated is the number of tasks the sources will produce if they're all
+// generators, or 0 if any reads a file
+func (s sourceFlags) generated() int {
+	total := 0
+	for _, spec := range s {
+		if spec.generate == 0 {
+			return 0
+		}
+		total += spec.generate
+	}
+	return total
+}
+
+// open opens each file source, so a missing file is reported before the
+// run starts
+func (s sourceFlags) open() error {
+	for _, spec := range s {
+		switch spec.file {
+		case "":
+		case stdinName:
+			spec.reader = os.Stdin
+		default:
+			f, err := os.Open(spec.file)
+			if err != nil {
+				return fmt.Errorf("source %q: %w", spec.name, err)
+			}
+			spec.reader = f
+		}
+		if spec.reader != nil {
+			spec.meter = newInputMeter(spec.reader)
+			spec.reader = spec.meter
+		}
+	}
+	return nil
+}
+
+// meters returns the input meters of the file sources, once opened
+func (s sourceFlags) meters() []*inputMeter {
+	var meters []*inputMeter
+	for _, spec := range s {
+		if spec.meter != nil {
+			meters = append(meters, spec.meter)
+		}
+	}
+	return meters
+}
+
+// start reads or generates every source's tasks concurrently, labelling
+// each with its source and merging them into out, which is closed once all
+// of the sources are exhausted
+func (s sourceFlags) start(format inputFormat, parsers int, batchSize int, seed int64, out chan<- []parsedRecord) {
+	var wg sync.WaitGroup
+	for _, spec := range s {
+		in := make(chan []parsedRecord, parsers)
+		if spec.generate > 0 {
+			go generateTasks(spec, seed, batchSize, in)
+		} else {
+			f := format
+			if spec.format != "" {
+				f.encoding = spec.format
+			}
+			go parseInput(spec.reader, f, parsers, batchSize, in)
+		}
+		if spec.rate > 0 {
+			paced := make(chan []parsedRecord)
+			go paceInput(in, paced, spec.rate)
+			in = paced
+		}
+
+		wg.Add(1)
+		go func(name string, in <-chan []parsedRecord) {
+			defer wg.Done()
+			for batch := range in {
+				for i := range batch {
+					batch[i].task.source = name
+				}
+				out <- batch
+			}
+		}(spec.name, in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// generateTasks sends spec.generate random tasks to out, then closes it
+func generateTasks(spec *sourceSpec, seed int64, batchSize int, out chan<- []parsedRecord) {
+	rng := newRand(seed, "source-"+spec.name)
+	span := int64(spec.to.Sub(spec.from) - spec.window)
+
+	var batch []parsedRecord
+	for i := 1; i <= spec.generate; i++ {
+		start := spec.from.Add(time.Duration(rng.Int63n(span + 1))).Truncate(time.Second)
+		end := start.Add(spec.window)
+		batch = append(batch, parsedRecord{
+			row: i,
+			task: task{
+				hostname:  fmt.Sprintf("host_%06d", rng.Intn(spec.hosts)),
+				start:     start.Format(generatedTimeLayout),
+				end:       end.Format(generatedTimeLayout),
+				startTime: start,
+				endTime:   end,
+			},
+		})
+		if len(batch) == batchSize {
+			out <- batch
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		out <- batch
+	}
+	close(out)
+}
+
+// paceInput passes records from in to out one at a time, no faster than
+// rate valid records per second
+func paceInput(in <-chan []parsedRecord, out chan<- []parsedRecord, rate float64) {
+	interval := time.Duration(float64(time.Second) / rate)
+	next := time.Now()
+	for batch := range in {
+		for _, r := range batch {
+			if r.err == nil {
+				if wait := time.Until(next); wait > 0 {
+					time.Sleep(wait)
+				}
+				next = next.Add(interval)
+			}
+			out <- []parsedRecord{r}
+		}
+	}
+	close(out)
+}
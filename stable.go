@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// How often -until-stable checks the p99's confidence interval
+const stabilityCheckInterval = time.Second
+
+// The quantile checked by -until-stable, and the normal quantile for a 95%
+// confidence interval around it
+const (
+	stabilityQuantile = 0.99
+	stabilityZ        = 1.96
+)
+
+// loopInput passes batches from in to out. Once in is exhausted, it repeats
+// the valid records until stop is closed, then closes out.
+func loopInput(in <-chan []parsedRecord, out chan<- []parsedRecord, stop <-chan struct{}) {
+	var kept [][]parsedRecord
+	for batch := range in {
+		var valid []parsedRecord
+		for _, r := range batch {
+			if r.err == nil {
+				r.looped = true
+				valid = append(valid, r)
+			}
+		}
+		if len(valid) > 0 {
+			kept = append(kept, valid)
+		}
+
+		select {
+		case out <- batch:
+		case <-stop:
+			close(out)
+			return
+		}
+	}
+	if len(kept) == 0 {
+		close(out)
+		return
+	}
+
+	kept[0][0].passStart = true
+	for pass := 2; ; pass++ {
+		log.Printf("[INFO] End of input, starting pass %d\n", pass)
+		for _, batch := range kept {
+			select {
+			case out <- batch:
+			case <-stop:
+				close(out)
+				return
+			}
+		}
+	}
+}
+
+// quantileInterval returns a distribution-free confidence interval for the
+// q-quantile of sorted, between the order statistics either side of it. ok
+// is false if there are too few values to bound the interval.
+func quantileInterval(sorted []int64, q float64, z float64) (lo, hi int64, ok bool) {
+	n := float64(len(sorted))
+	spread := z * math.Sqrt(n*q*(1-q))
+	l := int(math.Floor(n*q - spread))
+	u := int(math.Ceil(n*q + spread))
+	if l < 0 || u >= len(sorted) {
+		return 0, 0, false
+	}
+	return sorted[l], sorted[u], true
+}
+
+// stability tracks the confidence interval of the p99 under -until-stable
+type stability struct {
+	width       float64
+	maxDuration time.Duration
+
+	// As of the last check
+	count     int
+	estimate  float64
+	lo, hi    int64
+	bounded   bool
+	converged bool
+}
+
+func newStability(width float64, maxDuration time.Duration) *stability {
+	return &stability{width: width, maxDuration: maxDuration}
+}
+
+// relativeWidth is the width of the interval relative to the estimate
+func (s *stability) relativeWidth() float64 {
+	return float64(s.hi-s.lo) / s.estimate
+}
+
+// check updates the interval from the sorted query times, and reports
+// whether it's narrower than the target width
+func (s *stability) check(sorted []int64) bool {
+	s.count = len(sorted)
+	s.lo, s.hi, s.bounded = quantileInterval(sorted, stabilityQuantile, stabilityZ)
+	if !s.bounded {
+		return false
+	}
+	s.estimate = stats.Quantile(sorted, stabilityQuantile)
+	s.converged = s.estimate > 0 && s.relativeWidth() <= s.width
+	return s.converged
+}
+
+func printStabilityReport(s *stability) {
+	fmt.Printf("\n## Stability (p99, 95%% confidence)\n")
+	if !s.bounded {
+		fmt.Printf("Too few queries (%d) to bound the p99 before %s elapsed\n", s.count, s.maxDuration)
+		return
+	}
+	fmt.Printf("P99 query time:    %.3fms (%.3fms-%.3fms, %.1f%% wide)\n",
+		s.estimate/1000.0, float64(s.lo)/1000.0, float64(s.hi)/1000.0, 100*s.relativeWidth())
+	if s.converged {
+		fmt.Printf("Converged:         after %d queries (target %.1f%%)\n", s.count, 100*s.width)
+	} else {
+		fmt.Printf("Converged:         %s\n", colorize(fmt.Sprintf("no, stopped after %s (target %.1f%%)", s.maxDuration, 100*s.width), colorRed))
+	}
+}
@@ -0,0 +1,267 @@
+// Package stats aggregates latency distributions in bounded memory.
+//
+// An Aggregator keeps values in logarithmically sized buckets rather than
+// retaining them, so quantiles are approximate, to a fixed relative accuracy,
+// while count, sum, min and max are exact. Aggregators with the same accuracy
+// can be merged, so per-worker or per-agent distributions can be combined
+// without shipping the raw samples.
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultAccuracy is the relative accuracy of quantiles from NewAggregator(0)
+const DefaultAccuracy = 0.01
+
+// Values at or below this magnitude are counted as zero, which keeps the
+// number of buckets bounded for tiny values
+const minTracked = 1e-9
+
+// Aggregator accumulates a distribution of non-negative values. It is not
+// safe for concurrent use; give each goroutine its own and Merge them.
+type Aggregator struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+
+	buckets map[int]uint64
+	zero    uint64
+
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// Summary describes an aggregated distribution
+type Summary struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// NewAggregator returns an empty Aggregator whose quantiles are within
+// accuracy (e.g. 0.01 for 1%) of the true value. Zero selects
+// DefaultAccuracy.
+func NewAggregator(accuracy float64) *Aggregator {
+	if accuracy <= 0 || accuracy >= 1 {
+		accuracy = DefaultAccuracy
+	}
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &Aggregator{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		buckets:  make(map[int]uint64),
+	}
+}
+
+// Accuracy returns the relative accuracy of the Aggregator's quantiles
+func (a *Aggregator) Accuracy() float64 {
+	return a.accuracy
+}
+
+// Count returns the number of values added
+func (a *Aggregator) Count() uint64 {
+	return a.count
+}
+
+// Add records v. Negative values are counted as zero.
+func (a *Aggregator) Add(v float64) {
+	if v < 0 {
+		v = 0
+	}
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if v > a.max {
+		a.max = v
+	}
+	a.count++
+	a.sum += v
+
+	if v <= minTracked {
+		a.zero++
+		return
+	}
+	a.buckets[a.index(v)]++
+}
+
+// Merge adds every value recorded by o to a. Both must have been created
+// with the same accuracy.
+func (a *Aggregator) Merge(o *Aggregator) error {
+	if o.accuracy != a.accuracy {
+		return fmt.Errorf("can't merge aggregators with accuracy %g and %g", a.accuracy, o.accuracy)
+	}
+	if o.count == 0 {
+		return nil
+	}
+	if a.count == 0 || o.min < a.min {
+		a.min = o.min
+	}
+	if o.max > a.max {
+		a.max = o.max
+	}
+	a.count += o.count
+	a.sum += o.sum
+	a.zero += o.zero
+	for i, n := range o.buckets {
+		a.buckets[i] += n
+	}
+	return nil
+}
+
+// Reset discards all recorded values
+func (a *Aggregator) Reset() {
+	a.buckets = make(map[int]uint64)
+	a.zero = 0
+	a.count = 0
+	a.sum = 0
+	a.min = 0
+	a.max = 0
+}
+
+// Quantile returns an estimate of the q-quantile (0 <= q <= 1), or 0 if no
+// values were added
+func (a *Aggregator) Quantile(q float64) float64 {
+	if a.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return a.min
+	}
+	if q >= 1 {
+		return a.max
+	}
+
+	rank := uint64(q * float64(a.count-1))
+	if rank < a.zero {
+		return 0
+	}
+	seen := a.zero
+	keys := a.sortedKeys()
+	for _, i := range keys {
+		seen += a.buckets[i]
+		if seen > rank {
+			return a.clamp(a.value(i))
+		}
+	}
+	return a.max
+}
+
+// Summary returns exact counters together with estimated quantiles
+func (a *Aggregator) Summary() Summary {
+	if a.count == 0 {
+		return Summary{}
+	}
+	return Summary{
+		Count: a.count,
+		Sum:   a.sum,
+		Min:   a.min,
+		Max:   a.max,
+		Mean:  a.sum / float64(a.count),
+		P50:   a.Quantile(0.50),
+		P90:   a.Quantile(0.90),
+		P95:   a.Quantile(0.95),
+		P99:   a.Quantile(0.99),
+	}
+}
+
+// index returns the bucket holding v, covering (gamma^(i-1), gamma^i]
+func (a *Aggregator) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / a.logGamma))
+}
+
+// value returns the representative value of bucket i, which is within the
+// accuracy of every value in the bucket
+func (a *Aggregator) value(i int) float64 {
+	return 2 * math.Pow(a.gamma, float64(i)) / (a.gamma + 1)
+}
+
+// clamp keeps estimates within the exact range of recorded values
+func (a *Aggregator) clamp(v float64) float64 {
+	if v < a.min {
+		return a.min
+	}
+	if v > a.max {
+		return a.max
+	}
+	return v
+}
+
+func (a *Aggregator) sortedKeys() []int {
+	keys := make([]int, 0, len(a.buckets))
+	for i := range a.buckets {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// aggregatorJSON is the serialised form of an Aggregator, with buckets as
+// parallel arrays of index and count
+type aggregatorJSON struct {
+	Accuracy float64  `json:"accuracy"`
+	Count    uint64   `json:"count"`
+	Sum      float64  `json:"sum"`
+	Min      float64  `json:"min"`
+	Max      float64  `json:"max"`
+	Zero     uint64   `json:"zero,omitempty"`
+	Indexes  []int    `json:"indexes"`
+	Counts   []uint64 `json:"counts"`
+}
+
+// MarshalJSON encodes the Aggregator's buckets, so it can be sent to another
+// process and merged there
+func (a *Aggregator) MarshalJSON() ([]byte, error) {
+	keys := a.sortedKeys()
+	out := aggregatorJSON{
+		Accuracy: a.accuracy,
+		Count:    a.count,
+		Sum:      a.sum,
+		Min:      a.min,
+		Max:      a.max,
+		Zero:     a.zero,
+		Indexes:  keys,
+		Counts:   make([]uint64, len(keys)),
+	}
+	for j, i := range keys {
+		out.Counts[j] = a.buckets[i]
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON replaces the Aggregator with one encoded by MarshalJSON
+func (a *Aggregator) UnmarshalJSON(b []byte) error {
+	var in aggregatorJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	if len(in.Indexes) != len(in.Counts) {
+		return fmt.Errorf("aggregator has %d bucket indexes but %d counts", len(in.Indexes), len(in.Counts))
+	}
+	if in.Accuracy <= 0 || in.Accuracy >= 1 {
+		return fmt.Errorf("invalid aggregator accuracy %g", in.Accuracy)
+	}
+
+	*a = *NewAggregator(in.Accuracy)
+	a.count = in.Count
+	a.sum = in.Sum
+	a.min = in.Min
+	a.max = in.Max
+	a.zero = in.Zero
+	for j, i := range in.Indexes {
+		a.buckets[i] += in.Counts[j]
+	}
+	return nil
+}
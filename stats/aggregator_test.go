@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestAggregatorQuantiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		accuracy float64
+		values   func(i int) float64
+		n        int
+	}{
+		{"ascending", 0.01, func(i int) float64 { return float64(i + 1) }, 1000},
+		{"wide range", 0.01, func(i int) float64 { return math.Pow(1.01, float64(i)) }, 2000},
+		{"coarse", 0.05, func(i int) float64 { return float64(i%100 + 1) }, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(tt.accuracy)
+			exact := make([]float64, tt.n)
+			for i := 0; i < tt.n; i++ {
+				v := tt.values(i)
+				a.Add(v)
+				exact[i] = v
+			}
+			sort.Float64s(exact)
+			for _, q := range []float64{0.5, 0.9, 0.95, 0.99} {
+				want := exact[int(q*float64(tt.n-1))]
+				if got := a.Quantile(q); math.Abs(got-want) > tt.accuracy*want {
+					t.Errorf("Quantile(%g) = %g, want %g within %g", q, got, want, tt.accuracy)
+				}
+			}
+			s := a.Summary()
+			if s.Count != uint64(tt.n) || s.Min != exact[0] || s.Max != exact[tt.n-1] {
+				t.Errorf("Summary() = %+v, want exact count, min and max", s)
+			}
+		})
+	}
+}
+
+func TestAggregatorMergeAndJSON(t *testing.T) {
+	a, b, whole := NewAggregator(0), NewAggregator(0), NewAggregator(0)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+		whole.Add(v)
+	}
+
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Aggregator
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.Summary(), whole.Summary(); got != want {
+		t.Errorf("merged Summary() = %+v, want %+v", got, want)
+	}
+
+	if err := a.Merge(NewAggregator(0.05)); err == nil {
+		t.Error("merging aggregators of different accuracy succeeded")
+	}
+}
@@ -0,0 +1,95 @@
+package stats
+
+import "sort"
+
+// Distribution summarises a set of exact values, such as query times in
+// microseconds
+type Distribution struct {
+	Count  int
+	Total  int64
+	Min    int64
+	Max    int64
+	Median int64
+
+	// Number of values the median was estimated from, if fewer than Count
+	Sampled int
+}
+
+// Mean returns the mean of the values, or NaN if there are none
+func (d Distribution) Mean() float32 {
+	return float32(d.Total) / float32(d.Count)
+}
+
+// Summarise computes the Distribution of values, sorting them in place. The
+// median of an even number of values is the mean of the middle two, rounded
+// down.
+func Summarise(values []int64) Distribution {
+	n := len(values)
+	if n == 0 {
+		return Distribution{}
+	}
+
+	// Accumulating all results and then sorting is not
+	// the most efficient, but makes calculating the median
+	// value straightforward
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+
+	d := Distribution{
+		Count: n,
+		Min:   values[0],
+		Max:   values[n-1],
+	}
+	for _, v := range values {
+		d.Total += v
+	}
+	if n%2 == 0 {
+		d.Median = (values[n/2-1] + values[n/2]) / 2
+	} else {
+		d.Median = values[n/2]
+	}
+	return d
+}
+
+// Quantile returns the q-quantile (0 <= q <= 1) of sorted, interpolating
+// linearly between the closest ranks, or 0 if sorted is empty
+func Quantile(sorted []int64, q float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	pos := q * float64(n-1)
+	lo := int(pos)
+	if lo >= n-1 {
+		return float64(sorted[n-1])
+	}
+	frac := pos - float64(lo)
+	return float64(sorted[lo]) + frac*float64(sorted[lo+1]-sorted[lo])
+}
+
+// TrimmedMean discards the lowest and highest frac of sorted before
+// averaging, so a handful of extreme values can't dominate the result
+func TrimmedMean(sorted []int64, frac float64) float64 {
+	k := int(frac * float64(len(sorted)))
+	kept := sorted[k : len(sorted)-k]
+	if len(kept) == 0 {
+		return Quantile(sorted, 0.5)
+	}
+	var total int64
+	for _, v := range kept {
+		total += v
+	}
+	return float64(total) / float64(len(kept))
+}
+
+// Outliers counts values beyond Tukey's upper fence (Q3 + 1.5 IQR) of sorted
+func Outliers(sorted []int64) (count int, fence float64) {
+	q1 := Quantile(sorted, 0.25)
+	q3 := Quantile(sorted, 0.75)
+	fence = q3 + 1.5*(q3-q1)
+	i := sort.Search(len(sorted), func(i int) bool {
+		return float64(sorted[i]) > fence
+	})
+	return len(sorted) - i, fence
+}
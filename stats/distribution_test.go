@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarise(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		want   Distribution
+	}{
+		{"empty", nil, Distribution{}},
+		{"single", []int64{7}, Distribution{Count: 1, Total: 7, Min: 7, Max: 7, Median: 7}},
+		{"odd", []int64{5, 1, 3}, Distribution{Count: 3, Total: 9, Min: 1, Max: 5, Median: 3}},
+		{"even averages the middle two", []int64{4, 1, 3, 2}, Distribution{Count: 4, Total: 10, Min: 1, Max: 4, Median: 2}},
+		{"even rounds down", []int64{1, 2, 4, 8}, Distribution{Count: 4, Total: 15, Min: 1, Max: 8, Median: 3}},
+		{"duplicates", []int64{2, 2, 2, 9}, Distribution{Count: 4, Total: 15, Min: 2, Max: 9, Median: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Summarise(tt.values); got != tt.want {
+				t.Errorf("Summarise(%v) = %+v, want %+v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummariseSorts(t *testing.T) {
+	values := []int64{3, 1, 2}
+	Summarise(values)
+	for i, want := range []int64{1, 2, 3} {
+		if values[i] != want {
+			t.Fatalf("values not sorted in place: %v", values)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	ascending := make([]int64, 1000)
+	for i := range ascending {
+		ascending[i] = int64(i + 1)
+	}
+	tests := []struct {
+		name   string
+		sorted []int64
+		q      float64
+		want   float64
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []int64{42}, 0.99, 42},
+		{"min", []int64{1, 2, 3}, 0, 1},
+		{"max", []int64{1, 2, 3}, 1, 3},
+		{"exact rank", []int64{10, 20, 30}, 0.5, 20},
+		{"interpolated", []int64{10, 20}, 0.25, 12.5},
+		{"p99 of 1..1000", ascending, 0.99, 990.01},
+		{"p90 of 1..1000", ascending, 0.90, 900.1},
+		{"outlier", append(make100(10), 10000), 0.99, 109.9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Quantile(tt.sorted, tt.q); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Quantile(%g) = %g, want %g", tt.q, got, tt.want)
+			}
+		})
+	}
+}
+
+// make100 returns 99 copies of v, so a single larger value makes 100
+func make100(v int64) []int64 {
+	values := make([]int64, 99)
+	for i := range values {
+		values[i] = v
+	}
+	return values
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []int64
+		frac   float64
+		want   float64
+	}{
+		{"no trim", []int64{1, 2, 3, 10}, 0, 4},
+		{"trims each end", []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 100}, 0.1, 5.5},
+		{"rounds the count down", []int64{1, 2, 3, 100}, 0.2, 26.5},
+		{"falls back to the median", []int64{1, 2, 3, 100}, 0.5, 2.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TrimmedMean(tt.sorted, tt.frac); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("TrimmedMean(%v, %g) = %g, want %g", tt.sorted, tt.frac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutliers(t *testing.T) {
+	tests := []struct {
+		name      string
+		sorted    []int64
+		wantCount int
+		wantFence float64
+	}{
+		{"none", []int64{1, 2, 3, 4, 5}, 0, 7},
+		{"one", []int64{1, 2, 3, 4, 100}, 1, 7},
+		{"constant", []int64{5, 5, 5, 5}, 0, 5},
+		{"at the fence is not an outlier", []int64{1, 2, 3, 4, 7}, 0, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, fence := Outliers(tt.sorted)
+			if count != tt.wantCount || math.Abs(fence-tt.wantFence) > 1e-9 {
+				t.Errorf("Outliers(%v) = %d, %g, want %d, %g", tt.sorted, count, fence, tt.wantCount, tt.wantFence)
+			}
+		})
+	}
+}
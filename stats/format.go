@@ -0,0 +1,51 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+)
+
+// FormatVersion identifies the text written by the Write functions. Reports
+// are parsed by downstream tools, so any change to the output, as caught by
+// the golden files in testdata, must come with a new version.
+const FormatVersion = 1
+
+// WriteSummary writes a Distribution of query times in microseconds as
+// milliseconds, one labelled figure per line
+func WriteSummary(w io.Writer, d Distribution) {
+	fmt.Fprintf(w, "Number of queries: %d\n", d.Count)
+	fmt.Fprintf(w, "Total query time:  %.3fms\n", float32(d.Total)/1000.0)
+	fmt.Fprintf(w, "Min query time:    %.3fms\n", float32(d.Min)/1000.0)
+	fmt.Fprintf(w, "Max query time:    %.3fms\n", float32(d.Max)/1000.0)
+	fmt.Fprintf(w, "Mean query time:   %.3fms\n", d.Mean()/1000.0)
+	fmt.Fprintf(w, "Median query time: %.3fms\n", float32(d.Median)/1000.0)
+	if d.Sampled > 0 {
+		fmt.Fprintf(w, "(median and other quantiles estimated from %d sampled queries)\n", d.Sampled)
+	}
+}
+
+// WritePercentiles writes the tail quantiles of sorted query times, which
+// must be in ascending order
+func WritePercentiles(w io.Writer, sorted []int64) {
+	fmt.Fprintf(w, "P90 query time:    %.3fms\n", Quantile(sorted, 0.90)/1000.0)
+	fmt.Fprintf(w, "P95 query time:    %.3fms\n", Quantile(sorted, 0.95)/1000.0)
+	fmt.Fprintf(w, "P99 query time:    %.3fms\n", Quantile(sorted, 0.99)/1000.0)
+}
+
+// WriteRobust writes statistics less sensitive to outliers than the plain
+// mean: the mean with trim of each end discarded, and the mean without
+// Outliers. sorted must be in ascending order.
+func WriteRobust(w io.Writer, sorted []int64, trim float64) {
+	n, fence := Outliers(sorted)
+
+	var inliers int64
+	for _, v := range sorted[:len(sorted)-n] {
+		inliers += v
+	}
+
+	fmt.Fprintf(w, "Trimmed mean (%g%%): %.3fms\n", trim*100, TrimmedMean(sorted, trim)/1000.0)
+	fmt.Fprintf(w, "Outliers:          %d (> %.3fms)\n", n, fence/1000.0)
+	if n > 0 && n < len(sorted) {
+		fmt.Fprintf(w, "Mean w/o outliers: %.3fms\n", float64(inliers)/1000.0/float64(len(sorted)-n))
+	}
+}
@@ -0,0 +1,102 @@
+package stats
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/name.golden, or rewrites the file under
+// -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; if the change is intended, run go test -update and bump FormatVersion\ngot:\n%s\nwant:\n%s",
+			path, got, want)
+	}
+}
+
+// Query times in microseconds, with a long tail
+var goldenTimes = []int64{1200, 3400, 980, 15000, 2200, 2100, 1800, 250000, 1900, 2050, 2300, 1750, 2600, 1650, 2900, 3100, 1980, 2020, 45000, 2150}
+
+func sortedGoldenTimes() []int64 {
+	sorted := append([]int64(nil), goldenTimes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func TestWriteSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Distribution
+	}{
+		{"summary", Summarise(append([]int64(nil), goldenTimes...))},
+		{"summary_sampled", Distribution{Count: 100000, Total: 250000000, Min: 800, Max: 900000, Median: 2100, Sampled: 10000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			WriteSummary(&b, tt.d)
+			golden(t, tt.name, b.Bytes())
+		})
+	}
+}
+
+func TestWritePercentiles(t *testing.T) {
+	var b bytes.Buffer
+	WritePercentiles(&b, sortedGoldenTimes())
+	golden(t, "percentiles", b.Bytes())
+}
+
+func TestWriteRobust(t *testing.T) {
+	tests := []struct {
+		name string
+		trim float64
+	}{
+		{"robust", 0.05},
+		{"robust_trim10", 0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			WriteRobust(&b, sortedGoldenTimes(), tt.trim)
+			golden(t, tt.name, b.Bytes())
+		})
+	}
+}
+
+func TestWriteHeatmap(t *testing.T) {
+	var points []HeatPoint
+	for i := 0; i < 500; i++ {
+		points = append(points, HeatPoint{
+			Offset:  time.Duration(i) * 10 * time.Millisecond,
+			Latency: 1000 + int64(i*7919%50000),
+		})
+	}
+	var b bytes.Buffer
+	WriteHeatmap(&b, ", variant fast", points)
+	golden(t, "heatmap", b.Bytes())
+
+	b.Reset()
+	WriteHeatmap(&b, "", nil)
+	if b.Len() != 0 {
+		t.Errorf("heatmap of no points wrote %q", b.String())
+	}
+}
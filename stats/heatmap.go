@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Cells across (time) and down (latency) in a heatmap
+const (
+	HeatmapWidth  = 60
+	HeatmapHeight = 12
+)
+
+// Characters in order of increasing query count
+var heatmapShades = []byte(" .:-=+*#%@")
+
+// HeatPoint is one query in a heatmap
+type HeatPoint struct {
+	Offset  time.Duration // since the start of the run
+	Latency int64         // microseconds
+}
+
+// WriteHeatmap renders query latency over time, with time on the X axis and
+// logarithmic latency buckets on the Y axis, under a heading ending in
+// suffix. Nothing is written for no points.
+func WriteHeatmap(w io.Writer, suffix string, points []HeatPoint) {
+	if len(points) == 0 {
+		return
+	}
+
+	minLat, maxLat := points[0].Latency, points[0].Latency
+	var duration time.Duration
+	for _, p := range points {
+		if p.Latency < minLat {
+			minLat = p.Latency
+		}
+		if p.Latency > maxLat {
+			maxLat = p.Latency
+		}
+		if p.Offset > duration {
+			duration = p.Offset
+		}
+	}
+	if minLat < 1 {
+		minLat = 1
+	}
+	if maxLat <= minLat {
+		maxLat = minLat + 1
+	}
+	if duration <= 0 {
+		duration = 1
+	}
+
+	logMin := math.Log(float64(minLat))
+	logSpan := math.Log(float64(maxLat)) - logMin
+
+	var grid [HeatmapHeight][HeatmapWidth]int
+	maxCount := 0
+	for _, p := range points {
+		x := int(float64(p.Offset) / float64(duration) * HeatmapWidth)
+		if x >= HeatmapWidth {
+			x = HeatmapWidth - 1
+		}
+		lat := p.Latency
+		if lat < minLat {
+			lat = minLat
+		}
+		y := int((math.Log(float64(lat)) - logMin) / logSpan * HeatmapHeight)
+		if y >= HeatmapHeight {
+			y = HeatmapHeight - 1
+		}
+		grid[y][x]++
+		if grid[y][x] > maxCount {
+			maxCount = grid[y][x]
+		}
+	}
+
+	fmt.Fprintf(w, "\n## Latency heatmap%s (max %d queries per cell)\n", suffix, maxCount)
+
+	span := maxCount - 1
+	if span < 1 {
+		span = 1
+	}
+
+	// Highest latencies at the top
+	for y := HeatmapHeight - 1; y >= 0; y-- {
+		upper := math.Exp(logMin + logSpan*float64(y+1)/HeatmapHeight)
+		var row strings.Builder
+		for x := 0; x < HeatmapWidth; x++ {
+			c := grid[y][x]
+			shade := 0
+			if c > 0 {
+				// Any non-empty cell gets at least the lightest visible shade
+				shade = 1 + (c-1)*(len(heatmapShades)-2)/span
+			}
+			row.WriteByte(heatmapShades[shade])
+		}
+		fmt.Fprintf(w, "%10.3fms |%s|\n", upper/1000.0, row.String())
+	}
+	fmt.Fprintf(w, "%12s +%s+\n", "", strings.Repeat("-", HeatmapWidth))
+	fmt.Fprintf(w, "%12s  %-*s%s\n", "", HeatmapWidth-len(duration.Round(time.Millisecond).String()), "0s",
+		duration.Round(time.Millisecond))
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Recorder accumulates exact values. With a limit, only a uniform random
+// sample (reservoir) of that many values is retained, so memory stays
+// bounded on very long runs; count, total, min and max remain exact.
+type Recorder struct {
+	limit   int
+	rng     *rand.Rand
+	count   int
+	total   int64
+	min     int64
+	max     int64
+	samples []int64
+}
+
+// NewRecorder returns an empty Recorder keeping at most limit values (0
+// keeps all), drawing its sample from rng
+func NewRecorder(limit int, rng *rand.Rand) *Recorder {
+	return &Recorder{limit: limit, rng: rng}
+}
+
+// Add records v
+func (r *Recorder) Add(v int64) {
+	if r.count == 0 || v < r.min {
+		r.min = v
+	}
+	if v > r.max {
+		r.max = v
+	}
+	r.count++
+	r.total += v
+
+	if r.limit <= 0 || len(r.samples) < r.limit {
+		r.samples = append(r.samples, v)
+		return
+	}
+	// Algorithm R: the nth value replaces a random sample with
+	// probability limit/n
+	if i := r.rng.Intn(r.count); i < r.limit {
+		r.samples[i] = v
+	}
+}
+
+// Count returns the number of values recorded
+func (r *Recorder) Count() int {
+	return r.count
+}
+
+// Total returns the sum of the values recorded
+func (r *Recorder) Total() int64 {
+	return r.total
+}
+
+// Max returns the largest value recorded, or 0 if none were
+func (r *Recorder) Max() int64 {
+	return r.max
+}
+
+// Sampled reports whether some recorded values were discarded
+func (r *Recorder) Sampled() bool {
+	return r.count > len(r.samples)
+}
+
+// Values returns the retained values in ascending order
+func (r *Recorder) Values() []int64 {
+	sort.Slice(r.samples, func(i, j int) bool {
+		return r.samples[i] < r.samples[j]
+	})
+	return r.samples
+}
+
+// Summary returns exact counters, with the median estimated from the
+// retained sample if values were discarded
+func (r *Recorder) Summary() Distribution {
+	if r.count == 0 {
+		return Distribution{}
+	}
+	d := Summarise(r.Values())
+	d.Count = r.count
+	d.Total = r.total
+	d.Min = r.min
+	d.Max = r.max
+	if r.Sampled() {
+		d.Sampled = len(r.samples)
+	}
+	return d
+}
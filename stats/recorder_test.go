@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name        string
+		limit       int
+		values      []int64
+		want        Distribution
+		wantSampled bool
+	}{
+		{"empty", 0, nil, Distribution{}, false},
+		{"unlimited", 0, []int64{3, 1, 2}, Distribution{Count: 3, Total: 6, Min: 1, Max: 3, Median: 2}, false},
+		{"within limit", 3, []int64{3, 1, 2}, Distribution{Count: 3, Total: 6, Min: 1, Max: 3, Median: 2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecorder(tt.limit, rand.New(rand.NewSource(1)))
+			for _, v := range tt.values {
+				r.Add(v)
+			}
+			if got := r.Summary(); got != tt.want {
+				t.Errorf("Summary() = %+v, want %+v", got, tt.want)
+			}
+			if r.Sampled() != tt.wantSampled {
+				t.Errorf("Sampled() = %v, want %v", r.Sampled(), tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestRecorderSampling(t *testing.T) {
+	const n, limit = 10000, 100
+	r := NewRecorder(limit, rand.New(rand.NewSource(1)))
+	for i := int64(1); i <= n; i++ {
+		r.Add(i)
+	}
+
+	d := r.Summary()
+	want := Distribution{Count: n, Total: n * (n + 1) / 2, Min: 1, Max: n, Median: d.Median, Sampled: limit}
+	if d != want {
+		t.Errorf("Summary() = %+v, want exact counters %+v", d, want)
+	}
+	if !r.Sampled() {
+		t.Error("Sampled() = false after exceeding the limit")
+	}
+
+	values := r.Values()
+	if len(values) != limit {
+		t.Fatalf("retained %d values, want %d", len(values), limit)
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1] {
+			t.Fatalf("Values() not in ascending order: %v", values)
+		}
+	}
+	// A uniform sample's median is close to the true median
+	if d.Median < n/4 || d.Median > 3*n/4 {
+		t.Errorf("sampled median %d far from %d", d.Median, n/2)
+	}
+}
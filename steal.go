@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tasks queued per worker under -steal before dispatch waits for room
+const stealQueueLength = 8
+
+// taskSource hands tasks to one worker. done is called once the worker has
+// finished with a task, including any retries.
+type taskSource interface {
+	next() (task, bool)
+	done(t task)
+}
+
+// chanSource feeds a worker from its own channel
+type chanSource <-chan task
+
+func (c chanSource) next() (task, bool) {
+	t, ok := <-c
+	return t, ok
+}
+
+func (c chanSource) done(task) {}
+
+// workQueues holds a queue of tasks per worker. A worker takes from its own
+// queue first, and once that has nothing it can run, steals the oldest
+// runnable task from another worker's queue. A task is runnable while fewer
+// than maxPerHost queries for its hostname are in flight, so stealing never
+// adds concurrency for a hostname.
+type workQueues struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	queues     [][]task
+	inflight   map[string]int
+	maxPerHost int
+	closed     bool
+
+	// Tasks each worker took from another's queue
+	steals []int
+}
+
+func newWorkQueues(workers int, maxPerHost int) *workQueues {
+	q := &workQueues{
+		queues:     make([][]task, workers),
+		inflight:   make(map[string]int),
+		maxPerHost: maxPerHost,
+		steals:     make([]int, workers),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds t to worker w's queue, waiting while the queue is full
+func (q *workQueues) push(w int, t task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queues[w]) >= stealQueueLength {
+		q.cond.Wait()
+	}
+	q.queues[w] = append(q.queues[w], t)
+	q.cond.Broadcast()
+}
+
+// close wakes workers waiting for tasks, so they exit once the queues
+// are empty
+func (q *workQueues) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// runnable returns the index of the first runnable task in worker w's
+// queue, or -1
+func (q *workQueues) runnable(w int) int {
+	for i, t := range q.queues[w] {
+		if q.inflight[t.hostname] < q.maxPerHost {
+			return i
+		}
+	}
+	return -1
+}
+
+// take removes and returns the task at index i of worker w's queue
+func (q *workQueues) take(w int, i int) task {
+	t := q.queues[w][i]
+	q.queues[w] = append(q.queues[w][:i:i], q.queues[w][i+1:]...)
+	return t
+}
+
+func (q *workQueues) empty() bool {
+	for _, tasks := range q.queues {
+		if len(tasks) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// source returns worker w's view of the queues
+func (q *workQueues) source(w int) taskSource {
+	return stealingSource{q: q, w: w}
+}
+
+type stealingSource struct {
+	q *workQueues
+	w int
+}
+
+func (s stealingSource) next() (task, bool) {
+	q := s.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		from, i := s.w, q.runnable(s.w)
+		if i < 0 {
+			// Steal from the longest queue, as the most overloaded worker
+			for v := range q.queues {
+				if v == s.w || (i >= 0 && len(q.queues[v]) <= len(q.queues[from])) {
+					continue
+				}
+				if j := q.runnable(v); j >= 0 {
+					from, i = v, j
+				}
+			}
+		}
+		if i >= 0 {
+			t := q.take(from, i)
+			if from != s.w {
+				q.steals[s.w]++
+			}
+			q.inflight[t.hostname]++
+			q.cond.Broadcast()
+			return t, true
+		}
+		if q.closed && q.empty() {
+			return task{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+func (s stealingSource) done(t task) {
+	q := s.q
+	q.mu.Lock()
+	q.inflight[t.hostname]--
+	if q.inflight[t.hostname] == 0 {
+		delete(q.inflight, t.hostname)
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// stealCounts returns the number of tasks each worker stole
+func (q *workQueues) stealCounts() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]int(nil), q.steals...)
+}
+
+// printStealReport lists how many tasks each worker stole, out of the
+// tasks run
+func printStealReport(steals []int, tasks int) {
+	total := 0
+	for _, n := range steals {
+		total += n
+	}
+	fmt.Printf("\n## Work stealing\n")
+	fmt.Printf("Stolen tasks:      %d (%.2f%%)\n", total, 100*float64(total)/float64(tasks))
+	if total == 0 {
+		return
+	}
+	fmt.Printf("%-8s %8s\n", "worker", "stolen")
+	for w, n := range steals {
+		if n > 0 {
+			fmt.Printf("%-8d %8d\n", w, n)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Default -store file for the report command
+const defaultStoreFile = "results.db"
+
+// Runs listed by report list unless -limit is given
+const defaultListLimit = 20
+
+// Each run's headline figures are kept in columns for listing, alongside the
+// full manifest
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id               TEXT PRIMARY KEY,
+	started          TEXT NOT NULL,
+	duration_seconds REAL NOT NULL,
+	version          TEXT NOT NULL,
+	server_version   TEXT NOT NULL,
+	config_hash      TEXT NOT NULL,
+	labels           TEXT NOT NULL,
+	attempted        INTEGER NOT NULL,
+	error_rate       REAL NOT NULL,
+	throughput_qps   REAL NOT NULL,
+	median_ms        REAL NOT NULL,
+	p99_ms           REAL NOT NULL,
+	manifest         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_started ON runs (started);
+`
+
+// openStore opens the SQLite results store in fileName, creating it if
+// necessary
+func openStore(fileName string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return db, nil
+}
+
+// saveRun adds a run to the store under its run ID
+func saveRun(db *sql.DB, m *runManifest) error {
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	labels, err := json.Marshal(m.Labels)
+	if err != nil {
+		return err
+	}
+	r := newHistoryRecord(m)
+	_, err = db.Exec(`INSERT INTO runs (id, started, duration_seconds, version, server_version, config_hash,
+			labels, attempted, error_rate, throughput_qps, median_ms, p99_ms, manifest)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.RunID, r.Time.UTC().Format(time.RFC3339Nano), r.DurationSeconds, r.Version, r.ServerVersion, r.ConfigHash,
+		string(labels), r.Attempted, r.ErrorRate, r.Throughput, r.Median, r.P99, string(manifest))
+	return err
+}
+
+// storedRun is a run's row in the store, without its manifest
+type storedRun struct {
+	id string
+	historyRecord
+}
+
+// listRuns returns the most recent runs with all of the given labels, newest
+// first
+func listRuns(db *sql.DB, labels map[string]string, limit int) ([]storedRun, error) {
+	rows, err := db.Query(`SELECT id, started, duration_seconds, version, server_version, config_hash,
+			labels, attempted, error_rate, throughput_qps, median_ms, p99_ms
+		FROM runs ORDER BY started DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []storedRun
+	for rows.Next() && len(runs) < limit {
+		var r storedRun
+		var started, runLabels string
+		err := rows.Scan(&r.id, &started, &r.DurationSeconds, &r.Version, &r.ServerVersion, &r.ConfigHash,
+			&runLabels, &r.Attempted, &r.ErrorRate, &r.Throughput, &r.Median, &r.P99)
+		if err != nil {
+			return nil, err
+		}
+		if r.Time, err = time.Parse(time.RFC3339Nano, started); err != nil {
+			return nil, fmt.Errorf("run %s: %w", r.id, err)
+		}
+		if err := json.Unmarshal([]byte(runLabels), &r.Labels); err != nil {
+			return nil, fmt.Errorf("run %s: %w", r.id, err)
+		}
+		if hasLabels(r.Labels, labels) {
+			runs = append(runs, r)
+		}
+	}
+	return runs, rows.Err()
+}
+
+// loadHistory returns every run in the store, oldest first, summarised
+// from its manifest for the figures not kept in columns
+func loadHistory(db *sql.DB) ([]storedRun, error) {
+	rows, err := db.Query("SELECT id, manifest FROM runs ORDER BY started")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []storedRun
+	for rows.Next() {
+		var id, manifest string
+		if err := rows.Scan(&id, &manifest); err != nil {
+			return nil, err
+		}
+		var m runManifest
+		if err := json.Unmarshal([]byte(manifest), &m); err != nil {
+			return nil, fmt.Errorf("run %s: %w", id, err)
+		}
+		runs = append(runs, storedRun{id: id, historyRecord: newHistoryRecord(&m)})
+	}
+	return runs, rows.Err()
+}
+
+func hasLabels(labels map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// loadRun returns the manifest of the run whose ID is, or uniquely starts
+// with, id
+func loadRun(db *sql.DB, id string) (*runManifest, error) {
+	rows, err := db.Query("SELECT id, manifest FROM runs WHERE substr(id, 1, length(?)) = ? ORDER BY id", id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids, manifests []string
+	for rows.Next() {
+		var runID, manifest string
+		if err := rows.Scan(&runID, &manifest); err != nil {
+			return nil, err
+		}
+		ids = append(ids, runID)
+		manifests = append(manifests, manifest)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch len(ids) {
+	case 0:
+		return nil, fmt.Errorf("no run %s", id)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%s is ambiguous: %s", id, strings.Join(ids, ", "))
+	}
+
+	var m runManifest
+	if err := json.Unmarshal([]byte(manifests[0]), &m); err != nil {
+		return nil, fmt.Errorf("run %s: %w", ids[0], err)
+	}
+	return &m, nil
+}
+
+func printRunList(runs []storedRun) {
+	fmt.Printf("%-26s %-20s %9s %7s %9s %10s %10s  %s\n",
+		"id", "started", "queries", "failed", "qps", "median", "p99", "labels")
+	for _, r := range runs {
+		fmt.Printf("%-26s %-20s %9d %6.2f%% %9.1f %10.3f %10.3f  %s\n",
+			r.id, r.Time.Local().Format("2006-01-02 15:04:05"), r.Attempted, 100*r.ErrorRate,
+			r.Throughput, r.Median, r.P99, labelFlags(r.Labels).String())
+	}
+	fmt.Printf("(times in ms)\n")
+}
+
+// printRunSummary prints a stored run's identity, headline figures and
+// flags
+func printRunSummary(m *runManifest) {
+	r := newHistoryRecord(m)
+	fmt.Printf("Run:               %s\n", m.RunID)
+	fmt.Printf("Started:           %s\n", r.Time.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Duration:          %.1fs\n", r.DurationSeconds)
+	fmt.Printf("Tool version:      %s (%s)\n", m.Tool.Version, m.Tool.Commit)
+	fmt.Printf("Server version:    %s\n", r.ServerVersion)
+	if len(m.Labels) > 0 {
+		fmt.Printf("Labels:            %s\n", labelFlags(m.Labels).String())
+	}
+	fmt.Printf("Config hash:       %s\n", r.ConfigHash)
+	for _, metric := range runMetrics(r) {
+		fmt.Printf("%-19s%.3f\n", metric.name+":", metric.value)
+	}
+
+	names := make([]string, 0, len(m.Config))
+	for name := range m.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Flags:\n")
+	for _, name := range names {
+		fmt.Printf("  %-18s %s\n", name, m.Config[name])
+	}
+}
+
+// runReport queries the results store: report [-store FILE] list|show|diff
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	storeFile := fs.String("store", defaultStoreFile, "SQLite results store written by -store")
+	asJSON := fs.Bool("json", false, "under show, print the run's full manifest as JSON")
+	limit := fs.Int("limit", defaultListLimit, "under list, the number of most recent runs to list")
+	labels := make(labelFlags)
+	fs.Var(labels, "label", "under list, only list runs with this key=value label (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: report [flags] list | show RUN | diff RUN RUN\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// Flags may also follow the command name
+	cmd := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	runs := fs.Args()
+
+	if _, err := os.Stat(*storeFile); err != nil {
+		log.Fatalf("[ERROR] Unable to open results store: %s\n", err.Error())
+	}
+	db, err := openStore(*storeFile)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to open results store: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	switch {
+	case cmd == "list" && len(runs) == 0:
+		list, err := listRuns(db, labels, *limit)
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to list runs: %s\n", err.Error())
+		}
+		printRunList(list)
+	case cmd == "show" && len(runs) == 1:
+		m, err := loadRun(db, runs[0])
+		if err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+		if *asJSON {
+			encodeManifest(os.Stdout, m)
+		} else {
+			printRunSummary(m)
+		}
+	case cmd == "diff" && len(runs) == 2:
+		a, err := loadRun(db, runs[0])
+		if err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+		b, err := loadRun(db, runs[1])
+		if err != nil {
+			log.Fatalf("[ERROR] %s\n", err.Error())
+		}
+		printRunDiff(a.RunID, a, b.RunID, b)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// intervalStats accumulates results between the periodic progress lines
+// logged under -stream, where the run may never reach a final report. Times
+// go into a bucketed aggregator so a busy interval doesn't retain every one.
+type intervalStats struct {
+	start  time.Time
+	times  *stats.Aggregator
+	failed int
+
+	// Total query time of every result (µs)
+	busy int64
+}
+
+func newIntervalStats() *intervalStats {
+	return &intervalStats{start: time.Now(), times: stats.NewAggregator(0)}
+}
+
+func (s *intervalStats) add(r benchResult) {
+	s.busy += r.queryTime
+	if r.err != nil {
+		s.failed++
+		return
+	}
+	s.times.Add(float64(r.queryTime))
+}
+
+// intervalPoint summarises one interval's results; times are in µs
+type intervalPoint struct {
+	start   time.Time
+	elapsed time.Duration
+	queries int
+	failed  int
+	busy    int64
+	times   stats.Summary
+}
+
+func (p intervalPoint) throughput() float64 {
+	if p.elapsed <= 0 {
+		return 0
+	}
+	return float64(p.queries) / p.elapsed.Seconds()
+}
+
+// utilisation is the fraction of workers' time spent running queries
+func (p intervalPoint) utilisation(workers int) float64 {
+	if workers == 0 || p.elapsed <= 0 {
+		return 0
+	}
+	return float64(p.busy) / (float64(workers) * float64(p.elapsed.Microseconds()))
+}
+
+// reset summarises the interval so far and starts a new one
+func (s *intervalStats) reset() intervalPoint {
+	now := time.Now()
+	p := intervalPoint{
+		start:   s.start,
+		elapsed: now.Sub(s.start),
+		queries: int(s.times.Count()),
+		failed:  s.failed,
+		busy:    s.busy,
+		times:   s.times.Summary(),
+	}
+
+	s.start = now
+	s.times.Reset()
+	s.failed = 0
+	s.busy = 0
+	return p
+}
+
+// logAndReset logs the interval's throughput and latencies, then starts a
+// new interval
+func (s *intervalStats) logAndReset(totalQueries int) {
+	p := s.reset()
+	elapsed := p.elapsed.Round(time.Second)
+	if p.queries == 0 {
+		log.Printf("[INFO] Last %s: 0 queries, %d failed (%d total)\n",
+			elapsed, p.failed, totalQueries)
+	} else {
+		log.Printf("[INFO] Last %s: %d queries (%.1f/s), %d failed, median %.3fms, p99 %.3fms, max %.3fms (%d total)\n",
+			elapsed, p.queries, p.throughput(), p.failed,
+			p.times.P50/1000.0, p.times.P99/1000.0, p.times.Max/1000.0, totalQueries)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const primaryTargetName = "primary"
+
+// Matches references to benchRelation in query SQL
+var benchRelationRef = regexp.MustCompile(`\b` + benchRelation + `\b`)
+
+// dbTarget is a database (or schema) the workload is run against. When a
+// comparison target is configured, every task runs against each target.
+type dbTarget struct {
+	name string
+
+	// pool is nil when queries are answered by mock instead
+	pool *pgxpool.Pool
+	mock *mockDriver
+
+	// Phases of establishing the pool's connections
+	connects *connTimings
+
+	// If set, queries against benchRelation are pointed at this relation
+	// instead, such as a continuous aggregate
+	relation string
+
+	// Each variant's SQL as run against this target, by variant name
+	sql map[string]string
+}
+
+// prepare rewrites the variants' SQL for the target's relation
+func (t *dbTarget) prepare(variants []queryVariant) {
+	t.sql = make(map[string]string)
+	for _, v := range variants {
+		sql := v.sql
+		if t.relation != "" {
+			sql = benchRelationRef.ReplaceAllLiteralString(sql, quoteRelation(t.relation))
+		}
+		t.sql[v.name] = sql
+	}
+}
+
+// query returns the SQL to run for v against the target
+func (t *dbTarget) query(v queryVariant) string {
+	if sql, ok := t.sql[v.name]; ok {
+		return sql
+	}
+	return v.sql
+}
+
+// relationName returns the relation the target's queries run against
+func (t *dbTarget) relationName() string {
+	if t.relation != "" {
+		return t.relation
+	}
+	return benchRelation
+}
+
+// quoteRelation quotes a possibly schema-qualified relation name
+func quoteRelation(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
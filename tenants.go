@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Tenant of hostnames which match none of the configured patterns
+const defaultTenantName = "default"
+
+// Most tasks the tenant scheduler holds, across all tenants, before it stops
+// reading input
+const tenantQueueLimit = 10000
+
+// tenant is a group of hostnames sharing a rate limit and priority
+type tenant struct {
+	name     string
+	patterns []string
+
+	// Tasks per second dispatched for the tenant; 0 for no limit
+	rate float64
+
+	// When several tenants have tasks waiting, those with the highest
+	// priority are dispatched first
+	priority int
+}
+
+// loadTenants reads a tenants file. Each line names a tenant, a
+// comma-separated list of hostname patterns (as for path.Match), and
+// optionally rate=N and priority=N, e.g.
+//
+//	acme   host_0000*,host_0001*  rate=50  priority=1
+//
+// Blank lines and lines starting with # are ignored. A default tenant, with
+// no rate limit and priority 0, takes any hostname no pattern matches.
+func loadTenants(fileName string) ([]*tenant, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tenants []*tenant
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		t, err := parseTenant(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if seen[t.name] {
+			return nil, fmt.Errorf("line %d: duplicate tenant %q", line, t.name)
+		}
+		seen[t.name] = true
+		tenants = append(tenants, t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no tenants defined")
+	}
+	if !seen[defaultTenantName] {
+		tenants = append(tenants, &tenant{name: defaultTenantName})
+	}
+	return tenants, nil
+}
+
+func parseTenant(fields []string) (*tenant, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected a tenant name and hostname patterns")
+	}
+	t := &tenant{name: fields[0]}
+	for _, p := range strings.Split(fields[1], ",") {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return nil, fmt.Errorf("invalid hostname pattern %q", p)
+		}
+		t.patterns = append(t.patterns, p)
+	}
+	for _, opt := range fields[2:] {
+		eq := strings.Index(opt, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid option %q, expected rate=N or priority=N", opt)
+		}
+		key, value := opt[:eq], opt[eq+1:]
+		var err error
+		switch key {
+		case "rate":
+			t.rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && t.rate < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "priority":
+			t.priority, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q: %w", opt, err)
+		}
+	}
+	return t, nil
+}
+
+// matches reports whether hostname belongs to the tenant
+func (t *tenant) matches(hostname string) bool {
+	for _, p := range t.patterns {
+		if ok, _ := path.Match(p, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantOf returns the first tenant with a pattern matching hostname, or the
+// default tenant
+func tenantOf(tenants []*tenant, hostname string) *tenant {
+	var fallback *tenant
+	for _, t := range tenants {
+		if t.matches(hostname) {
+			return t
+		}
+		if t.name == defaultTenantName {
+			fallback = t
+		}
+	}
+	return fallback
+}
+
+// tenantQueue holds a tenant's tasks until the scheduler dispatches them
+type tenantQueue struct {
+	*tenant
+	records []parsedRecord
+
+	// Earliest time the tenant's next task may be dispatched
+	next time.Time
+}
+
+// scheduleTenants reorders tasks from in by tenant before they reach the
+// dispatcher: the highest priority tenant with a task waiting, and within
+// its rate limit, goes first, then whichever of equal priority has waited
+// longest. Tasks are passed on one at a time, so the order is decided only
+// as workers become free. Rejected records pass straight through.
+func scheduleTenants(tenants []*tenant, in <-chan []parsedRecord, out chan<- []parsedRecord) {
+	queues := make(map[string]*tenantQueue)
+	for _, t := range tenants {
+		queues[t.name] = &tenantQueue{tenant: t}
+	}
+	queued := 0
+
+	for in != nil || queued > 0 {
+		now := time.Now()
+		var next *tenantQueue
+		var wake time.Time
+		for _, t := range tenants {
+			q := queues[t.name]
+			if len(q.records) == 0 {
+				continue
+			}
+			if q.next.After(now) {
+				if wake.IsZero() || q.next.Before(wake) {
+					wake = q.next
+				}
+				continue
+			}
+			if next == nil || q.priority > next.priority ||
+				(q.priority == next.priority && q.records[0].task.queued.Before(next.records[0].task.queued)) {
+				next = q
+			}
+		}
+
+		var send chan<- []parsedRecord
+		var batch []parsedRecord
+		if next != nil {
+			send = out
+			batch = []parsedRecord{next.records[0]}
+		}
+		receive := in
+		if queued >= tenantQueueLimit {
+			receive = nil
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next == nil && !wake.IsZero() {
+			timer = time.NewTimer(time.Until(wake))
+			timeout = timer.C
+		}
+
+		select {
+		case b, ok := <-receive:
+			if !ok {
+				in = nil
+				break
+			}
+			received := time.Now()
+			var rejected []parsedRecord
+			for _, r := range b {
+				if r.err != nil {
+					rejected = append(rejected, r)
+					continue
+				}
+				q := queues[tenantOf(tenants, r.task.hostname).name]
+				r.task.tenant = q.name
+				r.task.queued = received
+				q.records = append(q.records, r)
+				queued++
+			}
+			if len(rejected) > 0 {
+				out <- rejected
+			}
+		case send <- batch:
+			next.records = next.records[1:]
+			queued--
+			if next.rate > 0 {
+				start := next.next
+				if start.Before(now) {
+					start = now
+				}
+				next.next = start.Add(time.Duration(float64(time.Second) / next.rate))
+			}
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	close(out)
+}
+
+// tenantBreakdown reports latencies and how long tasks were held back by
+// the tenant scheduler
+type tenantBreakdown struct {
+	tenants   []*tenant
+	latencies *comparison
+	waits     map[string]*stats.Recorder
+
+	// Tasks held for longer than threshold
+	threshold time.Duration
+	starved   map[string]int
+}
+
+func newTenantBreakdown(tenants []*tenant, threshold time.Duration, newRecorder recorderFactory) *tenantBreakdown {
+	var names []string
+	for _, t := range tenants {
+		names = append(names, t.name)
+	}
+	b := &tenantBreakdown{
+		tenants: tenants,
+		latencies: newComparison("tenant", names, func(r benchResult) string {
+			return r.task.tenant
+		}, newRecorder),
+		waits:     make(map[string]*stats.Recorder),
+		threshold: threshold,
+		starved:   make(map[string]int),
+	}
+	for _, name := range names {
+		b.waits[name] = newRecorder("tenant-wait-" + name)
+	}
+	return b
+}
+
+func (b *tenantBreakdown) add(r benchResult) {
+	b.latencies.add(r)
+	if r.attempt != 1 {
+		return
+	}
+	wait := r.task.dispatched.Sub(r.task.queued)
+	b.waits[r.task.tenant].Add(wait.Microseconds())
+	if wait > b.threshold {
+		b.starved[r.task.tenant]++
+	}
+}
+
+func printTenantReport(b *tenantBreakdown) {
+	printComparison("Tenants", b.latencies, true)
+
+	fmt.Printf("Scheduling waits (starved: held over %s):\n", b.threshold)
+	fmt.Printf("%-20s %8s %6s %10s %10s %10s %8s\n", "tenant", "priority", "rate", "median", "p99", "max", "starved")
+	for _, t := range b.tenants {
+		rate := "-"
+		if t.rate > 0 {
+			rate = strconv.FormatFloat(t.rate, 'g', -1, 64)
+		}
+		w := b.waits[t.name]
+		if w.Count() == 0 {
+			fmt.Printf("%-20s %8d %6s\n", t.name, t.priority, rate)
+			continue
+		}
+		s := w.Summary()
+		starved := fmt.Sprintf("%8d", b.starved[t.name])
+		if b.starved[t.name] > 0 {
+			starved = colorize(starved, colorRed)
+		}
+		fmt.Printf("%-20s %8d %6s %10.3f %10.3f %10.3f %s\n", t.name, t.priority, rate,
+			float64(s.Median)/1000.0, stats.Quantile(w.Values(), 0.99)/1000.0, float64(s.Max)/1000.0, starved)
+	}
+	fmt.Printf("(times in ms)\n")
+}
+
+type tenantStats struct {
+	Name     string        `json:"name"`
+	Priority int           `json:"priority"`
+	Rate     float64       `json:"rate,omitempty"`
+	Failed   int           `json:"failed"`
+	Latency  *latencyStats `json:"latency,omitempty"`
+	Wait     *latencyStats `json:"wait,omitempty"`
+	Starved  int           `json:"starved"`
+}
+
+func newTenantStats(b *tenantBreakdown, trim float64) []tenantStats {
+	var out []tenantStats
+	for _, t := range b.tenants {
+		out = append(out, tenantStats{
+			Name:     t.name,
+			Priority: t.priority,
+			Rate:     t.rate,
+			Failed:   b.latencies.failed[t.name],
+			Latency:  newLatencyStats(b.latencies.times[t.name], trim),
+			Wait:     newLatencyStats(b.waits[t.name], trim),
+			Starved:  b.starved[t.name],
+		})
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// resultHeap is a min-heap of results ordered by query time, so the fastest
+// of the retained queries is the one evicted
+type resultHeap []benchResult
+
+func (h resultHeap) Len() int            { return len(h) }
+func (h resultHeap) Less(i, j int) bool  { return h[i].queryTime < h[j].queryTime }
+func (h resultHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *resultHeap) Push(x interface{}) { *h = append(*h, x.(benchResult)) }
+func (h *resultHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// slowestQueries retains the n slowest results seen, in O(n) memory
+type slowestQueries struct {
+	n int
+	h resultHeap
+}
+
+func newSlowestQueries(n int) *slowestQueries {
+	return &slowestQueries{n: n}
+}
+
+func (s *slowestQueries) add(r benchResult) {
+	if s.n <= 0 {
+		return
+	}
+	if len(s.h) < s.n {
+		heap.Push(&s.h, r)
+	} else if r.queryTime > s.h[0].queryTime {
+		s.h[0] = r
+		heap.Fix(&s.h, 0)
+	}
+}
+
+// sorted returns the retained results, slowest first
+func (s *slowestQueries) sorted() []benchResult {
+	out := make([]benchResult, len(s.h))
+	copy(out, s.h)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].queryTime > out[j].queryTime
+	})
+	return out
+}
+
+// printSlowestQueries lists the slowest queries, with their target and
+// variant if several ran
+func printSlowestQueries(s *slowestQueries, showTarget bool, showVariant bool) {
+	results := s.sorted()
+	if len(results) == 0 {
+		return
+	}
+
+	fmt.Printf("\n## %d slowest queries\n", len(results))
+	fmt.Printf("%12s %6s %8s %-16s %-25s %-25s", "time (ms)", "worker", "rows", "hostname", "start", "end")
+	if showTarget {
+		fmt.Printf(" %-16s", "target")
+	}
+	if showVariant {
+		fmt.Printf(" %s", "variant")
+	}
+	fmt.Printf("\n")
+	for _, r := range results {
+		fmt.Printf("%12.3f %6d %8d %-16s %-25s %-25s",
+			float32(r.queryTime)/1000.0, r.worker, r.rows, r.task.hostname, r.task.start, r.task.end)
+		if showTarget {
+			fmt.Printf(" %-16s", r.task.target.name)
+		}
+		if showVariant {
+			fmt.Printf(" %s", r.task.variant.name)
+		}
+		fmt.Printf("\n")
+	}
+}
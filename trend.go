@@ -0,0 +1,439 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Output formats of the trend command
+const (
+	trendText = "text"
+	trendCSV  = "csv"
+	trendHTML = "html"
+)
+
+// Values of the trend command's -config besides a config hash
+const (
+	trendLatestConfig = "latest"
+	trendAllConfigs   = "all"
+)
+
+// Width of the sparklines in the trend command's text output
+const trendSparkWidth = 40
+
+// Size of each chart in the trend command's HTML output, in pixels
+const (
+	trendChartWidth  = 640
+	trendChartHeight = 160
+)
+
+//go:embed trend.html
+var trendPage string
+
+var trendTemplate = template.Must(template.New("trend").Parse(trendPage))
+
+// trendTest is a Mann–Kendall test of whether a metric tends to rise or
+// fall from run to run, using the normal approximation with a correction
+// for ties. Unlike a fitted line, it isn't thrown by the odd outlying run.
+type trendTest struct {
+	S int
+	Z float64
+	P float64
+}
+
+func mannKendall(values []float64) trendTest {
+	n := len(values)
+	t := trendTest{P: 1}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			switch {
+			case values[j] > values[i]:
+				t.S++
+			case values[j] < values[i]:
+				t.S--
+			}
+		}
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	fn := float64(n)
+	variance := fn * (fn - 1) * (2*fn + 5)
+	for i := 0; i < n; {
+		j := i
+		for j < n && sorted[j] == sorted[i] {
+			j++
+		}
+		ties := float64(j - i)
+		variance -= ties * (ties - 1) * (2*ties + 5)
+		i = j
+	}
+	variance /= 18
+	if variance > 0 && t.S != 0 {
+		// With a continuity correction towards zero
+		s := math.Abs(float64(t.S)) - 1
+		t.Z = math.Copysign(s/math.Sqrt(variance), float64(t.S))
+		t.P = math.Erfc(math.Abs(t.Z) / math.Sqrt2)
+	}
+	return t
+}
+
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// metricTrend is one headline figure over a series of runs
+type metricTrend struct {
+	runMetric
+	values []float64
+
+	// Theil–Sen line through the values: the median slope between every
+	// pair of runs, per day, and the fitted value at the first run
+	slope     float64
+	intercept float64
+
+	// Fitted change from the first run to the last, relative to the fitted
+	// first value, or false if that is zero
+	change   float64
+	changeOK bool
+
+	test trendTest
+}
+
+// drift reports whether the metric has significantly worsened or improved
+func (t *metricTrend) drift(alpha float64) (worse, better bool) {
+	if t.test.P >= alpha {
+		return false, false
+	}
+	worse, better = t.test.S > 0, t.test.S < 0
+	if !t.lowerIsBetter {
+		worse, better = better, worse
+	}
+	return worse, better
+}
+
+func (t *metricTrend) verdict(alpha float64) string {
+	switch worse, better := t.drift(alpha); {
+	case worse:
+		return "worsening"
+	case better:
+		return "improving"
+	}
+	return "stable"
+}
+
+// trendReport is the trend of each headline figure over runs, oldest first
+type trendReport struct {
+	runs    []storedRun
+	metrics []*metricTrend
+	alpha   float64
+}
+
+func newTrendReport(runs []storedRun, alpha float64) *trendReport {
+	tr := &trendReport{runs: runs, alpha: alpha}
+	days := make([]float64, len(runs))
+	for i, r := range runs {
+		days[i] = r.Time.Sub(runs[0].Time).Hours() / 24
+	}
+
+	for i, metric := range runMetrics(runs[0].historyRecord) {
+		t := &metricTrend{runMetric: metric}
+		recorded := false
+		for _, r := range runs {
+			v := runMetrics(r.historyRecord)[i].value
+			t.values = append(t.values, v)
+			recorded = recorded || v != 0
+		}
+		// Figures missing from every run, such as those older -history
+		// records lack
+		if !recorded {
+			continue
+		}
+
+		var slopes []float64
+		for a := range runs {
+			for b := a + 1; b < len(runs); b++ {
+				if days[b] > days[a] {
+					slopes = append(slopes, (t.values[b]-t.values[a])/(days[b]-days[a]))
+				}
+			}
+		}
+		t.slope = medianOf(slopes)
+		offsets := make([]float64, len(runs))
+		for j, v := range t.values {
+			offsets[j] = v - t.slope*days[j]
+		}
+		t.intercept = medianOf(offsets)
+		t.change, t.changeOK = metricChange(t.intercept, t.intercept+t.slope*days[len(days)-1])
+		t.test = mannKendall(t.values)
+		tr.metrics = append(tr.metrics, t)
+	}
+	return tr
+}
+
+func (tr *trendReport) span() string {
+	first, last := tr.runs[0].Time.Local(), tr.runs[len(tr.runs)-1].Time.Local()
+	return fmt.Sprintf("%d, from %s to %s", len(tr.runs), first.Format("2006-01-02 15:04"), last.Format("2006-01-02 15:04"))
+}
+
+func (tr *trendReport) configHashes() string {
+	seen := make(map[string]bool)
+	var hashes []string
+	for _, r := range tr.runs {
+		if !seen[r.ConfigHash] {
+			seen[r.ConfigHash] = true
+			hashes = append(hashes, r.ConfigHash)
+		}
+	}
+	if len(hashes) > 1 {
+		return fmt.Sprintf("%d different", len(hashes))
+	}
+	return hashes[0]
+}
+
+func (tr *trendReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "\n## Trend\n")
+	fmt.Fprintf(w, "Runs:              %s\n", tr.span())
+	fmt.Fprintf(w, "Config hash:       %s\n", tr.configHashes())
+	fmt.Fprintf(w, "%-20s %12s %12s %12s %9s %9s %-9s  %s\n",
+		"metric", "first", "last", "per day", "change", "p-value", "trend", "runs")
+	for _, t := range tr.metrics {
+		change := fmt.Sprintf("%9s", "-")
+		if t.changeOK {
+			change = fmt.Sprintf("%+8.1f%%", 100*t.change)
+		}
+		verdict := colorize(fmt.Sprintf("%-9s", t.verdict(tr.alpha)), colorIf(t.drift(tr.alpha)))
+		fmt.Fprintf(w, "%-20s %12.3f %12.3f %+12.3f %s %9.3g %s  %s\n", t.name, t.values[0], t.values[len(t.values)-1],
+			t.slope, change, t.test.P, verdict, trendSparkline(t.values))
+	}
+	fmt.Fprintf(w, "(times in ms; per day and change are from a Theil–Sen fit, trends are Mann–Kendall tests at %g)\n", tr.alpha)
+}
+
+// trendSparkline draws values scaled from their minimum to their maximum,
+// as drift is usually small beside the values themselves
+func trendSparkline(values []float64) string {
+	min := values[0]
+	for _, v := range values {
+		min = math.Min(min, v)
+	}
+	shifted := make([]float64, len(values))
+	for i, v := range values {
+		shifted[i] = v - min
+	}
+	return sparkline(shifted, trendSparkWidth)
+}
+
+// writeCSV writes one row per run, for charting elsewhere
+func (tr *trendReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"time", "run_id", "config_hash", "version", "server_version", "labels"}
+	for _, t := range tr.metrics {
+		header = append(header, t.key)
+	}
+	cw.Write(header)
+	for i, r := range tr.runs {
+		row := []string{r.Time.UTC().Format(time.RFC3339), r.id, r.ConfigHash, r.Version, r.ServerVersion, labelFlags(r.Labels).String()}
+		for _, t := range tr.metrics {
+			row = append(row, strconv.FormatFloat(t.values[i], 'g', -1, 64))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// trendChart is one metric's chart on the HTML page, in SVG coordinates
+type trendChart struct {
+	Name     string
+	Verdict  string
+	Summary  string
+	Points   string
+	FitStart [2]float64
+	FitEnd   [2]float64
+	Min, Max float64
+}
+
+func (tr *trendReport) writeHTML(w io.Writer) error {
+	span := tr.runs[len(tr.runs)-1].Time.Sub(tr.runs[0].Time).Hours() / 24
+	x := func(days float64) float64 {
+		if span == 0 {
+			return trendChartWidth / 2
+		}
+		return days / span * trendChartWidth
+	}
+
+	var charts []trendChart
+	for _, t := range tr.metrics {
+		c := trendChart{Name: t.name, Verdict: t.verdict(tr.alpha), Min: t.values[0], Max: t.values[0]}
+		for _, v := range t.values {
+			c.Min = math.Min(c.Min, v)
+			c.Max = math.Max(c.Max, v)
+		}
+		y := func(v float64) float64 {
+			if c.Max == c.Min {
+				return trendChartHeight / 2
+			}
+			return trendChartHeight - (v-c.Min)/(c.Max-c.Min)*trendChartHeight
+		}
+		for i, r := range tr.runs {
+			days := r.Time.Sub(tr.runs[0].Time).Hours() / 24
+			c.Points += fmt.Sprintf("%.1f,%.1f ", x(days), y(t.values[i]))
+		}
+		c.FitStart = [2]float64{x(0), y(t.intercept)}
+		c.FitEnd = [2]float64{x(span), y(t.intercept + t.slope*span)}
+		c.Summary = fmt.Sprintf("%.3f to %.3f, %+.3f per day, p = %.3g", t.values[0], t.values[len(t.values)-1], t.slope, t.test.P)
+		if t.changeOK {
+			c.Summary += fmt.Sprintf(", %+.1f%% overall", 100*t.change)
+		}
+		charts = append(charts, c)
+	}
+
+	return trendTemplate.Execute(w, struct {
+		Span          string
+		ConfigHash    string
+		Alpha         float64
+		Width, Height int
+		Charts        []trendChart
+	}{tr.span(), tr.configHashes(), tr.alpha, trendChartWidth, trendChartHeight, charts})
+}
+
+// loadTrendRuns reads runs from a -history file, or else the results store,
+// oldest first
+func loadTrendRuns(historyFile string, storeFile string) ([]storedRun, error) {
+	if historyFile != "" {
+		records, err := readHistory(historyFile)
+		if err != nil {
+			return nil, err
+		}
+		runs := make([]storedRun, len(records))
+		for i, r := range records {
+			runs[i] = storedRun{historyRecord: r}
+		}
+		sort.SliceStable(runs, func(i, j int) bool { return runs[i].Time.Before(runs[j].Time) })
+		return runs, nil
+	}
+
+	if _, err := os.Stat(storeFile); err != nil {
+		return nil, err
+	}
+	db, err := openStore(storeFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return loadHistory(db)
+}
+
+// selectTrendRuns keeps the runs with all of labels and the given config
+// hash, or that of the latest such run, and then the last limit of them if
+// limit is positive
+func selectTrendRuns(runs []storedRun, labels map[string]string, config string, limit int) []storedRun {
+	var labelled []storedRun
+	for _, r := range runs {
+		if hasLabels(r.Labels, labels) {
+			labelled = append(labelled, r)
+		}
+	}
+	if len(labelled) > 0 && config == trendLatestConfig {
+		config = labelled[len(labelled)-1].ConfigHash
+	}
+
+	var selected []storedRun
+	for _, r := range labelled {
+		if config == trendAllConfigs || r.ConfigHash == config {
+			selected = append(selected, r)
+		}
+	}
+	if limit > 0 && len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+	return selected
+}
+
+// runTrend reports how each headline figure has changed over past runs:
+// trend [flags]
+func runTrend(args []string) {
+	fs := flag.NewFlagSet("trend", flag.ExitOnError)
+	historyFile := fs.String("history", "", "read runs from this -history file instead of the results store")
+	storeFile := fs.String("store", defaultStoreFile, "SQLite results store written by -store")
+	format := fs.String("format", trendText, "output format: text, csv (one row per run) or html (a chart per metric)")
+	outFile := fs.String("o", stdoutName, "write the output to this file")
+	config := fs.String("config", trendLatestConfig, "only include runs with this config hash; latest for that of the latest run, or all")
+	limit := fs.Int("limit", 0, "only include this many of the most recent runs (0 for all)")
+	alpha := fs.Float64("alpha", defaultCompareAlpha, "significance level of the drift test")
+	labels := make(labelFlags)
+	fs.Var(labels, "label", "only include runs with this key=value label (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trend [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != trendText && *format != trendCSV && *format != trendHTML {
+		log.Fatalf("[ERROR] -format must be %s, %s or %s\n", trendText, trendCSV, trendHTML)
+	}
+
+	all, err := loadTrendRuns(*historyFile, *storeFile)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read runs: %s\n", err.Error())
+	}
+	runs := selectTrendRuns(all, labels, *config, *limit)
+	if len(runs) < 2 {
+		log.Fatalf("[ERROR] Found %d matching runs of %d, need at least 2 for a trend\n", len(runs), len(all))
+	}
+	if *config == trendLatestConfig && len(runs) < len(all) {
+		log.Printf("[INFO] Using %d of %d runs, with the latest run's config hash %s; pass -config all to include every run\n",
+			len(runs), len(all), runs[0].ConfigHash)
+	}
+	tr := newTrendReport(runs, *alpha)
+
+	out := os.Stdout
+	var file *atomicFile
+	if *outFile != stdoutName {
+		if file, err = createAtomic(*outFile); err != nil {
+			log.Fatalf("[ERROR] Unable to create %s: %s\n", *outFile, err.Error())
+		}
+		out = file.File
+	}
+	switch *format {
+	case trendText:
+		tr.writeText(out)
+	case trendCSV:
+		err = tr.writeCSV(out)
+	case trendHTML:
+		err = tr.writeHTML(out)
+	}
+	if err != nil {
+		if file != nil {
+			file.abort()
+		}
+		log.Fatalf("[ERROR] %s\n", err.Error())
+	}
+	if file != nil {
+		if err := file.commit(); err != nil {
+			log.Fatalf("[ERROR] Unable to write %s: %s\n", *outFile, err.Error())
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ANSI sequences for drawing the terminal dashboard on the alternate screen,
+// which restores the original contents on exit
+const (
+	ansiEnterAltScreen = "\x1b[?1049h"
+	ansiLeaveAltScreen = "\x1b[?1049l"
+	ansiHideCursor     = "\x1b[?25l"
+	ansiShowCursor     = "\x1b[?25h"
+	ansiClearHome      = "\x1b[H\x1b[2J"
+)
+
+// Points in each sparkline, log lines shown beneath the dashboard, and the
+// length errors are cut to
+const (
+	sparklineWidth = 60
+	tuiLogLines    = 5
+	tuiErrorLength = 100
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as a row of block characters scaled to their
+// maximum, keeping the last width
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	var max float64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	return b.String()
+}
+
+// logCapture holds log lines written while the terminal dashboard covers the
+// screen. Errors leave the dashboard and are written straight to out, as they
+// usually precede exit.
+type logCapture struct {
+	mu    sync.Mutex
+	lines [][]byte
+	out   io.Writer
+	leave func()
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	if i := bytes.IndexByte(p, '['); i >= 0 && bytes.HasPrefix(p[i:], []byte("[ERROR]")) {
+		c.leave()
+		return c.out.Write(p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// recent returns the last n lines logged
+func (c *logCapture) recent(n int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for i := len(c.lines) - n; i < len(c.lines); i++ {
+		if i >= 0 {
+			out = append(out, strings.TrimRight(string(c.lines[i]), "\n"))
+		}
+	}
+	return out
+}
+
+// terminalUI redraws the dashboard on stderr every dashboardInterval under
+// -tui, until stopped
+type terminalUI struct {
+	dash    *dashboard
+	out     io.Writer
+	logOut  io.Writer
+	capture *logCapture
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+	done     chan struct{}
+}
+
+func startTerminalUI(dash *dashboard) *terminalUI {
+	t := &terminalUI{
+		dash:    dash,
+		out:     os.Stderr,
+		logOut:  log.Writer(),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	t.capture = &logCapture{out: t.logOut, leave: t.leave}
+	fmt.Fprint(t.out, ansiEnterAltScreen+ansiHideCursor)
+	log.SetOutput(t.capture)
+
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+		for {
+			t.draw()
+			select {
+			case <-ticker.C:
+			case <-t.stopped:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// leave restores the screen and log output, without waiting for a redraw
+// in progress
+func (t *terminalUI) leave() {
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+		fmt.Fprint(t.out, ansiLeaveAltScreen+ansiShowCursor)
+		log.SetOutput(t.logOut)
+	})
+}
+
+// stop closes the dashboard, so the report prints to the normal screen, and
+// logs the warnings and errors that were hidden by it
+func (t *terminalUI) stop() {
+	t.leave()
+	<-t.done
+	t.capture.mu.Lock()
+	defer t.capture.mu.Unlock()
+	w := quietWriter{w: t.logOut}
+	for _, line := range t.capture.lines {
+		w.Write(line)
+	}
+}
+
+func (t *terminalUI) draw() {
+	s := t.dash.snapshot()
+	var qps, p50, p95, p99, util []float64
+	for _, p := range s.History {
+		qps = append(qps, p.Throughput)
+		p50 = append(p50, p.Median)
+		p95 = append(p95, p.P95)
+		p99 = append(p99, p.P99)
+		util = append(util, p.Utilisation)
+	}
+	last := dashboardPoint{}
+	if len(s.History) > 0 {
+		last = s.History[len(s.History)-1]
+	}
+
+	var b strings.Builder
+	b.WriteString(ansiClearHome)
+	fmt.Fprintf(&b, "Benchmark running for %s (interrupt to stop and print the report)\n\n",
+		(time.Duration(s.ElapsedSeconds) * time.Second).String())
+	fmt.Fprintf(&b, "Queries      %d (%s)\n", s.Queries+s.Failed,
+		colorize(fmt.Sprintf("%d failed, %.2f%%", s.Failed, 100*s.ErrorRate), colorIf(s.Failed > 0, false)))
+	fmt.Fprintf(&b, "Throughput   %-12s %s\n", fmt.Sprintf("%.1f/s", last.Throughput), sparkline(qps, sparklineWidth))
+	fmt.Fprintf(&b, "p50          %-12s %s\n", fmt.Sprintf("%.3fms", last.Median), sparkline(p50, sparklineWidth))
+	fmt.Fprintf(&b, "p95          %-12s %s\n", fmt.Sprintf("%.3fms", last.P95), sparkline(p95, sparklineWidth))
+	fmt.Fprintf(&b, "p99          %-12s %s\n", fmt.Sprintf("%.3fms", last.P99), sparkline(p99, sparklineWidth))
+	fmt.Fprintf(&b, "Workers      %-12s %s\n", fmt.Sprintf("%.0f%% busy", 100*last.Utilisation), sparkline(util, sparklineWidth))
+	fmt.Fprintf(&b, "Overall      median %.3fms, p95 %.3fms, p99 %.3fms, max %.3fms\n", s.Median, s.P95, s.P99, s.Max)
+
+	fmt.Fprintf(&b, "\nRecent errors\n")
+	if len(s.Errors) == 0 {
+		fmt.Fprintf(&b, "  none\n")
+	}
+	for i := len(s.Errors) - 1; i >= 0; i-- {
+		e := s.Errors[i]
+		msg := strings.ReplaceAll(e.Error, "\n", " ")
+		if len(msg) > tuiErrorLength {
+			msg = msg[:tuiErrorLength] + "..."
+		}
+		fmt.Fprintf(&b, "  %s %s: %s\n", e.Time.Format("15:04:05"), e.Hostname, colorize(msg, colorRed))
+	}
+
+	fmt.Fprintf(&b, "\nLog\n")
+	for _, line := range t.capture.recent(tuiLogLines) {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+
+	select {
+	case <-t.stopped:
+		// Don't draw over the normal screen
+	default:
+		io.WriteString(t.out, b.String())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Interval between the dashboard's points, and the number of them kept
+const (
+	dashboardInterval = time.Second
+	dashboardHistory  = 600
+)
+
+// Number of slowest hosts listed on the dashboard, and of the most recent
+// errors kept
+const (
+	dashboardTopHosts = 10
+	dashboardErrors   = 10
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// hostTotals accumulates one hostname's results for the dashboard; times
+// are in µs
+type hostTotals struct {
+	queries int
+	failed  int
+	total   int64
+	max     int64
+}
+
+// recentError is a failed query shown on the dashboard
+type recentError struct {
+	at       time.Time
+	hostname string
+	message  string
+}
+
+// dashboard keeps live statistics of the run for -ui and -tui. Results are
+// added from the collecting goroutine and read by HTTP handlers and the
+// terminal renderer, so all fields are guarded by mu.
+type dashboard struct {
+	mu       sync.Mutex
+	start    time.Time
+	workers  int
+	finished bool
+	queries  int
+	failed   int
+	times    *stats.Aggregator
+	current  *intervalStats
+	history  []intervalPoint
+	hosts    map[string]*hostTotals
+	errors   []recentError
+}
+
+func newDashboard(start time.Time, workers int) *dashboard {
+	return &dashboard{
+		start:   start,
+		workers: workers,
+		times:   stats.NewAggregator(0),
+		current: newIntervalStats(),
+		hosts:   make(map[string]*hostTotals),
+	}
+}
+
+func (d *dashboard) add(r benchResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.current.add(r)
+	h, ok := d.hosts[r.task.hostname]
+	if !ok {
+		h = &hostTotals{}
+		d.hosts[r.task.hostname] = h
+	}
+	if r.err != nil {
+		d.failed++
+		h.failed++
+		d.errors = append(d.errors, recentError{at: r.finished, hostname: r.task.hostname, message: r.err.Error()})
+		if len(d.errors) > dashboardErrors {
+			d.errors = d.errors[len(d.errors)-dashboardErrors:]
+		}
+		return
+	}
+	d.queries++
+	d.times.Add(float64(r.queryTime))
+	h.queries++
+	h.total += r.queryTime
+	if r.queryTime > h.max {
+		h.max = r.queryTime
+	}
+}
+
+// roll closes the current interval, adding it to the history
+func (d *dashboard) roll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished {
+		return
+	}
+	d.history = append(d.history, d.current.reset())
+	if len(d.history) > dashboardHistory {
+		d.history = d.history[len(d.history)-dashboardHistory:]
+	}
+}
+
+// finish marks the run as complete, freezing the history
+func (d *dashboard) finish() {
+	d.roll()
+	d.mu.Lock()
+	d.finished = true
+	d.mu.Unlock()
+}
+
+// rollEvery closes an interval every dashboardInterval until the run
+// finishes
+func (d *dashboard) rollEvery() {
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.roll()
+		d.mu.Lock()
+		finished := d.finished
+		d.mu.Unlock()
+		if finished {
+			return
+		}
+	}
+}
+
+// serve handles dashboard requests on addr for the rest of the process
+func (d *dashboard) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/stats", d.handleStats)
+
+	log.Printf("[INFO] Serving the dashboard on http://%s/\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("[ERROR] Dashboard server failed: %s\n", err.Error())
+	}
+}
+
+// dashboardStats is the JSON returned by GET /stats. Latencies are in
+// milliseconds.
+type dashboardStats struct {
+	ElapsedSeconds float64          `json:"elapsed_seconds"`
+	Finished       bool             `json:"finished"`
+	Queries        int              `json:"queries"`
+	Failed         int              `json:"failed"`
+	ErrorRate      float64          `json:"error_rate"`
+	Median         float64          `json:"median_ms"`
+	P95            float64          `json:"p95_ms"`
+	P99            float64          `json:"p99_ms"`
+	Max            float64          `json:"max_ms"`
+	History        []dashboardPoint `json:"history"`
+	Hosts          []dashboardHost  `json:"slowest_hosts"`
+	Errors         []dashboardError `json:"recent_errors"`
+}
+
+type dashboardPoint struct {
+	OffsetSeconds float64 `json:"offset_seconds"`
+	Throughput    float64 `json:"throughput_qps"`
+	Failed        int     `json:"failed"`
+	Median        float64 `json:"median_ms"`
+	P95           float64 `json:"p95_ms"`
+	P99           float64 `json:"p99_ms"`
+	Utilisation   float64 `json:"worker_utilisation"`
+}
+
+type dashboardError struct {
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Error    string    `json:"error"`
+}
+
+type dashboardHost struct {
+	Hostname string  `json:"hostname"`
+	Queries  int     `json:"queries"`
+	Failed   int     `json:"failed"`
+	Mean     float64 `json:"mean_ms"`
+	Max      float64 `json:"max_ms"`
+}
+
+func (d *dashboard) snapshot() dashboardStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sum := d.times.Summary()
+	s := dashboardStats{
+		ElapsedSeconds: time.Since(d.start).Seconds(),
+		Finished:       d.finished,
+		Queries:        d.queries,
+		Failed:         d.failed,
+		Median:         sum.P50 / 1000.0,
+		P95:            sum.P95 / 1000.0,
+		P99:            sum.P99 / 1000.0,
+		Max:            sum.Max / 1000.0,
+		History:        make([]dashboardPoint, 0, len(d.history)),
+	}
+	if attempted := d.queries + d.failed; attempted > 0 {
+		s.ErrorRate = float64(d.failed) / float64(attempted)
+	}
+	for _, p := range d.history {
+		s.History = append(s.History, dashboardPoint{
+			OffsetSeconds: p.start.Add(p.elapsed).Sub(d.start).Seconds(),
+			Throughput:    p.throughput(),
+			Failed:        p.failed,
+			Median:        p.times.P50 / 1000.0,
+			P95:           p.times.P95 / 1000.0,
+			P99:           p.times.P99 / 1000.0,
+			Utilisation:   p.utilisation(d.workers),
+		})
+	}
+	for _, e := range d.errors {
+		s.Errors = append(s.Errors, dashboardError{Time: e.at, Hostname: e.hostname, Error: e.message})
+	}
+
+	for name, h := range d.hosts {
+		host := dashboardHost{Hostname: name, Queries: h.queries, Failed: h.failed, Max: float64(h.max) / 1000.0}
+		if h.queries > 0 {
+			host.Mean = float64(h.total) / float64(h.queries) / 1000.0
+		}
+		s.Hosts = append(s.Hosts, host)
+	}
+	sort.Slice(s.Hosts, func(i, j int) bool {
+		if s.Hosts[i].Mean != s.Hosts[j].Mean {
+			return s.Hosts[i].Mean > s.Hosts[j].Mean
+		}
+		return s.Hosts[i].Hostname < s.Hosts[j].Hostname
+	})
+	if len(s.Hosts) > dashboardTopHosts {
+		s.Hosts = s.Hosts[:dashboardTopHosts]
+	}
+	return s
+}
+
+func (d *dashboard) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(d.snapshot()); err != nil {
+		log.Printf("[WARN] Failed to write dashboard stats: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long to allow for each artifact's upload
+const uploadTimeout = 5 * time.Minute
+
+// S3 requests sign the headers but not the body, so large raw files can be
+// streamed
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// objectStore is a bucket that run artifacts can be uploaded to
+type objectStore interface {
+	put(ctx context.Context, key string, fileName string) error
+	url(key string) string
+}
+
+// uploadDest is parsed from -upload: a bucket and a key prefix within it
+type uploadDest struct {
+	store  objectStore
+	prefix string
+}
+
+// parseUploadDest parses s3://bucket/prefix/ or gs://bucket/prefix/,
+// taking credentials from the environment
+func parseUploadDest(spec string) (*uploadDest, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: no bucket", spec)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	switch u.Scheme {
+	case "s3":
+		s, err := newS3Store(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &uploadDest{store: s, prefix: prefix}, nil
+	case "gs":
+		s, err := newGCSStore(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &uploadDest{store: s, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("%s: expected s3:// or gs://", spec)
+}
+
+// newRunID names a run uniquely by its start time and a random suffix, so
+// that agents uploading to the same prefix don't collide
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return start.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// upload puts each file under prefix/runID/, named by its base name
+func (d *uploadDest) upload(runID string, files []string) error {
+	for _, fileName := range files {
+		key := d.prefix + runID + "/" + filepath.Base(fileName)
+		ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+		err := d.store.put(ctx, key, fileName)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", fileName, err)
+		}
+		log.Printf("[INFO] Uploaded %s to %s\n", fileName, d.store.url(key))
+	}
+	return nil
+}
+
+// putFile sends fileName as the body of an HTTP PUT, authorised by sign, and
+// checks the response
+func putFile(ctx context.Context, endpoint string, fileName string, sign func(*http.Request)) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	sign(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3Store uploads to an S3 bucket, or an S3-compatible service at
+// AWS_ENDPOINT_URL, signing requests with AWS Signature Version 4
+type s3Store struct {
+	bucket       string
+	region       string
+	endpoint     string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Store(bucket string) (*s3Store, error) {
+	s := &s3Store{
+		bucket:       bucket,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		// Compatible services rarely support virtual-hosted buckets
+		s.endpoint = strings.TrimSuffix(endpoint, "/")
+		s.pathStyle = true
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, s.region)
+	}
+	return s, nil
+}
+
+func (s *s3Store) url(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
+
+func (s *s3Store) put(ctx context.Context, key string, fileName string) error {
+	objectPath := "/" + key
+	if s.pathStyle {
+		objectPath = "/" + s.bucket + objectPath
+	}
+	objectPath = escapePath(objectPath)
+	return putFile(ctx, s.endpoint+objectPath, fileName, func(req *http.Request) {
+		s.sign(req, objectPath, time.Now())
+	})
+}
+
+// sign adds AWS Signature Version 4 headers to req for the S3 service
+func (s *s3Store) sign(req *http.Request, escapedPath string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, escapedPath, req.URL.RawQuery,
+		canonicalHeaders.String(), signedHeaders, s3UnsignedPayload,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes every byte of p but unreserved characters and
+// slashes, as SigV4 requires
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsStore uploads to a Google Cloud Storage bucket through its XML API,
+// authenticating with the OAuth access token in GOOGLE_OAUTH_ACCESS_TOKEN
+// (e.g. from gcloud auth print-access-token)
+type gcsStore struct {
+	bucket string
+	token  string
+}
+
+func newGCSStore(bucket string) (*gcsStore, error) {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("GOOGLE_OAUTH_ACCESS_TOKEN must be set")
+	}
+	return &gcsStore{bucket: bucket, token: token}, nil
+}
+
+func (s *gcsStore) url(key string) string {
+	return "gs://" + s.bucket + "/" + key
+}
+
+func (s *gcsStore) put(ctx context.Context, key string, fileName string) error {
+	endpoint := "https://storage.googleapis.com" + escapePath(path.Join("/", s.bucket, key))
+	return putFile(ctx, endpoint, fileName, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultVariantName = "default"
+
+// The hypertable queried by the benchmark
+const benchRelation = "cpu_usage"
+
+// The benchmark query. Placeholders are $1 hostname, $2 start, $3 end and,
+// if the input has a bucket column, $4 bucket width.
+const defaultQuerySQL = `SELECT time_bucket('1 minutes', ts) AS minute,
+		MIN(usage) as minCpu,
+		MAX(usage) as maxCpu
+		FROM cpu_usage
+		WHERE host=$1 AND ts >= $2 AND ts <= $3
+		GROUP BY host, minute`
+
+// Marks the start of a named variant in a variants file
+const variantHeader = "-- variant:"
+
+// Optionally follows the variant name, giving its share of tasks under -mix
+const variantWeightPrefix = "weight="
+
+// queryVariant is one SQL formulation of the benchmark query
+type queryVariant struct {
+	name   string
+	sql    string
+	weight float64
+}
+
+// The benchmark query with the bucket width taken from the input, as $4
+const bucketQuerySQL = `SELECT time_bucket($4::interval, ts) AS bucket,
+		MIN(usage) as minCpu,
+		MAX(usage) as maxCpu
+		FROM cpu_usage
+		WHERE host=$1 AND ts >= $2 AND ts <= $3
+		GROUP BY host, bucket`
+
+var defaultVariants = []queryVariant{{name: defaultVariantName, sql: defaultQuerySQL, weight: 1}}
+
+var bucketVariants = []queryVariant{{name: defaultVariantName, sql: bucketQuerySQL, weight: 1}}
+
+// parseVariantHeader returns the name and weight from the rest of a
+// "-- variant: name [weight=N]" line. The weight defaults to 1.
+func parseVariantHeader(header string) (string, float64, error) {
+	fields := strings.Fields(header)
+	weight := 1.0
+	if n := len(fields); n > 1 && strings.HasPrefix(fields[n-1], variantWeightPrefix) {
+		w, err := strconv.ParseFloat(strings.TrimPrefix(fields[n-1], variantWeightPrefix), 64)
+		if err != nil || w <= 0 {
+			return "", 0, fmt.Errorf("invalid weight %q, expected a positive number", fields[n-1])
+		}
+		weight = w
+		fields = fields[:n-1]
+	}
+	return strings.Join(fields, " "), weight, nil
+}
+
+// variantPicker chooses variants at random in proportion to their weights
+type variantPicker struct {
+	variants   []queryVariant
+	cumulative []float64
+	rng        *rand.Rand
+}
+
+func newVariantPicker(variants []queryVariant, rng *rand.Rand) *variantPicker {
+	p := &variantPicker{variants: variants, rng: rng}
+	total := 0.0
+	for _, v := range variants {
+		total += v.weight
+		p.cumulative = append(p.cumulative, total)
+	}
+	return p
+}
+
+func (p *variantPicker) pick() queryVariant {
+	x := p.rng.Float64() * p.cumulative[len(p.cumulative)-1]
+	for i, c := range p.cumulative {
+		if x < c {
+			return p.variants[i]
+		}
+	}
+	return p.variants[len(p.variants)-1]
+}
+
+// loadVariants reads alternative formulations of the benchmark query. Each
+// variant starts with a "-- variant: name" line, optionally followed by
+// "weight=N", and then its SQL, which takes the same placeholders as the
+// default query.
+func loadVariants(fileName string) ([]queryVariant, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var variants []queryVariant
+	var sql strings.Builder
+	seen := make(map[string]bool)
+
+	finish := func() error {
+		if len(variants) == 0 {
+			if strings.TrimSpace(sql.String()) != "" {
+				return fmt.Errorf("SQL before first %q line", variantHeader)
+			}
+			return nil
+		}
+		v := &variants[len(variants)-1]
+		v.sql = strings.TrimRight(strings.TrimSpace(sql.String()), ";")
+		if v.sql == "" {
+			return fmt.Errorf("variant %q has no SQL", v.name)
+		}
+		return nil
+	}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, variantHeader) {
+			sql.WriteString(line)
+			sql.WriteString("\n")
+			continue
+		}
+
+		if err := finish(); err != nil {
+			return nil, err
+		}
+		name, weight, err := parseVariantHeader(strings.TrimPrefix(line, variantHeader))
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty variant name")
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate variant %q", name)
+		}
+		seen[name] = true
+		variants = append(variants, queryVariant{name: name, weight: weight})
+		sql.Reset()
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no variants defined")
+	}
+
+	return variants, nil
+}
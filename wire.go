@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nrhtr/timescale-project/stats"
+)
+
+// Read counts bytes received beneath any TLS, so they include its overhead
+func (c *timedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *timedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+// wireBytes returns the bytes sent and received so far over a pooled
+// connection, or false if they aren't being counted
+func wireBytes(c *pgxpool.Conn) (sent, received int64, ok bool) {
+	var nc net.Conn
+	if c != nil {
+		nc = c.Conn().PgConn().Conn()
+	}
+	if nc == nil {
+		return 0, 0, false
+	}
+	tc, ok := timedConnOf(nc)
+	if !ok {
+		return 0, 0, false
+	}
+	return atomic.LoadInt64(&tc.sent), atomic.LoadInt64(&tc.received), true
+}
+
+// wireVolume accumulates the bytes each query sent and received, including
+// those of failed queries
+type wireVolume struct {
+	queries  int
+	sent     int64
+	received int64
+
+	// Bytes received by each query
+	perQuery *stats.Recorder
+
+	// Total time of the queries counted, in µs
+	queryTime int64
+}
+
+func newWireVolume(newRecorder recorderFactory) *wireVolume {
+	return &wireVolume{perQuery: newRecorder("wire-received")}
+}
+
+func (w *wireVolume) add(r benchResult) {
+	if !r.wireCounted {
+		return
+	}
+	w.queries++
+	w.sent += r.bytesSent
+	w.received += r.bytesReceived
+	w.perQuery.Add(r.bytesReceived)
+	w.queryTime += r.queryTime
+}
+
+// receiveRate is the rate at which queries received data while running, in
+// MB/s. A rate near the link's capacity suggests a network-bound workload.
+func (w *wireVolume) receiveRate() float64 {
+	if w.queryTime == 0 {
+		return 0
+	}
+	return float64(w.received) / float64(w.queryTime)
+}
+
+func printWireVolume(w *wireVolume) {
+	if w.queries == 0 {
+		return
+	}
+	s := w.perQuery.Summary()
+	fmt.Printf("\n## Network volume\n")
+	fmt.Printf("Bytes sent:        %d (%.1f per query)\n", w.sent, float64(w.sent)/float64(w.queries))
+	fmt.Printf("Bytes received:    %d (%.1f per query)\n", w.received, float64(w.received)/float64(w.queries))
+	fmt.Printf("Received/query:    median %d, p99 %.0f, max %d\n", s.Median, stats.Quantile(w.perQuery.Values(), 0.99), s.Max)
+	fmt.Printf("Receive rate:      %.3f MB/s while querying\n", w.receiveRate())
+}
+
+type wireStats struct {
+	Queries        int     `json:"queries"`
+	BytesSent      int64   `json:"bytes_sent"`
+	BytesReceived  int64   `json:"bytes_received"`
+	MedianReceived int64   `json:"median_received"`
+	P99Received    float64 `json:"p99_received"`
+	ReceiveRate    float64 `json:"receive_rate_mb_per_s"`
+}
+
+func newWireStats(w *wireVolume) *wireStats {
+	if w.queries == 0 {
+		return nil
+	}
+	return &wireStats{
+		Queries:        w.queries,
+		BytesSent:      w.sent,
+		BytesReceived:  w.received,
+		MedianReceived: w.perQuery.Summary().Median,
+		P99Received:    stats.Quantile(w.perQuery.Values(), 0.99),
+		ReceiveRate:    w.receiveRate(),
+	}
+}